@@ -1,31 +1,81 @@
 package accesskey
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 )
 
 // AccessKey represents an access key in the system
 type AccessKey struct {
-	ID          string         `json:"id"`
-	SecretKey   string         `json:"secret_key"`
-	AccessKey   string         `json:"access_key"`
-	UserID      int64          `json:"user_id"`
-	Status      string         `json:"status"`
-	Permissions []*Permissions `json:"permissions"`
-	CreatedAt   time.Time      `json:"created_at"`
-	LastUsedAt  time.Time      `json:"last_used_at"`
-	ExpiresAt   time.Time      `json:"expires_at"`
+	ID string `json:"id"`
+	// KeyType is KeyTypeHMAC or KeyTypeEd25519, empty means KeyTypeHMAC
+	KeyType   string `json:"key_type"`
+	SecretKey string `json:"secret_key"`
+	// PublicKey is the base64 Ed25519 public key of KeyTypeEd25519 keys,
+	// which have no secret
+	PublicKey   string            `json:"public_key,omitempty"`
+	AccessKey   string            `json:"access_key"`
+	UserID      int64             `json:"user_id"`
+	Status      string            `json:"status"`
+	Permissions []*Permissions    `json:"permissions"`
+	CreatedAt   time.Time         `json:"created_at"`
+	LastUsedAt  time.Time         `json:"last_used_at"`
+	ExpiresAt   time.Time         `json:"expires_at"`
+	RotatedFrom string            `json:"rotated_from,omitempty"` // ID of the key replaced by this key
+	GraceUntil  time.Time         `json:"grace_until"`            // set on rotated keys, deactivated afterwards
+	Tags        map[string]string `json:"tags,omitempty"`
+	RateLimit   *RateLimit        `json:"rate_limit,omitempty"`
+}
+
+// User is a main account, or a RAM sub-account if ParentID is set
+type User struct {
+	ID           int64          `json:"id"`
+	ParentID     int64          `json:"parent_id,omitempty"`
+	Username     string         `json:"username"`
+	PasswordHash string         `json:"-"`
+	Status       string         `json:"status"`
+	Permissions  []*Permissions `json:"permissions"`
+	CreatedAt    time.Time      `json:"created_at"`
+	UpdatedAt    time.Time      `json:"updated_at"`
+}
+
+// Group is a group of users. Roles attached to a group apply to all its members.
+type Group struct {
+	ID          int       `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Policy is a named managed policy. Its document is versioned, the default
+// version applies wherever the policy is attached.
+type Policy struct {
+	ID             int    `json:"id"`
+	Name           string `json:"name"`
+	Description    string `json:"description"`
+	DefaultVersion int    `json:"default_version"`
+	// Document is the document of the default version
+	Document  []*Permissions `json:"document"`
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+}
+
+// PolicyVersion is an immutable version of a managed policy document
+type PolicyVersion struct {
+	PolicyID  int            `json:"policy_id"`
+	Version   int            `json:"version"`
+	Document  []*Permissions `json:"document"`
+	CreatedAt time.Time      `json:"created_at"`
 }
 
 // Role represents a role in the system
@@ -34,45 +84,117 @@ type Role struct {
 	Name        string         `json:"name"`
 	Description string         `json:"description"`
 	Permissions []*Permissions `json:"permissions"`
+	RateLimit   *RateLimit     `json:"rate_limit,omitempty"`
 	CreatedAt   time.Time      `json:"created_at"`
 	UpdatedAt   time.Time      `json:"updated_at"`
 }
 
 type Permissions struct {
-	Resources []string `json:"resources"`
-	Actions   []string `json:"actions"`
-	Effect    string   `json:"effect"`
+	Resources  []string   `json:"resources"`
+	Actions    []string   `json:"actions"`
+	Effect     string     `json:"effect"`
+	Conditions Conditions `json:"conditions,omitempty"`
 }
 
 // DB is the database connection
 var DB *sql.DB
 
-// InitDB initializes the database connection
-func InitDB(dataSourceName string) error {
-	var err error
-	DB, err = sql.Open("mysql", dataSourceName)
+// defaultService is the Service used by the package level functions
+var defaultService *Service
+
+var errNotInitialized = errors.New("database not initialized")
+
+// InitDB initializes the database connection. The options are applied to the
+// default Service, e.g. WithKeyring to encrypt secrets at rest. It returns
+// ErrSchemaOutdated if the database has not been migrated, see Migrate.
+func InitDB(dataSourceName string, opts ...ServiceOption) error {
+	db, err := OpenDB(dataSourceName)
 	if err != nil {
 		return err
 	}
 
-	// Check the connection
-	err = DB.Ping()
-	if err != nil {
+	// Refuse to run against a schema missing migrations, see Migrate
+	if err := CheckSchema(context.Background(), db); err != nil {
+		db.Close()
 		return err
 	}
+	DB = db
+
+	opts = append([]ServiceOption{
+		WithReplayWindow(replayWindow),
+		WithNonceStore(nonceStore),
+	}, opts...)
+	defaultService = NewService(NewMySQLStore(DB), opts...)
 
 	return nil
 }
 
-// GenerateAccessKeyPair generates a new access key pair
-func GenerateAccessKeyPair() (string, string, error) {
+// OpenDB opens and checks a MySQL connection with the settings the MySQL
+// store needs. Use it to run Migrate before creating a Service.
+func OpenDB(dataSourceName string) (*sql.DB, error) {
+	cfg, err := mysql.ParseDSN(dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	// created_at etc. are scanned into time.Time
+	cfg.ParseTime = true
+
+	db, err := sql.Open("mysql", cfg.FormatDSN())
+	if err != nil {
+		return nil, err
+	}
+
+	// Check the connection
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// SetDefaultService replaces the Service used by the package level functions,
+// e.g. with one backed by a MemoryStore
+func SetDefaultService(s *Service) {
+	defaultService = s
+}
+
+// DefaultService returns the Service used by the package level functions, or
+// nil if InitDB has not been called
+func DefaultService() *Service {
+	return defaultService
+}
+
+// getDefaultService returns the default Service or an error if InitDB has not been called
+func getDefaultService() (*Service, error) {
+	if defaultService == nil {
+		return nil, errNotInitialized
+	}
+	return defaultService, nil
+}
+
+// GenerateAccessKeyPair generates a new access key pair. By default the
+// secret is an HMAC key; WithKeyType(KeyTypeEd25519) returns an Ed25519
+// private key instead, whose public key is given by Ed25519PublicKey.
+func GenerateAccessKeyPair(opts ...KeyPairOption) (string, string, error) {
+	c := &keyPairConfig{keyType: KeyTypeHMAC}
+	for _, opt := range opts {
+		opt(c)
+	}
+
 	// 使用时间戳和随机数生成较短的 accessKeyID
-	timestamp := time.Now().UnixNano()
-	randomBytes := make([]byte, 4)
-	if _, err := rand.Read(randomBytes); err != nil {
+	accessKeyID, err := generateAccessKeyID()
+	if err != nil {
 		return "", "", err
 	}
-	accessKeyID := fmt.Sprintf("%x%x", timestamp, randomBytes)
+
+	switch c.keyType {
+	case KeyTypeHMAC:
+	case KeyTypeEd25519:
+		privateKey, err := generateEd25519PrivateKey()
+		return accessKeyID, privateKey, err
+	default:
+		return "", "", fmt.Errorf("%w: %q", ErrUnsupportedKeyType, c.keyType)
+	}
 
 	// 使用随机字节生成 accessKeySecret
 	secretBytes := make([]byte, 32)
@@ -84,181 +206,258 @@ func GenerateAccessKeyPair() (string, string, error) {
 	return accessKeyID, accessKeySecret, nil
 }
 
+// generateAccessKeyID generates a short access key ID from the time and random bytes
+func generateAccessKeyID() (string, error) {
+	timestamp := time.Now().UnixNano()
+	randomBytes := make([]byte, 4)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x%x", timestamp, randomBytes), nil
+}
+
 // CreateAccessKey creates a new access key for a user with specified permissions
 func CreateAccessKey(userID int64, permissions string) (string, string, error) {
-	if DB == nil {
-		return "", "", errors.New("database not initialized")
+	s, err := getDefaultService()
+	if err != nil {
+		return "", "", err
 	}
+	return s.CreateAccessKey(userID, permissions)
+}
 
-	// Generate access key pair
-	id, secret, err := GenerateAccessKeyPair()
+// CreateAccessKeyWithTTL creates a new access key which expires after ttl
+func CreateAccessKeyWithTTL(userID int64, permissions string, ttl time.Duration) (string, string, error) {
+	s, err := getDefaultService()
 	if err != nil {
 		return "", "", err
 	}
+	return s.CreateAccessKeyWithTTL(userID, permissions, ttl)
+}
 
-	// Create access key in database
-	_, err = DB.Exec(
-		"INSERT INTO access_keys (id, secret_key, access_key, user_id, permissions) VALUES (?, ?, ?, ?, ?)",
-		id,
-		secret,
-		id, // Access key is the same as ID for simplicity
-		userID,
-		permissions,
-	)
+// CreateAccessKeyWithPublicKey creates an Ed25519 access key from a public
+// key, see Service.CreateAccessKeyWithPublicKey
+func CreateAccessKeyWithPublicKey(userID int64, permissions, publicKey string) (string, error) {
+	s, err := getDefaultService()
+	if err != nil {
+		return "", err
+	}
+	return s.CreateAccessKeyWithPublicKey(userID, permissions, publicKey)
+}
 
+// ListExpiringAccessKeys returns the active access keys that expire within the given number of days
+func ListExpiringAccessKeys(days int) ([]AccessKey, error) {
+	s, err := getDefaultService()
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
+	return s.ListExpiringAccessKeys(days)
+}
 
-	return id, secret, nil
+// CreateUser creates a main account, or a RAM sub-account if parentID is not 0
+func CreateUser(username, password string, parentID int64) (*User, error) {
+	s, err := getDefaultService()
+	if err != nil {
+		return nil, err
+	}
+	return s.CreateUser(username, password, parentID)
 }
 
-// AssignRoleToAccessKey assigns a role to an access key
-func AssignRoleToAccessKey(accessKeyID string, roleID int) error {
-	if DB == nil {
-		return errors.New("database not initialized")
+// VerifyUserPassword checks the password of an active user and returns the user
+func VerifyUserPassword(username, password string) (*User, error) {
+	s, err := getDefaultService()
+	if err != nil {
+		return nil, err
 	}
+	return s.VerifyUserPassword(username, password)
+}
 
-	// Check if access key exists
-	var exists bool
-	err := DB.QueryRow("SELECT EXISTS(SELECT 1 FROM access_keys WHERE access_key = ?)", accessKeyID).Scan(&exists)
+// SuspendUser suspends a user and its sub-accounts and deactivates their access keys
+func SuspendUser(userID int64) error {
+	s, err := getDefaultService()
 	if err != nil {
 		return err
 	}
+	return s.SuspendUser(userID)
+}
 
-	if !exists {
-		return errors.New("access key not found")
+// DeleteUser deletes a user and its sub-accounts and deactivates their access keys
+func DeleteUser(userID int64) error {
+	s, err := getDefaultService()
+	if err != nil {
+		return err
 	}
+	return s.DeleteUser(userID)
+}
 
-	// Check if role exists
-	err = DB.QueryRow("SELECT EXISTS(SELECT 1 FROM roles WHERE id = ?)", roleID).Scan(&exists)
+// CreateGroup creates a group of users
+func CreateGroup(name, description string) (*Group, error) {
+	s, err := getDefaultService()
+	if err != nil {
+		return nil, err
+	}
+	return s.CreateGroup(name, description)
+}
+
+// AddUserToGroup makes a user a member of a group
+func AddUserToGroup(groupID int, userID int64) error {
+	s, err := getDefaultService()
 	if err != nil {
 		return err
 	}
+	return s.AddUserToGroup(groupID, userID)
+}
 
-	if !exists {
-		return errors.New("role not found")
+// AttachRoleToGroup attaches a role to all members of a group
+func AttachRoleToGroup(groupID, roleID int) error {
+	s, err := getDefaultService()
+	if err != nil {
+		return err
 	}
+	return s.AttachRoleToGroup(groupID, roleID)
+}
 
-	// Assign role to access key
-	_, err = DB.Exec(
-		"INSERT INTO access_key_roles (access_key_id, role_id) VALUES (?, ?)",
-		accessKeyID,
-		roleID,
-	)
+// AttachRoleToUser attaches a role to all access keys of a user
+func AttachRoleToUser(userID int64, roleID int) error {
+	s, err := getDefaultService()
+	if err != nil {
+		return err
+	}
+	return s.AttachRoleToUser(userID, roleID)
+}
 
-	return err
+// CreatePolicy creates a managed policy with the document as version 1
+func CreatePolicy(name, description, document string) (*Policy, error) {
+	s, err := getDefaultService()
+	if err != nil {
+		return nil, err
+	}
+	return s.CreatePolicy(name, description, document)
 }
 
-// ValidateAccessKey validates an access key
-func ValidateAccessKey(accessKeyID string) (bool, error) {
-	if DB == nil {
-		return false, errors.New("database not initialized")
+// CreatePolicyVersion adds a version to a managed policy
+func CreatePolicyVersion(policyID int, document string, setDefault bool) (*PolicyVersion, error) {
+	s, err := getDefaultService()
+	if err != nil {
+		return nil, err
 	}
+	return s.CreatePolicyVersion(policyID, document, setDefault)
+}
 
-	// Check if access key exists and is active
-	var status string
-	err := DB.QueryRow(
-		"SELECT status FROM access_keys WHERE access_key = ?",
-		accessKeyID,
-	).Scan(&status)
+// RollbackPolicy makes the version before the default version the default
+func RollbackPolicy(policyID int) (*Policy, error) {
+	s, err := getDefaultService()
+	if err != nil {
+		return nil, err
+	}
+	return s.RollbackPolicy(policyID)
+}
 
+// AttachPolicyToRole attaches a managed policy to a role
+func AttachPolicyToRole(policyID, roleID int) error {
+	s, err := getDefaultService()
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return false, nil
-		}
-		return false, err
+		return err
 	}
+	return s.AttachPolicyToRole(policyID, roleID)
+}
 
-	// Update last used timestamp
-	_, err = DB.Exec(
-		"UPDATE access_keys SET last_used_at = ? WHERE access_key = ?",
-		time.Now(),
-		accessKeyID,
-	)
+// AttachPolicyToUser attaches a managed policy to a user
+func AttachPolicyToUser(policyID int, userID int64) error {
+	s, err := getDefaultService()
+	if err != nil {
+		return err
+	}
+	return s.AttachPolicyToUser(policyID, userID)
+}
 
+// AttachPolicyToAccessKey attaches a managed policy to an access key
+func AttachPolicyToAccessKey(policyID int, accessKeyID string) error {
+	s, err := getDefaultService()
 	if err != nil {
-		return false, err
+		return err
 	}
+	return s.AttachPolicyToAccessKey(policyID, accessKeyID)
+}
 
-	return status == "active", nil
+// CreateRole creates a new role and returns its ID
+func CreateRole(name, description string, permissions string) (int, error) {
+	s, err := getDefaultService()
+	if err != nil {
+		return 0, err
+	}
+	return s.CreateRole(name, description, permissions)
 }
 
-// GetAccessKeyPermissions gets the permissions for an access key
-func GetAccessKeyPermissions(accessKeyID string) ([]*Permissions, error) {
-	if DB == nil {
-		return nil, errors.New("database not initialized")
+// AssignRoleToAccessKey assigns a role to an access key
+func AssignRoleToAccessKey(accessKeyID string, roleID int) error {
+	s, err := getDefaultService()
+	if err != nil {
+		return err
 	}
+	return s.AssignRoleToAccessKey(accessKeyID, roleID)
+}
 
-	// Get access key permissions
-	var permissions string
-	err := DB.QueryRow(
-		"SELECT permissions FROM access_keys WHERE access_key = ?",
-		accessKeyID,
-	).Scan(&permissions)
+// ValidateAccessKey validates an access key
+func ValidateAccessKey(accessKeyID string) (bool, error) {
+	s, err := getDefaultService()
+	if err != nil {
+		return false, err
+	}
+	return s.ValidateAccessKey(accessKeyID)
+}
 
+// GetAccessKeyPermissions gets the permissions for an access key
+func GetAccessKeyPermissions(accessKeyID string) ([]*Permissions, error) {
+	s, err := getDefaultService()
 	if err != nil {
 		return nil, err
 	}
+	return s.GetAccessKeyPermissions(accessKeyID)
+}
 
-	// Get role permissions
-	rows, err := DB.Query(
-		`SELECT r.permissions 
-		FROM roles r 
-		JOIN access_key_roles akr ON r.id = akr.role_id 
-		WHERE akr.access_key_id = ?`,
-		accessKeyID,
-	)
-
+// PermissionSources returns the permissions of an access key in resolution order
+func PermissionSources(accessKeyID string) ([]PermissionSource, error) {
+	s, err := getDefaultService()
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	return s.PermissionSources(accessKeyID)
+}
 
-	// Parse access key permissions
-	var keyPerms []*Permissions
-	err = json.Unmarshal([]byte(permissions), &keyPerms)
+// Explain simulates the authorization of a request by an access key, see Service.Explain
+func Explain(accessKeyID string, rc *RequestContext) (*Explanation, error) {
+	s, err := getDefaultService()
 	if err != nil {
 		return nil, err
 	}
+	return s.Explain(accessKeyID, rc)
+}
 
-	// Create a map to store unique permissions
-	permMap := make(map[string]*Permissions)
-
-	// Add access key permissions
-	for _, perm := range keyPerms {
-		key := fmt.Sprintf("%v-%v-%v", perm.Resources, perm.Actions, perm.Effect)
-		permMap[key] = perm
+// SetAccessKeyRateLimit sets the rate limit of an access key, nil removes it
+func SetAccessKeyRateLimit(accessKeyID string, limit *RateLimit) error {
+	s, err := getDefaultService()
+	if err != nil {
+		return err
 	}
+	return s.SetAccessKeyRateLimit(accessKeyID, limit)
+}
 
-	// Add role permissions
-	for rows.Next() {
-		var rolePermissions string
-		err = rows.Scan(&rolePermissions)
-		if err != nil {
-			return nil, err
-		}
-
-		var rolePerms []*Permissions
-		err = json.Unmarshal([]byte(rolePermissions), &rolePerms)
-		if err != nil {
-			return nil, err
-		}
-
-		for _, perm := range rolePerms {
-			key := fmt.Sprintf("%v-%v-%v", perm.Resources, perm.Actions, perm.Effect)
-			permMap[key] = perm
-		}
+// SetRoleRateLimit sets the rate limit of a role, nil removes it
+func SetRoleRateLimit(roleID int, limit *RateLimit) error {
+	s, err := getDefaultService()
+	if err != nil {
+		return err
 	}
+	return s.SetRoleRateLimit(roleID, limit)
+}
 
-	// Convert map values to slice
-	var allPermissions []*Permissions
-	for k, perm := range permMap {
-		log.Printf("key: %s, perm: %+v", k, perm)
-		allPermissions = append(allPermissions, perm)
+// SetAccessKeyTags replaces the tags of an access key
+func SetAccessKeyTags(accessKeyID string, tags map[string]string) error {
+	s, err := getDefaultService()
+	if err != nil {
+		return err
 	}
-
-	return allPermissions, nil
+	return s.SetAccessKeyTags(accessKeyID, tags)
 }
 
 // GenerateSignature generates an HMAC-SHA256 signature for a request
@@ -268,81 +467,47 @@ func GenerateSignature(accessKeySecret string, stringToSign string) string {
 	return base64.StdEncoding.EncodeToString(h.Sum(nil))
 }
 
-// VerifySignature verifies an HMAC-SHA256 signature for a request
-func VerifySignature(accessKeyID string, stringToSign string, signature string) (bool, error) {
-	if DB == nil {
-		return false, errors.New("database not initialized")
+// AssumeRole issues temporary credentials for a role, see Service.AssumeRole
+func AssumeRole(callerKeyID string, roleID int, policy string, duration time.Duration) (*Credentials, error) {
+	s, err := getDefaultService()
+	if err != nil {
+		return nil, err
 	}
+	return s.AssumeRole(callerKeyID, roleID, policy, duration)
+}
 
-	// Get access key secret
-	var secretKey string
-	err := DB.QueryRow(
-		"SELECT secret_key FROM access_keys WHERE access_key = ? AND status = 'active'",
-		accessKeyID,
-	).Scan(&secretKey)
-
+// RotateAccessKey issues a successor for an access key, see Service.RotateAccessKey
+func RotateAccessKey(accessKeyID string, grace time.Duration) (string, string, error) {
+	s, err := getDefaultService()
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return false, nil
-		}
-		return false, err
+		return "", "", err
 	}
+	return s.RotateAccessKey(accessKeyID, grace)
+}
 
-	// Generate signature
-	expectedSignature := GenerateSignature(secretKey, stringToSign)
+// EncryptSecrets encrypts all plaintext access key secrets, see Service.EncryptSecrets
+func EncryptSecrets() (int, error) {
+	s, err := getDefaultService()
+	if err != nil {
+		return 0, err
+	}
+	return s.EncryptSecrets()
+}
 
-	// Compare signatures
-	return expectedSignature == signature, nil
+// VerifySignature verifies an HMAC-SHA256 signature for a request
+func VerifySignature(accessKeyID string, stringToSign string, signature string) (bool, error) {
+	s, err := getDefaultService()
+	if err != nil {
+		return false, err
+	}
+	return s.VerifySignature(accessKeyID, stringToSign, signature)
 }
 
 // GetUserAccessKeys gets all access keys for a user
 func GetUserAccessKeys(userID int64) ([]AccessKey, error) {
-	if DB == nil {
-		return nil, errors.New("database not initialized")
-	}
-
-	// Get all access keys for user
-	rows, err := DB.Query(
-		"SELECT id, secret_key, access_key, user_id, status, permissions, created_at, last_used_at, expires_at FROM access_keys WHERE user_id = ?",
-		userID,
-	)
-
+	s, err := getDefaultService()
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	var accessKeys []AccessKey
-	for rows.Next() {
-		var ak AccessKey
-		var lastUsedAt, expiresAt sql.NullTime
-
-		err = rows.Scan(
-			&ak.ID,
-			&ak.SecretKey,
-			&ak.AccessKey,
-			&ak.UserID,
-			&ak.Status,
-			&ak.Permissions,
-			&ak.CreatedAt,
-			&lastUsedAt,
-			&expiresAt,
-		)
-
-		if err != nil {
-			return nil, err
-		}
-
-		if lastUsedAt.Valid {
-			ak.LastUsedAt = lastUsedAt.Time
-		}
-
-		if expiresAt.Valid {
-			ak.ExpiresAt = expiresAt.Time
-		}
-
-		accessKeys = append(accessKeys, ak)
-	}
-
-	return accessKeys, nil
+	return s.GetUserAccessKeys(userID)
 }
@@ -0,0 +1,417 @@
+package accesskey
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// AdminPathPrefix is the path prefix of the admin API
+const AdminPathPrefix = "/admin/v1/"
+
+// adminActionUnknown is the action of requests to unknown admin endpoints
+const adminActionUnknown = "admin:Unknown"
+
+// adminError is the body of admin API error responses
+type adminError struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// redactedAccessKey is an access key as returned by the admin API. The
+// SecretKey field shadows the secret of the embedded key and is left empty.
+type redactedAccessKey struct {
+	AccessKey
+	SecretKey string `json:"secret_key,omitempty"`
+}
+
+func redactAccessKeys(keys []AccessKey) []redactedAccessKey {
+	redacted := make([]redactedAccessKey, len(keys))
+	for i, ak := range keys {
+		redacted[i] = redactedAccessKey{AccessKey: ak}
+	}
+	return redacted
+}
+
+// AdminHandler returns the admin REST API for access keys and roles, mounted
+// at AdminPathPrefix:
+//
+//	GET    /admin/v1/keys[?user_id=1]          admin:ListAccessKeys
+//	POST   /admin/v1/keys                      admin:CreateAccessKey
+//	GET    /admin/v1/keys/{id}                 admin:GetAccessKey
+//	POST   /admin/v1/keys/{id}/deactivate      admin:DeactivateAccessKey
+//	DELETE /admin/v1/keys/{id}                 admin:DeleteAccessKey
+//	GET    /admin/v1/keys/{id}/roles           admin:ListAccessKeyRoles
+//	PUT    /admin/v1/keys/{id}/roles/{role_id} admin:AssignRole
+//	DELETE /admin/v1/keys/{id}/roles/{role_id} admin:UnassignRole
+//	GET    /admin/v1/roles                     admin:ListRoles
+//	POST   /admin/v1/roles                     admin:CreateRole
+//	GET    /admin/v1/roles/{id}                admin:GetRole
+//	PUT    /admin/v1/roles/{id}                admin:UpdateRole
+//	DELETE /admin/v1/roles/{id}                admin:DeleteRole
+//	GET    /admin/v1/users/{id}/keys           admin:ListUserAccessKeys
+//
+// The handler is protected by the signature middleware, configured with
+// opts. Requests are authorized for the action of the endpoint on the
+// request path instead of the HTTP method, e.g.
+//
+//	{"resources": ["/admin/**"], "actions": ["admin:*"], "effect": "allow"}
+//
+// Secrets are only returned when a key is created. Errors are returned as
+// {"error": {"code": "NotFound", "message": "..."}}.
+func (s *Service) AdminHandler(opts ...MiddlewareOption) http.Handler {
+	mux := http.NewServeMux()
+	actions := make(map[string]string)
+	handle := func(pattern, action string, h http.HandlerFunc) {
+		mux.HandleFunc(pattern, h)
+		actions[pattern] = action
+	}
+
+	handle("GET /admin/v1/keys", "admin:ListAccessKeys", s.adminListAccessKeys)
+	handle("POST /admin/v1/keys", "admin:CreateAccessKey", s.adminCreateAccessKey)
+	handle("GET /admin/v1/keys/{id}", "admin:GetAccessKey", s.adminGetAccessKey)
+	handle("POST /admin/v1/keys/{id}/deactivate", "admin:DeactivateAccessKey", s.adminDeactivateAccessKey)
+	handle("DELETE /admin/v1/keys/{id}", "admin:DeleteAccessKey", s.adminDeleteAccessKey)
+	handle("GET /admin/v1/keys/{id}/roles", "admin:ListAccessKeyRoles", s.adminListAccessKeyRoles)
+	handle("PUT /admin/v1/keys/{id}/roles/{role_id}", "admin:AssignRole", s.adminAssignRole)
+	handle("DELETE /admin/v1/keys/{id}/roles/{role_id}", "admin:UnassignRole", s.adminUnassignRole)
+	handle("GET /admin/v1/roles", "admin:ListRoles", s.adminListRoles)
+	handle("POST /admin/v1/roles", "admin:CreateRole", s.adminCreateRole)
+	handle("GET /admin/v1/roles/{id}", "admin:GetRole", s.adminGetRole)
+	handle("PUT /admin/v1/roles/{id}", "admin:UpdateRole", s.adminUpdateRole)
+	handle("DELETE /admin/v1/roles/{id}", "admin:DeleteRole", s.adminDeleteRole)
+	handle("GET /admin/v1/users/{id}/keys", "admin:ListUserAccessKeys", s.adminListUserAccessKeys)
+	mux.HandleFunc(AdminPathPrefix, func(w http.ResponseWriter, r *http.Request) {
+		writeAdminError(w, http.StatusNotFound, "NotFound", "no such endpoint")
+	})
+
+	resolveAction := func(r *http.Request) string {
+		_, pattern := mux.Handler(r)
+		if action, ok := actions[pattern]; ok {
+			return action
+		}
+		return adminActionUnknown
+	}
+
+	opts = append([]MiddlewareOption{
+		WithErrorResponder(adminErrorResponder),
+		WithActionResolver(resolveAction),
+	}, opts...)
+	return s.NewMiddleware(opts...)(mux)
+}
+
+// adminErrorResponder writes the errors of the signature middleware as JSON
+func adminErrorResponder(w http.ResponseWriter, r *http.Request, status int, err error) {
+	code := "InternalError"
+	switch status {
+	case http.StatusBadRequest:
+		code = "InvalidRequest"
+	case http.StatusUnauthorized:
+		code = "Unauthorized"
+	case http.StatusForbidden:
+		code = "Forbidden"
+	case http.StatusRequestEntityTooLarge:
+		code = "RequestTooLarge"
+	case http.StatusTooManyRequests:
+		code = "TooManyRequests"
+	}
+	writeAdminError(w, status, code, err.Error())
+}
+
+func writeAdminError(w http.ResponseWriter, status int, code, message string) {
+	var body adminError
+	body.Error.Code = code
+	body.Error.Message = message
+	writeAdminJSON(w, status, body)
+}
+
+// writeAdminServiceError maps an error of the Service to a response
+func writeAdminServiceError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrAccessKeyNotFound), errors.Is(err, ErrRoleNotFound), errors.Is(err, ErrUserNotFound):
+		writeAdminError(w, http.StatusNotFound, "NotFound", err.Error())
+	case errors.Is(err, ErrRoleExists):
+		writeAdminError(w, http.StatusConflict, "Conflict", err.Error())
+	case errors.Is(err, ErrUserNotActive):
+		writeAdminError(w, http.StatusConflict, "UserNotActive", err.Error())
+	case errors.Is(err, ErrInvalidPermissions):
+		writeAdminError(w, http.StatusBadRequest, "InvalidPermissions", err.Error())
+	case errors.Is(err, ErrInvalidPublicKey):
+		writeAdminError(w, http.StatusBadRequest, "InvalidPublicKey", err.Error())
+	default:
+		log.Printf("accesskey: admin %s %s: %v", r.Method, r.URL.Path, err)
+		writeAdminError(w, http.StatusInternalServerError, "InternalError", "internal error")
+	}
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// decodeAdminBody decodes the JSON request body into v, writing an error
+// response if it is invalid
+func decodeAdminBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeAdminError(w, http.StatusBadRequest, "InvalidRequest", "invalid request body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// adminIntPathValue parses an integer path wildcard, writing an error
+// response if it is invalid
+func adminIntPathValue(w http.ResponseWriter, r *http.Request, name string) (int64, bool) {
+	v, err := strconv.ParseInt(r.PathValue(name), 10, 64)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, "InvalidRequest", "invalid "+name)
+		return 0, false
+	}
+	return v, true
+}
+
+func (s *Service) adminListAccessKeys(w http.ResponseWriter, r *http.Request) {
+	var keys []AccessKey
+	var err error
+	if userID := r.URL.Query().Get("user_id"); userID != "" {
+		id, perr := strconv.ParseInt(userID, 10, 64)
+		if perr != nil {
+			writeAdminError(w, http.StatusBadRequest, "InvalidRequest", "invalid user_id")
+			return
+		}
+		keys, err = s.GetUserAccessKeys(id)
+	} else {
+		keys, err = s.ListAllAccessKeys()
+	}
+	if err != nil {
+		writeAdminServiceError(w, r, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{"access_keys": redactAccessKeys(keys)})
+}
+
+func (s *Service) adminCreateAccessKey(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		UserID      int64           `json:"user_id"`
+		Permissions json.RawMessage `json:"permissions"`
+		TTLSeconds  int64           `json:"ttl_seconds"`
+		// PublicKey creates an Ed25519 key, the response has no secret
+		PublicKey string `json:"public_key"`
+	}
+	if !decodeAdminBody(w, r, &input) {
+		return
+	}
+	if input.UserID == 0 {
+		writeAdminError(w, http.StatusBadRequest, "InvalidRequest", "user_id is required")
+		return
+	}
+
+	if input.PublicKey != "" {
+		if input.TTLSeconds > 0 {
+			writeAdminError(w, http.StatusBadRequest, "InvalidRequest", "ttl_seconds is not supported with public_key")
+			return
+		}
+		id, err := s.CreateAccessKeyWithPublicKey(input.UserID, string(input.Permissions), input.PublicKey)
+		if err != nil {
+			writeAdminServiceError(w, r, err)
+			return
+		}
+		writeAdminJSON(w, http.StatusCreated, map[string]string{"access_key_id": id, "key_type": KeyTypeEd25519})
+		return
+	}
+
+	var id, secret string
+	var err error
+	if input.TTLSeconds > 0 {
+		id, secret, err = s.CreateAccessKeyWithTTL(input.UserID, string(input.Permissions), time.Duration(input.TTLSeconds)*time.Second)
+	} else {
+		id, secret, err = s.CreateAccessKey(input.UserID, string(input.Permissions))
+	}
+	if err != nil {
+		writeAdminServiceError(w, r, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusCreated, map[string]string{"access_key_id": id, "secret": secret})
+}
+
+func (s *Service) adminGetAccessKey(w http.ResponseWriter, r *http.Request) {
+	ak, err := s.GetAccessKey(r.PathValue("id"))
+	if err != nil {
+		writeAdminServiceError(w, r, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, redactedAccessKey{AccessKey: *ak})
+}
+
+func (s *Service) adminDeactivateAccessKey(w http.ResponseWriter, r *http.Request) {
+	if err := s.DeactivateAccessKey(r.PathValue("id")); err != nil {
+		writeAdminServiceError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Service) adminDeleteAccessKey(w http.ResponseWriter, r *http.Request) {
+	if err := s.DeleteAccessKey(r.PathValue("id")); err != nil {
+		writeAdminServiceError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Service) adminListAccessKeyRoles(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if _, err := s.GetAccessKey(id); err != nil {
+		writeAdminServiceError(w, r, err)
+		return
+	}
+	roles, err := s.ListAccessKeyRoles(id)
+	if err != nil {
+		writeAdminServiceError(w, r, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{"roles": nonNilRoles(roles)})
+}
+
+func (s *Service) adminAssignRole(w http.ResponseWriter, r *http.Request) {
+	roleID, ok := adminIntPathValue(w, r, "role_id")
+	if !ok {
+		return
+	}
+	if err := s.AssignRoleToAccessKey(r.PathValue("id"), int(roleID)); err != nil {
+		writeAdminServiceError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Service) adminUnassignRole(w http.ResponseWriter, r *http.Request) {
+	roleID, ok := adminIntPathValue(w, r, "role_id")
+	if !ok {
+		return
+	}
+	if err := s.UnassignRoleFromAccessKey(r.PathValue("id"), int(roleID)); err != nil {
+		writeAdminServiceError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Service) adminListRoles(w http.ResponseWriter, r *http.Request) {
+	roles, err := s.ListRoles()
+	if err != nil {
+		writeAdminServiceError(w, r, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{"roles": nonNilRoles(roles)})
+}
+
+// adminRoleInput is the request body to create or update a role
+type adminRoleInput struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Permissions json.RawMessage `json:"permissions"`
+}
+
+func (s *Service) adminCreateRole(w http.ResponseWriter, r *http.Request) {
+	var input adminRoleInput
+	if !decodeAdminBody(w, r, &input) {
+		return
+	}
+	if input.Name == "" {
+		writeAdminError(w, http.StatusBadRequest, "InvalidRequest", "name is required")
+		return
+	}
+
+	id, err := s.CreateRole(input.Name, input.Description, string(input.Permissions))
+	if err != nil {
+		writeAdminServiceError(w, r, err)
+		return
+	}
+	role, err := s.GetRole(id)
+	if err != nil {
+		writeAdminServiceError(w, r, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusCreated, role)
+}
+
+func (s *Service) adminGetRole(w http.ResponseWriter, r *http.Request) {
+	id, ok := adminIntPathValue(w, r, "id")
+	if !ok {
+		return
+	}
+	role, err := s.GetRole(int(id))
+	if err != nil {
+		writeAdminServiceError(w, r, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, role)
+}
+
+func (s *Service) adminUpdateRole(w http.ResponseWriter, r *http.Request) {
+	id, ok := adminIntPathValue(w, r, "id")
+	if !ok {
+		return
+	}
+	var input adminRoleInput
+	if !decodeAdminBody(w, r, &input) {
+		return
+	}
+	if input.Name == "" {
+		writeAdminError(w, http.StatusBadRequest, "InvalidRequest", "name is required")
+		return
+	}
+
+	if err := s.UpdateRole(int(id), input.Name, input.Description, string(input.Permissions)); err != nil {
+		writeAdminServiceError(w, r, err)
+		return
+	}
+	role, err := s.GetRole(int(id))
+	if err != nil {
+		writeAdminServiceError(w, r, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, role)
+}
+
+func (s *Service) adminDeleteRole(w http.ResponseWriter, r *http.Request) {
+	id, ok := adminIntPathValue(w, r, "id")
+	if !ok {
+		return
+	}
+	if err := s.DeleteRole(int(id)); err != nil {
+		writeAdminServiceError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Service) adminListUserAccessKeys(w http.ResponseWriter, r *http.Request) {
+	id, ok := adminIntPathValue(w, r, "id")
+	if !ok {
+		return
+	}
+	keys, err := s.GetUserAccessKeys(id)
+	if err != nil {
+		writeAdminServiceError(w, r, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{"access_keys": redactAccessKeys(keys)})
+}
+
+// nonNilRoles makes empty role lists encode as [] instead of null
+func nonNilRoles(roles []*Role) []*Role {
+	if roles == nil {
+		return []*Role{}
+	}
+	return roles
+}
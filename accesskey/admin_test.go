@@ -0,0 +1,118 @@
+package accesskey
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// serveAdmin sends a request signed by id to the admin API
+func serveAdmin(h http.Handler, method, path, id, secret string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "http://example.com"+path, bytes.NewReader(body))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	SignRequest(req, id, secret, body)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestAdminAuthorization(t *testing.T) {
+	s, user := newTestService(t)
+	handler := s.AdminHandler()
+	admin, adminSecret := newTestKey(t, s, user, `[{"resources":["/admin/**"],"actions":["admin:*"],"effect":"allow"}]`)
+	reader, readerSecret := newTestKey(t, s, user, `[{"resources":["/admin/**"],"actions":["admin:Get*","admin:List*"],"effect":"allow"}]`)
+	// "*" grants all HTTP methods but no admin actions
+	wildcard, wildcardSecret := newTestKey(t, s, user, allowAll)
+	methods, methodsSecret := newTestKey(t, s, user, `[{"resources":["/admin/**"],"actions":["GET","POST"],"effect":"allow"}]`)
+
+	createRole := []byte(`{"name":"viewer","description":"","permissions":[{"resources":["/api/**"],"actions":["GET"],"effect":"allow"}]}`)
+	tests := []struct {
+		name   string
+		id     string
+		secret string
+		method string
+		path   string
+		body   []byte
+		want   int
+	}{
+		{"admin lists keys", admin, adminSecret, http.MethodGet, "/admin/v1/keys", nil, http.StatusOK},
+		{"reader lists keys", reader, readerSecret, http.MethodGet, "/admin/v1/keys", nil, http.StatusOK},
+		{"reader creates a role", reader, readerSecret, http.MethodPost, "/admin/v1/roles", createRole, http.StatusForbidden},
+		{"reader deactivates a key", reader, readerSecret, http.MethodPost, "/admin/v1/keys/" + admin + "/deactivate", nil, http.StatusForbidden},
+		{"wildcard lists keys", wildcard, wildcardSecret, http.MethodGet, "/admin/v1/keys", nil, http.StatusForbidden},
+		{"wildcard creates a role", wildcard, wildcardSecret, http.MethodPost, "/admin/v1/roles", createRole, http.StatusForbidden},
+		{"methods create a role", methods, methodsSecret, http.MethodPost, "/admin/v1/roles", createRole, http.StatusForbidden},
+		{"admin creates a role", admin, adminSecret, http.MethodPost, "/admin/v1/roles", createRole, http.StatusCreated},
+		{"unsigned", "", "", http.MethodGet, "/admin/v1/keys", nil, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		w := serveAdmin(handler, tt.method, tt.path, tt.id, tt.secret, tt.body)
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.want, w.Body)
+			continue
+		}
+		if tt.want == http.StatusForbidden {
+			var body adminError
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Error.Code != "Forbidden" {
+				t.Errorf("%s: body %s, want a Forbidden error", tt.name, w.Body)
+			}
+		}
+	}
+
+	// Denied requests have no effect
+	roles, err := s.ListRoles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roles) != 1 {
+		t.Errorf("%d roles created, want 1", len(roles))
+	}
+}
+
+func TestAdminRedactsSecrets(t *testing.T) {
+	s, user := newTestService(t)
+	handler := s.AdminHandler()
+	admin, adminSecret := newTestKey(t, s, user, `[{"resources":["/admin/**"],"actions":["admin:*"],"effect":"allow"}]`)
+
+	// The secret is returned once when a key is created
+	w := serveAdmin(handler, http.MethodPost, "/admin/v1/keys", admin, adminSecret,
+		[]byte(`{"user_id":`+strconv.FormatInt(user.ID, 10)+`,"permissions":`+allowAll+`}`))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create key: status %d: %s", w.Code, w.Body)
+	}
+	var created struct {
+		AccessKeyID string `json:"access_key_id"`
+		Secret      string `json:"secret"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil || created.Secret == "" {
+		t.Fatalf("create key: %s", w.Body)
+	}
+
+	for _, path := range []string{
+		"/admin/v1/keys",
+		"/admin/v1/keys/" + created.AccessKeyID,
+		"/admin/v1/keys?user_id=" + strconv.FormatInt(user.ID, 10),
+		"/admin/v1/users/" + strconv.FormatInt(user.ID, 10) + "/keys",
+	} {
+		w := serveAdmin(handler, http.MethodGet, path, admin, adminSecret, nil)
+		if w.Code != http.StatusOK {
+			t.Errorf("GET %s: status %d: %s", path, w.Code, w.Body)
+			continue
+		}
+		body := w.Body.String()
+		if !strings.Contains(body, created.AccessKeyID) {
+			t.Errorf("GET %s does not list the key: %s", path, body)
+		}
+		for _, secret := range []string{created.Secret, adminSecret, `"secret_key"`} {
+			if strings.Contains(body, secret) {
+				t.Errorf("GET %s returns %s: %s", path, secret, body)
+			}
+		}
+	}
+}
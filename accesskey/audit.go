@@ -0,0 +1,289 @@
+package accesskey
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Decisions recorded in audit events
+const (
+	AuditAllow = "allow"
+	AuditDeny  = "deny"
+)
+
+// DefaultAuditQueryLimit is the number of events returned by a query without a limit
+const DefaultAuditQueryLimit = 100
+
+// AuditEvent records one authentication and authorization decision of the middleware
+type AuditEvent struct {
+	Time        time.Time `json:"time"`
+	AccessKeyID string    `json:"access_key_id"`
+	UserID      int64     `json:"user_id,omitempty"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	SourceIP    string    `json:"source_ip,omitempty"`
+	Decision    string    `json:"decision"`
+	// Status is the status of rejected requests, 200 if the request was passed on
+	Status int `json:"status"`
+	// Reason is the failure reason of denied requests
+	Reason string `json:"reason,omitempty"`
+	// MatchedStatement is the statement that allowed or explicitly denied the request
+	MatchedStatement *Permissions `json:"matched_statement,omitempty"`
+	// Latency is the time spent authenticating and authorizing the request
+	Latency time.Duration `json:"latency_ns"`
+}
+
+// AuditSink receives the audit events of the middleware
+type AuditSink interface {
+	Record(e *AuditEvent) error
+}
+
+// AuditQuery filters audit events. Zero fields do not filter.
+type AuditQuery struct {
+	AccessKeyID string
+	UserID      int64
+	From        time.Time
+	To          time.Time
+	Decision    string
+	// Limit is DefaultAuditQueryLimit if <= 0
+	Limit int
+}
+
+// AuditReader queries recorded audit events, newest first
+type AuditReader interface {
+	QueryAuditEvents(q AuditQuery) ([]AuditEvent, error)
+}
+
+func (q AuditQuery) limit() int {
+	if q.Limit <= 0 {
+		return DefaultAuditQueryLimit
+	}
+	return q.Limit
+}
+
+func (q AuditQuery) matches(e *AuditEvent) bool {
+	if q.AccessKeyID != "" && e.AccessKeyID != q.AccessKeyID {
+		return false
+	}
+	if q.UserID != 0 && e.UserID != q.UserID {
+		return false
+	}
+	if !q.From.IsZero() && e.Time.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !e.Time.Before(q.To) {
+		return false
+	}
+	if q.Decision != "" && e.Decision != q.Decision {
+		return false
+	}
+	return true
+}
+
+// MySQLAuditSink stores audit events in the audit_log table
+type MySQLAuditSink struct {
+	db *sql.DB
+}
+
+// NewMySQLAuditSink creates an audit sink using the given database
+func NewMySQLAuditSink(db *sql.DB) *MySQLAuditSink {
+	return &MySQLAuditSink{db: db}
+}
+
+// Record implements AuditSink
+func (s *MySQLAuditSink) Record(e *AuditEvent) error {
+	var statement sql.NullString
+	if e.MatchedStatement != nil {
+		data, err := json.Marshal(e.MatchedStatement)
+		if err != nil {
+			return err
+		}
+		statement = sql.NullString{String: string(data), Valid: true}
+	}
+
+	_, err := s.db.Exec(
+		"INSERT INTO audit_log (created_at, access_key_id, user_id, method, path, source_ip, decision, status, reason, matched_statement, latency_us) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		e.Time,
+		e.AccessKeyID,
+		e.UserID,
+		e.Method,
+		truncate(e.Path, 2048),
+		e.SourceIP,
+		e.Decision,
+		e.Status,
+		truncate(e.Reason, 255),
+		statement,
+		e.Latency.Microseconds(),
+	)
+	return err
+}
+
+// truncate shortens s to at most n runes to fit a column
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n])
+}
+
+// QueryAuditEvents implements AuditReader
+func (s *MySQLAuditSink) QueryAuditEvents(q AuditQuery) ([]AuditEvent, error) {
+	var where []string
+	var args []interface{}
+	if q.AccessKeyID != "" {
+		where = append(where, "access_key_id = ?")
+		args = append(args, q.AccessKeyID)
+	}
+	if q.UserID != 0 {
+		where = append(where, "user_id = ?")
+		args = append(args, q.UserID)
+	}
+	if !q.From.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, q.From)
+	}
+	if !q.To.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, q.To)
+	}
+	if q.Decision != "" {
+		where = append(where, "decision = ?")
+		args = append(args, q.Decision)
+	}
+
+	query := "SELECT created_at, access_key_id, user_id, method, path, source_ip, decision, status, reason, matched_statement, latency_us FROM audit_log"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY created_at DESC, id DESC LIMIT ?"
+	args = append(args, q.limit())
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []AuditEvent
+	for rows.Next() {
+		var e AuditEvent
+		var statement sql.NullString
+		var latency int64
+		if err := rows.Scan(
+			&e.Time,
+			&e.AccessKeyID,
+			&e.UserID,
+			&e.Method,
+			&e.Path,
+			&e.SourceIP,
+			&e.Decision,
+			&e.Status,
+			&e.Reason,
+			&statement,
+			&latency,
+		); err != nil {
+			return nil, err
+		}
+		if statement.Valid {
+			if err := json.Unmarshal([]byte(statement.String), &e.MatchedStatement); err != nil {
+				return nil, err
+			}
+		}
+		e.Latency = time.Duration(latency) * time.Microsecond
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// JSONLAuditSink appends audit events to a file, one JSON object per line
+type JSONLAuditSink struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewJSONLAuditSink opens or creates the audit log file at path
+func NewJSONLAuditSink(path string) (*JSONLAuditSink, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONLAuditSink{path: path, file: f}, nil
+}
+
+// Record implements AuditSink
+func (s *JSONLAuditSink) Record(e *AuditEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return errors.New("audit log is closed")
+	}
+	_, err = s.file.Write(data)
+	return err
+}
+
+// QueryAuditEvents implements AuditReader by scanning the whole file
+func (s *JSONLAuditSink) QueryAuditEvents(q AuditQuery) ([]AuditEvent, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	limit := q.limit()
+	var events []AuditEvent
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var e AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// Skip a partially written last line
+			continue
+		}
+		if !q.matches(&e) {
+			continue
+		}
+		events = append(events, e)
+		// Only the newest events are returned
+		if len(events) > 2*limit {
+			events = append(events[:0], events[len(events)-limit:]...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(events) > limit {
+		events = events[len(events)-limit:]
+	}
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	return events, nil
+}
+
+// Close closes the audit log file
+func (s *JSONLAuditSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
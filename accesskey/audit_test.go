@@ -0,0 +1,159 @@
+package accesskey
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJSONLAuditSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	sink, err := NewJSONLAuditSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	events := []AuditEvent{
+		{Time: start, AccessKeyID: "AK1", UserID: 1, Decision: AuditAllow, Status: http.StatusOK},
+		{Time: start.Add(time.Minute), AccessKeyID: "AK2", UserID: 2, Decision: AuditDeny, Status: http.StatusForbidden},
+		{Time: start.Add(2 * time.Minute), AccessKeyID: "AK1", UserID: 1, Decision: AuditDeny, Status: http.StatusUnauthorized},
+		{Time: start.Add(3 * time.Minute), AccessKeyID: "AK1", UserID: 1, Decision: AuditAllow, Status: http.StatusOK},
+	}
+	for i := range events {
+		if err := sink.Record(&events[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Record(&events[0]); err == nil {
+		t.Error("Record succeeded after Close")
+	}
+
+	// A partially written last line is skipped
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"time":"2024-05-01T12:04:00Z","access_key_id":"AK1"`)
+	f.Close()
+
+	tests := []struct {
+		name  string
+		query AuditQuery
+		want  []int
+	}{
+		{"all, newest first", AuditQuery{}, []int{3, 2, 1, 0}},
+		{"access key", AuditQuery{AccessKeyID: "AK1"}, []int{3, 2, 0}},
+		{"user", AuditQuery{UserID: 2}, []int{1}},
+		{"decision", AuditQuery{Decision: AuditDeny}, []int{2, 1}},
+		{"time range", AuditQuery{From: start.Add(time.Minute), To: start.Add(3 * time.Minute)}, []int{2, 1}},
+		{"limit", AuditQuery{Limit: 2}, []int{3, 2}},
+	}
+	for _, tt := range tests {
+		got, err := sink.QueryAuditEvents(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: %d events, want %d", tt.name, len(got), len(tt.want))
+			continue
+		}
+		for i, idx := range tt.want {
+			if !got[i].Time.Equal(events[idx].Time) || got[i].Status != events[idx].Status {
+				t.Errorf("%s: event %d = %+v, want %+v", tt.name, i, got[i], events[idx])
+			}
+		}
+	}
+}
+
+// Only the newest events are kept while scanning a long file
+func TestJSONLAuditSinkQueryLimit(t *testing.T) {
+	sink, err := NewJSONLAuditSink(filepath.Join(t.TempDir(), "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	start := time.Now().Truncate(time.Second)
+	for i := 0; i < 25; i++ {
+		if err := sink.Record(&AuditEvent{Time: start.Add(time.Duration(i) * time.Second), Decision: AuditAllow}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := sink.QueryAuditEvents(AuditQuery{Limit: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 4 || !got[0].Time.Equal(start.Add(24*time.Second)) || !got[3].Time.Equal(start.Add(21*time.Second)) {
+		t.Errorf("QueryAuditEvents returned %v", got)
+	}
+}
+
+// memoryAuditSink keeps the recorded events
+type memoryAuditSink struct {
+	events []AuditEvent
+}
+
+func (s *memoryAuditSink) Record(e *AuditEvent) error {
+	s.events = append(s.events, *e)
+	return nil
+}
+
+func TestMiddlewareRecordsAuditEvents(t *testing.T) {
+	s, user := newTestService(t)
+	id, secret := newTestKey(t, s, user, `[{"resources":["/api/**"],"actions":["GET"],"effect":"allow"}]`)
+	sink := &memoryAuditSink{}
+	handler := s.NewMiddleware(WithAuditSink(sink))(&bodyRecorder{})
+
+	serve := func(path, secret string) {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+		req.RemoteAddr = "10.1.2.3:1234"
+		SignRequest(req, id, secret, nil)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	serve("/api/items", secret)
+	serve("/admin", secret)
+	serve("/api/items", "wrong secret")
+
+	want := []struct {
+		path     string
+		decision string
+		status   int
+		matched  bool
+	}{
+		{"/api/items", AuditAllow, http.StatusOK, true},
+		{"/admin", AuditDeny, http.StatusForbidden, false},
+		{"/api/items", AuditDeny, http.StatusUnauthorized, false},
+	}
+	if len(sink.events) != len(want) {
+		t.Fatalf("%d events recorded, want %d", len(sink.events), len(want))
+	}
+	for i, w := range want {
+		e := sink.events[i]
+		if e.Path != w.path || e.Decision != w.decision || e.Status != w.status || (e.MatchedStatement != nil) != w.matched {
+			t.Errorf("event %d = %+v, want %+v", i, e, w)
+		}
+		if e.AccessKeyID != id || e.Method != http.MethodGet || e.SourceIP != "10.1.2.3" || e.Time.IsZero() {
+			t.Errorf("event %d = %+v", i, e)
+		}
+		if (e.Decision == AuditDeny) != (e.Reason != "") {
+			t.Errorf("event %d: decision %s with reason %q", i, e.Decision, e.Reason)
+		}
+	}
+	if sink.events[0].UserID != user.ID {
+		t.Errorf("UserID = %d, want %d", sink.events[0].UserID, user.ID)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	if got := truncate("héllo", 2); got != "hé" {
+		t.Errorf("truncate = %q, want hé", got)
+	}
+	if got := truncate("abc", 5); got != "abc" {
+		t.Errorf("truncate = %q, want abc", got)
+	}
+}
@@ -0,0 +1,645 @@
+package accesskey
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default bounds of the CachingStore created by WithCache
+const (
+	DefaultCacheTTL        = 30 * time.Second
+	DefaultCacheMaxEntries = 10000
+)
+
+// Cache key prefixes, one entry per access key, role list, role, temporary
+// credential, group list, attached policy list and merged permissions
+const (
+	cacheKeyAccessKey   = "key:"
+	cacheKeyKeyRoles    = "roles:"
+	cacheKeyUserRoles   = "uroles:"
+	cacheKeyGroupRoles  = "groles:"
+	cacheKeyUserGroups  = "ugroups:"
+	cacheKeyPolicies    = "policies:"
+	cacheKeyRole        = "role:"
+	cacheKeyTemporary   = "sts:"
+	cacheKeyPermissions = "perms:"
+)
+
+// batchToucher is implemented by stores that record the last use of many
+// access keys at once
+type batchToucher interface {
+	TouchAccessKeys(usedAt map[string]time.Time) error
+}
+
+// permissionCache is implemented by stores that cache the merged permissions
+// computed by Service.GetAccessKeyPermissions
+type permissionCache interface {
+	cachedPermissions(accessKeyID string) ([]*Permissions, bool)
+	cachePermissions(accessKeyID string, perms []*Permissions)
+}
+
+type cacheEntry struct {
+	value     interface{}
+	expiresAt time.Time
+}
+
+// CachingStore is a Store that keeps access keys, roles, temporary
+// credentials and merged permissions in memory for a short time, so that an
+// authenticated request does not need a database round trip. Writes through
+// the CachingStore invalidate the affected entries. Changes made by other
+// instances become visible when the entries expire, or right away after
+// calling InvalidateAccessKey, InvalidateRole, InvalidateUser, InvalidateGroup,
+// InvalidatePolicy or Purge.
+//
+// Users, groups and policies are not cached themselves, only the role lists,
+// attached policies and permissions derived from them. Creating users, roles,
+// groups, policies and temporary credentials, changing passwords and adding
+// non-default policy versions therefore need no invalidation; expired
+// temporary credentials are rejected by their expiry time even while cached.
+//
+// Once StartFlusher has been called, TouchAccessKey only records the time in
+// memory and the last use times are written in batches.
+type CachingStore struct {
+	Store
+
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+
+	touchMu  sync.Mutex
+	touches  map[string]time.Time
+	batching bool
+}
+
+// NewCachingStore wraps a store with a cache. ttl and maxEntries <= 0 use
+// DefaultCacheTTL and DefaultCacheMaxEntries.
+func NewCachingStore(store Store, ttl time.Duration, maxEntries int) *CachingStore {
+	if ttl <= 0 {
+		ttl = DefaultCacheTTL
+	}
+	if maxEntries <= 0 {
+		maxEntries = DefaultCacheMaxEntries
+	}
+	return &CachingStore{
+		Store:      store,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]cacheEntry),
+		touches:    make(map[string]time.Time),
+	}
+}
+
+// WithCache wraps the store of the service in a CachingStore
+func WithCache(ttl time.Duration, maxEntries int) ServiceOption {
+	return func(s *Service) {
+		s.store = NewCachingStore(s.store, ttl, maxEntries)
+	}
+}
+
+func (c *CachingStore) get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !time.Now().Before(e.expiresAt) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return e.value, true
+}
+
+func (c *CachingStore) set(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= c.maxEntries {
+		c.evict()
+	}
+	c.entries[key] = cacheEntry{value: value, expiresAt: time.Now().Add(c.ttl)}
+}
+
+// evict drops expired entries, and random ones if the cache is still full.
+// c.mu must be held.
+func (c *CachingStore) evict() {
+	now := time.Now()
+	for key, e := range c.entries {
+		if !now.Before(e.expiresAt) {
+			delete(c.entries, key)
+		}
+	}
+	for key := range c.entries {
+		if len(c.entries) < c.maxEntries {
+			break
+		}
+		delete(c.entries, key)
+	}
+}
+
+// InvalidateAccessKey drops the cached access key, its roles and permissions
+func (c *CachingStore) InvalidateAccessKey(accessKeyID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, cacheKeyAccessKey+accessKeyID)
+	delete(c.entries, cacheKeyKeyRoles+accessKeyID)
+	delete(c.entries, cacheKeyPermissions+accessKeyID)
+	delete(c.entries, cacheKeyTemporary+accessKeyID)
+}
+
+// InvalidateRole drops the cached role. As a role may be bound to any number
+// of keys, users and groups, all cached role lists and permissions are
+// dropped as well.
+func (c *CachingStore) InvalidateRole(roleID int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, cacheKeyRole+strconv.Itoa(roleID))
+	c.deletePrefixes(cacheKeyKeyRoles, cacheKeyUserRoles, cacheKeyGroupRoles, cacheKeyPermissions)
+}
+
+// InvalidateUser drops the cached roles and groups of a user, and all cached
+// permissions
+func (c *CachingStore) InvalidateUser(userID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id := strconv.FormatInt(userID, 10)
+	delete(c.entries, cacheKeyUserRoles+id)
+	delete(c.entries, cacheKeyUserGroups+id)
+	c.deletePrefixes(cacheKeyPermissions)
+}
+
+// InvalidateGroup drops the cached roles of a group, and all cached
+// permissions
+func (c *CachingStore) InvalidateGroup(groupID int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, cacheKeyGroupRoles+strconv.Itoa(groupID))
+	c.deletePrefixes(cacheKeyPermissions)
+}
+
+// InvalidatePolicy drops all cached attached policies and permissions, as a
+// policy may be attached to any number of roles, users and keys
+func (c *CachingStore) InvalidatePolicy(policyID int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.deletePrefixes(cacheKeyPolicies, cacheKeyPermissions)
+}
+
+// deletePrefixes drops all entries with one of the key prefixes. c.mu must
+// be held.
+func (c *CachingStore) deletePrefixes(prefixes ...string) {
+	for key := range c.entries {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(key, prefix) {
+				delete(c.entries, key)
+				break
+			}
+		}
+	}
+}
+
+// Purge drops all cached entries
+func (c *CachingStore) Purge() {
+	c.mu.Lock()
+	c.entries = make(map[string]cacheEntry)
+	c.mu.Unlock()
+}
+
+// GetAccessKey implements Store
+func (c *CachingStore) GetAccessKey(accessKeyID string) (*AccessKey, error) {
+	if v, ok := c.get(cacheKeyAccessKey + accessKeyID); ok {
+		ak := *v.(*AccessKey)
+		return &ak, nil
+	}
+
+	ak, err := c.Store.GetAccessKey(accessKeyID)
+	if err != nil {
+		return nil, err
+	}
+	c.touchMu.Lock()
+	if usedAt, ok := c.touches[accessKeyID]; ok && usedAt.After(ak.LastUsedAt) {
+		ak.LastUsedAt = usedAt
+	}
+	c.touchMu.Unlock()
+
+	cached := *ak
+	c.set(cacheKeyAccessKey+accessKeyID, &cached)
+	return ak, nil
+}
+
+// CreateAccessKey implements Store
+func (c *CachingStore) CreateAccessKey(key *AccessKey) error {
+	defer c.InvalidateAccessKey(key.AccessKey)
+	return c.Store.CreateAccessKey(key)
+}
+
+// UpdateAccessKeyStatus implements Store
+func (c *CachingStore) UpdateAccessKeyStatus(accessKeyID string, status string) error {
+	defer c.InvalidateAccessKey(accessKeyID)
+	return c.Store.UpdateAccessKeyStatus(accessKeyID, status)
+}
+
+// RetireAccessKey implements Store
+func (c *CachingStore) RetireAccessKey(accessKeyID string) (bool, error) {
+	defer c.InvalidateAccessKey(accessKeyID)
+	return c.Store.RetireAccessKey(accessKeyID)
+}
+
+// UpdateAccessKeySecret implements Store
+func (c *CachingStore) UpdateAccessKeySecret(accessKeyID string, secret string) error {
+	defer c.InvalidateAccessKey(accessKeyID)
+	return c.Store.UpdateAccessKeySecret(accessKeyID, secret)
+}
+
+// SetAccessKeyGraceUntil implements Store
+func (c *CachingStore) SetAccessKeyGraceUntil(accessKeyID string, until time.Time) error {
+	defer c.InvalidateAccessKey(accessKeyID)
+	return c.Store.SetAccessKeyGraceUntil(accessKeyID, until)
+}
+
+// UpdateAccessKeyTags implements Store
+func (c *CachingStore) UpdateAccessKeyTags(accessKeyID string, tags map[string]string) error {
+	defer c.InvalidateAccessKey(accessKeyID)
+	return c.Store.UpdateAccessKeyTags(accessKeyID, tags)
+}
+
+// UpdateAccessKeyRateLimit implements Store
+func (c *CachingStore) UpdateAccessKeyRateLimit(accessKeyID string, limit *RateLimit) error {
+	defer c.InvalidateAccessKey(accessKeyID)
+	return c.Store.UpdateAccessKeyRateLimit(accessKeyID, limit)
+}
+
+// DeleteAccessKey implements Store
+func (c *CachingStore) DeleteAccessKey(accessKeyID string) error {
+	defer c.invalidateAttachedPolicies(PolicyTargetAccessKey, accessKeyID)
+	defer c.InvalidateAccessKey(accessKeyID)
+	return c.Store.DeleteAccessKey(accessKeyID)
+}
+
+// TouchAccessKey implements Store. The cached access key is updated right
+// away; the store is written on the next flush if the flusher is running.
+func (c *CachingStore) TouchAccessKey(accessKeyID string, usedAt time.Time) error {
+	c.mu.Lock()
+	if e, ok := c.entries[cacheKeyAccessKey+accessKeyID]; ok {
+		ak := *e.value.(*AccessKey)
+		ak.LastUsedAt = usedAt
+		e.value = &ak
+		c.entries[cacheKeyAccessKey+accessKeyID] = e
+	}
+	c.mu.Unlock()
+
+	c.touchMu.Lock()
+	if c.batching {
+		c.touches[accessKeyID] = usedAt
+		c.touchMu.Unlock()
+		return nil
+	}
+	c.touchMu.Unlock()
+	return c.Store.TouchAccessKey(accessKeyID, usedAt)
+}
+
+// GetRole implements Store
+func (c *CachingStore) GetRole(roleID int) (*Role, error) {
+	key := cacheKeyRole + strconv.Itoa(roleID)
+	if v, ok := c.get(key); ok {
+		role := *v.(*Role)
+		return &role, nil
+	}
+
+	role, err := c.Store.GetRole(roleID)
+	if err != nil {
+		return nil, err
+	}
+	cached := *role
+	c.set(key, &cached)
+	return role, nil
+}
+
+// UpdateRole implements Store
+func (c *CachingStore) UpdateRole(role *Role) error {
+	defer c.InvalidateRole(role.ID)
+	return c.Store.UpdateRole(role)
+}
+
+// DeleteRole implements Store
+func (c *CachingStore) DeleteRole(roleID int) error {
+	defer c.invalidateAttachedPolicies(PolicyTargetRole, strconv.Itoa(roleID))
+	defer c.InvalidateRole(roleID)
+	return c.Store.DeleteRole(roleID)
+}
+
+// UpdateRoleRateLimit implements Store
+func (c *CachingStore) UpdateRoleRateLimit(roleID int, limit *RateLimit) error {
+	defer c.InvalidateRole(roleID)
+	return c.Store.UpdateRoleRateLimit(roleID, limit)
+}
+
+// BindRole implements Store
+func (c *CachingStore) BindRole(accessKeyID string, roleID int) error {
+	defer c.InvalidateAccessKey(accessKeyID)
+	return c.Store.BindRole(accessKeyID, roleID)
+}
+
+// UnbindRole implements Store
+func (c *CachingStore) UnbindRole(accessKeyID string, roleID int) error {
+	defer c.InvalidateAccessKey(accessKeyID)
+	return c.Store.UnbindRole(accessKeyID, roleID)
+}
+
+// ListAccessKeyRoles implements Store
+func (c *CachingStore) ListAccessKeyRoles(accessKeyID string) ([]*Role, error) {
+	if v, ok := c.get(cacheKeyKeyRoles + accessKeyID); ok {
+		return copyRoles(v.([]*Role)), nil
+	}
+
+	roles, err := c.Store.ListAccessKeyRoles(accessKeyID)
+	if err != nil {
+		return nil, err
+	}
+	c.set(cacheKeyKeyRoles+accessKeyID, copyRoles(roles))
+	return roles, nil
+}
+
+// UpdateUserStatus implements Store
+func (c *CachingStore) UpdateUserStatus(userID int64, status string) error {
+	defer c.InvalidateUser(userID)
+	return c.Store.UpdateUserStatus(userID, status)
+}
+
+// AddGroupMember implements Store
+func (c *CachingStore) AddGroupMember(groupID int, userID int64) error {
+	defer c.InvalidateUser(userID)
+	return c.Store.AddGroupMember(groupID, userID)
+}
+
+// RemoveGroupMember implements Store
+func (c *CachingStore) RemoveGroupMember(groupID int, userID int64) error {
+	defer c.InvalidateUser(userID)
+	return c.Store.RemoveGroupMember(groupID, userID)
+}
+
+// ListUserGroups implements Store
+func (c *CachingStore) ListUserGroups(userID int64) ([]*Group, error) {
+	key := cacheKeyUserGroups + strconv.FormatInt(userID, 10)
+	if v, ok := c.get(key); ok {
+		return copyGroups(v.([]*Group)), nil
+	}
+
+	groups, err := c.Store.ListUserGroups(userID)
+	if err != nil {
+		return nil, err
+	}
+	c.set(key, copyGroups(groups))
+	return groups, nil
+}
+
+// BindGroupRole implements Store
+func (c *CachingStore) BindGroupRole(groupID int, roleID int) error {
+	defer c.InvalidateGroup(groupID)
+	return c.Store.BindGroupRole(groupID, roleID)
+}
+
+// UnbindGroupRole implements Store
+func (c *CachingStore) UnbindGroupRole(groupID int, roleID int) error {
+	defer c.InvalidateGroup(groupID)
+	return c.Store.UnbindGroupRole(groupID, roleID)
+}
+
+// ListGroupRoles implements Store
+func (c *CachingStore) ListGroupRoles(groupID int) ([]*Role, error) {
+	key := cacheKeyGroupRoles + strconv.Itoa(groupID)
+	if v, ok := c.get(key); ok {
+		return copyRoles(v.([]*Role)), nil
+	}
+
+	roles, err := c.Store.ListGroupRoles(groupID)
+	if err != nil {
+		return nil, err
+	}
+	c.set(key, copyRoles(roles))
+	return roles, nil
+}
+
+// BindUserRole implements Store
+func (c *CachingStore) BindUserRole(userID int64, roleID int) error {
+	defer c.InvalidateUser(userID)
+	return c.Store.BindUserRole(userID, roleID)
+}
+
+// UnbindUserRole implements Store
+func (c *CachingStore) UnbindUserRole(userID int64, roleID int) error {
+	defer c.InvalidateUser(userID)
+	return c.Store.UnbindUserRole(userID, roleID)
+}
+
+// ListUserRoles implements Store
+func (c *CachingStore) ListUserRoles(userID int64) ([]*Role, error) {
+	key := cacheKeyUserRoles + strconv.FormatInt(userID, 10)
+	if v, ok := c.get(key); ok {
+		return copyRoles(v.([]*Role)), nil
+	}
+
+	roles, err := c.Store.ListUserRoles(userID)
+	if err != nil {
+		return nil, err
+	}
+	c.set(key, copyRoles(roles))
+	return roles, nil
+}
+
+// CreatePolicyVersion implements Store
+func (c *CachingStore) CreatePolicyVersion(policyID int, document []*Permissions, setDefault bool) (*PolicyVersion, error) {
+	if setDefault {
+		defer c.InvalidatePolicy(policyID)
+	}
+	return c.Store.CreatePolicyVersion(policyID, document, setDefault)
+}
+
+// SetDefaultPolicyVersion implements Store
+func (c *CachingStore) SetDefaultPolicyVersion(policyID int, version int) error {
+	defer c.InvalidatePolicy(policyID)
+	return c.Store.SetDefaultPolicyVersion(policyID, version)
+}
+
+// AttachPolicy implements Store
+func (c *CachingStore) AttachPolicy(policyID int, targetType, targetID string) error {
+	defer c.invalidateAttachedPolicies(targetType, targetID)
+	return c.Store.AttachPolicy(policyID, targetType, targetID)
+}
+
+// DetachPolicy implements Store
+func (c *CachingStore) DetachPolicy(policyID int, targetType, targetID string) error {
+	defer c.invalidateAttachedPolicies(targetType, targetID)
+	return c.Store.DetachPolicy(policyID, targetType, targetID)
+}
+
+// ListAttachedPolicies implements Store
+func (c *CachingStore) ListAttachedPolicies(targetType, targetID string) ([]*Policy, error) {
+	key := cacheKeyPolicies + targetType + ":" + targetID
+	if v, ok := c.get(key); ok {
+		return copyPolicies(v.([]*Policy)), nil
+	}
+
+	policies, err := c.Store.ListAttachedPolicies(targetType, targetID)
+	if err != nil {
+		return nil, err
+	}
+	c.set(key, copyPolicies(policies))
+	return policies, nil
+}
+
+func (c *CachingStore) invalidateAttachedPolicies(targetType, targetID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, cacheKeyPolicies+targetType+":"+targetID)
+	c.deletePrefixes(cacheKeyPermissions)
+}
+
+func copyPolicies(policies []*Policy) []*Policy {
+	cp := make([]*Policy, len(policies))
+	for i, policy := range policies {
+		p := *policy
+		cp[i] = &p
+	}
+	return cp
+}
+
+func copyGroups(groups []*Group) []*Group {
+	cp := make([]*Group, len(groups))
+	for i, group := range groups {
+		g := *group
+		cp[i] = &g
+	}
+	return cp
+}
+
+func copyRoles(roles []*Role) []*Role {
+	cp := make([]*Role, len(roles))
+	for i, role := range roles {
+		r := *role
+		cp[i] = &r
+	}
+	return cp
+}
+
+// GetTemporaryCredential implements Store
+func (c *CachingStore) GetTemporaryCredential(accessKeyID string) (*TemporaryCredential, error) {
+	if v, ok := c.get(cacheKeyTemporary + accessKeyID); ok {
+		cred := *v.(*TemporaryCredential)
+		return &cred, nil
+	}
+
+	cred, err := c.Store.GetTemporaryCredential(accessKeyID)
+	if err != nil {
+		return nil, err
+	}
+	cached := *cred
+	c.set(cacheKeyTemporary+accessKeyID, &cached)
+	return cred, nil
+}
+
+func (c *CachingStore) cachedPermissions(accessKeyID string) ([]*Permissions, bool) {
+	v, ok := c.get(cacheKeyPermissions + accessKeyID)
+	if !ok {
+		return nil, false
+	}
+	return v.([]*Permissions), true
+}
+
+func (c *CachingStore) cachePermissions(accessKeyID string, perms []*Permissions) {
+	c.set(cacheKeyPermissions+accessKeyID, perms)
+}
+
+// Flush writes the buffered last use times to the store
+func (c *CachingStore) Flush() error {
+	c.touchMu.Lock()
+	touches := c.touches
+	c.touches = make(map[string]time.Time)
+	c.touchMu.Unlock()
+
+	if len(touches) == 0 {
+		return nil
+	}
+	if b, ok := c.Store.(batchToucher); ok {
+		if err := b.TouchAccessKeys(touches); err != nil {
+			c.requeueTouches(touches)
+			return err
+		}
+		return nil
+	}
+	for accessKeyID, usedAt := range touches {
+		if err := c.Store.TouchAccessKey(accessKeyID, usedAt); err != nil {
+			c.requeueTouches(touches)
+			return err
+		}
+		delete(touches, accessKeyID)
+	}
+	return nil
+}
+
+// requeueTouches puts last use times that could not be written back into the
+// buffer, unless a later use has been recorded in the meantime
+func (c *CachingStore) requeueTouches(touches map[string]time.Time) {
+	c.touchMu.Lock()
+	defer c.touchMu.Unlock()
+
+	for accessKeyID, usedAt := range touches {
+		if t, ok := c.touches[accessKeyID]; !ok || usedAt.After(t) {
+			c.touches[accessKeyID] = usedAt
+		}
+	}
+}
+
+// StartFlusher buffers last use times from now on and writes them to the
+// store every interval. The returned function stops the flusher and writes
+// the remaining times.
+func (c *CachingStore) StartFlusher(interval time.Duration) (stop func()) {
+	c.touchMu.Lock()
+	c.batching = true
+	c.touchMu.Unlock()
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := c.Flush(); err != nil {
+					log.Printf("accesskey: flush last used times: %v", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-finished
+
+			c.touchMu.Lock()
+			c.batching = false
+			c.touchMu.Unlock()
+			if err := c.Flush(); err != nil {
+				log.Printf("accesskey: flush last used times: %v", err)
+			}
+		})
+	}
+}
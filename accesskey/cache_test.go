@@ -0,0 +1,95 @@
+package accesskey
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// failingToucher fails to write last use times while fail is set
+type failingToucher struct {
+	Store
+
+	fail bool
+}
+
+func (s *failingToucher) TouchAccessKey(accessKeyID string, usedAt time.Time) error {
+	if s.fail {
+		return errors.New("store unavailable")
+	}
+	return s.Store.TouchAccessKey(accessKeyID, usedAt)
+}
+
+func TestFlushKeepsTouchesOnFailure(t *testing.T) {
+	store := &failingToucher{Store: NewMemoryStore(), fail: true}
+	cache := NewCachingStore(store, time.Minute, 0)
+	stop := cache.StartFlusher(time.Hour)
+	defer stop()
+
+	s := NewService(cache)
+	user, err := s.CreateUser("alice", "password123", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := newTestKey(t, s, user, allowAll)
+
+	first := time.Now().Add(-time.Minute).Truncate(time.Second)
+	if err := cache.TouchAccessKey(id, first); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Flush(); err == nil {
+		t.Fatal("Flush succeeded with a failing store")
+	}
+
+	store.fail = false
+	if err := cache.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	ak, err := store.Store.GetAccessKey(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ak.LastUsedAt.Equal(first) {
+		t.Errorf("LastUsedAt = %v, want %v", ak.LastUsedAt, first)
+	}
+}
+
+// A use recorded after a failed flush wins over the requeued one
+func TestRequeueTouchesKeepsLaterUse(t *testing.T) {
+	cache := NewCachingStore(NewMemoryStore(), time.Minute, 0)
+	now := time.Now()
+	cache.touches["AK1"] = now
+	cache.requeueTouches(map[string]time.Time{
+		"AK1": now.Add(-time.Second),
+		"AK2": now,
+	})
+	if got := cache.touches["AK1"]; !got.Equal(now) {
+		t.Errorf("AK1 = %v, want the later use %v", got, now)
+	}
+	if got := cache.touches["AK2"]; !got.Equal(now) {
+		t.Errorf("AK2 = %v, want %v", got, now)
+	}
+}
+
+func TestUpdateUserStatusInvalidatesPermissions(t *testing.T) {
+	cache := NewCachingStore(NewMemoryStore(), time.Minute, 0)
+	s := NewService(cache)
+	user, err := s.CreateUser("alice", "password123", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := newTestKey(t, s, user, allowAll)
+
+	if _, err := s.GetAccessKeyPermissions(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.cachedPermissions(id); !ok {
+		t.Fatal("permissions were not cached")
+	}
+	if err := cache.UpdateUserStatus(user.ID, "suspended"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.cachedPermissions(id); ok {
+		t.Error("permissions still cached after a user status change")
+	}
+}
@@ -0,0 +1,195 @@
+package accesskey
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCanonicalRequest(t *testing.T) {
+	params := SignatureParams{
+		Method: "get",
+		Path:   "/a b/ü",
+		Query:  url.Values{"b": {"2", "1"}, "a": {"x y"}, "c/d": {"e&f"}},
+		Headers: map[string]string{
+			"Content-Type": "text/plain;  charset=utf-8 ",
+			"X-Nonce":      "n",
+			"X-Unsigned":   "ignored",
+		},
+		Host:          "example.com",
+		SignedHeaders: []string{"content-type", "host", "x-nonce"},
+		Content:       []byte("hello"),
+	}
+	want := strings.Join([]string{
+		"GET",
+		"/a%20b/%C3%BC",
+		"a=x%20y&b=1&b=2&c%2Fd=e%26f",
+		"content-type:text/plain; charset=utf-8",
+		"host:example.com",
+		"x-nonce:n",
+		"",
+		"content-type;host;x-nonce",
+		"2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+	}, "\n")
+	if got := CanonicalRequest(params); got != want {
+		t.Errorf("CanonicalRequest =\n%s\nwant\n%s", got, want)
+	}
+
+	// A declared payload hash is signed instead of the content
+	params.ContentSHA256 = UnsignedPayload
+	if got := CanonicalRequest(params); !strings.HasSuffix(got, "\n"+UnsignedPayload) {
+		t.Errorf("CanonicalRequest does not end with the declared hash:\n%s", got)
+	}
+}
+
+func TestGenerateStringToSign(t *testing.T) {
+	v1 := SignatureParams{
+		Method:      "GET",
+		Path:        "/api/v1/users",
+		QueryParams: map[string]string{"b": "2", "a": "1"},
+		Timestamp:   "1700000000",
+		Nonce:       "abc",
+	}
+	if got, want := GenerateStringToSign(v1), "GET\n/api/v1/users\na=1&b=2\n1700000000\nabc\n"; got != want {
+		t.Errorf("version 1 string to sign = %q, want %q", got, want)
+	}
+	v1.Content = []byte("hello")
+	if got := GenerateStringToSign(v1); !strings.HasSuffix(got, "\nLPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=") {
+		t.Errorf("version 1 string to sign does not end with the base64 content hash: %q", got)
+	}
+
+	v2 := SignatureParams{
+		Version:       SignatureVersion2,
+		Method:        "GET",
+		Path:          "/api/v1/users",
+		Host:          "example.com",
+		SignedHeaders: []string{"host"},
+		Timestamp:     "1700000000",
+		Nonce:         "abc",
+	}
+	lines := strings.Split(GenerateStringToSign(v2), "\n")
+	if len(lines) != 4 || lines[0] != signatureV2Algorithm || lines[1] != "1700000000" || lines[2] != "abc" || len(lines[3]) != 64 {
+		t.Errorf("version 2 string to sign = %q", lines)
+	}
+}
+
+func TestURIEncode(t *testing.T) {
+	tests := []struct {
+		in          string
+		encodeSlash bool
+		want        string
+	}{
+		{"AZaz09-_.~", true, "AZaz09-_.~"},
+		{"/a/b", false, "/a/b"},
+		{"/a/b", true, "%2Fa%2Fb"},
+		{"a b+c", true, "a%20b%2Bc"},
+		{"é", false, "%C3%A9"},
+		{"%2F", false, "%252F"},
+	}
+	for _, tt := range tests {
+		if got := uriEncode(tt.in, tt.encodeSlash); got != tt.want {
+			t.Errorf("uriEncode(%q, %v) = %q, want %q", tt.in, tt.encodeSlash, got, tt.want)
+		}
+	}
+}
+
+func TestParseSignedHeaders(t *testing.T) {
+	names, err := parseSignedHeaders(" X-Timestamp;Host;;content-type ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(names, ";"); got != "content-type;host;x-timestamp" {
+		t.Errorf("parseSignedHeaders = %q", got)
+	}
+	for _, value := range []string{"", "x-timestamp;x-nonce"} {
+		if _, err := parseSignedHeaders(value); err == nil {
+			t.Errorf("parseSignedHeaders(%q) succeeded, want an error", value)
+		}
+	}
+}
+
+func TestSignatureVersions(t *testing.T) {
+	s, user := newTestService(t)
+	id, secret := newTestKey(t, s, user, allowAll)
+
+	newRequest := func(version string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/api/v1/users?a=1&a=2", nil)
+		req.Header.Set("Content-Type", "application/json")
+		if err := SignRequestWithVersion(req, id, secret, nil, version); err != nil {
+			t.Fatal(err)
+		}
+		return req
+	}
+
+	tests := []struct {
+		name    string
+		version string
+		modify  func(*http.Request)
+		valid   bool
+	}{
+		{"version 1", SignatureVersion1, func(*http.Request) {}, true},
+		{"version 2", SignatureVersion2, func(*http.Request) {}, true},
+
+		// Version 1 only signs the first value of each query parameter and
+		// no headers but its own
+		{"version 1 second query value", SignatureVersion1, func(r *http.Request) { r.URL.RawQuery = "a=1&a=3" }, true},
+		{"version 1 host", SignatureVersion1, func(r *http.Request) { r.Host = "evil.example.com" }, true},
+		{"version 1 first query value", SignatureVersion1, func(r *http.Request) { r.URL.RawQuery = "a=3&a=2" }, false},
+
+		{"version 2 second query value", SignatureVersion2, func(r *http.Request) { r.URL.RawQuery = "a=1&a=3" }, false},
+		{"version 2 query order", SignatureVersion2, func(r *http.Request) { r.URL.RawQuery = "a=2&a=1" }, true},
+		{"version 2 host", SignatureVersion2, func(r *http.Request) { r.Host = "evil.example.com" }, false},
+		{"version 2 signed header", SignatureVersion2, func(r *http.Request) { r.Header.Set("Content-Type", "text/plain") }, false},
+		{"version 2 unsigned header", SignatureVersion2, func(r *http.Request) { r.Header.Set("Accept", "text/plain") }, true},
+		{"version 2 path", SignatureVersion2, func(r *http.Request) { r.URL.Path = "/api/v1/users/" }, false},
+		{"version 2 without host", SignatureVersion2, func(r *http.Request) { r.Header.Set("X-Signed-Headers", "x-nonce;x-timestamp") }, false},
+		{"downgrade to version 1", SignatureVersion2, func(r *http.Request) { r.Header.Del("X-Signature-Version") }, false},
+		{"unsupported version", SignatureVersion2, func(r *http.Request) { r.Header.Set("X-Signature-Version", "3") }, false},
+	}
+	for _, tt := range tests {
+		req := newRequest(tt.version)
+		tt.modify(req)
+		ok, err := s.VerifyRequestSignature(req, nil)
+		if ok != tt.valid || (tt.valid && err != nil) {
+			t.Errorf("%s: VerifyRequestSignature = %v, %v, want %v", tt.name, ok, err, tt.valid)
+		}
+	}
+}
+
+func TestSignRequestSignsPresentHeaders(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/api/v1/users", nil)
+	req.Header.Set("Content-Type", "application/json")
+	SignRequest(req, "AK1", "secret", []byte("{}"))
+
+	if got := req.Header.Get("X-Signature-Version"); got != DefaultSignatureVersion {
+		t.Errorf("X-Signature-Version = %q, want %q", got, DefaultSignatureVersion)
+	}
+	if got, want := req.Header.Get("X-Signed-Headers"), "content-type;host;x-access-key-id;x-nonce;x-timestamp"; got != want {
+		t.Errorf("X-Signed-Headers = %q, want %q", got, want)
+	}
+}
+
+func TestSignRequestErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		secret  string
+		version string
+	}{
+		{"malformed ed25519 key", ed25519SecretPrefix + "not base64", SignatureVersion2},
+		{"short ed25519 key", ed25519SecretPrefix + "AAAA", SignatureVersion2},
+		{"unsupported version", "secret", "3"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/api", nil)
+		// A signature left over from an earlier attempt is removed
+		req.Header.Set("X-Signature", "stale")
+		if err := SignRequestWithVersion(req, "AK1", tt.secret, nil, tt.version); err == nil {
+			t.Errorf("%s: SignRequestWithVersion succeeded, want an error", tt.name)
+		}
+		if got := req.Header.Get("X-Signature"); got != "" {
+			t.Errorf("%s: X-Signature = %q, want none", tt.name, got)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package accesskey
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Transport is an http.RoundTripper that signs every request with the
+// credentials of its provider
+type Transport struct {
+	// Credentials supplies the signing credentials
+	Credentials CredentialsProvider
+	// Base performs the requests, http.DefaultTransport if nil
+	Base http.RoundTripper
+	// SignatureVersion is DefaultSignatureVersion if empty
+	SignatureVersion string
+
+	mu          sync.Mutex
+	clockOffset time.Duration
+}
+
+// NewClient creates an HTTP client that signs requests with a long-lived access key
+func NewClient(accessKeyID, secret string) *http.Client {
+	return NewClientWithProvider(NewStaticProvider(accessKeyID, secret))
+}
+
+// NewClientWithProvider creates an HTTP client that signs requests with the
+// credentials of the given provider
+func NewClientWithProvider(provider CredentialsProvider) *http.Client {
+	return &http.Client{Transport: &Transport{Credentials: provider}}
+}
+
+// RoundTrip implements http.RoundTripper. The body is buffered so it can be
+// hashed and, if the server rejects the request because of clock skew, sent
+// again with a timestamp corrected by the server's Date header.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	creds, err := t.Credentials.Retrieve()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.send(req, creds, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized && resp.Header.Get(authErrorHeader) == authErrorRequestExpired {
+		serverTime, perr := http.ParseTime(resp.Header.Get("Date"))
+		if perr == nil {
+			t.mu.Lock()
+			t.clockOffset = time.Until(serverTime)
+			t.mu.Unlock()
+
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			return t.send(req, creds, body)
+		}
+	}
+
+	return resp, nil
+}
+
+// send signs a copy of req and performs it
+func (t *Transport) send(req *http.Request, creds *Credentials, body []byte) (*http.Response, error) {
+	// A RoundTripper must not modify the original request
+	r := req.Clone(req.Context())
+	if body != nil {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+		r.ContentLength = int64(len(body))
+	}
+
+	if creds.SessionToken != "" {
+		r.Header.Set("X-Security-Token", creds.SessionToken)
+	}
+
+	version := t.SignatureVersion
+	if version == "" {
+		version = DefaultSignatureVersion
+	}
+
+	t.mu.Lock()
+	now := time.Now().Add(t.clockOffset)
+	t.mu.Unlock()
+
+	if err := signRequest(r, creds.AccessKeyID, creds.SecretKey, body, version, now); err != nil {
+		return nil, err
+	}
+
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(r)
+}
@@ -0,0 +1,184 @@
+package accesskey
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClientSignsRequests(t *testing.T) {
+	s, user := newTestService(t)
+	id, secret := newTestKey(t, s, user, allowAll)
+	rec := &bodyRecorder{}
+	srv := httptest.NewServer(s.Middleware(rec))
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/api/v1/users?a=1", strings.NewReader(`{"name":"bob"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := NewClient(id, secret).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	if string(rec.body) != `{"name":"bob"}` {
+		t.Errorf("handler read %q", rec.body)
+	}
+	// The request of the caller is not modified
+	if req.Header.Get("X-Signature") != "" {
+		t.Error("the transport signed the original request")
+	}
+
+	resp, err = NewClient(id, "wrong secret").Get(srv.URL + "/api/v1/users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("wrong secret: status %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
+
+// A request rejected because of clock skew is sent again with the server time
+func TestClientCorrectsClockSkew(t *testing.T) {
+	s, user := newTestService(t)
+	id, secret := newTestKey(t, s, user, allowAll)
+	var requests atomic.Int32
+	handler := s.Middleware(&bodyRecorder{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	transport := &Transport{Credentials: NewStaticProvider(id, secret)}
+	transport.clockOffset = -time.Hour
+	resp, err := (&http.Client{Transport: transport}).Post(srv.URL+"/api", "text/plain", strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("%d requests sent, want 2", n)
+	}
+	if offset := transport.clockOffset; offset < -time.Minute || offset > time.Minute {
+		t.Errorf("clock offset = %v after the correction", offset)
+	}
+}
+
+func TestClientWithSTSProvider(t *testing.T) {
+	s, user := newTestService(t)
+	id, secret := newTestKey(t, s, user, `[{"resources":["/sts/**"],"actions":["POST"],"effect":"allow"}]`)
+	roleID, err := s.CreateRole("reader", "", `[{"resources":["/api/**"],"actions":["GET"],"effect":"allow"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AssignRoleToAccessKey(id, roleID); err != nil {
+		t.Fatal(err)
+	}
+
+	var assumed atomic.Int32
+	assumeRole := s.AssumeRoleHandler()
+	mux := http.NewServeMux()
+	mux.Handle("/sts/assume-role", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assumed.Add(1)
+		assumeRole.ServeHTTP(w, r)
+	}))
+	mux.Handle("/api/", &bodyRecorder{})
+	srv := httptest.NewServer(s.Middleware(mux))
+	defer srv.Close()
+
+	provider := &STSProvider{
+		Client:   NewClient(id, secret),
+		Endpoint: srv.URL + "/sts/assume-role",
+		RoleID:   roleID,
+		Duration: time.Hour,
+	}
+	client := NewClientWithProvider(provider)
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(srv.URL + "/api/items")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d with temporary credentials: status %d", i+1, resp.StatusCode)
+		}
+	}
+	// The credentials are reused until shortly before they expire
+	if n := assumed.Load(); n != 1 {
+		t.Errorf("role assumed %d times, want 1", n)
+	}
+
+	provider.RoleID = roleID + 1
+	provider.creds = nil
+	if _, err := provider.Retrieve(); err == nil {
+		t.Error("Retrieve succeeded for a role that is not bound to the key")
+	}
+}
+
+func TestEnvProvider(t *testing.T) {
+	t.Setenv(EnvAccessKeyID, "AK1")
+	t.Setenv(EnvAccessSecret, "secret")
+	t.Setenv(EnvSessionToken, "token")
+	c, err := EnvProvider{}.Retrieve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.AccessKeyID != "AK1" || c.SecretKey != "secret" || c.SessionToken != "token" {
+		t.Errorf("credentials = %+v", c)
+	}
+
+	t.Setenv(EnvAccessSecret, "")
+	if _, err := (EnvProvider{}).Retrieve(); err == nil {
+		t.Error("Retrieve succeeded without a secret")
+	}
+}
+
+func TestFileProvider(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) *FileProvider {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return &FileProvider{Path: path}
+	}
+
+	expiration := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	c, err := write("valid.json", `{"access_key_id":"TMP1","secret_key":"secret","session_token":"token","expiration":"`+expiration+`"}`).Retrieve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.AccessKeyID != "TMP1" || c.SessionToken != "token" {
+		t.Errorf("credentials = %+v", c)
+	}
+
+	expired := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	for name, content := range map[string]string{
+		"expired.json":    `{"access_key_id":"TMP1","secret_key":"secret","expiration":"` + expired + `"}`,
+		"incomplete.json": `{"access_key_id":"TMP1"}`,
+		"invalid.json":    `access_key_id=TMP1`,
+	} {
+		if _, err := write(name, content).Retrieve(); err == nil {
+			t.Errorf("%s: Retrieve succeeded, want an error", name)
+		}
+	}
+	if _, err := (&FileProvider{Path: filepath.Join(dir, "missing.json")}).Retrieve(); err == nil {
+		t.Error("Retrieve of a missing file succeeded")
+	}
+}
@@ -0,0 +1,305 @@
+package accesskey
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Condition operators supported in the conditions block of Permissions
+const (
+	CondIpAddress       = "IpAddress"
+	CondNotIpAddress    = "NotIpAddress"
+	CondDateGreaterThan = "DateGreaterThan"
+	CondDateLessThan    = "DateLessThan"
+	CondBool            = "Bool"
+	CondStringEquals    = "StringEquals"
+	CondStringNotEquals = "StringNotEquals"
+)
+
+// Condition keys. String conditions also accept "header:<Name>" for request
+// headers and "tag:<name>" for tags of the access key.
+const (
+	CondKeySourceIP        = "SourceIp"
+	CondKeyCurrentTime     = "CurrentTime"
+	CondKeySecureTransport = "SecureTransport"
+)
+
+// timeOfDayLayout is accepted by the date conditions in place of an RFC 3339
+// timestamp to compare the time of day in UTC, e.g. "09:00"
+const timeOfDayLayout = "15:04"
+
+// Conditions maps an operator to its condition keys and values, e.g.
+//
+//	{"IpAddress": {"SourceIp": ["10.0.0.0/8"]}, "DateLessThan": {"CurrentTime": "18:00"}}
+//
+// All operators and keys must match; a key matches if any of its values does.
+type Conditions map[string]map[string]ConditionValues
+
+// ConditionValues is a list of condition values. In JSON a single value does
+// not need to be wrapped in an array.
+type ConditionValues []string
+
+// UnmarshalJSON accepts a string, boolean, number or an array of them
+func (v *ConditionValues) UnmarshalJSON(data []byte) error {
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	items, ok := raw.([]interface{})
+	if !ok {
+		items = []interface{}{raw}
+	}
+
+	values := make(ConditionValues, 0, len(items))
+	for _, item := range items {
+		switch x := item.(type) {
+		case string:
+			values = append(values, x)
+		case bool:
+			values = append(values, strconv.FormatBool(x))
+		case float64:
+			values = append(values, strconv.FormatFloat(x, 'f', -1, 64))
+		default:
+			return fmt.Errorf("invalid condition value %v", item)
+		}
+	}
+	*v = values
+	return nil
+}
+
+// RequestContext holds the request attributes conditions are evaluated against
+type RequestContext struct {
+	Method string
+	// Action is matched against the actions of statements instead of Method
+	// if set, e.g. admin:CreateAccessKey for the admin API
+	Action          string
+	Path            string
+	SourceIP        net.IP
+	SecureTransport bool
+	Headers         http.Header
+	// AccessKeyID and UserID identify the caller, they are filled in during
+	// authorization and substituted for ${key.id} and ${key.user_id} in resources
+	AccessKeyID string
+	UserID      int64
+	// Tags are the tags of the access key, or of the source key of temporary credentials
+	Tags map[string]string
+	// Time is the evaluation time, now if zero
+	Time time.Time
+}
+
+// NewRequestContext collects the condition attributes of an HTTP request.
+// The source IP is taken from RemoteAddr; use a middleware SourceIPResolver
+// if the service runs behind a proxy.
+func NewRequestContext(r *http.Request) *RequestContext {
+	return &RequestContext{
+		Method:          r.Method,
+		Path:            r.URL.Path,
+		SourceIP:        remoteIP(r.RemoteAddr),
+		SecureTransport: r.TLS != nil,
+		Headers:         r.Header,
+		Time:            time.Now(),
+	}
+}
+
+func remoteIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return net.ParseIP(host)
+}
+
+// Validate checks that all operators, keys and values of the conditions are supported
+func (c Conditions) Validate() error {
+	for op, keys := range c {
+		for key, values := range keys {
+			if len(values) == 0 {
+				return fmt.Errorf("condition %s/%s has no values", op, key)
+			}
+			switch op {
+			case CondIpAddress, CondNotIpAddress:
+				if !strings.EqualFold(key, CondKeySourceIP) {
+					return fmt.Errorf("condition %s does not support key %s", op, key)
+				}
+				for _, v := range values {
+					if _, err := parseCIDR(v); err != nil {
+						return err
+					}
+				}
+			case CondDateGreaterThan, CondDateLessThan:
+				if !strings.EqualFold(key, CondKeyCurrentTime) {
+					return fmt.Errorf("condition %s does not support key %s", op, key)
+				}
+				for _, v := range values {
+					if _, _, err := parseConditionTime(v); err != nil {
+						return err
+					}
+				}
+			case CondBool:
+				if !strings.EqualFold(key, CondKeySecureTransport) {
+					return fmt.Errorf("condition %s does not support key %s", op, key)
+				}
+				for _, v := range values {
+					if _, err := strconv.ParseBool(v); err != nil {
+						return fmt.Errorf("condition %s/%s: invalid boolean %q", op, key, v)
+					}
+				}
+			case CondStringEquals, CondStringNotEquals:
+				name, ok := strings.CutPrefix(key, "header:")
+				if !ok {
+					name, ok = strings.CutPrefix(key, "tag:")
+				}
+				if !ok || name == "" {
+					return fmt.Errorf("condition %s does not support key %q, use header:<Name> or tag:<name>", op, key)
+				}
+			default:
+				return fmt.Errorf("unsupported condition operator %s", op)
+			}
+		}
+	}
+	return nil
+}
+
+// Evaluate reports whether all conditions hold for the request
+func (c Conditions) Evaluate(rc *RequestContext) bool {
+	for op, keys := range c {
+		for key, values := range keys {
+			if !evaluateCondition(op, key, values, rc) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func evaluateCondition(op, key string, values ConditionValues, rc *RequestContext) bool {
+	switch op {
+	case CondIpAddress:
+		return rc.SourceIP != nil && ipInAny(rc.SourceIP, values)
+	case CondNotIpAddress:
+		return rc.SourceIP != nil && !ipInAny(rc.SourceIP, values)
+	case CondDateGreaterThan, CondDateLessThan:
+		now := rc.Time
+		if now.IsZero() {
+			now = time.Now()
+		}
+		for _, v := range values {
+			if compareConditionTime(op, now, v) {
+				return true
+			}
+		}
+		return false
+	case CondBool:
+		for _, v := range values {
+			if b, err := strconv.ParseBool(v); err == nil && b == rc.SecureTransport {
+				return true
+			}
+		}
+		return false
+	case CondStringEquals:
+		actual, ok := conditionString(key, rc)
+		return ok && containsString(values, actual)
+	case CondStringNotEquals:
+		actual, ok := conditionString(key, rc)
+		return ok && !containsString(values, actual)
+	}
+	// Unknown operators never match
+	return false
+}
+
+// conditionString looks up a header:<Name> or tag:<name> condition key
+func conditionString(key string, rc *RequestContext) (string, bool) {
+	if name, ok := strings.CutPrefix(key, "header:"); ok {
+		if rc.Headers == nil {
+			return "", false
+		}
+		values := rc.Headers.Values(name)
+		if len(values) == 0 {
+			return "", false
+		}
+		return values[0], true
+	}
+	if name, ok := strings.CutPrefix(key, "tag:"); ok {
+		v, ok := rc.Tags[name]
+		return v, ok
+	}
+	return "", false
+}
+
+func ipInAny(ip net.IP, values ConditionValues) bool {
+	for _, v := range values {
+		if n, err := parseCIDR(v); err == nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDR parses a CIDR block or a single IP address
+func parseCIDR(v string) (*net.IPNet, error) {
+	if !strings.Contains(v, "/") {
+		ip := net.ParseIP(v)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %q", v)
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR %q", v)
+	}
+	return n, nil
+}
+
+// parseConditionTime parses an RFC 3339 timestamp or a time of day. For a
+// time of day the returned duration is the offset from midnight UTC.
+func parseConditionTime(v string) (time.Time, time.Duration, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, -1, nil
+	}
+	if t, err := time.Parse(timeOfDayLayout, v); err == nil {
+		return time.Time{}, time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+	}
+	return time.Time{}, 0, fmt.Errorf("invalid time %q, expected RFC 3339 or HH:MM", v)
+}
+
+func compareConditionTime(op string, now time.Time, v string) bool {
+	t, timeOfDay, err := parseConditionTime(v)
+	if err != nil {
+		return false
+	}
+
+	if timeOfDay >= 0 {
+		utc := now.UTC()
+		current := time.Duration(utc.Hour())*time.Hour + time.Duration(utc.Minute())*time.Minute + time.Duration(utc.Second())*time.Second
+		if op == CondDateGreaterThan {
+			return current > timeOfDay
+		}
+		return current < timeOfDay
+	}
+
+	if op == CondDateGreaterThan {
+		return now.After(t)
+	}
+	return now.Before(t)
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
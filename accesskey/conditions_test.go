@@ -0,0 +1,134 @@
+package accesskey
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestConditionValuesUnmarshal(t *testing.T) {
+	var c Conditions
+	if err := json.Unmarshal([]byte(`{"Bool":{"SecureTransport":true},"StringEquals":{"tag:env":["prod",1]}}`), &c); err != nil {
+		t.Fatal(err)
+	}
+	if got := c[CondBool][CondKeySecureTransport]; len(got) != 1 || got[0] != "true" {
+		t.Errorf("Bool values = %q", got)
+	}
+	if got := c[CondStringEquals]["tag:env"]; len(got) != 2 || got[1] != "1" {
+		t.Errorf("StringEquals values = %q", got)
+	}
+	if err := json.Unmarshal([]byte(`{"Bool":{"SecureTransport":{"a":1}}}`), &c); err == nil {
+		t.Error("object condition value accepted")
+	}
+}
+
+func TestEvaluateConditions(t *testing.T) {
+	noon := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	rc := &RequestContext{
+		SourceIP:        net.ParseIP("10.1.2.3"),
+		SecureTransport: true,
+		Headers:         http.Header{"X-Env": {"prod"}},
+		Tags:            map[string]string{"team": "red"},
+		Time:            noon,
+	}
+	noIP := *rc
+	noIP.SourceIP = nil
+
+	tests := []struct {
+		name string
+		rc   *RequestContext
+		cond Conditions
+		want bool
+	}{
+		{"ip in range", rc, Conditions{CondIpAddress: {CondKeySourceIP: {"10.0.0.0/8"}}}, true},
+		{"single ip", rc, Conditions{CondIpAddress: {CondKeySourceIP: {"192.168.0.1", "10.1.2.3"}}}, true},
+		{"ip outside range", rc, Conditions{CondIpAddress: {CondKeySourceIP: {"192.168.0.0/16"}}}, false},
+		{"not ip outside range", rc, Conditions{CondNotIpAddress: {CondKeySourceIP: {"192.168.0.0/16"}}}, true},
+		{"not ip in range", rc, Conditions{CondNotIpAddress: {CondKeySourceIP: {"10.0.0.0/8"}}}, false},
+		// An unknown source IP satisfies neither
+		{"ip without source ip", &noIP, Conditions{CondIpAddress: {CondKeySourceIP: {"0.0.0.0/0"}}}, false},
+		{"not ip without source ip", &noIP, Conditions{CondNotIpAddress: {CondKeySourceIP: {"10.0.0.0/8"}}}, false},
+
+		{"after timestamp", rc, Conditions{CondDateGreaterThan: {CondKeyCurrentTime: {"2024-05-01T11:59:00Z"}}}, true},
+		{"before timestamp", rc, Conditions{CondDateLessThan: {CondKeyCurrentTime: {"2024-05-01T11:59:00Z"}}}, false},
+		{"within office hours", rc, Conditions{
+			CondDateGreaterThan: {CondKeyCurrentTime: {"09:00"}},
+			CondDateLessThan:    {CondKeyCurrentTime: {"18:00"}},
+		}, true},
+		{"after office hours", rc, Conditions{CondDateGreaterThan: {CondKeyCurrentTime: {"18:00"}}}, false},
+		{"invalid time", rc, Conditions{CondDateLessThan: {CondKeyCurrentTime: {"noon"}}}, false},
+
+		{"secure transport", rc, Conditions{CondBool: {CondKeySecureTransport: {"true"}}}, true},
+		{"insecure transport", rc, Conditions{CondBool: {CondKeySecureTransport: {"false"}}}, false},
+
+		{"header equals", rc, Conditions{CondStringEquals: {"header:X-Env": {"prod"}}}, true},
+		{"header differs", rc, Conditions{CondStringEquals: {"header:X-Env": {"dev"}}}, false},
+		{"missing header", rc, Conditions{CondStringNotEquals: {"header:X-Other": {"dev"}}}, false},
+		{"tag equals", rc, Conditions{CondStringEquals: {"tag:team": {"blue", "red"}}}, true},
+		{"tag not equals", rc, Conditions{CondStringNotEquals: {"tag:team": {"red"}}}, false},
+
+		{"unknown operator", rc, Conditions{"StringLike": {"tag:team": {"r*"}}}, false},
+		{"all must hold", rc, Conditions{
+			CondIpAddress: {CondKeySourceIP: {"10.0.0.0/8"}},
+			CondBool:      {CondKeySecureTransport: {"false"}},
+		}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.cond.Evaluate(tt.rc); got != tt.want {
+			t.Errorf("%s: Evaluate = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidateConditions(t *testing.T) {
+	valid := []Conditions{
+		{CondIpAddress: {CondKeySourceIP: {"10.0.0.0/8", "::1"}}},
+		{CondDateLessThan: {CondKeyCurrentTime: {"18:00", "2030-01-01T00:00:00Z"}}},
+		{CondBool: {CondKeySecureTransport: {"true"}}},
+		{CondStringEquals: {"header:X-Env": {"prod"}, "tag:team": {"red"}}},
+	}
+	for _, c := range valid {
+		if err := c.Validate(); err != nil {
+			t.Errorf("Validate(%v): %v", c, err)
+		}
+	}
+
+	invalid := []Conditions{
+		{"StringLike": {"tag:team": {"r*"}}},
+		{CondIpAddress: {CondKeySourceIP: {}}},
+		{CondIpAddress: {CondKeySourceIP: {"10.0.0.0/33"}}},
+		{CondIpAddress: {CondKeyCurrentTime: {"10.0.0.1"}}},
+		{CondDateGreaterThan: {CondKeyCurrentTime: {"noon"}}},
+		{CondBool: {CondKeySecureTransport: {"maybe"}}},
+		{CondStringEquals: {"X-Env": {"prod"}}},
+		{CondStringEquals: {"header:": {"prod"}}},
+		{CondStringNotEquals: {"tag:": {"red"}}},
+	}
+	for _, c := range invalid {
+		if err := c.Validate(); err == nil {
+			t.Errorf("Validate(%v) succeeded, want an error", c)
+		}
+	}
+}
+
+// Statements with conditions that do not hold are skipped
+func TestAuthorizeWithConditions(t *testing.T) {
+	s, user := newTestService(t)
+	id, _ := newTestKey(t, s, user, `[
+		{"resources":["**"],"actions":["GET"],"effect":"allow","conditions":{"IpAddress":{"SourceIp":"10.0.0.0/8"}}}
+	]`)
+
+	for addr, want := range map[string]bool{"10.1.2.3:1234": true, "192.168.0.1:1234": false} {
+		r, _ := http.NewRequest(http.MethodGet, "http://example.com/api", nil)
+		r.RemoteAddr = addr
+		ok, err := s.AuthorizeRequest(r, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != want {
+			t.Errorf("request from %s: AuthorizeRequest = %v, want %v", addr, ok, want)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package accesskey
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Environment variables read by EnvProvider
+const (
+	EnvAccessKeyID  = "ACCESSKEY_ID"
+	EnvAccessSecret = "ACCESSKEY_SECRET"
+	EnvSessionToken = "ACCESSKEY_SESSION_TOKEN"
+)
+
+// CredentialsProvider supplies the credentials used by Transport to sign requests
+type CredentialsProvider interface {
+	Retrieve() (*Credentials, error)
+}
+
+// StaticProvider always returns the same credentials
+type StaticProvider struct {
+	Credentials Credentials
+}
+
+// NewStaticProvider creates a provider for a long-lived access key
+func NewStaticProvider(accessKeyID, secret string) *StaticProvider {
+	return &StaticProvider{Credentials: Credentials{AccessKeyID: accessKeyID, SecretKey: secret}}
+}
+
+// Retrieve implements CredentialsProvider
+func (p *StaticProvider) Retrieve() (*Credentials, error) {
+	c := p.Credentials
+	return &c, nil
+}
+
+// EnvProvider reads the credentials from ACCESSKEY_ID, ACCESSKEY_SECRET and
+// the optional ACCESSKEY_SESSION_TOKEN
+type EnvProvider struct{}
+
+// Retrieve implements CredentialsProvider
+func (EnvProvider) Retrieve() (*Credentials, error) {
+	c := &Credentials{
+		AccessKeyID:  os.Getenv(EnvAccessKeyID),
+		SecretKey:    os.Getenv(EnvAccessSecret),
+		SessionToken: os.Getenv(EnvSessionToken),
+	}
+	if c.AccessKeyID == "" || c.SecretKey == "" {
+		return nil, fmt.Errorf("%s and %s must be set", EnvAccessKeyID, EnvAccessSecret)
+	}
+	return c, nil
+}
+
+// FileProvider reads the credentials from a JSON file in the format returned
+// by AssumeRole: {"access_key_id": "...", "secret_key": "...", "session_token": "..."}.
+// The file is read again on every Retrieve so it can be updated in place.
+type FileProvider struct {
+	Path string
+}
+
+// Retrieve implements CredentialsProvider
+func (p *FileProvider) Retrieve() (*Credentials, error) {
+	data, err := os.ReadFile(p.Path)
+	if err != nil {
+		return nil, err
+	}
+	var c Credentials
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("parse credentials file %s: %w", p.Path, err)
+	}
+	if c.AccessKeyID == "" || c.SecretKey == "" {
+		return nil, fmt.Errorf("credentials file %s has no access_key_id or secret_key", p.Path)
+	}
+	if !c.Expiration.IsZero() && !time.Now().Before(c.Expiration) {
+		return nil, fmt.Errorf("credentials in %s expired at %s", p.Path, c.Expiration)
+	}
+	return &c, nil
+}
+
+// STSProvider obtains temporary credentials from an AssumeRoleHandler endpoint
+// and refreshes them shortly before they expire
+type STSProvider struct {
+	// Client signs the AssumeRole call with the long-lived caller key, e.g. NewClient(keyID, secret)
+	Client *http.Client
+	// Endpoint is the URL of the AssumeRoleHandler
+	Endpoint string
+	RoleID   int
+	// Policy optionally scopes down the role's permissions
+	Policy   []*Permissions
+	Duration time.Duration
+	// RefreshBefore is how long before expiration the credentials are refreshed, one minute by default
+	RefreshBefore time.Duration
+
+	mu    sync.Mutex
+	creds *Credentials
+}
+
+// Retrieve implements CredentialsProvider
+func (p *STSProvider) Retrieve() (*Credentials, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	refreshBefore := p.RefreshBefore
+	if refreshBefore <= 0 {
+		refreshBefore = time.Minute
+	}
+	if p.creds != nil && time.Now().Add(refreshBefore).Before(p.creds.Expiration) {
+		c := *p.creds
+		return &c, nil
+	}
+
+	creds, err := p.assumeRole()
+	if err != nil {
+		return nil, err
+	}
+	p.creds = creds
+	c := *creds
+	return &c, nil
+}
+
+func (p *STSProvider) assumeRole() (*Credentials, error) {
+	if p.Client == nil {
+		return nil, errors.New("STSProvider requires a signing client")
+	}
+
+	input := map[string]interface{}{
+		"role_id":          p.RoleID,
+		"duration_seconds": int64(p.Duration / time.Second),
+	}
+	if p.Policy != nil {
+		input["policy"] = p.Policy
+	}
+	body, err := json.Marshal(input)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := p.Client.Post(p.Endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("assume role: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	var creds Credentials
+	if err := json.NewDecoder(resp.Body).Decode(&creds); err != nil {
+		return nil, fmt.Errorf("assume role: decode response: %w", err)
+	}
+	return &creds, nil
+}
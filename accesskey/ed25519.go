@@ -0,0 +1,193 @@
+package accesskey
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Access key types
+const (
+	// KeyTypeHMAC keys share a secret between client and server and sign
+	// with HMAC-SHA256
+	KeyTypeHMAC = "hmac"
+	// KeyTypeEd25519 keys sign with an Ed25519 private key held by the client,
+	// the server only stores the public key
+	KeyTypeEd25519 = "ed25519"
+)
+
+// Signature algorithms, selected by the X-Signature-Algorithm header
+const (
+	// SignatureAlgorithmHMACSHA256 is used by requests without X-Signature-Algorithm
+	SignatureAlgorithmHMACSHA256 = "HMAC-SHA256"
+	SignatureAlgorithmEd25519    = "ED25519"
+)
+
+// ed25519SecretPrefix marks Ed25519 private keys returned by
+// GenerateAccessKeyPair, so that SignRequest can tell them from HMAC secrets
+const ed25519SecretPrefix = "ed25519:"
+
+var (
+	// ErrUnsupportedKeyType is returned for unknown access key types
+	ErrUnsupportedKeyType = errors.New("unsupported key type")
+	// ErrInvalidPublicKey is returned when a public key is not a base64
+	// encoded Ed25519 public key
+	ErrInvalidPublicKey = errors.New("invalid public key")
+	// ErrPublicKeyRequired is returned when rotating an Ed25519 access key
+	// without a new public key, see RotateAccessKeyWithPublicKey
+	ErrPublicKeyRequired = errors.New("ed25519 access keys are rotated with a new public key")
+)
+
+// KeyPairOption configures GenerateAccessKeyPair
+type KeyPairOption func(*keyPairConfig)
+
+type keyPairConfig struct {
+	keyType string
+}
+
+// WithKeyType sets the type of the generated key pair, KeyTypeHMAC by default
+func WithKeyType(keyType string) KeyPairOption {
+	return func(c *keyPairConfig) {
+		c.keyType = keyType
+	}
+}
+
+// generateEd25519PrivateKey returns a new private key in the secret format
+// accepted by SignRequest
+func generateEd25519PrivateKey() (string, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	return ed25519SecretPrefix + base64.StdEncoding.EncodeToString(priv.Seed()), nil
+}
+
+// isEd25519Secret reports whether a secret passed to SignRequest is an
+// Ed25519 private key
+func isEd25519Secret(secret string) bool {
+	return strings.HasPrefix(secret, ed25519SecretPrefix)
+}
+
+func parseEd25519PrivateKey(secret string) (ed25519.PrivateKey, error) {
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(secret, ed25519SecretPrefix))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.New("invalid ed25519 private key")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// Ed25519PublicKey returns the base64 public key of an Ed25519 private key
+// generated by GenerateAccessKeyPair, to be registered with
+// CreateAccessKeyWithPublicKey
+func Ed25519PublicKey(privateKey string) (string, error) {
+	if !isEd25519Secret(privateKey) {
+		return "", errors.New("not an ed25519 private key")
+	}
+	priv, err := parseEd25519PrivateKey(privateKey)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(priv.Public().(ed25519.PublicKey)), nil
+}
+
+func parseEd25519PublicKey(publicKey string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, ErrInvalidPublicKey
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// signEd25519 returns the base64 Ed25519 signature of a string to sign
+func signEd25519(privateKey, stringToSign string) (string, error) {
+	priv, err := parseEd25519PrivateKey(privateKey)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(priv, []byte(stringToSign))), nil
+}
+
+// verifyEd25519 checks a base64 Ed25519 signature of a string to sign
+func verifyEd25519(publicKey, stringToSign, signature string) bool {
+	pub, err := parseEd25519PublicKey(publicKey)
+	if err != nil {
+		return false
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(pub, []byte(stringToSign), sig)
+}
+
+// keyType returns the type of an access key, KeyTypeHMAC if not set
+func (ak *AccessKey) keyType() string {
+	if ak.KeyType == "" {
+		return KeyTypeHMAC
+	}
+	return ak.KeyType
+}
+
+// signatureAlgorithm returns the algorithm requests signed with the key must use
+func (ak *AccessKey) signatureAlgorithm() string {
+	if ak.keyType() == KeyTypeEd25519 {
+		return SignatureAlgorithmEd25519
+	}
+	return SignatureAlgorithmHMACSHA256
+}
+
+// CreateAccessKeyWithPublicKey creates an Ed25519 access key for a user from
+// the public key of a key pair generated by the client, e.g. with
+// GenerateAccessKeyPair(WithKeyType(KeyTypeEd25519)). The private key never
+// reaches the server. It returns the ID of the new key.
+func (s *Service) CreateAccessKeyWithPublicKey(userID int64, permissions, publicKey string) (string, error) {
+	perms, err := ParsePermissions(permissions)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidPermissions, err)
+	}
+	if _, err := parseEd25519PublicKey(publicKey); err != nil {
+		return "", err
+	}
+	if err := s.checkUserActive(userID); err != nil {
+		return "", err
+	}
+
+	id, err := generateAccessKeyID()
+	if err != nil {
+		return "", err
+	}
+	err = s.store.CreateAccessKey(&AccessKey{
+		ID:          id,
+		KeyType:     KeyTypeEd25519,
+		PublicKey:   publicKey,
+		AccessKey:   id,
+		UserID:      userID,
+		Status:      "active",
+		Permissions: perms,
+	})
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// RotateAccessKeyWithPublicKey issues a successor for an Ed25519 access key
+// with a new public key, like RotateAccessKey does for HMAC keys. It returns
+// the ID of the successor.
+func (s *Service) RotateAccessKeyWithPublicKey(accessKeyID, publicKey string, grace time.Duration) (string, error) {
+	if _, err := parseEd25519PublicKey(publicKey); err != nil {
+		return "", err
+	}
+	old, err := s.store.GetAccessKey(accessKeyID)
+	if err != nil {
+		return "", err
+	}
+	if old.keyType() != KeyTypeEd25519 {
+		return "", fmt.Errorf("access key %s is not an ed25519 key", accessKeyID)
+	}
+	return s.rotate(old, &AccessKey{KeyType: KeyTypeEd25519, PublicKey: publicKey}, grace)
+}
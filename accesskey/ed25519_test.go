@@ -0,0 +1,144 @@
+package accesskey
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newEd25519Key registers the public key of a new key pair and returns the
+// key ID and the private key
+func newEd25519Key(t *testing.T, s *Service, user *User) (string, string) {
+	t.Helper()
+	_, priv, err := GenerateAccessKeyPair(WithKeyType(KeyTypeEd25519))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := Ed25519PublicKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := s.CreateAccessKeyWithPublicKey(user.ID, allowAll, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id, priv
+}
+
+func TestEd25519Signatures(t *testing.T) {
+	s, user := newTestService(t)
+	id, priv := newEd25519Key(t, s, user)
+	_, otherPriv, err := GenerateAccessKeyPair(WithKeyType(KeyTypeEd25519))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hmacID, hmacSecret := newTestKey(t, s, user, allowAll)
+
+	stored, err := s.store.GetAccessKey(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.SecretKey != "" || stored.KeyType != KeyTypeEd25519 {
+		t.Fatalf("stored key type %q, secret %q", stored.KeyType, stored.SecretKey)
+	}
+
+	tests := []struct {
+		name   string
+		id     string
+		secret string
+		modify func(*http.Request)
+		valid  bool
+	}{
+		{"ed25519 key", id, priv, nil, true},
+		{"version 1", id, priv, func(r *http.Request) {
+			SignRequestWithVersion(r, id, priv, nil, SignatureVersion1)
+		}, true},
+		{"wrong private key", id, otherPriv, nil, false},
+		{"modified path", id, priv, func(r *http.Request) { r.URL.Path = "/api/v1/other" }, false},
+		{"hmac signature for an ed25519 key", id, hmacSecret, nil, false},
+		{"algorithm header removed", id, priv, func(r *http.Request) { r.Header.Del("X-Signature-Algorithm") }, false},
+		{"ed25519 signature for an hmac key", hmacID, priv, nil, false},
+		{"unknown algorithm", id, priv, func(r *http.Request) { r.Header.Set("X-Signature-Algorithm", "RSA") }, false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/api/v1/users", nil)
+		SignRequest(req, tt.id, tt.secret, nil)
+		if tt.modify != nil {
+			tt.modify(req)
+		}
+		ok, err := s.VerifyRequestSignature(req, nil)
+		if ok != tt.valid || (tt.valid && err != nil) {
+			t.Errorf("%s: VerifyRequestSignature = %v, %v, want %v", tt.name, ok, err, tt.valid)
+		}
+	}
+}
+
+// Temporary credentials are HMAC credentials only
+func TestTemporaryCredentialsRejectEd25519(t *testing.T) {
+	s, user := newTestService(t)
+	id, _ := newTestKey(t, s, user, allowAll)
+	roleID, err := s.CreateRole("reader", "", allowAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AssignRoleToAccessKey(id, roleID); err != nil {
+		t.Fatal(err)
+	}
+	creds, err := s.AssumeRole(id, roleID, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, priv, err := GenerateAccessKeyPair(WithKeyType(KeyTypeEd25519))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		secret string
+		valid  bool
+	}{
+		{creds.SecretKey, true},
+		{priv, false},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/api/v1/users", nil)
+		req.Header.Set("X-Security-Token", creds.SessionToken)
+		SignRequest(req, creds.AccessKeyID, tt.secret, nil)
+		if ok, err := s.VerifyRequestSignature(req, nil); ok != tt.valid || (tt.valid && err != nil) {
+			t.Errorf("algorithm %q: VerifyRequestSignature = %v, %v, want %v", req.Header.Get("X-Signature-Algorithm"), ok, err, tt.valid)
+		}
+	}
+}
+
+func TestEd25519PublicKeys(t *testing.T) {
+	s, user := newTestService(t)
+	for _, pub := range []string{"", "not base64", "AAAA"} {
+		if _, err := s.CreateAccessKeyWithPublicKey(user.ID, allowAll, pub); !errors.Is(err, ErrInvalidPublicKey) {
+			t.Errorf("public key %q: %v, want ErrInvalidPublicKey", pub, err)
+		}
+	}
+	if _, err := Ed25519PublicKey("plain secret"); err == nil {
+		t.Error("Ed25519PublicKey accepted an HMAC secret")
+	}
+
+	id, _ := newEd25519Key(t, s, user)
+	if _, _, err := s.RotateAccessKey(id, time.Hour); !errors.Is(err, ErrPublicKeyRequired) {
+		t.Errorf("RotateAccessKey of an ed25519 key: %v, want ErrPublicKeyRequired", err)
+	}
+
+	_, priv, err := GenerateAccessKeyPair(WithKeyType(KeyTypeEd25519))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, _ := Ed25519PublicKey(priv)
+	newID, err := s.RotateAccessKeyWithPublicKey(id, pub, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/api/v1/users", nil)
+	SignRequest(req, newID, priv, nil)
+	if ok, err := s.VerifyRequestSignature(req, nil); !ok || err != nil {
+		t.Errorf("successor signed with the new private key: %v, %v", ok, err)
+	}
+}
@@ -0,0 +1,92 @@
+package accesskey
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// KeyExpiredEvent is emitted by the expirer for every access key it marks as expired
+type KeyExpiredEvent struct {
+	AccessKeyID string    `json:"access_key_id"`
+	UserID      int64     `json:"user_id"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	ExpiredAt   time.Time `json:"expired_at"`
+}
+
+// ExpireAccessKeys marks all active access keys past their expiry time as
+// expired and returns an event for each of them
+func (s *Service) ExpireAccessKeys() ([]KeyExpiredEvent, error) {
+	now := time.Now()
+	keys, err := s.store.ListAccessKeysExpiringBefore(now)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []KeyExpiredEvent
+	for _, ak := range keys {
+		if err := s.store.UpdateAccessKeyStatus(ak.AccessKey, "expired"); err != nil {
+			return events, err
+		}
+		events = append(events, KeyExpiredEvent{
+			AccessKeyID: ak.AccessKey,
+			UserID:      ak.UserID,
+			ExpiresAt:   ak.ExpiresAt,
+			ExpiredAt:   now,
+		})
+	}
+	return events, nil
+}
+
+// ListExpiringAccessKeys returns the active access keys that expire within the
+// given number of days, soonest first. Keys that are already overdue but not
+// yet marked as expired are included.
+func (s *Service) ListExpiringAccessKeys(days int) ([]AccessKey, error) {
+	return s.store.ListAccessKeysExpiringBefore(time.Now().AddDate(0, 0, days))
+}
+
+// StartExpirer runs ExpireAccessKeys, DeactivateRotatedKeys and
+// PurgeTemporaryCredentials every interval in the background. onExpired, if
+// not nil, is called for every expired key. The returned function stops the
+// expirer and waits for it to finish.
+func (s *Service) StartExpirer(interval time.Duration, onExpired func(KeyExpiredEvent)) (stop func()) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			events, err := s.ExpireAccessKeys()
+			if err != nil {
+				log.Printf("expire access keys: %v", err)
+			}
+			if onExpired != nil {
+				for _, ev := range events {
+					onExpired(ev)
+				}
+			}
+			if _, err := s.DeactivateRotatedKeys(); err != nil {
+				log.Printf("deactivate rotated access keys: %v", err)
+			}
+			if _, err := s.PurgeTemporaryCredentials(); err != nil {
+				log.Printf("purge temporary credentials: %v", err)
+			}
+
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		wg.Wait()
+	}
+}
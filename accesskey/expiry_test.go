@@ -0,0 +1,83 @@
+package accesskey
+
+import (
+	"testing"
+	"time"
+)
+
+// newExpiredKey stores an active key that expired an hour ago
+func newExpiredKey(t *testing.T, s *Service, user *User, id string) {
+	t.Helper()
+	err := s.store.CreateAccessKey(&AccessKey{
+		AccessKey: id,
+		SecretKey: "secret",
+		UserID:    user.ID,
+		ExpiresAt: time.Now().Add(-time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExpireAccessKeys(t *testing.T) {
+	s, user := newTestService(t)
+	newExpiredKey(t, s, user, "AKexpired")
+	expiring, _, err := s.CreateAccessKeyWithTTL(user.ID, allowAll, 48*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTestKey(t, s, user, allowAll)
+
+	keys, err := s.ListExpiringAccessKeys(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].AccessKey != "AKexpired" || keys[1].AccessKey != expiring {
+		t.Errorf("ListExpiringAccessKeys(7) = %v, want the overdue key and %s", keys, expiring)
+	}
+	if keys, _ := s.ListExpiringAccessKeys(1); len(keys) != 1 || keys[0].AccessKey != "AKexpired" {
+		t.Errorf("ListExpiringAccessKeys(1) = %v, want the overdue key", keys)
+	}
+
+	events, err := s.ExpireAccessKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].AccessKeyID != "AKexpired" || events[0].UserID != user.ID || events[0].ExpiredAt.IsZero() {
+		t.Fatalf("ExpireAccessKeys = %+v", events)
+	}
+	if ak, _ := s.store.GetAccessKey("AKexpired"); ak.Status != "expired" {
+		t.Errorf("status = %q, want expired", ak.Status)
+	}
+	if ak, _ := s.store.GetAccessKey(expiring); ak.Status != "active" {
+		t.Errorf("status of the key expiring later = %q, want active", ak.Status)
+	}
+
+	// Expired keys are reported once
+	if events, err := s.ExpireAccessKeys(); err != nil || len(events) != 0 {
+		t.Errorf("second ExpireAccessKeys = %+v, %v", events, err)
+	}
+	if valid, err := s.ValidateAccessKey("AKexpired"); valid || err != nil {
+		t.Errorf("ValidateAccessKey of an expired key = %v, %v", valid, err)
+	}
+}
+
+func TestStartExpirer(t *testing.T) {
+	s, user := newTestService(t)
+	newExpiredKey(t, s, user, "AKexpired")
+
+	expired := make(chan KeyExpiredEvent, 1)
+	stop := s.StartExpirer(time.Hour, func(ev KeyExpiredEvent) { expired <- ev })
+
+	// The first run starts right away
+	select {
+	case ev := <-expired:
+		if ev.AccessKeyID != "AKexpired" {
+			t.Errorf("expired %s, want AKexpired", ev.AccessKeyID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the expirer did not run")
+	}
+	stop()
+	stop()
+}
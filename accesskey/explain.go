@@ -0,0 +1,251 @@
+package accesskey
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Decisions returned by the policy simulator
+const (
+	DecisionAllow        = "allow"
+	DecisionExplicitDeny = "explicit_deny"
+	DecisionImplicitDeny = "implicit_deny"
+)
+
+// Sources of the statements evaluated by the policy simulator
+const (
+	SourceAccessKey     = "access_key"
+	SourceUser          = "user"
+	SourceRole          = "role"
+	SourceUserRole      = "user_role"
+	SourceGroupRole     = "group_role"
+	SourceSessionPolicy = "session_policy"
+	SourceInline        = "inline"
+)
+
+// StatementResult describes how one statement was evaluated for a request
+type StatementResult struct {
+	Source    string `json:"source"`
+	RoleID    int    `json:"role_id,omitempty"`
+	RoleName  string `json:"role_name,omitempty"`
+	GroupID   int    `json:"group_id,omitempty"`
+	GroupName string `json:"group_name,omitempty"`
+	// PolicyID is set for statements of managed policies
+	PolicyID      int          `json:"policy_id,omitempty"`
+	PolicyName    string       `json:"policy_name,omitempty"`
+	PolicyVersion int          `json:"policy_version,omitempty"`
+	Statement     *Permissions `json:"statement"`
+	Matched       bool         `json:"matched"`
+	// Reason tells why a statement did not match: effect, action, resource or conditions
+	Reason string `json:"reason,omitempty"`
+}
+
+// Explanation is the result of simulating an authorization decision
+type Explanation struct {
+	Allowed  bool   `json:"allowed"`
+	Decision string `json:"decision"`
+	// Reason summarizes the decision
+	Reason     string            `json:"reason"`
+	Statements []StatementResult `json:"statements"`
+	// DeniedBy is the first matching deny statement, if any
+	DeniedBy *StatementResult `json:"denied_by,omitempty"`
+}
+
+// MatchedStatements returns the statements that applied to the request
+func (e *Explanation) MatchedStatements() []StatementResult {
+	var matched []StatementResult
+	for _, st := range e.Statements {
+		if st.Matched {
+			matched = append(matched, st)
+		}
+	}
+	return matched
+}
+
+// ExplainPermissions simulates the authorization of a request against a raw
+// set of permissions
+func ExplainPermissions(perms []*Permissions, rc *RequestContext) *Explanation {
+	statements := make([]StatementResult, 0, len(perms))
+	for _, perm := range perms {
+		statements = append(statements, StatementResult{Source: SourceInline, Statement: perm})
+	}
+	return explain(statements, false, rc)
+}
+
+// Explain simulates the authorization of a request by an access key and
+// reports which statements matched and where they came from. The decision is
+// the same as AuthorizeContext makes without a PermissionResolver.
+func (s *Service) Explain(accessKeyID string, rc *RequestContext) (*Explanation, error) {
+	if rc.AccessKeyID == "" {
+		if err := s.fillKeyContext(accessKeyID, rc); err != nil {
+			return nil, err
+		}
+	}
+
+	sources, err := s.PermissionSources(accessKeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	var statements []StatementResult
+	hasSessionPolicy := false
+	for _, src := range sources {
+		if src.Source == SourceSessionPolicy {
+			hasSessionPolicy = true
+		}
+		for _, perm := range src.Permissions {
+			statements = append(statements, StatementResult{
+				Source:    src.Source,
+				RoleID:    src.RoleID,
+				RoleName:  src.RoleName,
+				GroupID:   src.GroupID,
+				GroupName: src.GroupName,
+
+				PolicyID:      src.PolicyID,
+				PolicyName:    src.PolicyName,
+				PolicyVersion: src.PolicyVersion,
+				Statement:     perm,
+			})
+		}
+	}
+
+	return explain(statements, hasSessionPolicy, rc), nil
+}
+
+// explain evaluates the statements like hasPermission does. Session policy
+// statements must allow the request in addition to the other statements.
+func explain(statements []StatementResult, hasSessionPolicy bool, rc *RequestContext) *Explanation {
+	e := &Explanation{Statements: statements}
+
+	allowed, policyAllowed := false, false
+	for i := range e.Statements {
+		st := &e.Statements[i]
+		check := checkStatement(st.Statement, rc)
+		switch {
+		case check.effect == "":
+			st.Reason = "effect"
+		case !check.actionMatched:
+			st.Reason = "action"
+		case !check.resourceMatched:
+			st.Reason = "resource"
+		case !check.conditionsMatched:
+			st.Reason = "conditions"
+		default:
+			st.Matched = true
+		}
+		if !st.Matched {
+			continue
+		}
+
+		if check.effect == "deny" {
+			if e.DeniedBy == nil {
+				e.DeniedBy = st
+			}
+		} else if st.Source == SourceSessionPolicy {
+			policyAllowed = true
+		} else {
+			allowed = true
+		}
+	}
+
+	switch {
+	case e.DeniedBy != nil:
+		e.Decision = DecisionExplicitDeny
+		e.Reason = "explicitly denied by a " + e.DeniedBy.Source + " statement"
+	case !allowed:
+		e.Decision = DecisionImplicitDeny
+		e.Reason = "no statement allows the request"
+	case hasSessionPolicy && !policyAllowed:
+		e.Decision = DecisionImplicitDeny
+		e.Reason = "the session policy does not allow the request"
+	default:
+		e.Allowed = true
+		e.Decision = DecisionAllow
+		e.Reason = "allowed"
+	}
+	return e
+}
+
+// ExplainHandler returns an HTTP handler running the policy simulator, for
+// support engineers debugging 403 responses. It expects a JSON body like
+//
+//	{"access_key_id": "...", "method": "GET", "path": "/api/v1/users/1",
+//	 "source_ip": "10.0.0.1", "secure_transport": true, "headers": {"X-Env": "prod"}}
+//
+// "permissions" may be given to simulate a raw set of permissions instead of
+// those of the access key. The handler reveals the permissions of any key,
+// mount it behind the middleware and allow it only for administrators.
+func (s *Service) ExplainHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			AccessKeyID     string            `json:"access_key_id"`
+			Permissions     json.RawMessage   `json:"permissions"`
+			Method          string            `json:"method"`
+			Path            string            `json:"path"`
+			SourceIP        string            `json:"source_ip"`
+			SecureTransport bool              `json:"secure_transport"`
+			Headers         map[string]string `json:"headers"`
+			Tags            map[string]string `json:"tags"`
+			Time            time.Time         `json:"time"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+		if input.Method == "" || input.Path == "" {
+			http.Error(w, "method and path are required", http.StatusBadRequest)
+			return
+		}
+
+		rc := &RequestContext{
+			Method:          input.Method,
+			Path:            input.Path,
+			SourceIP:        net.ParseIP(input.SourceIP),
+			SecureTransport: input.SecureTransport,
+			Headers:         make(http.Header),
+			Tags:            input.Tags,
+			Time:            input.Time,
+		}
+		for name, value := range input.Headers {
+			rc.Headers.Set(name, value)
+		}
+
+		var e *Explanation
+		var err error
+		switch {
+		case len(input.Permissions) > 0:
+			var perms []*Permissions
+			perms, err = ParsePermissions(string(input.Permissions))
+			if err != nil {
+				http.Error(w, "invalid permissions: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if input.AccessKeyID != "" {
+				// Resolve ${key.*} variables and tags of the given key
+				err = s.fillKeyContext(input.AccessKeyID, rc)
+			}
+			if err == nil {
+				e = ExplainPermissions(perms, rc)
+			}
+		case input.AccessKeyID != "":
+			e, err = s.Explain(input.AccessKeyID, rc)
+		default:
+			http.Error(w, "access_key_id or permissions is required", http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, ErrAccessKeyNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(e)
+	})
+}
@@ -0,0 +1,197 @@
+package accesskey
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestExplainPermissions(t *testing.T) {
+	perms, err := ParsePermissions(`[
+		{"resources":["/api/**"],"actions":["GET"],"effect":"allow"},
+		{"resources":["/api/admin/**"],"actions":["*"],"effect":"deny"},
+		{"resources":["/api/**"],"actions":["POST"],"effect":"allow","conditions":{"Bool":{"SecureTransport":"true"}}}
+	]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method, path string
+		decision     string
+		reasons      []string
+	}{
+		{"GET", "/api/users", DecisionAllow, []string{"", "resource", "action"}},
+		{"GET", "/api/admin/users", DecisionExplicitDeny, []string{"", "", "action"}},
+		{"POST", "/api/users", DecisionImplicitDeny, []string{"action", "resource", "conditions"}},
+		{"GET", "/other", DecisionImplicitDeny, []string{"resource", "resource", "action"}},
+	}
+	for _, tt := range tests {
+		e := ExplainPermissions(perms, &RequestContext{Method: tt.method, Path: tt.path})
+		if e.Decision != tt.decision || e.Allowed != (tt.decision == DecisionAllow) {
+			t.Errorf("%s %s: decision %s, allowed %v, want %s", tt.method, tt.path, e.Decision, e.Allowed, tt.decision)
+		}
+		for i, st := range e.Statements {
+			if st.Reason != tt.reasons[i] || st.Matched != (tt.reasons[i] == "") || st.Source != SourceInline {
+				t.Errorf("%s %s: statement %d matched %v, reason %q, want reason %q", tt.method, tt.path, i, st.Matched, st.Reason, tt.reasons[i])
+			}
+		}
+		if tt.decision == DecisionExplicitDeny && (e.DeniedBy == nil || e.DeniedBy.Statement != perms[1]) {
+			t.Errorf("%s %s: DeniedBy = %+v, want the deny statement", tt.method, tt.path, e.DeniedBy)
+		}
+	}
+
+	invalidEffect := []*Permissions{{Resources: []string{"**"}, Actions: []string{"*"}, Effect: "maybe"}}
+	if e := ExplainPermissions(invalidEffect, &RequestContext{Method: "GET", Path: "/"}); e.Allowed || e.Statements[0].Reason != "effect" {
+		t.Errorf("statement with an invalid effect: %+v", e.Statements[0])
+	}
+}
+
+// Explain makes the same decision as Authorize and names the source of each statement
+func TestExplainSources(t *testing.T) {
+	s, user := newTestService(t)
+	id, _ := newTestKey(t, s, user, `[{"resources":["/api/public/**"],"actions":["GET"],"effect":"allow"}]`)
+
+	roleID, err := s.CreateRole("writer", "", `[{"resources":["/api/**"],"actions":["POST"],"effect":"allow"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AssignRoleToAccessKey(id, roleID); err != nil {
+		t.Fatal(err)
+	}
+	groupRoleID, err := s.CreateRole("reader", "", `[{"resources":["/api/**"],"actions":["GET"],"effect":"allow"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	group, err := s.CreateGroup("devs", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddUserToGroup(group.ID, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AttachRoleToGroup(group.ID, groupRoleID); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := s.CreatePolicy("no-secrets", "", `[{"resources":["/api/secrets/**"],"actions":["*"],"effect":"deny"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AttachPolicyToAccessKey(policy.ID, id); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, req := range []struct{ method, path string }{
+		{"GET", "/api/public/a"},
+		{"GET", "/api/items"},
+		{"POST", "/api/items"},
+		{"DELETE", "/api/items"},
+		{"GET", "/api/secrets/a"},
+	} {
+		e, err := s.Explain(id, &RequestContext{Method: req.method, Path: req.path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		allowed, err := s.Authorize(id, req.method, req.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Allowed != allowed {
+			t.Errorf("%s %s: Explain allowed %v, Authorize %v", req.method, req.path, e.Allowed, allowed)
+		}
+	}
+
+	e, err := s.Explain(id, &RequestContext{Method: "GET", Path: "/api/secrets/a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Decision != DecisionExplicitDeny || e.DeniedBy == nil || e.DeniedBy.PolicyID != policy.ID || e.DeniedBy.PolicyName != "no-secrets" {
+		t.Errorf("denied by %+v, want the managed policy", e.DeniedBy)
+	}
+	var matched []string
+	for _, st := range e.MatchedStatements() {
+		matched = append(matched, st.Source)
+		if st.Source == SourceGroupRole && (st.GroupID != group.ID || st.RoleID != groupRoleID || st.RoleName != "reader") {
+			t.Errorf("group role statement = %+v", st)
+		}
+	}
+	if len(matched) != 2 {
+		t.Errorf("matched statements from %v, want the group role and the policy", matched)
+	}
+}
+
+func TestExplainSessionPolicy(t *testing.T) {
+	s, user := newTestService(t)
+	id, _ := newTestKey(t, s, user, `[]`)
+	roleID, err := s.CreateRole("reader", "", `[{"resources":["/api/**"],"actions":["GET"],"effect":"allow"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AssignRoleToAccessKey(id, roleID); err != nil {
+		t.Fatal(err)
+	}
+	creds, err := s.AssumeRole(id, roleID, `[{"resources":["/api/public/**"],"actions":["GET"],"effect":"allow"}]`, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := s.Explain(creds.AccessKeyID, &RequestContext{Method: "GET", Path: "/api/items"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Allowed || e.Reason != "the session policy does not allow the request" {
+		t.Errorf("request outside the session policy: %s: %s", e.Decision, e.Reason)
+	}
+	if e, _ := s.Explain(creds.AccessKeyID, &RequestContext{Method: "GET", Path: "/api/public/a"}); !e.Allowed {
+		t.Errorf("request within the session policy: %s: %s", e.Decision, e.Reason)
+	}
+}
+
+func TestExplainHandler(t *testing.T) {
+	s, user := newTestService(t)
+	id, _ := newTestKey(t, s, user, `[{"resources":["/api/**"],"actions":["GET"],"effect":"allow"}]`)
+	handler := s.ExplainHandler()
+
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/explain", bytes.NewBufferString(body)))
+		return w
+	}
+
+	tests := []struct {
+		body    string
+		status  int
+		allowed bool
+	}{
+		{`{"access_key_id":` + strconv.Quote(id) + `,"method":"GET","path":"/api/items"}`, http.StatusOK, true},
+		{`{"access_key_id":` + strconv.Quote(id) + `,"method":"DELETE","path":"/api/items"}`, http.StatusOK, false},
+		{`{"permissions":[{"resources":["/x"],"actions":["GET"],"effect":"allow","conditions":{"IpAddress":{"SourceIp":"10.0.0.0/8"}}}],` +
+			`"method":"GET","path":"/x","source_ip":"10.1.2.3"}`, http.StatusOK, true},
+		{`{"access_key_id":"AKunknown","method":"GET","path":"/api/items"}`, http.StatusNotFound, false},
+		{`{"method":"GET","path":"/api/items"}`, http.StatusBadRequest, false},
+		{`{"access_key_id":` + strconv.Quote(id) + `,"path":"/api/items"}`, http.StatusBadRequest, false},
+		{`{"permissions":"nope","method":"GET","path":"/"}`, http.StatusBadRequest, false},
+		{`not json`, http.StatusBadRequest, false},
+	}
+	for _, tt := range tests {
+		w := post(tt.body)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.body, w.Code, tt.status, w.Body)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		var e Explanation
+		if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Allowed != tt.allowed {
+			t.Errorf("%s: allowed %v, want %v", tt.body, e.Allowed, tt.allowed)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package accesskey
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// PermissionSource is a set of statements an access key gets from one place
+type PermissionSource struct {
+	// Source is SourceAccessKey, SourceUser, SourceRole, SourceUserRole,
+	// SourceGroupRole or SourceSessionPolicy
+	Source    string `json:"source"`
+	RoleID    int    `json:"role_id,omitempty"`
+	RoleName  string `json:"role_name,omitempty"`
+	GroupID   int    `json:"group_id,omitempty"`
+	GroupName string `json:"group_name,omitempty"`
+	// PolicyID is set if the statements are the default version of a
+	// managed policy attached to the source
+	PolicyID      int            `json:"policy_id,omitempty"`
+	PolicyName    string         `json:"policy_name,omitempty"`
+	PolicyVersion int            `json:"policy_version,omitempty"`
+	Permissions   []*Permissions `json:"permissions"`
+
+	role *Role
+}
+
+// CreateGroup creates a group of users
+func (s *Service) CreateGroup(name, description string) (*Group, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, errors.New("group name is required")
+	}
+
+	group := &Group{Name: name, Description: description}
+	if err := s.store.CreateGroup(group); err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+// GetGroup returns a group
+func (s *Service) GetGroup(groupID int) (*Group, error) {
+	return s.store.GetGroup(groupID)
+}
+
+// ListGroups returns all groups
+func (s *Service) ListGroups() ([]*Group, error) {
+	return s.store.ListGroups()
+}
+
+// ListGroupMembers returns the users in a group
+func (s *Service) ListGroupMembers(groupID int) ([]User, error) {
+	if _, err := s.store.GetGroup(groupID); err != nil {
+		return nil, err
+	}
+	return s.store.ListGroupMembers(groupID)
+}
+
+// ListUserGroups returns the groups a user belongs to
+func (s *Service) ListUserGroups(userID int64) ([]*Group, error) {
+	return s.store.ListUserGroups(userID)
+}
+
+// AddUserToGroup makes a user a member of a group. Adding a member twice is
+// not an error.
+func (s *Service) AddUserToGroup(groupID int, userID int64) error {
+	if _, err := s.store.GetGroup(groupID); err != nil {
+		return err
+	}
+	if _, err := s.store.GetUser(userID); err != nil {
+		return err
+	}
+	return s.store.AddGroupMember(groupID, userID)
+}
+
+// RemoveUserFromGroup removes a user from a group
+func (s *Service) RemoveUserFromGroup(groupID int, userID int64) error {
+	return s.store.RemoveGroupMember(groupID, userID)
+}
+
+// AttachRoleToGroup attaches a role to a group, giving its permissions to
+// the access keys of all members
+func (s *Service) AttachRoleToGroup(groupID, roleID int) error {
+	if _, err := s.store.GetGroup(groupID); err != nil {
+		return err
+	}
+	if _, err := s.store.GetRole(roleID); err != nil {
+		return err
+	}
+	return s.store.BindGroupRole(groupID, roleID)
+}
+
+// DetachRoleFromGroup detaches a role from a group
+func (s *Service) DetachRoleFromGroup(groupID, roleID int) error {
+	return s.store.UnbindGroupRole(groupID, roleID)
+}
+
+// ListGroupRoles returns the roles attached to a group
+func (s *Service) ListGroupRoles(groupID int) ([]*Role, error) {
+	return s.store.ListGroupRoles(groupID)
+}
+
+// AttachRoleToUser attaches a role to a user, giving its permissions to all
+// access keys of the user
+func (s *Service) AttachRoleToUser(userID int64, roleID int) error {
+	if _, err := s.store.GetUser(userID); err != nil {
+		return err
+	}
+	if _, err := s.store.GetRole(roleID); err != nil {
+		return err
+	}
+	return s.store.BindUserRole(userID, roleID)
+}
+
+// DetachRoleFromUser detaches a role from a user
+func (s *Service) DetachRoleFromUser(userID int64, roleID int) error {
+	return s.store.UnbindUserRole(userID, roleID)
+}
+
+// ListUserRoles returns the roles attached to a user
+func (s *Service) ListUserRoles(userID int64) ([]*Role, error) {
+	return s.store.ListUserRoles(userID)
+}
+
+// PermissionSources returns where the permissions of an access key come
+// from, in the order they are resolved:
+//
+//  1. the inline permissions of the key, then the policies attached to it
+//  2. the policies attached to the user of the key
+//  3. the roles assigned to the key
+//  4. the roles attached to the user of the key
+//  5. the roles attached to the groups of the user, by group ID
+//
+// Each role is followed by the managed policies attached to it. Temporary
+// credentials get the permissions of the assumed role, restricted by their
+// session policy. GetAccessKeyPermissions returns the statements of all
+// sources except the session policy, without duplicates.
+func (s *Service) PermissionSources(accessKeyID string) ([]PermissionSource, error) {
+	if IsTemporaryAccessKeyID(accessKeyID) {
+		cred, err := s.getTemporaryCredential(accessKeyID)
+		if err != nil {
+			return nil, err
+		}
+		role, err := s.store.GetRole(cred.RoleID)
+		if err != nil {
+			return nil, err
+		}
+		sources, err := s.appendRoleSources(nil, SourceRole, role, nil)
+		if err != nil {
+			return nil, err
+		}
+		if cred.Policy != nil {
+			sources = append(sources, PermissionSource{Source: SourceSessionPolicy, Permissions: cred.Policy})
+		}
+		return sources, nil
+	}
+
+	ak, err := s.store.GetAccessKey(accessKeyID)
+	if err != nil {
+		return nil, err
+	}
+	return s.accessKeySources(ak)
+}
+
+// accessKeySources returns the permission sources of a long-term access key
+func (s *Service) accessKeySources(ak *AccessKey) ([]PermissionSource, error) {
+	sources := []PermissionSource{{Source: SourceAccessKey, Permissions: ak.Permissions}}
+
+	userID := strconv.FormatInt(ak.UserID, 10)
+	sources, err := s.appendPolicySources(sources, PermissionSource{Source: SourceAccessKey}, PolicyTargetAccessKey, ak.AccessKey)
+	if err != nil {
+		return nil, err
+	}
+	sources, err = s.appendPolicySources(sources, PermissionSource{Source: SourceUser}, PolicyTargetUser, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	roles, err := s.store.ListAccessKeyRoles(ak.AccessKey)
+	if err != nil {
+		return nil, err
+	}
+	for _, role := range roles {
+		if sources, err = s.appendRoleSources(sources, SourceRole, role, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	roles, err = s.store.ListUserRoles(ak.UserID)
+	if err != nil {
+		return nil, err
+	}
+	for _, role := range roles {
+		if sources, err = s.appendRoleSources(sources, SourceUserRole, role, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	groups, err := s.store.ListUserGroups(ak.UserID)
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range groups {
+		roles, err := s.store.ListGroupRoles(group.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, role := range roles {
+			if sources, err = s.appendRoleSources(sources, SourceGroupRole, role, group); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return sources, nil
+}
+
+// appendRoleSources appends the inline permissions of a role and the
+// policies attached to it
+func (s *Service) appendRoleSources(sources []PermissionSource, source string, role *Role, group *Group) ([]PermissionSource, error) {
+	src := PermissionSource{
+		Source:   source,
+		RoleID:   role.ID,
+		RoleName: role.Name,
+	}
+	if group != nil {
+		src.GroupID = group.ID
+		src.GroupName = group.Name
+	}
+
+	inline := src
+	inline.Permissions = role.Permissions
+	inline.role = role
+	sources = append(sources, inline)
+	return s.appendPolicySources(sources, src, PolicyTargetRole, strconv.Itoa(role.ID))
+}
+
+// appendPolicySources appends the policies attached to a target as copies of src
+func (s *Service) appendPolicySources(sources []PermissionSource, src PermissionSource, targetType, targetID string) ([]PermissionSource, error) {
+	policies, err := s.store.ListAttachedPolicies(targetType, targetID)
+	if err != nil {
+		return nil, err
+	}
+	for _, policy := range policies {
+		ps := src
+		ps.PolicyID = policy.ID
+		ps.PolicyName = policy.Name
+		ps.PolicyVersion = policy.DefaultVersion
+		ps.Permissions = policy.Document
+		sources = append(sources, ps)
+	}
+	return sources, nil
+}
@@ -0,0 +1,194 @@
+package accesskey
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// sealedPrefix marks a secret_key value that has been encrypted by a Keyring.
+// Plaintext secrets are standard base64 and never contain a colon.
+const sealedPrefix = "enc:"
+
+var (
+	// ErrUnknownMasterKey is returned when a sealed secret references a master key that is not in the keyring
+	ErrUnknownMasterKey = errors.New("unknown master key")
+	// ErrMalformedSecret is returned when a sealed secret cannot be parsed
+	ErrMalformedSecret = errors.New("malformed sealed secret")
+)
+
+// Keyring holds the master keys used to encrypt access key secrets at rest.
+// New secrets are always sealed with the primary key, older keys are kept so
+// that secrets sealed before a master key rotation can still be opened.
+type Keyring struct {
+	primary string
+	keys    map[string]cipher.AEAD
+}
+
+// NewKeyring creates a keyring. keys maps key IDs to 32 byte AES-256 keys and
+// primaryID selects the key used for new secrets.
+func NewKeyring(primaryID string, keys map[string][]byte) (*Keyring, error) {
+	k := &Keyring{
+		primary: primaryID,
+		keys:    make(map[string]cipher.AEAD, len(keys)),
+	}
+	for id, key := range keys {
+		if id == "" || strings.ContainsAny(id, ":,") {
+			return nil, fmt.Errorf("invalid master key ID %q", id)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("master key %s must be 32 bytes, got %d", id, len(key))
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[id] = aead
+	}
+	if _, ok := k.keys[primaryID]; !ok {
+		return nil, fmt.Errorf("primary master key %q not found", primaryID)
+	}
+	return k, nil
+}
+
+// ParseKeyring parses master keys in the form "id1:base64key,id2:base64key".
+// Entries may also be separated by newlines. The first entry is the primary key.
+func ParseKeyring(spec string) (*Keyring, error) {
+	fields := strings.FieldsFunc(spec, func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r'
+	})
+
+	primary := ""
+	keys := make(map[string][]byte)
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		if field == "" || strings.HasPrefix(field, "#") {
+			continue
+		}
+		id, encoded, ok := strings.Cut(field, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid master key entry %q, expected id:base64key", field)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid master key %s: %w", id, err)
+		}
+		if _, dup := keys[id]; dup {
+			return nil, fmt.Errorf("duplicated master key ID %q", id)
+		}
+		if primary == "" {
+			primary = id
+		}
+		keys[id] = key
+	}
+
+	if primary == "" {
+		return nil, errors.New("no master key configured")
+	}
+	return NewKeyring(primary, keys)
+}
+
+// LoadKeyringFromEnv loads the keyring from an environment variable, see ParseKeyring
+func LoadKeyringFromEnv(name string) (*Keyring, error) {
+	spec := os.Getenv(name)
+	if spec == "" {
+		return nil, fmt.Errorf("environment variable %s is not set", name)
+	}
+	return ParseKeyring(spec)
+}
+
+// LoadKeyringFromFile loads the keyring from a file with one id:base64key entry per line
+func LoadKeyringFromFile(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeyring(string(data))
+}
+
+// GenerateMasterKey generates a random master key encoded in base64
+func GenerateMasterKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// PrimaryKeyID returns the ID of the key used for new secrets
+func (k *Keyring) PrimaryKeyID() string {
+	return k.primary
+}
+
+// Seal encrypts a secret with the primary master key. The access key ID is
+// used as additional data, so a sealed secret cannot be moved to another key.
+func (k *Keyring) Seal(accessKeyID, secret string) (string, error) {
+	aead := k.keys[k.primary]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(secret), []byte(accessKeyID))
+	return sealedPrefix + k.primary + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a secret sealed by Seal
+func (k *Keyring) Open(accessKeyID, sealed string) (string, error) {
+	keyID, data, err := splitSealed(sealed)
+	if err != nil {
+		return "", err
+	}
+	aead, ok := k.keys[keyID]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownMasterKey, keyID)
+	}
+	if len(data) < aead.NonceSize() {
+		return "", ErrMalformedSecret
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(accessKeyID))
+	if err != nil {
+		return "", fmt.Errorf("decrypt secret: %w", err)
+	}
+	return string(plaintext), nil
+}
+
+// NeedsReseal reports whether a stored secret is plaintext or sealed with a
+// master key other than the primary one
+func (k *Keyring) NeedsReseal(stored string) bool {
+	if !IsSealedSecret(stored) {
+		return true
+	}
+	keyID, _, err := splitSealed(stored)
+	return err != nil || keyID != k.primary
+}
+
+// IsSealedSecret reports whether a stored secret has been encrypted
+func IsSealedSecret(stored string) bool {
+	return strings.HasPrefix(stored, sealedPrefix)
+}
+
+func splitSealed(sealed string) (string, []byte, error) {
+	rest, ok := strings.CutPrefix(sealed, sealedPrefix)
+	if !ok {
+		return "", nil, ErrMalformedSecret
+	}
+	keyID, encoded, ok := strings.Cut(rest, ":")
+	if !ok {
+		return "", nil, ErrMalformedSecret
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", nil, ErrMalformedSecret
+	}
+	return keyID, data, nil
+}
@@ -0,0 +1,213 @@
+package accesskey
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestKeyring(t *testing.T, primary string, ids ...string) *Keyring {
+	t.Helper()
+	keys := make(map[string][]byte)
+	for _, id := range append([]string{primary}, ids...) {
+		keys[id] = bytes.Repeat([]byte(id[:1]), 32)
+	}
+	k, err := NewKeyring(primary, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestKeyringRoundTrip(t *testing.T) {
+	k := newTestKeyring(t, "k1")
+	sealed, err := k.Seal("AK1", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsSealedSecret(sealed) || !strings.HasPrefix(sealed, "enc:k1:") || strings.Contains(sealed, "secret") {
+		t.Fatalf("sealed secret %q", sealed)
+	}
+	if again, _ := k.Seal("AK1", "secret"); again == sealed {
+		t.Error("sealing twice gave the same ciphertext")
+	}
+	if k.NeedsReseal(sealed) {
+		t.Error("secret sealed with the primary key needs resealing")
+	}
+	if got, err := k.Open("AK1", sealed); err != nil || got != "secret" {
+		t.Errorf("Open = %q, %v", got, err)
+	}
+}
+
+func TestKeyringRejectsTamperedSecrets(t *testing.T) {
+	k := newTestKeyring(t, "k1")
+	sealed, err := k.Seal("AK1", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(sealed, "enc:k1:"))
+	data[len(data)-1] ^= 1
+	flipped := "enc:k1:" + base64.StdEncoding.EncodeToString(data)
+
+	// A keyring with another key under the same ID
+	other, err := NewKeyring("k1", map[string][]byte{"k1": bytes.Repeat([]byte("x"), 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		keyring *Keyring
+		id      string
+		sealed  string
+		want    error
+	}{
+		{"other access key", k, "AK2", sealed, nil},
+		{"modified ciphertext", k, "AK1", flipped, nil},
+		{"wrong master key", other, "AK1", sealed, nil},
+		{"unknown master key", k, "AK1", strings.Replace(sealed, "enc:k1:", "enc:k9:", 1), ErrUnknownMasterKey},
+		{"not base64", k, "AK1", "enc:k1:%%%", ErrMalformedSecret},
+		{"no key ID", k, "AK1", "enc:abc", ErrMalformedSecret},
+		{"too short", k, "AK1", "enc:k1:AAAA", ErrMalformedSecret},
+		{"plaintext", k, "AK1", "secret", ErrMalformedSecret},
+	}
+	for _, tt := range tests {
+		got, err := tt.keyring.Open(tt.id, tt.sealed)
+		if err == nil {
+			t.Errorf("%s: Open = %q, want an error", tt.name, got)
+			continue
+		}
+		if tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("%s: Open error %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+// Secrets sealed before a master key rotation can still be opened
+func TestKeyringMasterKeyRotation(t *testing.T) {
+	sealed, err := newTestKeyring(t, "k1").Seal("AK1", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := newTestKeyring(t, "k2", "k1")
+	if got, err := k.Open("AK1", sealed); err != nil || got != "secret" {
+		t.Errorf("Open with the old key = %q, %v", got, err)
+	}
+	if !k.NeedsReseal(sealed) {
+		t.Error("secret sealed with an old key does not need resealing")
+	}
+	if !k.NeedsReseal("plaintext") {
+		t.Error("plaintext secret does not need sealing")
+	}
+}
+
+func TestParseKeyring(t *testing.T) {
+	key1 := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("a"), 32))
+	key2 := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("b"), 32))
+
+	k, err := ParseKeyring("# master keys\nk2:" + key2 + "\r\n\nk1:" + key1 + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.PrimaryKeyID() != "k2" {
+		t.Errorf("primary key %q, want k2", k.PrimaryKeyID())
+	}
+
+	for _, spec := range []string{
+		"",
+		"# only a comment",
+		"k1",
+		"k1:not base64",
+		"k1:" + base64.StdEncoding.EncodeToString([]byte("short")),
+		"k1:" + key1 + ",k1:" + key2,
+	} {
+		if _, err := ParseKeyring(spec); err == nil {
+			t.Errorf("ParseKeyring(%q) succeeded, want an error", spec)
+		}
+	}
+
+	generated, err := GenerateMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseKeyring("gen:" + generated); err != nil {
+		t.Errorf("generated master key: %v", err)
+	}
+}
+
+func TestServiceSealsSecrets(t *testing.T) {
+	keyring := newTestKeyring(t, "k1")
+	s, user := newTestService(t, WithKeyring(keyring))
+	id, secret := newTestKey(t, s, user, allowAll)
+
+	stored, err := s.store.GetAccessKey(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsSealedSecret(stored.SecretKey) || strings.Contains(stored.SecretKey, secret) {
+		t.Fatalf("stored secret %q is not sealed", stored.SecretKey)
+	}
+	if ok, err := verifySignedRequest(s, id, secret); !ok || err != nil {
+		t.Errorf("request signed with a sealed key: %v, %v", ok, err)
+	}
+
+	// Without the keyring, sealed secrets cannot be used
+	plain := NewService(s.store)
+	if ok, err := verifySignedRequest(plain, id, secret); ok || err == nil {
+		t.Errorf("request verified without the keyring: %v, %v", ok, err)
+	}
+}
+
+// Rows written before secrets were encrypted keep working and are sealed by
+// EncryptSecrets, as run by cmd/akencrypt
+func TestEncryptSecretsMigratesPlaintextRows(t *testing.T) {
+	store := NewMemoryStore()
+	plain := NewService(store)
+	user, err := plain.CreateUser("alice", "password123", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, secret := newTestKey(t, plain, user, allowAll)
+
+	s := NewService(store, WithKeyring(newTestKeyring(t, "k1")))
+	if ok, err := verifySignedRequest(s, id, secret); !ok || err != nil {
+		t.Fatalf("plaintext row with a keyring: %v, %v", ok, err)
+	}
+
+	if n, err := s.EncryptSecrets(); err != nil || n != 1 {
+		t.Fatalf("EncryptSecrets = %d, %v, want 1", n, err)
+	}
+	stored, err := store.GetAccessKey(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsSealedSecret(stored.SecretKey) {
+		t.Fatalf("secret %q was not sealed", stored.SecretKey)
+	}
+	if ok, err := verifySignedRequest(s, id, secret); !ok || err != nil {
+		t.Errorf("after EncryptSecrets: %v, %v", ok, err)
+	}
+	if n, err := s.EncryptSecrets(); err != nil || n != 0 {
+		t.Errorf("second EncryptSecrets = %d, %v, want 0", n, err)
+	}
+
+	// After a master key rotation the secrets are sealed with the new key
+	rotated := NewService(store, WithKeyring(newTestKeyring(t, "k2", "k1")))
+	if n, err := rotated.EncryptSecrets(); err != nil || n != 1 {
+		t.Fatalf("EncryptSecrets after rotation = %d, %v, want 1", n, err)
+	}
+	if stored, _ := store.GetAccessKey(id); !strings.HasPrefix(stored.SecretKey, "enc:k2:") {
+		t.Errorf("secret %q not sealed with the new primary key", stored.SecretKey)
+	}
+}
+
+// verifySignedRequest signs a request with the key and verifies it with s
+func verifySignedRequest(s *Service, id, secret string) (bool, error) {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/api/v1/users", nil)
+	SignRequest(req, id, secret, nil)
+	return s.VerifyRequestSignature(req, nil)
+}
@@ -0,0 +1,447 @@
+package accesskey
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// DefaultMaxBodySize is the largest request body the middleware reads by default
+const DefaultMaxBodySize = 10 << 20
+
+var (
+	// ErrInvalidSignature is passed to the ErrorResponder when signature verification fails
+	ErrInvalidSignature = errors.New("invalid signature")
+	// ErrInvalidAccessKey is passed to the ErrorResponder when the access key is not usable
+	ErrInvalidAccessKey = errors.New("invalid access key")
+	// ErrInsufficientPermissions is passed to the ErrorResponder when the access key is not allowed to call the endpoint
+	ErrInsufficientPermissions = errors.New("insufficient permissions")
+	// ErrBodyTooLarge is passed to the ErrorResponder when the request body exceeds the maximum size
+	ErrBodyTooLarge = errors.New("request body too large")
+)
+
+// authErrorHeader is set on responses rejected because of clock skew
+const (
+	authErrorHeader         = "X-Auth-Error"
+	authErrorRequestExpired = "RequestExpired"
+)
+
+// ErrorResponder writes the response for a request rejected by the middleware
+type ErrorResponder func(w http.ResponseWriter, r *http.Request, status int, err error)
+
+// PermissionResolver returns the permissions of a verified access key for a
+// request. It replaces Service.GetAccessKeyPermissions in the middleware.
+type PermissionResolver func(r *http.Request, accessKeyID string) ([]*Permissions, error)
+
+// MiddlewareOption configures the signature middleware
+type MiddlewareOption func(*middlewareConfig)
+
+type middlewareConfig struct {
+	skip         []func(*http.Request) bool
+	maxBodySize  int64
+	respondError ErrorResponder
+	resolve      PermissionResolver
+	action       func(*http.Request) string
+	sourceIP     func(*http.Request) net.IP
+	audit        AuditSink
+	limiter      *RateLimiter
+	unsigned     []string
+
+	devMode      bool
+	devKeyID     string
+	devKeySecret string
+}
+
+// WithSkipPaths skips verification for requests whose path matches one of the patterns
+func WithSkipPaths(patterns ...string) MiddlewareOption {
+	return WithSkipMatcher(func(r *http.Request) bool {
+		for _, pattern := range patterns {
+			if matchPathPattern(pattern, r.URL.Path) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// WithSkipMatcher skips verification for requests for which match returns true
+func WithSkipMatcher(match func(*http.Request) bool) MiddlewareOption {
+	return func(c *middlewareConfig) {
+		c.skip = append(c.skip, match)
+	}
+}
+
+// WithMaxBodySize sets the largest request body that is read for verification,
+// larger requests are rejected with 413. Bodies declared with X-Content-SHA256
+// are not read by the middleware; for StreamingPayload it limits the size of
+// each chunk.
+func WithMaxBodySize(n int64) MiddlewareOption {
+	return func(c *middlewareConfig) {
+		c.maxBodySize = n
+	}
+}
+
+// WithUnsignedPayload accepts requests with X-Content-SHA256: UNSIGNED-PAYLOAD,
+// whose body is not covered by the signature, for paths matching one of the
+// patterns, e.g. uploads checked by the handler itself
+func WithUnsignedPayload(patterns ...string) MiddlewareOption {
+	return func(c *middlewareConfig) {
+		c.unsigned = append(c.unsigned, patterns...)
+	}
+}
+
+// allowsUnsignedPayload reports whether the body of r may be unsigned
+func (c *middlewareConfig) allowsUnsignedPayload(r *http.Request) bool {
+	for _, pattern := range c.unsigned {
+		if matchPathPattern(pattern, r.URL.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// WithErrorResponder replaces the default plain text error responses
+func WithErrorResponder(respond ErrorResponder) MiddlewareOption {
+	return func(c *middlewareConfig) {
+		c.respondError = respond
+	}
+}
+
+// WithPermissionResolver replaces how the permissions of an access key are resolved
+func WithPermissionResolver(resolve PermissionResolver) MiddlewareOption {
+	return func(c *middlewareConfig) {
+		c.resolve = resolve
+	}
+}
+
+// WithActionResolver sets the action a request is authorized for. By default
+// statements are matched against the HTTP method.
+func WithActionResolver(resolve func(*http.Request) string) MiddlewareOption {
+	return func(c *middlewareConfig) {
+		c.action = resolve
+	}
+}
+
+// WithSourceIPResolver sets how the client IP used by IpAddress conditions is
+// determined, e.g. from X-Forwarded-For when running behind a trusted proxy.
+// By default the IP of RemoteAddr is used.
+func WithSourceIPResolver(resolve func(*http.Request) net.IP) MiddlewareOption {
+	return func(c *middlewareConfig) {
+		c.sourceIP = resolve
+	}
+}
+
+// WithAuditSink records every decision of the middleware in the sink
+func WithAuditSink(sink AuditSink) MiddlewareOption {
+	return func(c *middlewareConfig) {
+		c.audit = sink
+	}
+}
+
+// WithRateLimiter enforces the rate limits and quotas of access keys and
+// their roles. Rejected requests get a 429 response.
+func WithRateLimiter(limiter *RateLimiter) MiddlewareOption {
+	return func(c *middlewareConfig) {
+		c.limiter = limiter
+	}
+}
+
+// WithDevMode signs unsigned requests with the given credentials before
+// verifying them, so that endpoints can be tried without a signing client.
+// Never use it in production.
+func WithDevMode(accessKeyID, secret string) MiddlewareOption {
+	return func(c *middlewareConfig) {
+		c.devMode = true
+		c.devKeyID = accessKeyID
+		c.devKeySecret = secret
+	}
+}
+
+func newMiddlewareConfig(opts []MiddlewareOption) *middlewareConfig {
+	c := &middlewareConfig{
+		maxBodySize:  DefaultMaxBodySize,
+		respondError: defaultErrorResponder,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.devMode {
+		log.Printf("accesskey: middleware running in dev mode, unsigned requests are signed as %s", c.devKeyID)
+	}
+	return c
+}
+
+// record passes an audit event to the audit sink, if any
+func (c *middlewareConfig) record(e *AuditEvent, start time.Time, status int, err error) {
+	if c.audit == nil {
+		return
+	}
+	e.Latency = time.Since(start)
+	e.Status = status
+	e.Decision = AuditAllow
+	if err != nil {
+		e.Decision = AuditDeny
+		e.Reason = err.Error()
+	}
+	if err := c.audit.Record(e); err != nil {
+		log.Printf("accesskey: record audit event: %v", err)
+	}
+}
+
+// defaultErrorResponder writes the error message as plain text
+func defaultErrorResponder(w http.ResponseWriter, r *http.Request, status int, err error) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write([]byte(err.Error()))
+}
+
+// NewMiddleware creates a signature verification middleware using the Service
+// created by InitDB
+func NewMiddleware(opts ...MiddlewareOption) func(http.Handler) http.Handler {
+	c := newMiddlewareConfig(opts)
+	return func(f http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s, err := getDefaultService()
+			if err != nil {
+				c.respondError(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			s.serveHTTP(c, f, w, r)
+		})
+	}
+}
+
+// CreateMiddleware creates a middleware for signature verification using the
+// Service created by InitDB and the default options
+func CreateMiddleware(f http.Handler) http.Handler {
+	return NewMiddleware()(f)
+}
+
+// Middleware creates a middleware for signature verification with the default options
+func (s *Service) Middleware(f http.Handler) http.Handler {
+	return s.NewMiddleware()(f)
+}
+
+// NewMiddleware creates a signature verification middleware
+func (s *Service) NewMiddleware(opts ...MiddlewareOption) func(http.Handler) http.Handler {
+	c := newMiddlewareConfig(opts)
+	return func(f http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.serveHTTP(c, f, w, r)
+		})
+	}
+}
+
+func (s *Service) serveHTTP(c *middlewareConfig, f http.Handler, w http.ResponseWriter, r *http.Request) {
+	// Skip signature verification for certain paths
+	for _, skip := range c.skip {
+		if skip(r) {
+			f.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	start := time.Now()
+	rc := NewRequestContext(r)
+	if c.sourceIP != nil {
+		rc.SourceIP = c.sourceIP(r)
+	}
+	if c.action != nil {
+		rc.Action = c.action(r)
+	}
+	event := &AuditEvent{Time: start, Method: r.Method, Path: r.URL.Path}
+	if rc.SourceIP != nil {
+		event.SourceIP = rc.SourceIP.String()
+	}
+	deny := func(status int, err error) {
+		c.record(event, start, status, err)
+		c.respondError(w, r, status, err)
+	}
+
+	// Bodies declared with X-Content-SHA256 are verified while the handler
+	// reads them instead of being buffered
+	payload := payloadMode(r)
+	if payload == UnsignedPayload && !c.allowsUnsignedPayload(r) {
+		deny(http.StatusUnauthorized, ErrUnsignedPayloadNotAllowed)
+		return
+	}
+	var body []byte
+	if r.Body != nil && payload == "" {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(r.Body, c.maxBodySize+1))
+		if err != nil {
+			deny(http.StatusBadRequest, fmt.Errorf("read request body: %w", err))
+			return
+		}
+		if int64(len(body)) > c.maxBodySize {
+			deny(http.StatusRequestEntityTooLarge, ErrBodyTooLarge)
+			return
+		}
+		// Reset the body for subsequent reads
+		r.Body = io.NopCloser(bytes.NewBuffer(body))
+	}
+
+	devSigned := c.devMode && r.Header.Get("X-Signature") == "" && !isPresigned(r)
+	if devSigned {
+		if err := SignRequestWithVersion(r, c.devKeyID, c.devKeySecret, body, DefaultSignatureVersion); err != nil {
+			log.Printf("accesskey: sign development request: %v", err)
+			c.record(event, start, http.StatusInternalServerError, fmt.Errorf("error signing development request: %w", err))
+			c.respondError(w, r, http.StatusInternalServerError, errors.New("error signing development request"))
+			return
+		}
+	}
+	accessKeyID := requestAccessKeyID(r)
+	event.AccessKeyID = accessKeyID
+
+	// Verify signature in the server
+	valid, err := s.verifyRequestSignature(r, body, true)
+	if errors.Is(err, ErrRequestExpired) {
+		// Lets clients correct their clock using the Date header and retry
+		w.Header().Set(authErrorHeader, authErrorRequestExpired)
+	}
+	if errors.Is(err, ErrRequestExpired) || errors.Is(err, ErrNonceReused) || errors.Is(err, ErrInvalidSessionToken) ||
+		errors.Is(err, ErrPresignedURLExpired) {
+		deny(http.StatusUnauthorized, err)
+		return
+	}
+	if err != nil {
+		deny(http.StatusUnauthorized, fmt.Errorf("%w: %v", ErrInvalidSignature, err))
+		return
+	}
+	if !valid {
+		deny(http.StatusUnauthorized, ErrInvalidSignature)
+		return
+	}
+	if r.Body != nil && payload != "" && payload != UnsignedPayload {
+		if err := s.wrapPayload(c, r, payload); err != nil {
+			deny(http.StatusUnauthorized, fmt.Errorf("%w: %v", ErrInvalidSignature, err))
+			return
+		}
+	}
+
+	// Verify whether the access key is available
+	valid, err = s.ValidateAccessKey(accessKeyID)
+	if err != nil {
+		// Unknown, inactive and expired keys are not errors, this is a
+		// failure of the store that must not look like bad credentials
+		log.Printf("accesskey: validate access key %s: %v", accessKeyID, err)
+		c.record(event, start, http.StatusInternalServerError, fmt.Errorf("error validating access key: %w", err))
+		c.respondError(w, r, http.StatusInternalServerError, errors.New("error validating access key"))
+		return
+	}
+	if !valid {
+		deny(http.StatusUnauthorized, ErrInvalidAccessKey)
+		return
+	}
+
+	// Check if the access key has permission to access the endpoint
+	var permissions []*Permissions
+	if c.resolve != nil {
+		permissions, err = c.resolve(r, accessKeyID)
+	} else {
+		permissions, err = s.GetAccessKeyPermissions(accessKeyID)
+	}
+	var allowed bool
+	var statement *Permissions
+	if err == nil {
+		allowed, statement, err = s.authorize(accessKeyID, permissions, rc)
+	}
+	event.UserID = rc.UserID
+	event.MatchedStatement = statement
+	if err != nil {
+		log.Printf("accesskey: resolve permissions of %s: %v", accessKeyID, err)
+		c.record(event, start, http.StatusInternalServerError, fmt.Errorf("error getting permissions: %w", err))
+		c.respondError(w, r, http.StatusInternalServerError, errors.New("error getting permissions"))
+		return
+	}
+	if !allowed {
+		deny(http.StatusForbidden, ErrInsufficientPermissions)
+		return
+	}
+
+	// Only authorized requests count against the rate limit, so that requests
+	// rejected with 401 or 403 do not use up the quota
+	if c.limiter != nil {
+		if err := s.checkRateLimit(c.limiter, w, accessKeyID); err != nil {
+			deny(http.StatusTooManyRequests, err)
+			return
+		}
+	}
+
+	authMethod := AuthMethodAccessKey
+	switch {
+	case devSigned:
+		authMethod = AuthMethodDev
+	case isPresigned(r):
+		authMethod = AuthMethodPresigned
+	case IsTemporaryAccessKeyID(accessKeyID):
+		authMethod = AuthMethodTemporary
+	}
+	principal, err := s.newPrincipal(accessKeyID, permissions, rc, authMethod)
+	if err != nil {
+		log.Printf("accesskey: resolve principal of %s: %v", accessKeyID, err)
+		c.record(event, start, http.StatusInternalServerError, fmt.Errorf("error getting principal: %w", err))
+		c.respondError(w, r, http.StatusInternalServerError, errors.New("error getting principal"))
+		return
+	}
+
+	c.record(event, start, http.StatusOK, nil)
+
+	// Call the next handler with the principal in the request context
+	f.ServeHTTP(w, r.WithContext(ContextWithPrincipal(r.Context(), principal)))
+}
+
+// wrapPayload replaces the body of a verified request with a reader checking
+// it against its X-Content-SHA256 header
+func (s *Service) wrapPayload(c *middlewareConfig, r *http.Request, payload string) error {
+	if payload != StreamingPayload {
+		r.Body = newHashingBody(r.Body, payload)
+		return nil
+	}
+
+	algorithm, err := parseSignatureAlgorithm(r.Header.Get("X-Signature-Algorithm"))
+	if err != nil {
+		return err
+	}
+	verify, err := s.signatureVerifier(r.Header.Get("X-Access-Key-ID"), algorithm)
+	if err != nil {
+		return err
+	}
+	if verify == nil {
+		return errors.New("access key cannot verify chunks")
+	}
+	r.Body = newChunkedReader(r, verify, c.maxBodySize)
+	r.ContentLength = -1
+	return nil
+}
+
+// checkRateLimit counts the request against the rate limit of the access key
+// and sets the X-RateLimit-* headers. Errors of the limiter are logged and the
+// request is let through, so that an unavailable counter does not take down the API.
+func (s *Service) checkRateLimit(limiter *RateLimiter, w http.ResponseWriter, accessKeyID string) error {
+	limit, subject, err := s.rateLimitFor(accessKeyID)
+	if err != nil {
+		log.Printf("accesskey: resolve rate limit of %s: %v", accessKeyID, err)
+		return nil
+	}
+	if limit == nil {
+		return nil
+	}
+
+	now := time.Now()
+	result, err := limiter.Allow(subject, limit, now)
+	if err != nil {
+		log.Printf("accesskey: rate limit %s: %v", accessKeyID, err)
+		return nil
+	}
+	rateLimitHeaders(w.Header(), result, now)
+	if !result.Allowed {
+		return result.Err
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package accesskey
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Failures of the store are not reported as bad credentials
+func TestMiddlewareValidateAccessKeyErrors(t *testing.T) {
+	store := &failingToucher{Store: NewMemoryStore()}
+	s := NewService(store)
+	user, err := s.CreateUser("alice", "password123", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, secret := newTestKey(t, s, user, allowAll)
+	inactive, inactiveSecret := newTestKey(t, s, user, allowAll)
+	if err := s.DeactivateAccessKey(inactive); err != nil {
+		t.Fatal(err)
+	}
+	handler := s.Middleware(&bodyRecorder{})
+
+	serve := func(id, secret string) int {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/api", nil)
+		SignRequest(req, id, secret, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := serve(id, secret); code != http.StatusOK {
+		t.Errorf("valid key: status %d, want %d", code, http.StatusOK)
+	}
+	if code := serve(inactive, inactiveSecret); code != http.StatusUnauthorized {
+		t.Errorf("inactive key: status %d, want %d", code, http.StatusUnauthorized)
+	}
+	store.fail = true
+	if code := serve(id, secret); code != http.StatusInternalServerError {
+		t.Errorf("failing store: status %d, want %d", code, http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,430 @@
+package accesskey
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationFiles are the schema migrations, named VERSION_NAME.up.sql and
+// VERSION_NAME.down.sql. Applied migrations must never be edited; add a new
+// migration instead.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLock is the MySQL named lock held while migrating, so that
+// instances starting at the same time do not migrate concurrently
+const migrationLock = "accesskey_schema_migrations"
+
+var (
+	// ErrSchemaOutdated is returned when the database lacks migrations this
+	// version of the package needs, see Migrate
+	ErrSchemaOutdated = errors.New("database schema is outdated")
+	// ErrSchemaTooNew is returned when the database has migrations this version
+	// of the package does not know, e.g. after a rollback of the application
+	ErrSchemaTooNew = errors.New("database schema is newer than this version")
+	// ErrMigrationChecksum is returned when an applied migration differs from
+	// the embedded one
+	ErrMigrationChecksum = errors.New("migration checksum mismatch")
+)
+
+// Migration is one embedded schema migration
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+	// Checksum is the SHA-256 of Up, recorded when the migration is applied
+	Checksum string
+}
+
+// AppliedMigration is a row of the schema_migrations table
+type AppliedMigration struct {
+	Version   int
+	Name      string
+	Checksum  string
+	AppliedAt time.Time
+}
+
+var migrationName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migrations returns the embedded migrations ordered by version
+func Migrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		m := migrationName.FindStringSubmatch(entry.Name())
+		if m == nil {
+			return nil, fmt.Errorf("invalid migration file name %q", entry.Name())
+		}
+		version, _ := strconv.Atoi(m[1])
+		data, err := migrationFiles.ReadFile("migrations/" + entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		mig := byVersion[version]
+		if mig == nil {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		} else if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.Up = string(data)
+			sum := sha256.Sum256(data)
+			mig.Checksum = hex.EncodeToString(sum[:])
+		} else {
+			mig.Down = string(data)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.Up == "" {
+			return nil, fmt.Errorf("migration %d has no up script", mig.Version)
+		}
+		migrations = append(migrations, *mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// LatestSchemaVersion returns the version of the newest embedded migration
+func LatestSchemaVersion() int {
+	migrations, err := Migrations()
+	if err != nil || len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+// Migrate applies all pending migrations to the database. The connection
+// must be opened with parseTime=true, as OpenDB does.
+func Migrate(ctx context.Context, db *sql.DB) error {
+	return MigrateTo(ctx, db, LatestSchemaVersion())
+}
+
+// MigrateTo migrates the database up or down to the given version. Version 0
+// drops all tables, reverting 0002_key_types deletes all Ed25519 keys. MySQL
+// commits DDL statements implicitly, so a migration that fails halfway is not
+// recorded and has to be cleaned up by hand.
+func MigrateTo(ctx context.Context, db *sql.DB, version int) error {
+	migrations, err := Migrations()
+	if err != nil {
+		return err
+	}
+	if version != 0 && !hasMigration(migrations, version) {
+		return fmt.Errorf("unknown schema version %d", version)
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var locked sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 60)", migrationLock).Scan(&locked); err != nil {
+		return err
+	}
+	if locked.Int64 != 1 {
+		return errors.New("timed out waiting for another migration to finish")
+	}
+	defer conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", migrationLock)
+
+	if err := createMigrationsTable(ctx, conn); err != nil {
+		return err
+	}
+	applied, err := appliedMigrations(ctx, conn)
+	if err != nil {
+		return err
+	}
+	if err := verifyApplied(migrations, applied); err != nil && !errors.Is(err, ErrSchemaOutdated) {
+		return err
+	}
+
+	done := make(map[int]bool, len(applied))
+	for _, a := range applied {
+		done[a.Version] = true
+	}
+
+	for _, mig := range migrations {
+		if mig.Version > version {
+			continue
+		}
+		if !done[mig.Version] {
+			if err := execScript(ctx, conn, mig.Up); err != nil {
+				return fmt.Errorf("migration %d_%s: %w", mig.Version, mig.Name, err)
+			}
+			if _, err := conn.ExecContext(ctx,
+				"INSERT INTO schema_migrations (version, name, checksum) VALUES (?, ?, ?)",
+				mig.Version, mig.Name, mig.Checksum,
+			); err != nil {
+				return err
+			}
+		}
+		// Also upgrades databases where 0001_initial was recorded without
+		// adding the columns
+		if mig.Version == 1 {
+			if err := addBaselineColumns(ctx, conn); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		mig := migrations[i]
+		if mig.Version <= version || !done[mig.Version] {
+			continue
+		}
+		if mig.Down == "" {
+			return fmt.Errorf("migration %d_%s cannot be reverted", mig.Version, mig.Name)
+		}
+		if err := execScript(ctx, conn, mig.Down); err != nil {
+			return fmt.Errorf("revert migration %d_%s: %w", mig.Version, mig.Name, err)
+		}
+		if _, err := conn.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = ?", mig.Version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MigrationStatus returns the migrations applied to the database
+func MigrationStatus(ctx context.Context, db *sql.DB) ([]AppliedMigration, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	exists, err := migrationsTableExists(ctx, conn)
+	if err != nil || !exists {
+		return nil, err
+	}
+	return appliedMigrations(ctx, conn)
+}
+
+// CheckSchema returns ErrSchemaOutdated if migrations are pending or tables
+// created before migrations lack columns, ErrSchemaTooNew if the database has
+// unknown migrations and ErrMigrationChecksum if an applied migration was
+// changed. InitDB refuses to start unless the schema is up to date.
+func CheckSchema(ctx context.Context, db *sql.DB) error {
+	migrations, err := Migrations()
+	if err != nil {
+		return err
+	}
+	applied, err := MigrationStatus(ctx, db)
+	if err != nil {
+		return err
+	}
+	if err := verifyApplied(migrations, applied); err != nil {
+		return err
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	missing, err := missingBaselineColumns(ctx, conn)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		names := make([]string, len(missing))
+		for i, col := range missing {
+			names[i] = col.table + "." + col.column
+		}
+		return fmt.Errorf("%w: missing columns %s", ErrSchemaOutdated, strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// baselineColumn is a column of 0001_initial that the tables of the schema
+// used before migrations lack
+type baselineColumn struct {
+	table      string
+	column     string
+	definition string
+}
+
+// baselineColumns are added by Migrate to tables that predate migrations,
+// which 0001_initial keeps as they are
+var baselineColumns = []baselineColumn{
+	{"access_keys", "rotated_from", "VARCHAR(64) DEFAULT NULL"},
+	{"access_keys", "grace_until", "DATETIME DEFAULT NULL"},
+	{"access_keys", "tags", "JSON DEFAULT NULL"},
+	{"access_keys", "rate_limit", "JSON DEFAULT NULL"},
+	{"roles", "rate_limit", "JSON DEFAULT NULL"},
+	{"users", "parent_id", "BIGINT DEFAULT NULL"},
+}
+
+// missingBaselineColumns returns the baseline columns missing from existing tables
+func missingBaselineColumns(ctx context.Context, conn *sql.Conn) ([]baselineColumn, error) {
+	rows, err := conn.QueryContext(ctx,
+		"SELECT table_name, column_name FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name IN ('access_keys', 'roles', 'users')",
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tables := make(map[string]bool)
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var table, column string
+		if err := rows.Scan(&table, &column); err != nil {
+			return nil, err
+		}
+		tables[table] = true
+		columns[table+"."+column] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var missing []baselineColumn
+	for _, col := range baselineColumns {
+		if tables[col.table] && !columns[col.table+"."+col.column] {
+			missing = append(missing, col)
+		}
+	}
+	return missing, nil
+}
+
+// addBaselineColumns adds the missing baseline columns
+func addBaselineColumns(ctx context.Context, conn *sql.Conn) error {
+	missing, err := missingBaselineColumns(ctx, conn)
+	if err != nil {
+		return err
+	}
+	for _, col := range missing {
+		if _, err := conn.ExecContext(ctx, "ALTER TABLE "+col.table+" ADD COLUMN "+col.column+" "+col.definition); err != nil {
+			return fmt.Errorf("add column %s.%s: %w", col.table, col.column, err)
+		}
+	}
+	return nil
+}
+
+func verifyApplied(migrations []Migration, applied []AppliedMigration) error {
+	byVersion := make(map[int]Migration, len(migrations))
+	for _, mig := range migrations {
+		byVersion[mig.Version] = mig
+	}
+	done := make(map[int]bool, len(applied))
+	for _, a := range applied {
+		mig, ok := byVersion[a.Version]
+		if !ok {
+			return fmt.Errorf("%w: unknown migration %d_%s", ErrSchemaTooNew, a.Version, a.Name)
+		}
+		if a.Checksum != mig.Checksum {
+			return fmt.Errorf("%w: migration %d_%s", ErrMigrationChecksum, a.Version, a.Name)
+		}
+		done[a.Version] = true
+	}
+
+	var pending []string
+	for _, mig := range migrations {
+		if !done[mig.Version] {
+			pending = append(pending, fmt.Sprintf("%d_%s", mig.Version, mig.Name))
+		}
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("%w: pending migrations %s", ErrSchemaOutdated, strings.Join(pending, ", "))
+	}
+	return nil
+}
+
+func hasMigration(migrations []Migration, version int) bool {
+	for _, mig := range migrations {
+		if mig.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+func createMigrationsTable(ctx context.Context, conn *sql.Conn) error {
+	_, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+    version INT PRIMARY KEY,
+    name VARCHAR(128) NOT NULL,
+    checksum CHAR(64) NOT NULL,
+    applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci`)
+	return err
+}
+
+func migrationsTableExists(ctx context.Context, conn *sql.Conn) (bool, error) {
+	var n int
+	err := conn.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = 'schema_migrations'",
+	).Scan(&n)
+	return n > 0, err
+}
+
+func appliedMigrations(ctx context.Context, conn *sql.Conn) ([]AppliedMigration, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT version, name, checksum, applied_at FROM schema_migrations ORDER BY version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var applied []AppliedMigration
+	for rows.Next() {
+		var a AppliedMigration
+		if err := rows.Scan(&a.Version, &a.Name, &a.Checksum, &a.AppliedAt); err != nil {
+			return nil, err
+		}
+		applied = append(applied, a)
+	}
+	return applied, rows.Err()
+}
+
+// execScript runs the statements of a migration one by one, the MySQL
+// driver does not allow several statements in one Exec by default
+func execScript(ctx context.Context, conn *sql.Conn, script string) error {
+	for _, stmt := range splitStatements(script) {
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitStatements splits a script on semicolons and drops "--" comment
+// lines. Migrations must not use semicolons inside strings.
+func splitStatements(script string) []string {
+	var lines []string
+	for _, line := range strings.Split(script, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "--") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	var statements []string
+	for _, stmt := range strings.Split(strings.Join(lines, "\n"), ";") {
+		if stmt = strings.TrimSpace(stmt); stmt != "" {
+			statements = append(statements, stmt)
+		}
+	}
+	return statements
+}
@@ -0,0 +1,52 @@
+package accesskey
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMigrations(t *testing.T) {
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, mig := range migrations {
+		if mig.Version != i+1 {
+			t.Errorf("migration %d_%s has version %d, want %d", mig.Version, mig.Name, mig.Version, i+1)
+		}
+		if mig.Down == "" {
+			t.Errorf("migration %d_%s has no down script", mig.Version, mig.Name)
+		}
+	}
+	if got := LatestSchemaVersion(); got != len(migrations) {
+		t.Errorf("LatestSchemaVersion = %d, want %d", got, len(migrations))
+	}
+}
+
+// The columns added to tables that predate migrations must be those of
+// 0001_initial
+func TestBaselineColumnsMatchInitialMigration(t *testing.T) {
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	initial := migrations[0].Up
+	for _, col := range baselineColumns {
+		start := strings.Index(initial, "CREATE TABLE IF NOT EXISTS "+col.table+" (")
+		if start < 0 {
+			t.Fatalf("0001_initial does not create %s", col.table)
+		}
+		table := initial[start : start+strings.Index(initial[start:], ") ENGINE")]
+		if !strings.Contains(table, "\n    "+col.column+" "+col.definition+",") {
+			t.Errorf("0001_initial does not define %s.%s as %s", col.table, col.column, col.definition)
+		}
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	got := splitStatements("-- comment; with a semicolon\nCREATE TABLE a (id INT);\n\n  -- another\nDROP TABLE b;\n")
+	want := []string{"CREATE TABLE a (id INT)", "DROP TABLE b"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("splitStatements = %q, want %q", got, want)
+	}
+}
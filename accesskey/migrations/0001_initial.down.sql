@@ -0,0 +1,16 @@
+-- Drop the initial schema, dependent tables first
+DROP TABLE IF EXISTS rate_limit_counters;
+DROP TABLE IF EXISTS audit_log;
+DROP TABLE IF EXISTS sts_credentials;
+DROP TABLE IF EXISTS request_nonces;
+DROP TABLE IF EXISTS policy_attachments;
+DROP TABLE IF EXISTS policy_versions;
+DROP TABLE IF EXISTS policies;
+DROP TABLE IF EXISTS user_roles;
+DROP TABLE IF EXISTS user_group_roles;
+DROP TABLE IF EXISTS user_group_members;
+DROP TABLE IF EXISTS user_groups;
+DROP TABLE IF EXISTS access_key_roles;
+DROP TABLE IF EXISTS users;
+DROP TABLE IF EXISTS roles;
+DROP TABLE IF EXISTS access_keys;
@@ -0,0 +1,186 @@
+-- Initial schema: access keys, roles, users, groups, managed policies,
+-- temporary credentials, nonces, audit log and quota counters.
+
+-- Access Keys table
+CREATE TABLE IF NOT EXISTS access_keys (
+    id VARCHAR(64) PRIMARY KEY,
+    secret_key VARCHAR(256) NOT NULL,
+    access_key VARCHAR(64) NOT NULL,
+    user_id BIGINT NOT NULL,
+    status ENUM('active','inactive','expired') NOT NULL DEFAULT 'active',
+    permissions JSON NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_used_at DATETIME DEFAULT NULL,
+    expires_at TIMESTAMP NULL,
+    rotated_from VARCHAR(64) DEFAULT NULL,
+    grace_until DATETIME DEFAULT NULL,
+    tags JSON DEFAULT NULL,
+    rate_limit JSON DEFAULT NULL,
+    UNIQUE KEY uk_access_key (access_key),
+    INDEX idx_user_id (user_id),
+    INDEX idx_status (status),
+    INDEX idx_created_at (created_at),
+    INDEX idx_grace_until (grace_until),
+    INDEX idx_expires_at (expires_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Role Definitions table
+CREATE TABLE IF NOT EXISTS roles (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    name VARCHAR(64) NOT NULL,
+    description TEXT,
+    permissions JSON NOT NULL,
+    rate_limit JSON DEFAULT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    UNIQUE KEY uk_name (name)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- User Definitions table
+CREATE TABLE IF NOT EXISTS users (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    parent_id BIGINT DEFAULT NULL,
+    username VARCHAR(64) NOT NULL,
+    password VARCHAR(255) NOT NULL,
+    status ENUM('active','suspended','deleted') NOT NULL DEFAULT 'active',
+    permissions JSON NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    UNIQUE KEY uk_username (username),
+    INDEX idx_parent_id (parent_id),
+    FOREIGN KEY (parent_id) REFERENCES users(id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Access Key Role Mappings table. access_key_id is the access key ID the
+-- code looks keys up by, i.e. access_keys.access_key.
+CREATE TABLE IF NOT EXISTS access_key_roles (
+    access_key_id VARCHAR(64) NOT NULL,
+    role_id INT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (access_key_id, role_id),
+    FOREIGN KEY (access_key_id) REFERENCES access_keys(access_key) ON DELETE CASCADE,
+    FOREIGN KEY (role_id) REFERENCES roles(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- User Groups table
+CREATE TABLE IF NOT EXISTS user_groups (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    name VARCHAR(64) NOT NULL,
+    description TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    UNIQUE KEY uk_name (name)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Group Memberships table
+CREATE TABLE IF NOT EXISTS user_group_members (
+    group_id INT NOT NULL,
+    user_id BIGINT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (group_id, user_id),
+    INDEX idx_user_id (user_id),
+    FOREIGN KEY (group_id) REFERENCES user_groups(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Group Role Mappings table
+CREATE TABLE IF NOT EXISTS user_group_roles (
+    group_id INT NOT NULL,
+    role_id INT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (group_id, role_id),
+    FOREIGN KEY (group_id) REFERENCES user_groups(id) ON DELETE CASCADE,
+    FOREIGN KEY (role_id) REFERENCES roles(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- User Role Mappings table
+CREATE TABLE IF NOT EXISTS user_roles (
+    user_id BIGINT NOT NULL,
+    role_id INT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, role_id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (role_id) REFERENCES roles(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Managed Policies table
+CREATE TABLE IF NOT EXISTS policies (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    name VARCHAR(128) NOT NULL,
+    description TEXT,
+    default_version INT NOT NULL DEFAULT 1,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    UNIQUE KEY uk_name (name)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Policy Versions table, versions are never updated
+CREATE TABLE IF NOT EXISTS policy_versions (
+    policy_id INT NOT NULL,
+    version INT NOT NULL,
+    document JSON NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (policy_id, version),
+    FOREIGN KEY (policy_id) REFERENCES policies(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Policy Attachments table. target_id is a role ID, user ID or access key ID
+-- depending on target_type.
+CREATE TABLE IF NOT EXISTS policy_attachments (
+    policy_id INT NOT NULL,
+    target_type ENUM('role','user','access_key') NOT NULL,
+    target_id VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (policy_id, target_type, target_id),
+    INDEX idx_target (target_type, target_id),
+    FOREIGN KEY (policy_id) REFERENCES policies(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Request Nonces table (replay protection, see MySQLNonceStore)
+CREATE TABLE IF NOT EXISTS request_nonces (
+    nonce VARCHAR(160) PRIMARY KEY,
+    expires_at DATETIME NOT NULL,
+    INDEX idx_expires_at (expires_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Temporary credentials issued by AssumeRole
+CREATE TABLE IF NOT EXISTS sts_credentials (
+    access_key_id VARCHAR(64) PRIMARY KEY,
+    secret_key VARCHAR(256) NOT NULL,
+    session_token_hash CHAR(64) NOT NULL,
+    source_access_key VARCHAR(64) NOT NULL,
+    user_id BIGINT NOT NULL,
+    role_id INT NOT NULL,
+    policy JSON DEFAULT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at DATETIME NOT NULL,
+    INDEX idx_expires_at (expires_at),
+    FOREIGN KEY (role_id) REFERENCES roles(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Audit log written by MySQLAuditSink
+CREATE TABLE IF NOT EXISTS audit_log (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    created_at DATETIME(3) NOT NULL,
+    access_key_id VARCHAR(64) NOT NULL DEFAULT '',
+    user_id BIGINT NOT NULL DEFAULT 0,
+    method VARCHAR(16) NOT NULL,
+    path VARCHAR(2048) NOT NULL,
+    source_ip VARCHAR(45) NOT NULL DEFAULT '',
+    decision VARCHAR(16) NOT NULL,
+    status INT NOT NULL,
+    reason VARCHAR(255) NOT NULL DEFAULT '',
+    matched_statement JSON DEFAULT NULL,
+    latency_us BIGINT NOT NULL DEFAULT 0,
+    INDEX idx_key_created (access_key_id, created_at),
+    INDEX idx_user_created (user_id, created_at),
+    INDEX idx_created_at (created_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Quota counters shared by MySQLQuotaCounter
+CREATE TABLE IF NOT EXISTS rate_limit_counters (
+    counter_key VARCHAR(128) PRIMARY KEY,
+    count BIGINT NOT NULL,
+    expires_at DATETIME NOT NULL,
+    INDEX idx_expires_at (expires_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
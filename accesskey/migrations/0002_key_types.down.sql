@@ -0,0 +1,9 @@
+-- Ed25519 keys have no secret and would become HMAC keys with an empty
+-- secret, so they are deleted first
+DELETE FROM policy_attachments
+    WHERE target_type = 'access_key'
+    AND target_id IN (SELECT access_key FROM access_keys WHERE key_type = 'ed25519');
+DELETE FROM access_keys WHERE key_type = 'ed25519';
+ALTER TABLE access_keys
+    DROP COLUMN public_key,
+    DROP COLUMN key_type;
@@ -0,0 +1,5 @@
+-- Ed25519 access keys: the server stores the public key, secret_key is
+-- empty. Existing keys are HMAC keys.
+ALTER TABLE access_keys
+    ADD COLUMN key_type ENUM('hmac','ed25519') NOT NULL DEFAULT 'hmac' AFTER id,
+    ADD COLUMN public_key VARCHAR(64) DEFAULT NULL AFTER secret_key;
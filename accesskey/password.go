@@ -0,0 +1,85 @@
+package accesskey
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Password hashing parameters. Hashes record their iteration count, so it can
+// be raised without invalidating existing passwords.
+const (
+	passwordHashScheme     = "pbkdf2-sha256"
+	passwordHashIterations = 210000
+	passwordSaltSize       = 16
+	passwordKeySize        = 32
+)
+
+// MinPasswordLength is the shortest password accepted for users
+const MinPasswordLength = 8
+
+// ErrMalformedPasswordHash is returned when a stored password hash cannot be parsed
+var ErrMalformedPasswordHash = errors.New("malformed password hash")
+
+// maxPasswordHashIterations bounds the iteration count read from stored
+// hashes, so that a corrupted row cannot make every login for a user burn CPU
+const maxPasswordHashIterations = 10 * passwordHashIterations
+
+// HashPassword hashes a password with PBKDF2-HMAC-SHA256 and a random salt.
+// The result has the form pbkdf2-sha256$<iterations>$<salt>$<hash>.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, passwordSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2.Key([]byte(password), salt, passwordHashIterations, passwordKeySize, sha256.New)
+	return formatPasswordHash(passwordHashIterations, salt, key), nil
+}
+
+func formatPasswordHash(iterations int, salt, key []byte) string {
+	return fmt.Sprintf("%s$%d$%s$%s",
+		passwordHashScheme,
+		iterations,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	)
+}
+
+// CheckPassword reports whether password matches a hash created by HashPassword
+func CheckPassword(hash, password string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != passwordHashScheme {
+		return false, ErrMalformedPasswordHash
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 || iterations > maxPasswordHashIterations {
+		return false, ErrMalformedPasswordHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil || len(salt) == 0 {
+		return false, ErrMalformedPasswordHash
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(want) != passwordKeySize {
+		return false, ErrMalformedPasswordHash
+	}
+
+	got := pbkdf2.Key([]byte(password), salt, iterations, passwordKeySize, sha256.New)
+	return subtle.ConstantTimeCompare(got, want) == 1, nil
+}
+
+// dummyPasswordHash is checked for unknown usernames, so that they take as
+// long as wrong passwords
+var dummyPasswordHash = sync.OnceValue(func() string {
+	salt := make([]byte, passwordSaltSize)
+	key := pbkdf2.Key(nil, salt, passwordHashIterations, passwordKeySize, sha256.New)
+	return formatPasswordHash(passwordHashIterations, salt, key)
+})
@@ -0,0 +1,85 @@
+package accesskey
+
+import (
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"testing"
+)
+
+// PBKDF2-HMAC-SHA256 vectors from RFC 7914 section 11. CheckPassword uses
+// 32 byte keys, which are the first half of the 64 byte vectors.
+func TestCheckPasswordVectors(t *testing.T) {
+	tests := []struct {
+		password, salt string
+		iterations     int
+		key            string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56"},
+	}
+	for _, tt := range tests {
+		key, _ := hex.DecodeString(tt.key)
+		hash := formatPasswordHash(tt.iterations, []byte(tt.salt), key)
+
+		ok, err := CheckPassword(hash, tt.password)
+		if err != nil || !ok {
+			t.Errorf("CheckPassword(%q) = %v, %v, want true", tt.password, ok, err)
+		}
+		ok, err = CheckPassword(hash, tt.password+"x")
+		if err != nil || ok {
+			t.Errorf("CheckPassword(%q) with wrong password = %v, %v, want false", tt.password, ok, err)
+		}
+	}
+}
+
+func TestHashPasswordRoundTrip(t *testing.T) {
+	hash, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := CheckPassword(hash, "correct horse"); err != nil || !ok {
+		t.Fatalf("CheckPassword = %v, %v, want true", ok, err)
+	}
+	if ok, _ := CheckPassword(hash, "battery staple"); ok {
+		t.Fatal("CheckPassword accepted a wrong password")
+	}
+}
+
+func TestCheckPasswordRejectsMalformedHashes(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	key := make([]byte, passwordKeySize)
+	tests := map[string]string{
+		"scheme":              "bcrypt$10$c2FsdA$a2V5",
+		"fields":              "pbkdf2-sha256$1$c2FsdA",
+		"iterations":          "pbkdf2-sha256$x$c2FsdA$a2V5",
+		"zero iterations":     formatPasswordHash(0, salt, key),
+		"too many iterations": formatPasswordHash(maxPasswordHashIterations+1, salt, key),
+		"huge iterations":     "pbkdf2-sha256$" + strconv.Itoa(2000000000) + "$c2FsdA$a2V5",
+		"empty salt":          formatPasswordHash(1, nil, key),
+		"short key":           formatPasswordHash(1, salt, key[:16]),
+		"long key":            formatPasswordHash(1, salt, append(key, 0)),
+	}
+	for name, hash := range tests {
+		if _, err := CheckPassword(hash, "password"); !errors.Is(err, ErrMalformedPasswordHash) {
+			t.Errorf("%s: CheckPassword error = %v, want ErrMalformedPasswordHash", name, err)
+		}
+	}
+}
+
+func TestVerifyUserPassword(t *testing.T) {
+	s := NewService(NewMemoryStore())
+	if _, err := s.CreateUser("alice", "password123", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.VerifyUserPassword("alice", "password123"); err != nil {
+		t.Errorf("correct password: %v", err)
+	}
+	if _, err := s.VerifyUserPassword("alice", "password124"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("wrong password: %v, want ErrInvalidCredentials", err)
+	}
+	if _, err := s.VerifyUserPassword("bob", "password123"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("unknown user: %v, want ErrInvalidCredentials", err)
+	}
+}
@@ -0,0 +1,241 @@
+package accesskey
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Resource patterns are matched segment by segment against the request path,
+// a leading "/" is ignored on both sides:
+//
+//	*         any characters within one segment
+//	**        a whole segment matching zero or more segments
+//	/*        at the end, the same as /**: the prefix and everything below it
+//	?         one character within a segment
+//	{name}    one non-empty segment; repeated names must match the same value
+//	${var}    one segment equal to a variable of the calling key:
+//	          ${key.id}, ${key.user_id} or ${key.tag.<name>}
+//
+// For example "api/v1/users/${key.user_id}/**" allows a key to access
+// everything below its own user.
+
+// maxCachedPatterns bounds the number of compiled patterns kept in memory
+const maxCachedPatterns = 4096
+
+var validPatternName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// pathPattern is a compiled resource pattern
+type pathPattern struct {
+	re *regexp.Regexp
+	// groups describes the capture groups of re in order
+	groups []patternGroup
+}
+
+type patternGroup struct {
+	name     string
+	variable bool
+}
+
+type cachedPattern struct {
+	pattern *pathPattern
+	err     error
+}
+
+var patternCache = struct {
+	sync.RWMutex
+	m map[string]cachedPattern
+}{m: make(map[string]cachedPattern)}
+
+// compiledPattern returns the compiled pattern from the cache, compiling it on first use
+func compiledPattern(pattern string) (*pathPattern, error) {
+	patternCache.RLock()
+	c, ok := patternCache.m[pattern]
+	patternCache.RUnlock()
+	if ok {
+		return c.pattern, c.err
+	}
+
+	p, err := compilePathPattern(pattern)
+
+	patternCache.Lock()
+	if len(patternCache.m) >= maxCachedPatterns {
+		patternCache.m = make(map[string]cachedPattern)
+	}
+	patternCache.m[pattern] = cachedPattern{pattern: p, err: err}
+	patternCache.Unlock()
+	return p, err
+}
+
+// compilePathPattern translates a resource pattern into a regular expression
+func compilePathPattern(pattern string) (*pathPattern, error) {
+	p := &pathPattern{}
+	segments := strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+
+	var b strings.Builder
+	b.WriteString("^")
+	skipSep := false
+	for i, seg := range segments {
+		last := i == len(segments)-1
+		// A trailing "/*" keeps its prefix meaning, so that existing
+		// statements on e.g. "files/*" still cover "files/a/b"
+		if seg == "**" || (seg == "*" && last && i > 0) {
+			switch {
+			case i == 0 && last:
+				b.WriteString(".*")
+			case i == 0:
+				// Any leading segments, each followed by a separator
+				b.WriteString("(?:.*/)?")
+				skipSep = true
+			default:
+				// Any further segments, including none
+				b.WriteString("(?:/.*)?")
+			}
+			continue
+		}
+
+		if i > 0 && !skipSep {
+			b.WriteString("/")
+		}
+		skipSep = false
+		if err := p.compileSegment(&b, seg); err != nil {
+			return nil, fmt.Errorf("invalid resource pattern %q: %w", pattern, err)
+		}
+	}
+	b.WriteString("$")
+
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid resource pattern %q: %w", pattern, err)
+	}
+	p.re = re
+	return p, nil
+}
+
+func (p *pathPattern) compileSegment(b *strings.Builder, seg string) error {
+	for len(seg) > 0 {
+		i := strings.IndexAny(seg, "*?{}$")
+		if i < 0 {
+			b.WriteString(regexp.QuoteMeta(seg))
+			return nil
+		}
+		b.WriteString(regexp.QuoteMeta(seg[:i]))
+		seg = seg[i:]
+
+		switch {
+		case seg[0] == '*':
+			b.WriteString("[^/]*")
+			seg = seg[1:]
+		case seg[0] == '?':
+			b.WriteString("[^/]")
+			seg = seg[1:]
+		case strings.HasPrefix(seg, "${"), seg[0] == '{':
+			variable := seg[0] == '$'
+			if variable {
+				seg = seg[1:]
+			}
+			end := strings.IndexByte(seg, '}')
+			if end < 0 {
+				return fmt.Errorf("unclosed %q", seg)
+			}
+			name := seg[1:end]
+			seg = seg[end+1:]
+			if variable {
+				if !validPatternVariable(name) {
+					return fmt.Errorf("unknown variable ${%s}", name)
+				}
+			} else if !validPatternName.MatchString(name) {
+				return fmt.Errorf("invalid segment name {%s}", name)
+			}
+			b.WriteString("([^/]+)")
+			p.groups = append(p.groups, patternGroup{name: name, variable: variable})
+		case seg[0] == '$':
+			b.WriteString(regexp.QuoteMeta("$"))
+			seg = seg[1:]
+		default:
+			return fmt.Errorf("unexpected %q", seg[:1])
+		}
+	}
+	return nil
+}
+
+func validPatternVariable(name string) bool {
+	switch name {
+	case "key.id", "key.user_id":
+		return true
+	}
+	tag, ok := strings.CutPrefix(name, "key.tag.")
+	return ok && tag != ""
+}
+
+// match reports whether path matches the pattern. lookup resolves ${var}
+// variables; a pattern with variables never matches if lookup is nil.
+func (p *pathPattern) match(path string, lookup func(name string) (string, bool)) bool {
+	m := p.re.FindStringSubmatch(strings.TrimPrefix(path, "/"))
+	if m == nil {
+		return false
+	}
+
+	var named map[string]string
+	for i, g := range p.groups {
+		value := m[i+1]
+		if g.variable {
+			if lookup == nil {
+				return false
+			}
+			want, ok := lookup(g.name)
+			if !ok || want != value {
+				return false
+			}
+			continue
+		}
+		if named == nil {
+			named = make(map[string]string)
+		}
+		if prev, ok := named[g.name]; ok && prev != value {
+			return false
+		}
+		named[g.name] = value
+	}
+	return true
+}
+
+// matchPathPattern checks if a request path matches a pattern with wildcards.
+// Patterns using ${var} variables never match here.
+func matchPathPattern(pattern, path string) bool {
+	p, err := compiledPattern(pattern)
+	if err != nil {
+		return false
+	}
+	return p.match(path, nil)
+}
+
+// matchResource checks if a request path matches a resource pattern, with
+// variables resolved from the calling key in rc
+func matchResource(pattern, path string, rc *RequestContext) bool {
+	p, err := compiledPattern(pattern)
+	if err != nil {
+		return false
+	}
+	return p.match(path, rc.patternVariable)
+}
+
+// patternVariable resolves a ${var} of a resource pattern
+func (rc *RequestContext) patternVariable(name string) (string, bool) {
+	if rc.AccessKeyID == "" {
+		return "", false
+	}
+	switch name {
+	case "key.id":
+		return rc.AccessKeyID, true
+	case "key.user_id":
+		return strconv.FormatInt(rc.UserID, 10), true
+	}
+	if tag, ok := strings.CutPrefix(name, "key.tag."); ok {
+		v, ok := rc.Tags[tag]
+		return v, ok && v != ""
+	}
+	return "", false
+}
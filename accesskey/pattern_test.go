@@ -0,0 +1,147 @@
+package accesskey
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestMatchResource(t *testing.T) {
+	rc := &RequestContext{
+		AccessKeyID: "AK1",
+		UserID:      42,
+		Tags:        map[string]string{"team": "red"},
+	}
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		// Literal paths, with or without a leading slash
+		{"api/v1/users", "/api/v1/users", true},
+		{"/api/v1/users", "api/v1/users", true},
+		{"api/v1/users", "/api/v1/users/1", false},
+
+		// * stays within one segment
+		{"api/v1/*/orders", "/api/v1/users/orders", true},
+		{"api/v1/*/orders", "/api/v1/users/1/orders", false},
+		{"files/*.pdf", "/files/report.pdf", true},
+		{"files/*.pdf", "/files/a/report.pdf", false},
+
+		// A trailing /* is a prefix match on segment boundaries
+		{"api/v1/users/*", "/api/v1/users/1", true},
+		{"api/v1/users/*", "/api/v1/users/", true},
+		{"api/v1/users/*", "/api/v1/users/1/orders", true},
+		{"api/v1/users/*", "/api/v1/users", true},
+		{"api/v1/users/*", "/api/v1/usersettings", false},
+		{"*", "/api", true},
+		{"*", "/api/v1", false},
+
+		// Trailing ** matches the prefix and everything below it
+		{"api/v1/users/**", "/api/v1/users", true},
+		{"api/v1/users/**", "/api/v1/users/1", true},
+		{"api/v1/users/**", "/api/v1/users/1/orders", true},
+		{"api/v1/users/**", "/api/v1/usersettings", false},
+
+		// Leading ** matches any leading segments
+		{"**/orders", "/orders", true},
+		{"**/orders", "/api/v1/users/1/orders", true},
+		{"**/orders", "/api/v1/preorders", false},
+
+		// ** in the middle matches zero or more segments
+		{"api/**/orders", "/api/orders", true},
+		{"api/**/orders", "/api/v1/users/1/orders", true},
+		{"api/**/orders", "/api/v1/orders/1", false},
+		{"api/**/orders", "/apiv1/orders", false},
+
+		// ** alone matches everything
+		{"**", "/", true},
+		{"**", "/api/v1/users/1", true},
+
+		// ? matches one character within a segment
+		{"api/v?/users", "/api/v1/users", true},
+		{"api/v?/users", "/api/v12/users", false},
+		{"api/v?/users", "/api/v/users", false},
+		{"api/v?", "/api/v/", false},
+
+		// {name} matches one non-empty segment, repeated names must agree
+		{"users/{id}/orders", "/users/7/orders", true},
+		{"users/{id}/orders", "/users//orders", false},
+		{"users/{id}/orders", "/users/7/8/orders", false},
+		{"users/{id}/friends/{id}", "/users/7/friends/7", true},
+		{"users/{id}/friends/{id}", "/users/7/friends/8", false},
+
+		// ${var} must equal a variable of the calling key
+		{"users/${key.user_id}/**", "/users/42", true},
+		{"users/${key.user_id}/**", "/users/42/orders/1", true},
+		{"users/${key.user_id}/**", "/users/43/orders/1", false},
+		{"keys/${key.id}", "/keys/AK1", true},
+		{"keys/${key.id}", "/keys/AK2", false},
+		{"teams/${key.tag.team}/*", "/teams/red/x", true},
+		{"teams/${key.tag.team}/*", "/teams/blue/x", false},
+		{"teams/${key.tag.unset}/*", "/teams//x", false},
+
+		// Other characters are literal
+		{"a.b/c+d", "/a.b/c+d", true},
+		{"a.b/c+d", "/aXb/c+d", false},
+		{"price/$5", "/price/$5", true},
+	}
+	for _, tt := range tests {
+		if got := matchResource(tt.pattern, tt.path, rc); got != tt.want {
+			t.Errorf("matchResource(%q, %q) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+// Variables are only resolved for requests of an access key
+func TestMatchPathPatternWithoutVariables(t *testing.T) {
+	if matchPathPattern("users/${key.user_id}", "/users/0") {
+		t.Error("pattern with a variable matched without a calling key")
+	}
+	if !matchPathPattern("public/**", "/public/css/site.css") {
+		t.Error("public/** did not match")
+	}
+}
+
+func TestInvalidPatterns(t *testing.T) {
+	for _, pattern := range []string{
+		"users/{id",
+		"users/{1id}",
+		"users/${key.secret}",
+		"users/${key.tag.}",
+		"users/}",
+	} {
+		if _, err := compilePathPattern(pattern); err == nil {
+			t.Errorf("compilePathPattern(%q) succeeded, want an error", pattern)
+		}
+		if _, err := ParsePermissions(`{"resources":["` + pattern + `"],"actions":["GET"],"effect":"allow"}`); err == nil {
+			t.Errorf("ParsePermissions accepted resource %q", pattern)
+		}
+	}
+}
+
+// Statements written for the prefix meaning of a trailing /* keep it, so
+// that a deny on "files/*" still blocks paths several segments below
+func TestTrailingWildcardDenyCoversSubpaths(t *testing.T) {
+	s, user := newTestService(t)
+	id, _ := newTestKey(t, s, user, `[
+		{"resources":["**"],"actions":["*"],"effect":"allow"},
+		{"resources":["files/*"],"actions":["*"],"effect":"deny"}
+	]`)
+
+	for path, want := range map[string]bool{
+		"/files/a":      false,
+		"/files/a/b":    false,
+		"/files/a/b/c":  false,
+		"/files":        false,
+		"/filesX":       true,
+		"/other/file/a": true,
+	} {
+		ok, err := s.Authorize(id, http.MethodGet, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != want {
+			t.Errorf("Authorize(%q) = %v, want %v", path, ok, want)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package accesskey
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Targets managed policies can be attached to
+const (
+	PolicyTargetRole      = "role"
+	PolicyTargetUser      = "user"
+	PolicyTargetAccessKey = "access_key"
+)
+
+// CreatePolicy creates a managed policy with the document as version 1
+func (s *Service) CreatePolicy(name, description, document string) (*Policy, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, errors.New("policy name is required")
+	}
+	perms, err := ParsePermissions(document)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy document: %w", err)
+	}
+
+	policy := &Policy{Name: name, Description: description, Document: perms}
+	if err := s.store.CreatePolicy(policy); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// GetPolicy returns a managed policy with the document of its default version
+func (s *Service) GetPolicy(policyID int) (*Policy, error) {
+	return s.store.GetPolicy(policyID)
+}
+
+// ListPolicies returns all managed policies
+func (s *Service) ListPolicies() ([]*Policy, error) {
+	return s.store.ListPolicies()
+}
+
+// CreatePolicyVersion adds a version to a managed policy. With setDefault
+// the new document applies right away wherever the policy is attached.
+func (s *Service) CreatePolicyVersion(policyID int, document string, setDefault bool) (*PolicyVersion, error) {
+	perms, err := ParsePermissions(document)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy document: %w", err)
+	}
+	return s.store.CreatePolicyVersion(policyID, perms, setDefault)
+}
+
+// GetPolicyVersion returns a version of a managed policy
+func (s *Service) GetPolicyVersion(policyID, version int) (*PolicyVersion, error) {
+	return s.store.GetPolicyVersion(policyID, version)
+}
+
+// ListPolicyVersions returns all versions of a managed policy, oldest first
+func (s *Service) ListPolicyVersions(policyID int) ([]PolicyVersion, error) {
+	if _, err := s.store.GetPolicy(policyID); err != nil {
+		return nil, err
+	}
+	return s.store.ListPolicyVersions(policyID)
+}
+
+// SetDefaultPolicyVersion makes an existing version the default version of a
+// managed policy
+func (s *Service) SetDefaultPolicyVersion(policyID, version int) error {
+	if _, err := s.store.GetPolicyVersion(policyID, version); err != nil {
+		return err
+	}
+	return s.store.SetDefaultPolicyVersion(policyID, version)
+}
+
+// RollbackPolicy makes the newest version before the default version the
+// default version of a managed policy. The rolled back version is kept.
+func (s *Service) RollbackPolicy(policyID int) (*Policy, error) {
+	policy, err := s.store.GetPolicy(policyID)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := s.store.ListPolicyVersions(policyID)
+	if err != nil {
+		return nil, err
+	}
+
+	previous := 0
+	for _, v := range versions {
+		if v.Version < policy.DefaultVersion && v.Version > previous {
+			previous = v.Version
+		}
+	}
+	if previous == 0 {
+		return nil, fmt.Errorf("policy %d has no version before %d", policyID, policy.DefaultVersion)
+	}
+
+	if err := s.store.SetDefaultPolicyVersion(policyID, previous); err != nil {
+		return nil, err
+	}
+	return s.store.GetPolicy(policyID)
+}
+
+// AttachPolicyToRole attaches a managed policy to a role
+func (s *Service) AttachPolicyToRole(policyID, roleID int) error {
+	if _, err := s.store.GetRole(roleID); err != nil {
+		return err
+	}
+	return s.attachPolicy(policyID, PolicyTargetRole, strconv.Itoa(roleID))
+}
+
+// DetachPolicyFromRole detaches a managed policy from a role
+func (s *Service) DetachPolicyFromRole(policyID, roleID int) error {
+	return s.store.DetachPolicy(policyID, PolicyTargetRole, strconv.Itoa(roleID))
+}
+
+// AttachPolicyToUser attaches a managed policy to a user, giving its
+// permissions to all access keys of the user
+func (s *Service) AttachPolicyToUser(policyID int, userID int64) error {
+	if _, err := s.store.GetUser(userID); err != nil {
+		return err
+	}
+	return s.attachPolicy(policyID, PolicyTargetUser, strconv.FormatInt(userID, 10))
+}
+
+// DetachPolicyFromUser detaches a managed policy from a user
+func (s *Service) DetachPolicyFromUser(policyID int, userID int64) error {
+	return s.store.DetachPolicy(policyID, PolicyTargetUser, strconv.FormatInt(userID, 10))
+}
+
+// AttachPolicyToAccessKey attaches a managed policy to an access key
+func (s *Service) AttachPolicyToAccessKey(policyID int, accessKeyID string) error {
+	if _, err := s.store.GetAccessKey(accessKeyID); err != nil {
+		return err
+	}
+	return s.attachPolicy(policyID, PolicyTargetAccessKey, accessKeyID)
+}
+
+// DetachPolicyFromAccessKey detaches a managed policy from an access key
+func (s *Service) DetachPolicyFromAccessKey(policyID int, accessKeyID string) error {
+	return s.store.DetachPolicy(policyID, PolicyTargetAccessKey, accessKeyID)
+}
+
+// ListAttachedPolicies returns the managed policies attached to a role, user
+// or access key. targetID is the role ID, user ID or access key ID.
+func (s *Service) ListAttachedPolicies(targetType, targetID string) ([]*Policy, error) {
+	switch targetType {
+	case PolicyTargetRole, PolicyTargetUser, PolicyTargetAccessKey:
+	default:
+		return nil, fmt.Errorf("unknown policy target type %q", targetType)
+	}
+	return s.store.ListAttachedPolicies(targetType, targetID)
+}
+
+func (s *Service) attachPolicy(policyID int, targetType, targetID string) error {
+	if _, err := s.store.GetPolicy(policyID); err != nil {
+		return err
+	}
+	return s.store.AttachPolicy(policyID, targetType, targetID)
+}
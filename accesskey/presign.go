@@ -0,0 +1,193 @@
+package accesskey
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxPresignTTL is the longest lifetime of a presigned URL
+const MaxPresignTTL = 7 * 24 * time.Hour
+
+// Query parameters of presigned URLs. They have the names of the
+// corresponding headers; X-Expires is the lifetime in seconds from X-Timestamp.
+const (
+	presignExpiresParam   = "X-Expires"
+	presignSignatureParam = "X-Signature"
+)
+
+// presignParams are the query parameters set by Presign, removed from the
+// URL before it is signed
+var presignParams = []string{
+	"X-Access-Key-ID",
+	"X-Timestamp",
+	"X-Nonce",
+	presignExpiresParam,
+	"X-Signature-Version",
+	"X-Signature-Algorithm",
+	"X-Signed-Headers",
+	presignSignatureParam,
+}
+
+// ErrPresignedURLExpired is returned when a presigned URL is used after its expiry
+var ErrPresignedURLExpired = errors.New("presigned URL has expired")
+
+// Presign returns rawURL with a signature in its query parameters, valid for
+// ttl (at most MaxPresignTTL), so that e.g. browsers can download from a
+// protected endpoint without a secret. The URL signs the method, path, query
+// and host; requests with a body cannot be presigned. For temporary
+// credentials, add X-Security-Token to the query of rawURL before signing.
+// Presigned URLs can be used any number of times until they expire.
+func Presign(method, rawURL, keyID, secret string, ttl time.Duration) (string, error) {
+	return presign(method, rawURL, keyID, secret, ttl, time.Now())
+}
+
+func presign(method, rawURL, keyID, secret string, ttl time.Duration, now time.Time) (string, error) {
+	if ttl < time.Second || ttl > MaxPresignTTL {
+		return "", fmt.Errorf("presign ttl must be between 1s and %s", MaxPresignTTL)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Host == "" {
+		return "", errors.New("presign URL must be absolute")
+	}
+	nonce, err := GenerateNonce()
+	if err != nil {
+		return "", err
+	}
+
+	query := u.Query()
+	for _, name := range presignParams {
+		query.Del(name)
+	}
+	query.Set("X-Access-Key-ID", keyID)
+	query.Set("X-Timestamp", strconv.FormatInt(now.Unix(), 10))
+	query.Set("X-Nonce", nonce)
+	query.Set(presignExpiresParam, strconv.FormatInt(int64(ttl/time.Second), 10))
+	query.Set("X-Signature-Version", SignatureVersion2)
+	query.Set("X-Signed-Headers", "host")
+	if isEd25519Secret(secret) {
+		query.Set("X-Signature-Algorithm", SignatureAlgorithmEd25519)
+	}
+
+	stringToSign := GenerateStringToSign(SignatureParams{
+		AccessKeyID:   keyID,
+		Method:        method,
+		Path:          u.Path,
+		Timestamp:     query.Get("X-Timestamp"),
+		Nonce:         nonce,
+		Version:       SignatureVersion2,
+		Host:          u.Host,
+		Query:         query,
+		SignedHeaders: []string{"host"},
+	})
+
+	var signature string
+	if isEd25519Secret(secret) {
+		if signature, err = signEd25519(secret, stringToSign); err != nil {
+			return "", err
+		}
+	} else {
+		signature = GenerateSignature(secret, stringToSign)
+	}
+
+	query.Set(presignSignatureParam, signature)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// isPresigned reports whether a request carries its signature in the query
+// instead of the headers
+func isPresigned(req *http.Request) bool {
+	return req.Header.Get("X-Signature") == "" && req.URL.Query().Get(presignSignatureParam) != ""
+}
+
+// requestAccessKeyID returns the access key ID of a header or query signed request
+func requestAccessKeyID(req *http.Request) string {
+	if isPresigned(req) {
+		return req.URL.Query().Get("X-Access-Key-ID")
+	}
+	return req.Header.Get("X-Access-Key-ID")
+}
+
+// verifyPresignedRequest verifies the query signature of a presigned URL.
+// The canonical query string covers all parameters except X-Signature. Nonces
+// are not checked, a presigned URL may be used until it expires.
+func (s *Service) verifyPresignedRequest(req *http.Request, content []byte) (bool, error) {
+	query := req.URL.Query()
+
+	accessKeyID := query.Get("X-Access-Key-ID")
+	if accessKeyID == "" {
+		return false, fmt.Errorf("missing X-Access-Key-ID parameter")
+	}
+	if version := query.Get("X-Signature-Version"); version != SignatureVersion2 {
+		return false, fmt.Errorf("unsupported presign signature version %q", version)
+	}
+
+	ts, err := strconv.ParseInt(query.Get("X-Timestamp"), 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("invalid X-Timestamp parameter: %w", err)
+	}
+	expires, err := strconv.ParseInt(query.Get(presignExpiresParam), 10, 64)
+	if err != nil || expires <= 0 || time.Duration(expires)*time.Second > MaxPresignTTL {
+		return false, fmt.Errorf("invalid %s parameter", presignExpiresParam)
+	}
+	now := time.Now()
+	signedAt := time.Unix(ts, 0)
+	// Allow the same clock skew as for signed headers
+	if signedAt.After(now.Add(s.replayWindow)) {
+		return false, ErrRequestExpired
+	}
+	if !now.Before(signedAt.Add(time.Duration(expires) * time.Second)) {
+		return false, ErrPresignedURLExpired
+	}
+
+	algorithm, err := parseSignatureAlgorithm(query.Get("X-Signature-Algorithm"))
+	if err != nil {
+		return false, err
+	}
+
+	if IsTemporaryAccessKeyID(accessKeyID) {
+		if err := s.checkSessionToken(accessKeyID, query.Get("X-Security-Token")); err != nil {
+			return false, err
+		}
+	}
+
+	signedHeaders, err := parseSignedHeaders(query.Get("X-Signed-Headers"))
+	if err != nil {
+		return false, err
+	}
+	headers := make(map[string]string)
+	for k, v := range req.Header {
+		if len(v) > 0 {
+			headers[k] = strings.Join(v, ",")
+		}
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	signature := query.Get(presignSignatureParam)
+	query.Del(presignSignatureParam)
+
+	stringToSign := GenerateStringToSign(SignatureParams{
+		AccessKeyID:   accessKeyID,
+		Method:        req.Method,
+		Path:          req.URL.Path,
+		Headers:       headers,
+		Timestamp:     query.Get("X-Timestamp"),
+		Nonce:         query.Get("X-Nonce"),
+		Content:       content,
+		Version:       SignatureVersion2,
+		Host:          host,
+		Query:         query,
+		SignedHeaders: signedHeaders,
+	})
+	return s.verifySignature(accessKeyID, algorithm, stringToSign, signature)
+}
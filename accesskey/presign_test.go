@@ -0,0 +1,150 @@
+package accesskey
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPresignedURLThroughMiddleware(t *testing.T) {
+	s, user := newTestService(t)
+	id, secret := newTestKey(t, s, user, allowAll)
+	handler := s.Middleware(&bodyRecorder{})
+
+	signed, err := Presign(http.MethodGet, "http://example.com/files/report.pdf?download=1", id, secret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := func(method, rawURL string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, rawURL, nil))
+		return w.Code
+	}
+
+	// Presigned URLs can be used more than once
+	for i := 0; i < 2; i++ {
+		if code := serve(http.MethodGet, signed); code != http.StatusOK {
+			t.Fatalf("use %d of the presigned URL: status %d", i+1, code)
+		}
+	}
+
+	tampered := map[string]string{
+		"path":           strings.Replace(signed, "/files/report.pdf", "/files/other.pdf", 1),
+		"query value":    strings.Replace(signed, "download=1", "download=2", 1),
+		"added query":    signed + "&extra=1",
+		"removed query":  strings.Replace(signed, "&download=1", "", 1),
+		"host":           strings.Replace(signed, "example.com", "evil.example.com", 1),
+		"longer expiry":  strings.Replace(signed, "X-Expires=3600", "X-Expires=7200", 1),
+		"other key":      strings.Replace(signed, "X-Access-Key-ID="+id, "X-Access-Key-ID=AKother", 1),
+		"signature only": strings.Replace(signed, "X-Signature=", "X-Signature=0", 1),
+	}
+	for name, rawURL := range tampered {
+		if rawURL == signed {
+			t.Fatalf("%s: URL was not modified", name)
+		}
+		if code := serve(http.MethodGet, rawURL); code != http.StatusUnauthorized {
+			t.Errorf("%s: status %d, want %d", name, code, http.StatusUnauthorized)
+		}
+	}
+	if code := serve(http.MethodDelete, signed); code != http.StatusUnauthorized {
+		t.Errorf("other method: status %d, want %d", code, http.StatusUnauthorized)
+	}
+}
+
+func TestPresignedURLExpiry(t *testing.T) {
+	s, user := newTestService(t, WithReplayWindow(time.Minute))
+	id, secret := newTestKey(t, s, user, allowAll)
+
+	verify := func(signedAt time.Time, ttl time.Duration) (bool, error) {
+		t.Helper()
+		signed, err := presign(http.MethodGet, "http://example.com/files/a", id, secret, ttl, signedAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.VerifyRequestSignature(httptest.NewRequest(http.MethodGet, signed, nil), nil)
+	}
+
+	// The lifetime is not limited by the replay window
+	if ok, err := verify(time.Now().Add(-time.Hour), 2*time.Hour); !ok || err != nil {
+		t.Errorf("URL within its lifetime: %v, %v", ok, err)
+	}
+	if ok, err := verify(time.Now().Add(-2*time.Hour), time.Hour); ok || !errors.Is(err, ErrPresignedURLExpired) {
+		t.Errorf("expired URL: %v, %v, want ErrPresignedURLExpired", ok, err)
+	}
+	// Timestamps in the future are accepted within the clock skew only
+	if ok, err := verify(time.Now().Add(30*time.Second), time.Hour); !ok || err != nil {
+		t.Errorf("URL signed by a clock slightly ahead: %v, %v", ok, err)
+	}
+	if ok, err := verify(time.Now().Add(time.Hour), time.Hour); ok || !errors.Is(err, ErrRequestExpired) {
+		t.Errorf("URL signed in the future: %v, %v, want ErrRequestExpired", ok, err)
+	}
+}
+
+func TestPresignedURLInvalidExpiresParameter(t *testing.T) {
+	s, user := newTestService(t)
+	id, secret := newTestKey(t, s, user, allowAll)
+	signed, err := Presign(http.MethodGet, "http://example.com/files/a", id, secret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expires := range []string{"", "0", "-1", "soon", "604801"} {
+		u, _ := url.Parse(signed)
+		query := u.Query()
+		query.Set(presignExpiresParam, expires)
+		u.RawQuery = query.Encode()
+		if ok, err := s.VerifyRequestSignature(httptest.NewRequest(http.MethodGet, u.String(), nil), nil); ok || err == nil {
+			t.Errorf("X-Expires=%q: VerifyRequestSignature = %v, %v, want an error", expires, ok, err)
+		}
+	}
+}
+
+func TestPresignTTLBounds(t *testing.T) {
+	tests := []struct {
+		ttl   time.Duration
+		valid bool
+	}{
+		{0, false},
+		{-time.Hour, false},
+		{500 * time.Millisecond, false},
+		{time.Second, true},
+		{MaxPresignTTL, true},
+		{MaxPresignTTL + time.Second, false},
+	}
+	for _, tt := range tests {
+		_, err := Presign(http.MethodGet, "http://example.com/files/a", "AK1", "secret", tt.ttl)
+		if (err == nil) != tt.valid {
+			t.Errorf("Presign with ttl %v: %v, want valid %v", tt.ttl, err, tt.valid)
+		}
+	}
+
+	if _, err := Presign(http.MethodGet, "/files/a", "AK1", "secret", time.Hour); err == nil {
+		t.Error("Presign accepted a relative URL")
+	}
+}
+
+// Presigning replaces signature parameters already in the URL
+func TestPresignReplacesSignatureParameters(t *testing.T) {
+	signed, err := Presign(http.MethodGet, "http://example.com/files/a?X-Expires=1&X-Signature=old&keep=1", "AK1", "secret", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if got := query[presignExpiresParam]; len(got) != 1 || got[0] != "3600" {
+		t.Errorf("X-Expires = %q, want [3600]", got)
+	}
+	if got := query[presignSignatureParam]; len(got) != 1 || got[0] == "old" {
+		t.Errorf("X-Signature = %q", got)
+	}
+	if got := query.Get("keep"); got != "1" {
+		t.Errorf("keep = %q, want 1", got)
+	}
+}
@@ -0,0 +1,156 @@
+package accesskey
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// Authentication methods of a Principal
+const (
+	// AuthMethodAccessKey is a request signed with a long-term access key
+	AuthMethodAccessKey = "access_key"
+	// AuthMethodTemporary is a request signed with AssumeRole credentials
+	AuthMethodTemporary = "temporary"
+	// AuthMethodPresigned is a request to a URL created by Presign
+	AuthMethodPresigned = "presigned"
+	// AuthMethodDev is a request signed by the middleware in dev mode
+	AuthMethodDev = "dev"
+)
+
+// ErrUnauthenticated is passed to the ErrorResponder by Require when the
+// request did not pass the signature middleware
+var ErrUnauthenticated = errors.New("request is not authenticated")
+
+// Principal is the caller of a request approved by the signature middleware
+type Principal struct {
+	AccessKeyID string `json:"access_key_id"`
+	UserID      int64  `json:"user_id"`
+	// ParentID is the main account of a RAM sub-account, 0 for main accounts
+	// and for users unknown to the store
+	ParentID int64 `json:"parent_id,omitempty"`
+	// Roles are the roles the permissions come from: roles of the key, of the
+	// user and of its groups, or the assumed role of temporary credentials
+	Roles []*Role `json:"roles"`
+	// Permissions are the effective permissions the request was authorized with
+	Permissions []*Permissions `json:"permissions"`
+	// SessionPolicy further restricts temporary credentials, if set
+	SessionPolicy []*Permissions    `json:"session_policy,omitempty"`
+	AuthMethod    string            `json:"auth_method"`
+	Tags          map[string]string `json:"tags,omitempty"`
+	// SourceIP is the client IP the request was authorized for
+	SourceIP net.IP `json:"source_ip,omitempty"`
+}
+
+type principalKey struct{}
+
+// PrincipalFrom returns the principal the signature middleware attached to
+// the request context, or nil if the request was not authenticated, e.g.
+// because its path is skipped
+func PrincipalFrom(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// ContextWithPrincipal returns a copy of ctx carrying the principal, e.g. to
+// call handlers using PrincipalFrom in tests
+func ContextWithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// HasRole reports whether the principal has the role with the given name
+func (p *Principal) HasRole(name string) bool {
+	for _, role := range p.Roles {
+		if role.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows reports whether the principal may perform action on resource.
+// Conditions are evaluated against the request r. Like the middleware, a
+// matching deny statement wins and temporary credentials must also be
+// allowed by their session policy.
+func (p *Principal) Allows(r *http.Request, action, resource string) bool {
+	rc := NewRequestContext(r)
+	rc.Action = action
+	rc.Path = resource
+	if p.SourceIP != nil {
+		rc.SourceIP = p.SourceIP
+	}
+	rc.AccessKeyID = p.AccessKeyID
+	rc.UserID = p.UserID
+	rc.Tags = p.Tags
+	if rc.Tags == nil {
+		rc.Tags = map[string]string{}
+	}
+
+	if !hasPermission(p.Permissions, rc) {
+		return false
+	}
+	return p.SessionPolicy == nil || hasPermission(p.SessionPolicy, rc)
+}
+
+// Require wraps a handler behind the signature middleware with a check that
+// the principal may perform action on resource. An empty resource is the
+// request path. Requests without a principal get 401, denied requests 403.
+// Of the middleware options only WithErrorResponder applies.
+func Require(action, resource string, opts ...MiddlewareOption) func(http.Handler) http.Handler {
+	c := newMiddlewareConfig(opts)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p := PrincipalFrom(r.Context())
+			if p == nil {
+				c.respondError(w, r, http.StatusUnauthorized, ErrUnauthenticated)
+				return
+			}
+			res := resource
+			if res == "" {
+				res = r.URL.Path
+			}
+			if !p.Allows(r, action, res) {
+				c.respondError(w, r, http.StatusForbidden, ErrInsufficientPermissions)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// newPrincipal describes the caller of a request authorized with permissions
+func (s *Service) newPrincipal(accessKeyID string, permissions []*Permissions, rc *RequestContext, authMethod string) (*Principal, error) {
+	p := &Principal{
+		AccessKeyID: accessKeyID,
+		UserID:      rc.UserID,
+		Permissions: permissions,
+		AuthMethod:  authMethod,
+		Tags:        rc.Tags,
+		SourceIP:    rc.SourceIP,
+	}
+
+	user, err := s.store.GetUser(rc.UserID)
+	switch {
+	case err == nil:
+		p.ParentID = user.ParentID
+	case !errors.Is(err, ErrUserNotFound):
+		return nil, err
+	}
+
+	sources, err := s.PermissionSources(accessKeyID)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[int]bool)
+	for _, src := range sources {
+		if src.Source == SourceSessionPolicy {
+			p.SessionPolicy = src.Permissions
+		}
+		if src.role != nil && !seen[src.role.ID] {
+			seen[src.role.ID] = true
+			p.Roles = append(p.Roles, src.role)
+		}
+	}
+	return p, nil
+}
@@ -0,0 +1,188 @@
+package accesskey
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// principalRecorder keeps the principal of the last request
+type principalRecorder struct {
+	principal *Principal
+}
+
+func (h *principalRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.principal = PrincipalFrom(r.Context())
+}
+
+func TestMiddlewareAttachesPrincipal(t *testing.T) {
+	s, alice := newTestService(t)
+	bob, err := s.CreateUser("bob", "password123", alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, secret := newTestKey(t, s, bob, allowAll)
+	roleID, err := s.CreateRole("reader", "", `[{"resources":["/api/**"],"actions":["GET"],"effect":"allow"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AssignRoleToAccessKey(id, roleID); err != nil {
+		t.Fatal(err)
+	}
+	// A role held through the key and the user appears once
+	if err := s.AttachRoleToUser(bob.ID, roleID); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &principalRecorder{}
+	handler := s.Middleware(rec)
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/api/items", nil)
+	req.RemoteAddr = "10.1.2.3:1234"
+	SignRequest(req, id, secret, nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	p := rec.principal
+	if p == nil {
+		t.Fatal("no principal in the request context")
+	}
+	if p.AccessKeyID != id || p.UserID != bob.ID || p.ParentID != alice.ID || p.AuthMethod != AuthMethodAccessKey {
+		t.Errorf("principal = %+v", p)
+	}
+	if len(p.Roles) != 1 || !p.HasRole("reader") || p.HasRole("writer") {
+		t.Errorf("roles = %v, want reader once", p.Roles)
+	}
+	if !p.SourceIP.Equal(net.ParseIP("10.1.2.3")) || p.SessionPolicy != nil {
+		t.Errorf("source IP %v, session policy %v", p.SourceIP, p.SessionPolicy)
+	}
+
+	presigned, err := Presign(http.MethodGet, "http://example.com/api/items", id, secret, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, presigned, nil))
+	if rec.principal == nil || rec.principal.AuthMethod != AuthMethodPresigned {
+		t.Errorf("principal of a presigned URL = %+v", rec.principal)
+	}
+
+	rec.principal = nil
+	s.NewMiddleware(WithDevMode(id, secret))(rec).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/api/items", nil))
+	if rec.principal == nil || rec.principal.AuthMethod != AuthMethodDev {
+		t.Errorf("principal in dev mode = %+v", rec.principal)
+	}
+
+	// Skipped paths have no principal
+	rec.principal = &Principal{}
+	s.NewMiddleware(WithSkipPaths("/health"))(rec).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/health", nil))
+	if rec.principal != nil {
+		t.Errorf("principal of a skipped path = %+v", rec.principal)
+	}
+}
+
+func TestPrincipalOfTemporaryCredentials(t *testing.T) {
+	s, user := newTestService(t)
+	id, _ := newTestKey(t, s, user, `[]`)
+	roleID, err := s.CreateRole("reader", "", `[{"resources":["/api/**"],"actions":["GET","docs:Read"],"effect":"allow"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AssignRoleToAccessKey(id, roleID); err != nil {
+		t.Fatal(err)
+	}
+	creds, err := s.AssumeRole(id, roleID, `[{"resources":["/api/public/**"],"actions":["GET","docs:Read"],"effect":"allow"}]`, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &principalRecorder{}
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/api/public/a", nil)
+	req.Header.Set("X-Security-Token", creds.SessionToken)
+	SignRequest(req, creds.AccessKeyID, creds.SecretKey, nil)
+	s.Middleware(rec).ServeHTTP(httptest.NewRecorder(), req)
+
+	p := rec.principal
+	if p == nil {
+		t.Fatal("no principal in the request context")
+	}
+	if p.AuthMethod != AuthMethodTemporary || !p.HasRole("reader") || p.SessionPolicy == nil || p.UserID != user.ID {
+		t.Errorf("principal = %+v", p)
+	}
+	// The session policy restricts Allows like the middleware
+	if !p.Allows(req, "docs:Read", "/api/public/doc") {
+		t.Error("Allows denied an action within the session policy")
+	}
+	if p.Allows(req, "docs:Read", "/api/private/doc") {
+		t.Error("Allows granted an action outside the session policy")
+	}
+}
+
+func TestPrincipalAllows(t *testing.T) {
+	perms, err := ParsePermissions(`[
+		{"resources":["/docs/**"],"actions":["docs:*"],"effect":"allow"},
+		{"resources":["/docs/secret/**"],"actions":["docs:Delete"],"effect":"deny"},
+		{"resources":["/office/**"],"actions":["docs:Read"],"effect":"allow","conditions":{"IpAddress":{"SourceIp":"10.0.0.0/8"}}}
+	]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Principal{Permissions: perms, SourceIP: net.ParseIP("192.168.0.1")}
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+
+	tests := []struct {
+		action, resource string
+		want             bool
+	}{
+		{"docs:Read", "/docs/a", true},
+		{"docs:Delete", "/docs/a", true},
+		{"docs:Delete", "/docs/secret/a", false},
+		{"files:Read", "/docs/a", false},
+		// The source IP of the principal is used, not the one of the request
+		{"docs:Read", "/office/a", false},
+	}
+	for _, tt := range tests {
+		if got := p.Allows(req, tt.action, tt.resource); got != tt.want {
+			t.Errorf("Allows(%s, %s) = %v, want %v", tt.action, tt.resource, got, tt.want)
+		}
+	}
+	p.SourceIP = net.ParseIP("10.1.2.3")
+	if !p.Allows(req, "docs:Read", "/office/a") {
+		t.Error("Allows ignored the source IP of the principal")
+	}
+}
+
+func TestRequire(t *testing.T) {
+	perms, err := ParsePermissions(`[{"resources":["/docs/**"],"actions":["docs:Read"],"effect":"allow"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	principal := &Principal{AccessKeyID: "AK1", Permissions: perms}
+
+	tests := []struct {
+		name      string
+		principal *Principal
+		action    string
+		resource  string
+		path      string
+		want      int
+	}{
+		{"allowed", principal, "docs:Read", "/docs/a", "/anything", http.StatusOK},
+		{"request path", principal, "docs:Read", "", "/docs/b", http.StatusOK},
+		{"other action", principal, "docs:Write", "/docs/a", "/docs/a", http.StatusForbidden},
+		{"other path", principal, "docs:Read", "", "/files/a", http.StatusForbidden},
+		{"unauthenticated", nil, "docs:Read", "/docs/a", "/docs/a", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		handler := Require(tt.action, tt.resource)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		req := httptest.NewRequest(http.MethodGet, "http://example.com"+tt.path, nil)
+		if tt.principal != nil {
+			req = req.WithContext(ContextWithPrincipal(context.Background(), tt.principal))
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
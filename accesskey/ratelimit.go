@@ -0,0 +1,394 @@
+package accesskey
+
+import (
+	"database/sql"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrRateLimited is passed to the ErrorResponder when an access key exceeds its request rate
+	ErrRateLimited = errors.New("rate limit exceeded")
+	// ErrQuotaExceeded is passed to the ErrorResponder when an access key used up its daily or monthly quota
+	ErrQuotaExceeded = errors.New("request quota exceeded")
+)
+
+// RateLimit limits the requests of an access key. It can be set on access
+// keys and roles; the most restrictive value of each field applies. Zero
+// fields do not limit.
+type RateLimit struct {
+	// RequestsPerSecond is the sustained rate of the token bucket
+	RequestsPerSecond float64 `json:"requests_per_second,omitempty"`
+	// Burst is the size of the token bucket, RequestsPerSecond rounded up if zero
+	Burst        int   `json:"burst,omitempty"`
+	DailyQuota   int64 `json:"daily_quota,omitempty"`
+	MonthlyQuota int64 `json:"monthly_quota,omitempty"`
+}
+
+// Validate checks that no field is negative
+func (l *RateLimit) Validate() error {
+	if l.RequestsPerSecond < 0 || l.Burst < 0 || l.DailyQuota < 0 || l.MonthlyQuota < 0 {
+		return errors.New("rate limit values must not be negative")
+	}
+	return nil
+}
+
+func (l *RateLimit) burst() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return int(math.Max(1, math.Ceil(l.RequestsPerSecond)))
+}
+
+// mergeRateLimits returns the most restrictive value of each field, nil if no limit is set
+func mergeRateLimits(limits ...*RateLimit) *RateLimit {
+	var merged *RateLimit
+	minFloat := func(a, b float64) float64 {
+		if a == 0 || (b != 0 && b < a) {
+			return b
+		}
+		return a
+	}
+	minInt := func(a, b int64) int64 {
+		if a == 0 || (b != 0 && b < a) {
+			return b
+		}
+		return a
+	}
+
+	for _, l := range limits {
+		if l == nil {
+			continue
+		}
+		if merged == nil {
+			merged = &RateLimit{}
+		}
+		merged.RequestsPerSecond = minFloat(merged.RequestsPerSecond, l.RequestsPerSecond)
+		merged.Burst = int(minInt(int64(merged.Burst), int64(l.Burst)))
+		merged.DailyQuota = minInt(merged.DailyQuota, l.DailyQuota)
+		merged.MonthlyQuota = minInt(merged.MonthlyQuota, l.MonthlyQuota)
+	}
+	return merged
+}
+
+// RateLimitResult describes the most constraining limit of a request, as
+// reported in the X-RateLimit-* headers
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int64
+	Remaining int64
+	Reset     time.Time
+	// Err is ErrRateLimited or ErrQuotaExceeded if the request is not allowed
+	Err error
+}
+
+// QuotaCounter counts requests for the daily and monthly quotas
+type QuotaCounter interface {
+	// Increment adds one to the counter and returns the new value. The
+	// counter is not needed after expiresAt.
+	Increment(key string, expiresAt time.Time) (int64, error)
+}
+
+// RateLimiter enforces RateLimits with an in-memory token bucket per access
+// key and a QuotaCounter for the quotas. The token buckets are local to the
+// process, so with several instances each allows the full rate.
+type RateLimiter struct {
+	counter QuotaCounter
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	rate   float64
+	burst  float64
+}
+
+// NewRateLimiter creates a rate limiter. Quotas are counted in memory if
+// counter is nil; use a MySQLQuotaCounter to share them between instances.
+func NewRateLimiter(counter QuotaCounter) *RateLimiter {
+	if counter == nil {
+		counter = NewMemoryQuotaCounter()
+	}
+	return &RateLimiter{
+		counter: counter,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Allow counts a request of key against limit
+func (l *RateLimiter) Allow(key string, limit *RateLimit, now time.Time) (*RateLimitResult, error) {
+	var result *RateLimitResult
+	tighter := func(r *RateLimitResult) {
+		if result == nil || r.Remaining < result.Remaining {
+			result = r
+		}
+	}
+
+	if limit.RequestsPerSecond > 0 {
+		r := l.take(key, limit, now)
+		if !r.Allowed {
+			return r, nil
+		}
+		tighter(r)
+	}
+
+	quotas := []struct {
+		quota  int64
+		window string
+		reset  time.Time
+	}{
+		{limit.DailyQuota, now.UTC().Format("20060102"), startOfNextDay(now)},
+		{limit.MonthlyQuota, now.UTC().Format("200601"), startOfNextMonth(now)},
+	}
+	for _, q := range quotas {
+		if q.quota <= 0 {
+			continue
+		}
+		count, err := l.counter.Increment(key+":"+q.window, q.reset)
+		if err != nil {
+			return nil, err
+		}
+		r := &RateLimitResult{
+			Allowed:   count <= q.quota,
+			Limit:     q.quota,
+			Remaining: max(q.quota-count, 0),
+			Reset:     q.reset,
+		}
+		if !r.Allowed {
+			r.Err = ErrQuotaExceeded
+			return r, nil
+		}
+		tighter(r)
+	}
+
+	if result == nil {
+		return &RateLimitResult{Allowed: true}, nil
+	}
+	return result, nil
+}
+
+// take removes a token from the bucket of key
+func (l *RateLimiter) take(key string, limit *RateLimit, now time.Time) *RateLimitResult {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	rate, burst := limit.RequestsPerSecond, float64(limit.burst())
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	// The limit may have changed since the bucket was created
+	b.rate, b.burst = rate, burst
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	r := &RateLimitResult{Limit: int64(burst)}
+	if b.tokens < 1 {
+		r.Reset = now.Add(time.Duration((1 - b.tokens) / rate * float64(time.Second)))
+		r.Err = ErrRateLimited
+		return r
+	}
+	b.tokens--
+	r.Allowed = true
+	r.Remaining = int64(b.tokens)
+	r.Reset = now.Add(time.Duration((burst - b.tokens) / rate * float64(time.Second)))
+	return r
+}
+
+// sweep drops buckets that have been refilled completely, at most once a
+// minute. l.mu must be held.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func startOfNextDay(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+}
+
+func startOfNextMonth(t time.Time) time.Time {
+	y, m, _ := t.UTC().Date()
+	return time.Date(y, m+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// MemoryQuotaCounter counts quotas in memory
+type MemoryQuotaCounter struct {
+	mu        sync.Mutex
+	counts    map[string]*quotaCount
+	lastSweep time.Time
+}
+
+type quotaCount struct {
+	count     int64
+	expiresAt time.Time
+}
+
+// NewMemoryQuotaCounter creates an in-memory quota counter
+func NewMemoryQuotaCounter() *MemoryQuotaCounter {
+	return &MemoryQuotaCounter{counts: make(map[string]*quotaCount)}
+}
+
+// Increment implements QuotaCounter
+func (c *MemoryQuotaCounter) Increment(key string, expiresAt time.Time) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.lastSweep) >= time.Minute {
+		c.lastSweep = now
+		for k, qc := range c.counts {
+			if now.After(qc.expiresAt) {
+				delete(c.counts, k)
+			}
+		}
+	}
+
+	qc, ok := c.counts[key]
+	if !ok {
+		qc = &quotaCount{expiresAt: expiresAt}
+		c.counts[key] = qc
+	}
+	qc.count++
+	return qc.count, nil
+}
+
+// MySQLQuotaCounter counts quotas in the rate_limit_counters table, so that
+// they are shared between several server instances
+type MySQLQuotaCounter struct {
+	db *sql.DB
+}
+
+// NewMySQLQuotaCounter creates a quota counter using the given database
+func NewMySQLQuotaCounter(db *sql.DB) *MySQLQuotaCounter {
+	return &MySQLQuotaCounter{db: db}
+}
+
+// Increment implements QuotaCounter
+func (c *MySQLQuotaCounter) Increment(key string, expiresAt time.Time) (int64, error) {
+	// LAST_INSERT_ID(expr) makes the updated count available without a second query
+	result, err := c.db.Exec(
+		"INSERT INTO rate_limit_counters (counter_key, count, expires_at) VALUES (?, 1, ?) ON DUPLICATE KEY UPDATE count = LAST_INSERT_ID(count + 1)",
+		key,
+		expiresAt,
+	)
+	if err != nil {
+		return 0, err
+	}
+	count, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if count == 0 {
+		// A new row was inserted
+		count = 1
+	}
+	return count, nil
+}
+
+// Purge deletes expired counters
+func (c *MySQLQuotaCounter) Purge() error {
+	_, err := c.db.Exec("DELETE FROM rate_limit_counters WHERE expires_at < ?", time.Now())
+	return err
+}
+
+// SetAccessKeyRateLimit sets the rate limit of an access key, nil removes it
+func (s *Service) SetAccessKeyRateLimit(accessKeyID string, limit *RateLimit) error {
+	if limit != nil {
+		if err := limit.Validate(); err != nil {
+			return err
+		}
+	}
+	if _, err := s.store.GetAccessKey(accessKeyID); err != nil {
+		return err
+	}
+	return s.store.UpdateAccessKeyRateLimit(accessKeyID, limit)
+}
+
+// SetRoleRateLimit sets the rate limit of a role, nil removes it. It applies
+// to all access keys the role is assigned to.
+func (s *Service) SetRoleRateLimit(roleID int, limit *RateLimit) error {
+	if limit != nil {
+		if err := limit.Validate(); err != nil {
+			return err
+		}
+	}
+	if _, err := s.store.GetRole(roleID); err != nil {
+		return err
+	}
+	return s.store.UpdateRoleRateLimit(roleID, limit)
+}
+
+// EffectiveRateLimit returns the most restrictive combination of the rate
+// limits of an access key and all roles it gets permissions from, including
+// those of its user and groups, nil if there is none
+func (s *Service) EffectiveRateLimit(accessKeyID string) (*RateLimit, error) {
+	limit, _, err := s.rateLimitFor(accessKeyID)
+	return limit, err
+}
+
+// rateLimitFor returns the effective rate limit and the key requests are
+// counted for. Temporary credentials count against the key they were issued
+// to, so that assuming a role many times does not multiply the limit.
+func (s *Service) rateLimitFor(accessKeyID string) (*RateLimit, string, error) {
+	var limits []*RateLimit
+	if IsTemporaryAccessKeyID(accessKeyID) {
+		cred, err := s.getTemporaryCredential(accessKeyID)
+		if err != nil {
+			return nil, "", err
+		}
+		role, err := s.store.GetRole(cred.RoleID)
+		if err != nil {
+			return nil, "", err
+		}
+		limits = append(limits, role.RateLimit)
+		accessKeyID = cred.SourceAccessKey
+	}
+
+	ak, err := s.store.GetAccessKey(accessKeyID)
+	if err != nil {
+		return nil, "", err
+	}
+	sources, err := s.accessKeySources(ak)
+	if err != nil {
+		return nil, "", err
+	}
+	limits = append(limits, ak.RateLimit)
+	for _, src := range sources {
+		if src.role != nil {
+			limits = append(limits, src.role.RateLimit)
+		}
+	}
+	return mergeRateLimits(limits...), accessKeyID, nil
+}
+
+// rateLimitHeaders sets the X-RateLimit-* headers of a response
+func rateLimitHeaders(h http.Header, r *RateLimitResult, now time.Time) {
+	if r.Limit == 0 {
+		return
+	}
+	h.Set("X-RateLimit-Limit", strconv.FormatInt(r.Limit, 10))
+	h.Set("X-RateLimit-Remaining", strconv.FormatInt(r.Remaining, 10))
+	h.Set("X-RateLimit-Reset", strconv.FormatInt(r.Reset.Unix(), 10))
+	if !r.Allowed {
+		h.Set("Retry-After", strconv.FormatInt(int64(math.Ceil(r.Reset.Sub(now).Seconds())), 10))
+	}
+}
@@ -0,0 +1,170 @@
+package accesskey
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterBurstAndRefill(t *testing.T) {
+	l := NewRateLimiter(nil)
+	limit := &RateLimit{RequestsPerSecond: 2, Burst: 3}
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	allow := func(at time.Time) *RateLimitResult {
+		t.Helper()
+		r, err := l.Allow("AK1", limit, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	// The full burst is available at once
+	for i := 0; i < 3; i++ {
+		if r := allow(now); !r.Allowed || r.Remaining != int64(2-i) || r.Limit != 3 {
+			t.Fatalf("request %d of the burst: %+v", i+1, r)
+		}
+	}
+	r := allow(now)
+	if r.Allowed || !errors.Is(r.Err, ErrRateLimited) {
+		t.Fatalf("request after the burst: %+v", r)
+	}
+	if want := now.Add(500 * time.Millisecond); !r.Reset.Equal(want) {
+		t.Errorf("Reset = %v, want %v", r.Reset, want)
+	}
+
+	// Tokens are refilled at the sustained rate
+	if r := allow(now.Add(500 * time.Millisecond)); !r.Allowed {
+		t.Errorf("request after half a second: %+v", r)
+	}
+	if r := allow(now.Add(600 * time.Millisecond)); r.Allowed {
+		t.Errorf("second request after half a second: %+v", r)
+	}
+	// but not beyond the burst
+	later := now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if r := allow(later); !r.Allowed {
+			t.Fatalf("request %d after an hour: %+v", i+1, r)
+		}
+	}
+	if r := allow(later); r.Allowed {
+		t.Errorf("request beyond the burst after an hour: %+v", r)
+	}
+
+	// Other keys have their own bucket
+	if r, _ := l.Allow("AK2", limit, now); !r.Allowed {
+		t.Errorf("request of another key: %+v", r)
+	}
+}
+
+func TestRateLimiterQuotas(t *testing.T) {
+	l := NewRateLimiter(nil)
+	limit := &RateLimit{DailyQuota: 2, MonthlyQuota: 3}
+	day := time.Date(2024, 5, 30, 12, 0, 0, 0, time.UTC)
+	nextDay, nextMonth := day.Add(24*time.Hour), day.Add(48*time.Hour)
+
+	tests := []struct {
+		at        time.Time
+		allowed   bool
+		limit     int64
+		remaining int64
+		reset     time.Time
+	}{
+		{day, true, 2, 1, time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC)},
+		{day, true, 2, 0, time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC)},
+		{day, false, 2, 0, time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC)},
+		// A new day has a new daily quota, the monthly one is reported when it is tighter
+		{nextDay, true, 3, 0, time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{nextDay, false, 3, 0, time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{nextMonth, true, 2, 1, time.Date(2024, 6, 2, 0, 0, 0, 0, time.UTC)},
+	}
+	for i, tt := range tests {
+		r, err := l.Allow("AK1", limit, tt.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Allowed != tt.allowed || r.Limit != tt.limit || r.Remaining != tt.remaining || !r.Reset.Equal(tt.reset) {
+			t.Errorf("request %d: %+v, want allowed %v, limit %d, remaining %d, reset %v",
+				i+1, r, tt.allowed, tt.limit, tt.remaining, tt.reset)
+		}
+		if !r.Allowed && !errors.Is(r.Err, ErrQuotaExceeded) {
+			t.Errorf("request %d: Err = %v, want ErrQuotaExceeded", i+1, r.Err)
+		}
+	}
+}
+
+func TestMergeRateLimits(t *testing.T) {
+	if got := mergeRateLimits(nil, nil); got != nil {
+		t.Errorf("mergeRateLimits(nil, nil) = %+v, want nil", got)
+	}
+	got := mergeRateLimits(
+		&RateLimit{RequestsPerSecond: 10, Burst: 20},
+		nil,
+		&RateLimit{RequestsPerSecond: 5, DailyQuota: 100},
+		&RateLimit{Burst: 30, DailyQuota: 50, MonthlyQuota: 1000},
+	)
+	want := RateLimit{RequestsPerSecond: 5, Burst: 20, DailyQuota: 50, MonthlyQuota: 1000}
+	if *got != want {
+		t.Errorf("mergeRateLimits = %+v, want %+v", *got, want)
+	}
+}
+
+func TestRateLimitValidate(t *testing.T) {
+	if err := (&RateLimit{RequestsPerSecond: 1.5}).Validate(); err != nil {
+		t.Error(err)
+	}
+	for _, l := range []RateLimit{{RequestsPerSecond: -1}, {Burst: -1}, {DailyQuota: -1}, {MonthlyQuota: -1}} {
+		if err := l.Validate(); err == nil {
+			t.Errorf("Validate(%+v) succeeded, want an error", l)
+		}
+	}
+	if got := (&RateLimit{RequestsPerSecond: 0.5}).burst(); got != 1 {
+		t.Errorf("burst of 0.5 requests per second = %d, want 1", got)
+	}
+	if got := (&RateLimit{RequestsPerSecond: 2.5}).burst(); got != 3 {
+		t.Errorf("burst of 2.5 requests per second = %d, want 3", got)
+	}
+}
+
+func TestMiddlewareRateLimit(t *testing.T) {
+	s, user := newTestService(t)
+	id, secret := newTestKey(t, s, user, `[{"resources":["/api/**"],"actions":["GET"],"effect":"allow"}]`)
+	if err := s.SetAccessKeyRateLimit(id, &RateLimit{DailyQuota: 2}); err != nil {
+		t.Fatal(err)
+	}
+	handler := s.NewMiddleware(WithRateLimiter(NewRateLimiter(nil)))(&bodyRecorder{})
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+		SignRequest(req, id, secret, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// Forbidden requests do not use up the quota
+	for i := 0; i < 3; i++ {
+		if w := serve("/admin"); w.Code != http.StatusForbidden {
+			t.Fatalf("forbidden request %d: status %d", i+1, w.Code)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		w := serve("/api/users")
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d within the quota: status %d", i+1, w.Code)
+		}
+		if got, want := w.Header().Get("X-RateLimit-Remaining"), []string{"1", "0"}[i]; got != want {
+			t.Errorf("request %d: X-RateLimit-Remaining = %q, want %q", i+1, got, want)
+		}
+	}
+	w := serve("/api/users")
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("request beyond the quota: status %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Retry-After is not set")
+	}
+}
@@ -0,0 +1,175 @@
+package accesskey
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+var (
+	// ErrRequestExpired is returned when X-Timestamp falls outside the allowed clock-skew window
+	ErrRequestExpired = errors.New("request timestamp outside allowed window")
+	// ErrNonceReused is returned when a signed request is replayed with an already seen X-Nonce
+	ErrNonceReused = errors.New("nonce has already been used")
+)
+
+// DefaultReplayWindow is the default tolerated clock skew between client and server
+const DefaultReplayWindow = 5 * time.Minute
+
+// NonceStore remembers request nonces so that replayed requests can be rejected
+type NonceStore interface {
+	// CheckAndStore records the nonce until expiresAt. It returns false if the
+	// nonce has already been recorded and has not expired yet.
+	CheckAndStore(nonce string, expiresAt time.Time) (bool, error)
+}
+
+var (
+	replayWindow            = DefaultReplayWindow
+	nonceStore   NonceStore = NewMemoryNonceStore()
+)
+
+// SetReplayWindow sets the tolerated clock skew for X-Timestamp
+func SetReplayWindow(window time.Duration) {
+	replayWindow = window
+	if defaultService != nil {
+		defaultService.replayWindow = window
+	}
+}
+
+// SetNonceStore sets the store used to remember request nonces
+func SetNonceStore(store NonceStore) {
+	nonceStore = store
+	if defaultService != nil {
+		defaultService.nonces = store
+	}
+}
+
+// GenerateNonce generates a random nonce for the X-Nonce header
+func GenerateNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// maxNonceLength bounds X-Nonce, which is stored with the access key ID in
+// request_nonces.nonce VARCHAR(160)
+const maxNonceLength = 64
+
+// checkNonce checks that a nonce has the form of GenerateNonce: at most
+// maxNonceLength lowercase hex digits
+func checkNonce(nonce string) error {
+	if nonce == "" {
+		return errors.New("missing X-Nonce header")
+	}
+	if len(nonce) > maxNonceLength {
+		return fmt.Errorf("X-Nonce header longer than %d characters", maxNonceLength)
+	}
+	for i := 0; i < len(nonce); i++ {
+		if c := nonce[i]; (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return errors.New("X-Nonce header must be lowercase hex")
+		}
+	}
+	return nil
+}
+
+// checkTimestamp checks that a unix timestamp is within window of now
+func checkTimestamp(ts int64, now time.Time, window time.Duration) error {
+	t := time.Unix(ts, 0)
+	if t.Before(now.Add(-window)) || t.After(now.Add(window)) {
+		return ErrRequestExpired
+	}
+	return nil
+}
+
+// MemoryNonceStore is an in-memory NonceStore with TTL based eviction
+type MemoryNonceStore struct {
+	mu        sync.Mutex
+	nonces    map[string]time.Time
+	lastSweep time.Time
+}
+
+// NewMemoryNonceStore creates a new in-memory nonce store
+func NewMemoryNonceStore() *MemoryNonceStore {
+	return &MemoryNonceStore{
+		nonces:    make(map[string]time.Time),
+		lastSweep: time.Now(),
+	}
+}
+
+// CheckAndStore implements NonceStore
+func (s *MemoryNonceStore) CheckAndStore(nonce string, expiresAt time.Time) (bool, error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Drop expired nonces at most once a minute
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, exp := range s.nonces {
+			if now.After(exp) {
+				delete(s.nonces, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	if exp, ok := s.nonces[nonce]; ok && now.Before(exp) {
+		return false, nil
+	}
+	s.nonces[nonce] = expiresAt
+	return true, nil
+}
+
+// MySQLNonceStore is a NonceStore backed by the request_nonces table, so that
+// nonces are shared between several server instances
+type MySQLNonceStore struct {
+	db *sql.DB
+}
+
+// NewMySQLNonceStore creates a nonce store using the given database
+func NewMySQLNonceStore(db *sql.DB) *MySQLNonceStore {
+	return &MySQLNonceStore{db: db}
+}
+
+// CheckAndStore implements NonceStore
+func (s *MySQLNonceStore) CheckAndStore(nonce string, expiresAt time.Time) (bool, error) {
+	// Remove the nonce if a previous record has already expired
+	_, err := s.db.Exec(
+		"DELETE FROM request_nonces WHERE nonce = ? AND expires_at < ?",
+		nonce,
+		time.Now(),
+	)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = s.db.Exec(
+		"INSERT INTO request_nonces (nonce, expires_at) VALUES (?, ?)",
+		nonce,
+		expiresAt,
+	)
+	if err != nil {
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == 1062 {
+			// Duplicate entry
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Purge deletes all expired nonces
+func (s *MySQLNonceStore) Purge() error {
+	_, err := s.db.Exec("DELETE FROM request_nonces WHERE expires_at < ?", time.Now())
+	return err
+}
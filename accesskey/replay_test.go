@@ -0,0 +1,148 @@
+package accesskey
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckNonce(t *testing.T) {
+	generated, err := GenerateNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		nonce string
+		valid bool
+	}{
+		{generated, true},
+		{"0123456789abcdef", true},
+		{strings.Repeat("a", maxNonceLength), true},
+		{"", false},
+		{strings.Repeat("a", maxNonceLength+1), false},
+		{"0123456789ABCDEF", false},
+		{"nonce-with-dashes", false},
+		{"abc:def", false},
+	}
+	for _, tt := range tests {
+		if err := checkNonce(tt.nonce); (err == nil) != tt.valid {
+			t.Errorf("checkNonce(%q) = %v, want valid %v", tt.nonce, err, tt.valid)
+		}
+	}
+}
+
+func TestVerifyRejectsExpiredTimestamps(t *testing.T) {
+	s, user := newTestService(t, WithReplayWindow(time.Minute))
+	id, secret := newTestKey(t, s, user, allowAll)
+
+	for _, offset := range []time.Duration{-2 * time.Minute, 2 * time.Minute} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/api/v1/users", nil)
+		if err := signRequest(req, id, secret, nil, SignatureVersion2, time.Now().Add(offset)); err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := s.VerifyRequestSignature(req, nil); ok || !errors.Is(err, ErrRequestExpired) {
+			t.Errorf("timestamp %v from now: VerifyRequestSignature = %v, %v, want ErrRequestExpired", offset, ok, err)
+		}
+	}
+
+	// Within the window
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/api/v1/users", nil)
+	if err := signRequest(req, id, secret, nil, SignatureVersion2, time.Now().Add(-30*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.VerifyRequestSignature(req, nil); !ok || err != nil {
+		t.Errorf("timestamp within the window: VerifyRequestSignature = %v, %v", ok, err)
+	}
+}
+
+func TestVerifyRejectsReusedNonces(t *testing.T) {
+	s, user := newTestService(t)
+	id, secret := newTestKey(t, s, user, allowAll)
+	otherID, otherSecret := newTestKey(t, s, user, allowAll)
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/api/v1/users", nil)
+	SignRequest(req, id, secret, nil)
+	if ok, err := s.VerifyRequestSignature(req, nil); !ok || err != nil {
+		t.Fatalf("first request: VerifyRequestSignature = %v, %v", ok, err)
+	}
+	if ok, err := s.VerifyRequestSignature(req, nil); ok || !errors.Is(err, ErrNonceReused) {
+		t.Errorf("replayed request: VerifyRequestSignature = %v, %v, want ErrNonceReused", ok, err)
+	}
+
+	// Nonces are remembered per access key
+	other := httptest.NewRequest(http.MethodGet, "http://example.com/api/v1/users", nil)
+	SignRequest(other, otherID, otherSecret, nil)
+	other.Header.Set("X-Nonce", req.Header.Get("X-Nonce"))
+	if err := signRequestKeepingNonce(other, otherID, otherSecret); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.VerifyRequestSignature(other, nil); !ok || err != nil {
+		t.Errorf("same nonce with another key: VerifyRequestSignature = %v, %v", ok, err)
+	}
+}
+
+// A request with a bad signature must not use up its nonce
+func TestVerifyKeepsNonceOfRejectedRequests(t *testing.T) {
+	s, user := newTestService(t)
+	id, secret := newTestKey(t, s, user, allowAll)
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/api/v1/users", nil)
+	SignRequest(req, id, secret, nil)
+	signature := req.Header.Get("X-Signature")
+	req.Header.Set("X-Signature", strings.Repeat("0", len(signature)))
+	if ok, _ := s.VerifyRequestSignature(req, nil); ok {
+		t.Fatal("request with a wrong signature was accepted")
+	}
+	req.Header.Set("X-Signature", signature)
+	if ok, err := s.VerifyRequestSignature(req, nil); !ok || err != nil {
+		t.Errorf("VerifyRequestSignature = %v, %v after a rejected attempt", ok, err)
+	}
+}
+
+func TestMemoryNonceStore(t *testing.T) {
+	store := NewMemoryNonceStore()
+	if fresh, err := store.CheckAndStore("AK1:n", time.Now().Add(time.Minute)); !fresh || err != nil {
+		t.Fatalf("first use = %v, %v", fresh, err)
+	}
+	if fresh, _ := store.CheckAndStore("AK1:n", time.Now().Add(time.Minute)); fresh {
+		t.Error("nonce accepted twice")
+	}
+	if fresh, _ := store.CheckAndStore("AK1:old", time.Now().Add(-time.Second)); !fresh {
+		t.Fatal("first use of an expired nonce rejected")
+	}
+	if fresh, _ := store.CheckAndStore("AK1:old", time.Now().Add(time.Minute)); !fresh {
+		t.Error("expired nonce still remembered")
+	}
+}
+
+// Nonces are checked before the signature, so that they cannot reach the
+// nonce store even when correctly signed
+func TestVerifyRejectsInvalidNonces(t *testing.T) {
+	s, user := newTestService(t)
+	id, secret := newTestKey(t, s, user, allowAll)
+
+	for _, nonce := range []string{strings.Repeat("a", 200), "NOT-HEX"} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/api/v1/users", nil)
+		SignRequest(req, id, secret, nil)
+		req.Header.Set("X-Nonce", nonce)
+		if err := signRequestKeepingNonce(req, id, secret); err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := s.VerifyRequestSignature(req, nil); ok || err == nil {
+			t.Errorf("nonce %q: VerifyRequestSignature = %v, %v, want an error", nonce, ok, err)
+		}
+	}
+}
+
+// signRequestKeepingNonce re-signs a request with the X-Nonce it already has
+func signRequestKeepingNonce(req *http.Request, id, secret string) error {
+	params, err := newSignatureParams(req, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Signature", GenerateSignature(secret, GenerateStringToSign(params)))
+	return nil
+}
@@ -0,0 +1,150 @@
+package accesskey
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// DefaultRotationGracePeriod is how long a rotated access key stays valid by default
+const DefaultRotationGracePeriod = 24 * time.Hour
+
+// ErrAlreadyRotated is returned when rotating an access key that already has a successor
+var ErrAlreadyRotated = errors.New("access key is already being rotated")
+
+// RotateAccessKey issues a successor for an access key. The successor gets the
+// same user, permissions, tags, rate limit, roles and managed policies. Both keys stay valid until the grace period
+// ends or the successor is used for the first time, whichever comes first.
+// A grace period <= 0 uses DefaultRotationGracePeriod. Ed25519 keys return
+// ErrPublicKeyRequired, see RotateAccessKeyWithPublicKey.
+func (s *Service) RotateAccessKey(accessKeyID string, grace time.Duration) (string, string, error) {
+	old, err := s.store.GetAccessKey(accessKeyID)
+	if err != nil {
+		return "", "", err
+	}
+	if old.keyType() != KeyTypeHMAC {
+		return "", "", ErrPublicKeyRequired
+	}
+
+	id, secret, err := GenerateAccessKeyPair()
+	if err != nil {
+		return "", "", err
+	}
+
+	storedSecret, err := s.sealSecret(id, secret)
+	if err != nil {
+		return "", "", err
+	}
+
+	if _, err := s.rotate(old, &AccessKey{ID: id, KeyType: KeyTypeHMAC, SecretKey: storedSecret}, grace); err != nil {
+		return "", "", err
+	}
+	return id, secret, nil
+}
+
+// rotate stores successor, which has its ID and credentials set, as the
+// successor of old and starts the grace period of old
+func (s *Service) rotate(old, successor *AccessKey, grace time.Duration) (string, error) {
+	if grace <= 0 {
+		grace = DefaultRotationGracePeriod
+	}
+	if old.Status != "active" {
+		return "", errors.New("only active access keys can be rotated")
+	}
+	if !old.GraceUntil.IsZero() {
+		return "", ErrAlreadyRotated
+	}
+
+	roles, err := s.store.ListAccessKeyRoles(old.AccessKey)
+	if err != nil {
+		return "", err
+	}
+	policies, err := s.store.ListAttachedPolicies(PolicyTargetAccessKey, old.AccessKey)
+	if err != nil {
+		return "", err
+	}
+
+	if successor.ID == "" {
+		if successor.ID, err = generateAccessKeyID(); err != nil {
+			return "", err
+		}
+	}
+	successor.AccessKey = successor.ID
+	successor.UserID = old.UserID
+	successor.Status = "active"
+	successor.Permissions = old.Permissions
+	successor.ExpiresAt = old.ExpiresAt
+	successor.RotatedFrom = old.AccessKey
+	successor.Tags = old.Tags
+	successor.RateLimit = old.RateLimit
+	if err := s.store.CreateAccessKey(successor); err != nil {
+		return "", err
+	}
+
+	for _, role := range roles {
+		if err := s.store.BindRole(successor.ID, role.ID); err != nil {
+			return "", err
+		}
+	}
+	for _, policy := range policies {
+		if err := s.store.AttachPolicy(policy.ID, PolicyTargetAccessKey, successor.ID); err != nil {
+			return "", err
+		}
+	}
+
+	if err := s.store.SetAccessKeyGraceUntil(old.AccessKey, time.Now().Add(grace)); err != nil {
+		return "", err
+	}
+
+	return successor.ID, nil
+}
+
+// DeactivateRotatedKeys deactivates all rotated access keys whose grace period
+// has ended and returns how many keys were deactivated. Rotated keys are also
+// rejected on use once the grace period is over; this only cleans up the status.
+func (s *Service) DeactivateRotatedKeys() (int, error) {
+	keys, err := s.store.ListGraceEndedAccessKeys(time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	deactivated := 0
+	for _, ak := range keys {
+		retired, err := s.store.RetireAccessKey(ak.AccessKey)
+		if err != nil {
+			return deactivated, err
+		}
+		if retired {
+			deactivated++
+		}
+	}
+	return deactivated, nil
+}
+
+// graceEnded reports whether a rotated access key is past its grace period
+func graceEnded(ak *AccessKey, now time.Time) bool {
+	return !ak.GraceUntil.IsZero() && !now.Before(ak.GraceUntil)
+}
+
+// retireRotatedKey deactivates a rotated key that is used after its grace
+// period, instead of waiting for DeactivateRotatedKeys
+func (s *Service) retireRotatedKey(ak *AccessKey, now time.Time) {
+	if ak.Status != "active" || !graceEnded(ak, now) {
+		return
+	}
+	if _, err := s.store.RetireAccessKey(ak.AccessKey); err != nil {
+		log.Printf("deactivate rotated access key %s: %v", ak.AccessKey, err)
+	}
+}
+
+// retirePredecessor ends the grace period of the key that ak replaced, once ak
+// is used for the first time. Only an active predecessor is written, so that
+// calls before the first use of ak has been recorded, e.g. while a
+// CachingStore buffers last use times, do not rewrite its status.
+func (s *Service) retirePredecessor(ak *AccessKey) error {
+	if ak.RotatedFrom == "" || !ak.LastUsedAt.IsZero() {
+		return nil
+	}
+	_, err := s.store.RetireAccessKey(ak.RotatedFrom)
+	return err
+}
@@ -0,0 +1,163 @@
+package accesskey
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// statusCountingStore counts the status writes that change an access key
+type statusCountingStore struct {
+	Store
+
+	mu      sync.Mutex
+	changes map[string]int
+}
+
+func (s *statusCountingStore) UpdateAccessKeyStatus(accessKeyID string, status string) error {
+	s.count(accessKeyID)
+	return s.Store.UpdateAccessKeyStatus(accessKeyID, status)
+}
+
+func (s *statusCountingStore) RetireAccessKey(accessKeyID string) (bool, error) {
+	retired, err := s.Store.RetireAccessKey(accessKeyID)
+	if retired {
+		s.count(accessKeyID)
+	}
+	return retired, err
+}
+
+func (s *statusCountingStore) count(accessKeyID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.changes[accessKeyID]++
+}
+
+func (s *statusCountingStore) statusChanges(accessKeyID string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.changes[accessKeyID]
+}
+
+func TestRotationRetiresPredecessorOnce(t *testing.T) {
+	counting := &statusCountingStore{Store: NewMemoryStore(), changes: make(map[string]int)}
+	cache := NewCachingStore(counting, time.Minute, 0)
+	stop := cache.StartFlusher(time.Hour)
+	defer stop()
+
+	s := NewService(cache)
+	user, err := s.CreateUser("alice", "password123", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldID, _ := newTestKey(t, s, user, allowAll)
+	newID, _, err := s.RotateAccessKey(oldID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := s.ValidateAccessKey(oldID); err != nil || !ok {
+		t.Fatalf("predecessor during grace period: %v, %v", ok, err)
+	}
+
+	successor, err := s.store.GetAccessKey(newID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.ValidateAccessKey(newID); err != nil || !ok {
+		t.Fatalf("successor: %v, %v", ok, err)
+	}
+	// Requests that see the successor before its first use has been written,
+	// e.g. on other instances while last use times are buffered
+	for i := 0; i < 5; i++ {
+		if err := s.retirePredecessor(successor); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := counting.statusChanges(oldID); n != 1 {
+		t.Errorf("predecessor status changed %d times, want 1", n)
+	}
+	if ok, _ := s.ValidateAccessKey(oldID); ok {
+		t.Error("predecessor still valid after the first use of its successor")
+	}
+}
+
+func TestGraceEndedKeyIsRejected(t *testing.T) {
+	s, user := newTestService(t)
+	oldID, _ := newTestKey(t, s, user, allowAll)
+	if _, _, err := s.RotateAccessKey(oldID, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.store.SetAccessKeyGraceUntil(oldID, time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	// usable is a predicate without side effects
+	ak, _ := s.store.GetAccessKey(oldID)
+	if s.usable(ak, time.Now()) {
+		t.Fatal("key past its grace period is usable")
+	}
+	if ak, _ := s.store.GetAccessKey(oldID); ak.Status != "active" {
+		t.Fatalf("usable changed the status to %q", ak.Status)
+	}
+
+	// Using the key deactivates it
+	if ok, err := s.ValidateAccessKey(oldID); err != nil || ok {
+		t.Fatalf("ValidateAccessKey = %v, %v, want false", ok, err)
+	}
+	if ak, _ := s.store.GetAccessKey(oldID); ak.Status != "inactive" {
+		t.Fatalf("status %q after use, want inactive", ak.Status)
+	}
+	if n, err := s.DeactivateRotatedKeys(); err != nil || n != 0 {
+		t.Fatalf("DeactivateRotatedKeys = %d, %v, want 0", n, err)
+	}
+}
+
+func TestRotationKeepsRateLimit(t *testing.T) {
+	s, user := newTestService(t)
+	oldID, _ := newTestKey(t, s, user, allowAll)
+	limit := &RateLimit{RequestsPerSecond: 5, Burst: 10, DailyQuota: 1000}
+	if err := s.SetAccessKeyRateLimit(oldID, limit); err != nil {
+		t.Fatal(err)
+	}
+
+	newID, _, err := s.RotateAccessKey(oldID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.EffectiveRateLimit(newID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || *got != *limit {
+		t.Errorf("rate limit of the successor = %+v, want %+v", got, limit)
+	}
+}
+
+func TestRotationKeepsAttachedPolicies(t *testing.T) {
+	s, user := newTestService(t)
+	oldID, _ := newTestKey(t, s, user, `[]`)
+	policy, err := s.CreatePolicy("reader", "", `[{"resources":["api/**"],"actions":["GET"],"effect":"allow"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AttachPolicyToAccessKey(policy.ID, oldID); err != nil {
+		t.Fatal(err)
+	}
+
+	newID, _, err := s.RotateAccessKey(oldID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policies, err := s.ListAttachedPolicies(PolicyTargetAccessKey, newID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policies) != 1 || policies[0].ID != policy.ID {
+		t.Fatalf("policies of the successor = %v, want %d", policies, policy.ID)
+	}
+	if ok, err := s.Authorize(newID, "GET", "/api/v1/users"); err != nil || !ok {
+		t.Errorf("Authorize with the successor = %v, %v, want true", ok, err)
+	}
+}
@@ -1,48 +0,0 @@
--- Access Keys table
-CREATE TABLE IF NOT EXISTS access_keys (
-    id VARCHAR(64) PRIMARY KEY,
-    secret_key VARCHAR(256) NOT NULL,
-    access_key VARCHAR(256) NOT NULL,
-    user_id BIGINT NOT NULL,
-    status ENUM('active','inactive','expired') NOT NULL DEFAULT 'active',
-    permissions JSON NOT NULL,
-    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
-    last_used_at DATETIME DEFAULT NULL,
-    expires_at TIMESTAMP NULL,
-    INDEX idx_user_id (user_id),
-    INDEX idx_status (status),
-    INDEX idx_created_at (created_at)
-) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
-
--- Role Definitions table
-CREATE TABLE IF NOT EXISTS roles (
-    id INT AUTO_INCREMENT PRIMARY KEY,
-    name VARCHAR(64) NOT NULL,
-    description TEXT,
-    permissions JSON NOT NULL,
-    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
-    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
-    UNIQUE KEY uk_name (name)
-) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
-
--- User Definitions table
-CREATE TABLE IF NOT EXISTS users (
-    id INT AUTO_INCREMENT PRIMARY KEY,
-    username VARCHAR(64) NOT NULL,
-    password VARCHAR(255) NOT NULL,
-    status ENUM('active','suspended','deleted') NOT NULL DEFAULT 'active',
-    permissions JSON NOT NULL,
-    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
-    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
-    UNIQUE KEY uk_name (name)
-) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
-
--- Access Key Role Mappings table
-CREATE TABLE IF NOT EXISTS access_key_roles (
-    access_key_id VARCHAR(64) NOT NULL,
-    role_id INT NOT NULL,
-    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
-    PRIMARY KEY (access_key_id, role_id),
-    FOREIGN KEY (access_key_id) REFERENCES access_keys(id) ON DELETE CASCADE,
-    FOREIGN KEY (role_id) REFERENCES roles(id) ON DELETE CASCADE
-) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
\ No newline at end of file
@@ -0,0 +1,562 @@
+package accesskey
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Service implements access key management and request verification on top
+// of a Store. The package level functions use the Service created by InitDB.
+type Service struct {
+	store        Store
+	nonces       NonceStore
+	replayWindow time.Duration
+	keyring      *Keyring
+}
+
+// ServiceOption configures a Service
+type ServiceOption func(*Service)
+
+// WithNonceStore sets the store used to remember request nonces
+func WithNonceStore(nonces NonceStore) ServiceOption {
+	return func(s *Service) {
+		s.nonces = nonces
+	}
+}
+
+// WithReplayWindow sets the tolerated clock skew for X-Timestamp
+func WithReplayWindow(window time.Duration) ServiceOption {
+	return func(s *Service) {
+		s.replayWindow = window
+	}
+}
+
+// WithKeyring encrypts access key secrets at rest with the given master keys
+func WithKeyring(keyring *Keyring) ServiceOption {
+	return func(s *Service) {
+		s.keyring = keyring
+	}
+}
+
+// NewService creates a Service using the given store
+func NewService(store Store, opts ...ServiceOption) *Service {
+	s := &Service{
+		store:        store,
+		nonces:       NewMemoryNonceStore(),
+		replayWindow: DefaultReplayWindow,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Store returns the store used by the service
+func (s *Service) Store() Store {
+	return s.store
+}
+
+// CreateAccessKey creates a new access key for a user with specified permissions
+func (s *Service) CreateAccessKey(userID int64, permissions string) (string, string, error) {
+	return s.createAccessKey(userID, permissions, time.Time{})
+}
+
+// CreateAccessKeyWithTTL creates a new access key which expires after ttl
+func (s *Service) CreateAccessKeyWithTTL(userID int64, permissions string, ttl time.Duration) (string, string, error) {
+	if ttl <= 0 {
+		return "", "", errors.New("ttl must be positive")
+	}
+	return s.createAccessKey(userID, permissions, time.Now().Add(ttl))
+}
+
+func (s *Service) createAccessKey(userID int64, permissions string, expiresAt time.Time) (string, string, error) {
+	perms, err := ParsePermissions(permissions)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %v", ErrInvalidPermissions, err)
+	}
+
+	if err := s.checkUserActive(userID); err != nil {
+		return "", "", err
+	}
+
+	// Generate access key pair
+	id, secret, err := GenerateAccessKeyPair()
+	if err != nil {
+		return "", "", err
+	}
+
+	storedSecret, err := s.sealSecret(id, secret)
+	if err != nil {
+		return "", "", err
+	}
+
+	err = s.store.CreateAccessKey(&AccessKey{
+		ID:          id,
+		KeyType:     KeyTypeHMAC,
+		SecretKey:   storedSecret,
+		AccessKey:   id, // Access key is the same as ID for simplicity
+		UserID:      userID,
+		Status:      "active",
+		Permissions: perms,
+		ExpiresAt:   expiresAt,
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	return id, secret, nil
+}
+
+// CreateRole creates a new role and returns its ID
+func (s *Service) CreateRole(name, description string, permissions string) (int, error) {
+	perms, err := ParsePermissions(permissions)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidPermissions, err)
+	}
+
+	role := &Role{
+		Name:        name,
+		Description: description,
+		Permissions: perms,
+	}
+	if err := s.store.CreateRole(role); err != nil {
+		return 0, err
+	}
+	return role.ID, nil
+}
+
+// AssignRoleToAccessKey assigns a role to an access key
+func (s *Service) AssignRoleToAccessKey(accessKeyID string, roleID int) error {
+	// Check if access key exists
+	if _, err := s.store.GetAccessKey(accessKeyID); err != nil {
+		return err
+	}
+
+	// Check if role exists
+	if _, err := s.store.GetRole(roleID); err != nil {
+		return err
+	}
+
+	return s.store.BindRole(accessKeyID, roleID)
+}
+
+// UnassignRoleFromAccessKey removes a role from an access key
+func (s *Service) UnassignRoleFromAccessKey(accessKeyID string, roleID int) error {
+	return s.store.UnbindRole(accessKeyID, roleID)
+}
+
+// ListAccessKeyRoles returns the roles assigned to an access key
+func (s *Service) ListAccessKeyRoles(accessKeyID string) ([]*Role, error) {
+	return s.store.ListAccessKeyRoles(accessKeyID)
+}
+
+// GetRole returns a role
+func (s *Service) GetRole(roleID int) (*Role, error) {
+	return s.store.GetRole(roleID)
+}
+
+// ListRoles returns all roles
+func (s *Service) ListRoles() ([]*Role, error) {
+	return s.store.ListRoles()
+}
+
+// UpdateRole replaces the name, description and permissions of a role
+func (s *Service) UpdateRole(roleID int, name, description string, permissions string) error {
+	perms, err := ParsePermissions(permissions)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPermissions, err)
+	}
+
+	role, err := s.store.GetRole(roleID)
+	if err != nil {
+		return err
+	}
+	role.Name = name
+	role.Description = description
+	role.Permissions = perms
+	return s.store.UpdateRole(role)
+}
+
+// DeleteRole deletes a role. It is removed from all keys, users and groups,
+// and temporary credentials of the role stop working.
+func (s *Service) DeleteRole(roleID int) error {
+	return s.store.DeleteRole(roleID)
+}
+
+// GetAccessKey returns an access key. The secret is stored sealed if a
+// keyring is configured.
+func (s *Service) GetAccessKey(accessKeyID string) (*AccessKey, error) {
+	return s.store.GetAccessKey(accessKeyID)
+}
+
+// ListAllAccessKeys returns the access keys of all users
+func (s *Service) ListAllAccessKeys() ([]AccessKey, error) {
+	return s.store.ListAllAccessKeys()
+}
+
+// DeactivateAccessKey deactivates an access key. Temporary credentials issued
+// to it stop working as well.
+func (s *Service) DeactivateAccessKey(accessKeyID string) error {
+	if _, err := s.store.GetAccessKey(accessKeyID); err != nil {
+		return err
+	}
+	return s.store.UpdateAccessKeyStatus(accessKeyID, "inactive")
+}
+
+// DeleteAccessKey deletes an access key with its role bindings
+func (s *Service) DeleteAccessKey(accessKeyID string) error {
+	return s.store.DeleteAccessKey(accessKeyID)
+}
+
+// ValidateAccessKey validates an access key and records its usage. Unknown,
+// inactive and expired keys are reported as not valid; an error means the
+// store failed.
+func (s *Service) ValidateAccessKey(accessKeyID string) (bool, error) {
+	if IsTemporaryAccessKeyID(accessKeyID) {
+		cred, err := s.getTemporaryCredential(accessKeyID)
+		if errors.Is(err, ErrAccessKeyNotFound) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		// Temporary credentials are revoked with the key they were issued to,
+		// e.g. when its user is suspended
+		source, err := s.store.GetAccessKey(cred.SourceAccessKey)
+		if errors.Is(err, ErrAccessKeyNotFound) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		return s.usable(source, time.Now()), nil
+	}
+
+	ak, err := s.store.GetAccessKey(accessKeyID)
+	if err != nil {
+		if errors.Is(err, ErrAccessKeyNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	now := time.Now()
+	if !s.usable(ak, now) {
+		s.retireRotatedKey(ak, now)
+		return false, nil
+	}
+
+	// The first use of a successor key retires the rotated key
+	if err := s.retirePredecessor(ak); err != nil {
+		return false, err
+	}
+
+	// Update last used timestamp
+	if err := s.store.TouchAccessKey(accessKeyID, now); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// GetAccessKeyPermissions gets the permissions for an access key, merging the
+// permissions of the key itself with those of its roles. For temporary
+// credentials these are the permissions of the assumed role, the session
+// policy is applied on top of them by Authorize.
+func (s *Service) GetAccessKeyPermissions(accessKeyID string) ([]*Permissions, error) {
+	if cache, ok := s.store.(permissionCache); ok {
+		if perms, ok := cache.cachedPermissions(accessKeyID); ok {
+			return perms, nil
+		}
+		perms, err := s.resolvePermissions(accessKeyID)
+		if err != nil {
+			return nil, err
+		}
+		cache.cachePermissions(accessKeyID, perms)
+		return perms, nil
+	}
+	return s.resolvePermissions(accessKeyID)
+}
+
+// resolvePermissions merges the permissions of all sources of an access
+// key, see PermissionSources
+func (s *Service) resolvePermissions(accessKeyID string) ([]*Permissions, error) {
+	sources, err := s.PermissionSources(accessKeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Use a map to drop duplicated permissions
+	seen := make(map[string]bool)
+	var allPermissions []*Permissions
+	for _, src := range sources {
+		if src.Source == SourceSessionPolicy {
+			// Checked separately, see authorize
+			continue
+		}
+		for _, perm := range src.Permissions {
+			key := permissionKey(perm)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			allPermissions = append(allPermissions, perm)
+		}
+	}
+
+	return allPermissions, nil
+}
+
+// Authorize checks whether an access key may perform method on path. Only
+// conditions on the time and the key tags can be satisfied, use
+// AuthorizeRequest to evaluate conditions on the request.
+func (s *Service) Authorize(accessKeyID string, method, path string) (bool, error) {
+	return s.AuthorizeContext(accessKeyID, &RequestContext{Method: method, Path: path})
+}
+
+// AuthorizeRequest checks whether an access key may perform an HTTP request
+func (s *Service) AuthorizeRequest(r *http.Request, accessKeyID string) (bool, error) {
+	return s.AuthorizeContext(accessKeyID, NewRequestContext(r))
+}
+
+// AuthorizeContext checks whether an access key may perform the request described by rc
+func (s *Service) AuthorizeContext(accessKeyID string, rc *RequestContext) (bool, error) {
+	permissions, err := s.GetAccessKeyPermissions(accessKeyID)
+	if err != nil {
+		return false, err
+	}
+	return s.authorizeWith(accessKeyID, permissions, rc)
+}
+
+// authorizeWith checks permissions, and the session policy of temporary credentials
+func (s *Service) authorizeWith(accessKeyID string, permissions []*Permissions, rc *RequestContext) (bool, error) {
+	allowed, _, err := s.authorize(accessKeyID, permissions, rc)
+	return allowed, err
+}
+
+// authorize is authorizeWith that also returns the deciding statement, if any
+func (s *Service) authorize(accessKeyID string, permissions []*Permissions, rc *RequestContext) (bool, *Permissions, error) {
+	if rc.AccessKeyID == "" {
+		if err := s.fillKeyContext(accessKeyID, rc); err != nil {
+			return false, nil, err
+		}
+	}
+
+	allowed, statement := decidePermission(permissions, rc)
+	if !allowed {
+		return false, statement, nil
+	}
+
+	// Temporary credentials must also be allowed by their session policy
+	if IsTemporaryAccessKeyID(accessKeyID) {
+		cred, err := s.getTemporaryCredential(accessKeyID)
+		if err != nil {
+			return false, nil, err
+		}
+		if cred.Policy != nil {
+			if ok, policyStatement := decidePermission(cred.Policy, rc); !ok {
+				return false, policyStatement, nil
+			}
+		}
+	}
+
+	return true, statement, nil
+}
+
+// SetAccessKeyTags replaces the tags of an access key, which can be used in
+// StringEquals conditions as tag:<name>
+func (s *Service) SetAccessKeyTags(accessKeyID string, tags map[string]string) error {
+	if _, err := s.store.GetAccessKey(accessKeyID); err != nil {
+		return err
+	}
+	return s.store.UpdateAccessKeyTags(accessKeyID, tags)
+}
+
+// fillKeyContext sets the access key, user and tags of rc. Temporary
+// credentials use the user and tags of the key they were issued to.
+func (s *Service) fillKeyContext(accessKeyID string, rc *RequestContext) error {
+	sourceKeyID := accessKeyID
+	if IsTemporaryAccessKeyID(accessKeyID) {
+		cred, err := s.getTemporaryCredential(accessKeyID)
+		if err != nil {
+			return err
+		}
+		sourceKeyID = cred.SourceAccessKey
+	}
+
+	ak, err := s.store.GetAccessKey(sourceKeyID)
+	if err != nil {
+		return err
+	}
+
+	rc.AccessKeyID = accessKeyID
+	rc.UserID = ak.UserID
+	if rc.Tags == nil {
+		rc.Tags = ak.Tags
+	}
+	if rc.Tags == nil {
+		rc.Tags = map[string]string{}
+	}
+	return nil
+}
+
+// VerifySignature verifies an HMAC-SHA256 signature for a request. Signatures
+// of Ed25519 access keys are verified by VerifyRequestSignature.
+func (s *Service) VerifySignature(accessKeyID string, stringToSign string, signature string) (bool, error) {
+	return s.verifySignature(accessKeyID, SignatureAlgorithmHMACSHA256, stringToSign, signature)
+}
+
+// verifySignature verifies a signature made with the given algorithm, which
+// must be the algorithm of the access key so that a request cannot pick a
+// weaker check than the key requires
+func (s *Service) verifySignature(accessKeyID, algorithm, stringToSign, signature string) (bool, error) {
+	verify, err := s.signatureVerifier(accessKeyID, algorithm)
+	if err != nil || verify == nil {
+		return false, err
+	}
+	return verify(stringToSign, signature), nil
+}
+
+// signatureVerifier returns a function checking signatures made with the
+// access key using algorithm, or nil if the key does not exist, is not
+// usable or has another type. The streaming body reader uses it to verify
+// every chunk.
+func (s *Service) signatureVerifier(accessKeyID, algorithm string) (func(stringToSign, signature string) bool, error) {
+	if IsTemporaryAccessKeyID(accessKeyID) {
+		if algorithm != SignatureAlgorithmHMACSHA256 {
+			return nil, nil
+		}
+		cred, err := s.getTemporaryCredential(accessKeyID)
+		if err != nil {
+			if errors.Is(err, ErrAccessKeyNotFound) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		secret, err := s.openSecret(&AccessKey{AccessKey: cred.AccessKeyID, SecretKey: cred.SecretKey})
+		if err != nil {
+			return nil, err
+		}
+		return hmacVerifier(secret), nil
+	}
+
+	ak, err := s.store.GetAccessKey(accessKeyID)
+	if err != nil {
+		if errors.Is(err, ErrAccessKeyNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if !s.usable(ak, time.Now()) {
+		return nil, nil
+	}
+	if algorithm != ak.signatureAlgorithm() {
+		return nil, nil
+	}
+	if ak.keyType() == KeyTypeEd25519 {
+		publicKey := ak.PublicKey
+		return func(stringToSign, signature string) bool {
+			return verifyEd25519(publicKey, stringToSign, signature)
+		}, nil
+	}
+
+	secret, err := s.openSecret(ak)
+	if err != nil {
+		return nil, err
+	}
+	return hmacVerifier(secret), nil
+}
+
+// hmacVerifier compares signatures with the HMAC-SHA256 signature of secret
+func hmacVerifier(secret string) func(stringToSign, signature string) bool {
+	return func(stringToSign, signature string) bool {
+		expectedSignature := GenerateSignature(secret, stringToSign)
+		return hmac.Equal([]byte(expectedSignature), []byte(signature))
+	}
+}
+
+// usable reports whether an access key may be used to authenticate at now
+func (s *Service) usable(ak *AccessKey, now time.Time) bool {
+	if ak.Status != "active" {
+		return false
+	}
+	// Overdue keys are flipped to expired by the expirer
+	if !ak.ExpiresAt.IsZero() && !now.Before(ak.ExpiresAt) {
+		return false
+	}
+	return !graceEnded(ak, now)
+}
+
+// GetUserAccessKeys gets all access keys for a user
+func (s *Service) GetUserAccessKeys(userID int64) ([]AccessKey, error) {
+	return s.store.ListAccessKeys(userID)
+}
+
+// EncryptSecrets seals all plaintext secrets, and secrets sealed with an old
+// master key, with the primary master key. It returns the number of updated keys.
+func (s *Service) EncryptSecrets() (int, error) {
+	if s.keyring == nil {
+		return 0, errors.New("no keyring configured")
+	}
+
+	keys, err := s.store.ListAllAccessKeys()
+	if err != nil {
+		return 0, err
+	}
+
+	updated := 0
+	for i := range keys {
+		ak := &keys[i]
+		// Ed25519 keys have no secret
+		if ak.keyType() != KeyTypeHMAC || !s.keyring.NeedsReseal(ak.SecretKey) {
+			continue
+		}
+		secret, err := s.openSecret(ak)
+		if err != nil {
+			return updated, fmt.Errorf("access key %s: %w", ak.AccessKey, err)
+		}
+		sealed, err := s.keyring.Seal(ak.AccessKey, secret)
+		if err != nil {
+			return updated, err
+		}
+		if err := s.store.UpdateAccessKeySecret(ak.AccessKey, sealed); err != nil {
+			return updated, fmt.Errorf("access key %s: %w", ak.AccessKey, err)
+		}
+		updated++
+	}
+
+	return updated, nil
+}
+
+// sealSecret prepares a secret for storage, encrypting it if a keyring is configured
+func (s *Service) sealSecret(accessKeyID, secret string) (string, error) {
+	if s.keyring == nil {
+		return secret, nil
+	}
+	return s.keyring.Seal(accessKeyID, secret)
+}
+
+// openSecret returns the plaintext secret of a stored access key. Secrets that
+// have not been migrated yet are stored in plaintext and returned as is.
+func (s *Service) openSecret(ak *AccessKey) (string, error) {
+	if !IsSealedSecret(ak.SecretKey) {
+		return ak.SecretKey, nil
+	}
+	if s.keyring == nil {
+		return "", errors.New("access key secret is encrypted but no keyring is configured")
+	}
+	return s.keyring.Open(ak.AccessKey, ak.SecretKey)
+}
+
+// permissionKey identifies a permission statement for deduplication
+func permissionKey(perm *Permissions) string {
+	data, err := json.Marshal(perm)
+	if err != nil {
+		return fmt.Sprintf("%v-%v-%v", perm.Resources, perm.Actions, perm.Effect)
+	}
+	return string(data)
+}
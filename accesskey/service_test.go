@@ -0,0 +1,29 @@
+package accesskey
+
+import (
+	"testing"
+)
+
+// allowAll grants every action on every resource
+const allowAll = `[{"actions":["*"],"resources":["**"],"effect":"allow"}]`
+
+// newTestService returns a Service on a MemoryStore with an active user
+func newTestService(t *testing.T, opts ...ServiceOption) (*Service, *User) {
+	t.Helper()
+	s := NewService(NewMemoryStore(), opts...)
+	user, err := s.CreateUser("alice", "password123", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, user
+}
+
+// newTestKey creates an HMAC access key for user and returns its ID and secret
+func newTestKey(t *testing.T, s *Service, user *User, permissions string) (string, string) {
+	t.Helper()
+	id, secret, err := s.CreateAccessKey(user.ID, permissions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id, secret
+}
@@ -1,14 +1,13 @@
 package accesskey
 
 import (
-	"bytes"
 	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
-	"io"
-	"log"
 	"net/http"
+	"net/url"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -21,11 +20,26 @@ type SignatureParams struct {
 	QueryParams map[string]string
 	Headers     map[string]string
 	Timestamp   string
+	Nonce       string
 	Content     []byte
+	// ContentSHA256 is the X-Content-SHA256 header. If set, it is signed
+	// instead of the hash of Content, see StreamingPayload.
+	ContentSHA256 string
+
+	// Version selects the canonicalization, SignatureVersion1 if empty
+	Version string
+	// Host, Query and SignedHeaders are only used by SignatureVersion2
+	Host          string
+	Query         url.Values
+	SignedHeaders []string
 }
 
 // GenerateStringToSign generates the string to be signed
 func GenerateStringToSign(params SignatureParams) string {
+	if params.Version == SignatureVersion2 {
+		return generateStringToSignV2(params)
+	}
+
 	// 1. Start with HTTP method
 	parts := []string{params.Method}
 
@@ -45,11 +59,14 @@ func GenerateStringToSign(params SignatureParams) string {
 	}
 	parts = append(parts, strings.Join(queryParts, "&"))
 
-	// 4. Add timestamp
+	// 4. Add timestamp and nonce
 	parts = append(parts, params.Timestamp)
+	parts = append(parts, params.Nonce)
 
 	// 5. Add content hash if available
-	if len(params.Content) > 0 {
+	if params.ContentSHA256 != "" {
+		parts = append(parts, params.ContentSHA256)
+	} else if len(params.Content) > 0 {
 		contentHash := sha256.Sum256(params.Content)
 		parts = append(parts, base64.StdEncoding.EncodeToString(contentHash[:]))
 	} else {
@@ -59,16 +76,98 @@ func GenerateStringToSign(params SignatureParams) string {
 	return strings.Join(parts, "\n")
 }
 
-// SignRequest signs an HTTP request with HMAC-SHA256
+// SignRequest signs an HTTP request using DefaultSignatureVersion. The
+// request is signed with HMAC-SHA256, or with Ed25519 if accessKeySecret is
+// an Ed25519 private key from GenerateAccessKeyPair. If the request cannot be
+// signed, e.g. because of a malformed Ed25519 private key, it is left without
+// X-Signature; use SignRequestWithVersion to get the error.
 func SignRequest(req *http.Request, accessKeyID string, accessKeySecret string, content []byte) {
+	SignRequestWithVersion(req, accessKeyID, accessKeySecret, content, DefaultSignatureVersion)
+}
+
+// SignRequestWithVersion signs an HTTP request like SignRequest using the
+// given signature version. On error the request is left without X-Signature.
+func SignRequestWithVersion(req *http.Request, accessKeyID string, accessKeySecret string, content []byte, version string) error {
+	if err := signRequest(req, accessKeyID, accessKeySecret, content, version, time.Now()); err != nil {
+		req.Header.Del("X-Signature")
+		return err
+	}
+	return nil
+}
+
+// signRequest signs a request with the given signing time
+func signRequest(req *http.Request, accessKeyID string, accessKeySecret string, content []byte, version string, now time.Time) error {
+	if version != SignatureVersion1 && version != SignatureVersion2 {
+		return fmt.Errorf("unsupported signature version %q", version)
+	}
+
 	// Add required headers
-	timestamp := fmt.Sprintf("%d", time.Now().Unix())
+	timestamp := fmt.Sprintf("%d", now.Unix())
+	nonce, err := GenerateNonce()
+	if err != nil {
+		return fmt.Errorf("generate nonce: %w", err)
+	}
 	req.Header.Set("X-Access-Key-ID", accessKeyID)
 	req.Header.Set("X-Timestamp", timestamp)
+	req.Header.Set("X-Nonce", nonce)
+	if isEd25519Secret(accessKeySecret) {
+		req.Header.Set("X-Signature-Algorithm", SignatureAlgorithmEd25519)
+	} else {
+		req.Header.Del("X-Signature-Algorithm")
+	}
+
+	if version == SignatureVersion2 {
+		signed := []string{"host"}
+		for _, name := range defaultSignedHeaders {
+			if req.Header.Get(name) != "" {
+				signed = append(signed, name)
+			}
+		}
+		sort.Strings(signed)
+		req.Header.Set("X-Signature-Version", version)
+		req.Header.Set("X-Signed-Headers", strings.Join(signed, ";"))
+	} else {
+		req.Header.Del("X-Signature-Version")
+		req.Header.Del("X-Signed-Headers")
+	}
 
 	// Prepare signature parameters
+	params, err := newSignatureParams(req, content)
+	if err != nil {
+		return err
+	}
+
+	// Generate string to sign
+	stringToSign := GenerateStringToSign(params)
+
+	// Generate signature
+	var signature string
+	if isEd25519Secret(accessKeySecret) {
+		if signature, err = signEd25519(accessKeySecret, stringToSign); err != nil {
+			return err
+		}
+	} else {
+		signature = GenerateSignature(accessKeySecret, stringToSign)
+	}
+
+	// Add signature to request
+	req.Header.Set("X-Signature", signature)
+	return nil
+}
+
+// newSignatureParams collects the signature parameters from a request
+func newSignatureParams(req *http.Request, content []byte) (SignatureParams, error) {
+	version := req.Header.Get("X-Signature-Version")
+	if version == "" {
+		version = SignatureVersion1
+	}
+	if version != SignatureVersion1 && version != SignatureVersion2 {
+		return SignatureParams{}, fmt.Errorf("unsupported signature version %q", version)
+	}
+
+	query := req.URL.Query()
 	queryParams := make(map[string]string)
-	for k, v := range req.URL.Query() {
+	for k, v := range query {
 		if len(v) > 0 {
 			queryParams[k] = v[0]
 		}
@@ -76,33 +175,68 @@ func SignRequest(req *http.Request, accessKeyID string, accessKeySecret string,
 
 	headers := make(map[string]string)
 	for k, v := range req.Header {
-		if len(v) > 0 {
-			headers[k] = v[0]
+		if len(v) > 0 && k != "X-Signature" {
+			headers[k] = strings.Join(v, ",")
 		}
 	}
 
 	params := SignatureParams{
-		AccessKeyID: accessKeyID,
+		AccessKeyID: req.Header.Get("X-Access-Key-ID"),
 		Method:      req.Method,
 		Path:        req.URL.Path,
 		QueryParams: queryParams,
 		Headers:     headers,
-		Timestamp:   timestamp,
+		Timestamp:   req.Header.Get("X-Timestamp"),
+		Nonce:       req.Header.Get("X-Nonce"),
 		Content:     content,
-	}
+		Version:     version,
 
-	// Generate string to sign
-	stringToSign := GenerateStringToSign(params)
+		ContentSHA256: req.Header.Get(contentSHA256Header),
+	}
 
-	// Generate signature
-	signature := GenerateSignature(accessKeySecret, stringToSign)
+	if version == SignatureVersion2 {
+		signedHeaders, err := parseSignedHeaders(req.Header.Get("X-Signed-Headers"))
+		if err != nil {
+			return SignatureParams{}, err
+		}
+		params.SignedHeaders = signedHeaders
+		params.Query = query
+		params.Host = req.Host
+		if params.Host == "" {
+			params.Host = req.URL.Host
+		}
+	}
 
-	// Add signature to request
-	req.Header.Set("X-Signature", signature)
+	return params, nil
 }
 
 // VerifyRequestSignature verifies the signature of an HTTP request
 func VerifyRequestSignature(req *http.Request, content []byte) (bool, error) {
+	s, err := getDefaultService()
+	if err != nil {
+		return false, err
+	}
+	return s.VerifyRequestSignature(req, content)
+}
+
+// VerifyRequestSignature verifies the signature of an HTTP request, given in
+// the headers or, for URLs created by Presign, in the query. content is the
+// whole body: requests declaring UNSIGNED-PAYLOAD or StreamingPayload in
+// X-Content-SHA256 are rejected with ErrUnsignedPayloadNotAllowed, only the
+// middleware verifies them.
+func (s *Service) VerifyRequestSignature(req *http.Request, content []byte) (bool, error) {
+	return s.verifyRequestSignature(req, content, false)
+}
+
+// verifyRequestSignature is VerifyRequestSignature for the middleware. With
+// deferredPayload, the body of requests declaring X-Content-SHA256 is not
+// passed in content but checked while the handler reads it, and
+// UNSIGNED-PAYLOAD has been allowed for the path.
+func (s *Service) verifyRequestSignature(req *http.Request, content []byte, deferredPayload bool) (bool, error) {
+	if isPresigned(req) {
+		return s.verifyPresignedRequest(req, content)
+	}
+
 	// Get access key ID from request
 	accessKeyID := req.Header.Get("X-Access-Key-ID")
 	if accessKeyID == "" {
@@ -114,6 +248,19 @@ func VerifyRequestSignature(req *http.Request, content []byte) (bool, error) {
 	if timestamp == "" {
 		return false, fmt.Errorf("missing X-Timestamp header")
 	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("invalid X-Timestamp header: %w", err)
+	}
+	if err := checkTimestamp(ts, time.Now(), s.replayWindow); err != nil {
+		return false, err
+	}
+
+	// Get nonce from request
+	nonce := req.Header.Get("X-Nonce")
+	if err := checkNonce(nonce); err != nil {
+		return false, err
+	}
 
 	// Get signature from request
 	signature := req.Header.Get("X-Signature")
@@ -121,168 +268,156 @@ func VerifyRequestSignature(req *http.Request, content []byte) (bool, error) {
 		return false, fmt.Errorf("missing X-Signature header")
 	}
 
-	// Prepare signature parameters
-	queryParams := make(map[string]string)
-	for k, v := range req.URL.Query() {
-		if len(v) > 0 {
-			queryParams[k] = v[0]
-		}
+	// Get signature algorithm, which must match the type of the access key
+	algorithm, err := parseSignatureAlgorithm(req.Header.Get("X-Signature-Algorithm"))
+	if err != nil {
+		return false, err
 	}
 
-	headers := make(map[string]string)
-	for k, v := range req.Header {
-		if len(v) > 0 && k != "X-Signature" {
-			headers[k] = v[0]
+	// Temporary credentials must present their session token
+	if IsTemporaryAccessKeyID(accessKeyID) {
+		if err := s.checkSessionToken(accessKeyID, req.Header.Get("X-Security-Token")); err != nil {
+			return false, err
 		}
 	}
 
-	params := SignatureParams{
-		AccessKeyID: accessKeyID,
-		Method:      req.Method,
-		Path:        req.URL.Path,
-		QueryParams: queryParams,
-		Headers:     headers,
-		Timestamp:   timestamp,
-		Content:     content,
+	// Prepare signature parameters
+	params, err := newSignatureParams(req, content)
+	if err != nil {
+		return false, err
+	}
+	if err := checkContentSHA256(params.ContentSHA256, content, deferredPayload); err != nil {
+		return false, err
 	}
 
 	// Generate string to sign
 	stringToSign := GenerateStringToSign(params)
 
 	// Verify signature
-	return VerifySignature(accessKeyID, stringToSign, signature)
-}
+	valid, err := s.verifySignature(accessKeyID, algorithm, stringToSign, signature)
+	if err != nil || !valid {
+		return valid, err
+	}
 
-// matchPathPattern checks if a request path matches a pattern with wildcards
-func matchPathPattern(pattern, path string) bool {
-	// If pattern ends with *, it's a prefix match
-	if strings.HasSuffix(pattern, "/*") {
-		prefix := strings.TrimSuffix(pattern, "/*")
-		return strings.HasPrefix(path, prefix)
+	// Only remember nonces of correctly signed requests. The nonce has to be
+	// kept as long as its timestamp is acceptable, i.e. until ts + window.
+	fresh, err := s.nonces.CheckAndStore(accessKeyID+":"+nonce, time.Unix(ts, 0).Add(s.replayWindow))
+	if err != nil {
+		return false, err
+	}
+	if !fresh {
+		return false, ErrNonceReused
 	}
 
-	// Exact match
-	return pattern == path
+	return true, nil
 }
 
-// hasPermission checks if the given permissions allow access to the specified method and path
-func hasPermission(perms []*Permissions, method, path string) bool {
-	// Check if permissions are empty
-	if perms == nil || len(perms) == 0 {
-		return false
+// parseSignatureAlgorithm checks an X-Signature-Algorithm value, empty means
+// SignatureAlgorithmHMACSHA256
+func parseSignatureAlgorithm(value string) (string, error) {
+	switch value {
+	case "":
+		return SignatureAlgorithmHMACSHA256, nil
+	case SignatureAlgorithmHMACSHA256, SignatureAlgorithmEd25519:
+		return value, nil
+	default:
+		return "", fmt.Errorf("unsupported signature algorithm %q", value)
 	}
+}
 
-	// Track if we found any matching rules
-	foundMatch := false
-	finalAllow := false
+// hasPermission checks if the given permissions allow access to the method and
+// path of the request context. Statements whose conditions do not hold are ignored.
+func hasPermission(perms []*Permissions, rc *RequestContext) bool {
+	allowed, _ := decidePermission(perms, rc)
+	return allowed
+}
 
+// decidePermission is hasPermission that also returns the deciding statement:
+// the matching deny statement, or the first matching allow statement
+func decidePermission(perms []*Permissions, rc *RequestContext) (bool, *Permissions) {
+	var allowedBy *Permissions
 	for _, perm := range perms {
-		resources := perm.Resources
-		actions := perm.Actions
-		effect := perm.Effect
-
-		effect = strings.ToLower(effect)
-		if effect != "allow" && effect != "deny" {
+		check := checkStatement(perm, rc)
+		if !check.applies() {
 			continue
 		}
-		// Check if method is allowed
-		methodAllowed := false
-		for _, actionStr := range actions {
-			actionStr = strings.ToUpper(actionStr)
-			if actionStr == strings.ToUpper(method) || actionStr == "*" {
-				methodAllowed = true
-				break
-			}
+		// For deny rules, return false immediately
+		if check.effect == "deny" {
+			return false, perm
 		}
-		if !methodAllowed {
-			continue
-		}
-		// Check if path is allowed
-		pathAllowed := false
-		for _, resource := range resources {
-			if matchPathPattern(resource, path) {
-				pathAllowed = true
-				break
-			}
-		}
-		if pathAllowed {
-			foundMatch = true
-			// For deny rules, return false immediately
-			if effect == "deny" {
-				return false
-			}
-			// For allow rules, mark it but continue checking for deny rules
-			finalAllow = true
+		// For allow rules, mark it but continue checking for deny rules
+		if allowedBy == nil {
+			allowedBy = perm
 		}
 	}
-	// Return true only if we found at least one match and the final result is allow
-	return foundMatch && finalAllow
+	return allowedBy != nil, allowedBy
 }
 
-// CreateMiddleware creates a middleware for signature verification
-func CreateMiddleware(f http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+// statementCheck is the result of matching one statement against a request
+type statementCheck struct {
+	effect            string // lower case, empty if invalid
+	actionMatched     bool
+	resourceMatched   bool
+	conditionsMatched bool
+}
 
-		var body []byte
-		if r.Body != nil {
-			body, _ = io.ReadAll(r.Body)
-			// Reset the body for subsequent reads
-			r.Body = io.NopCloser(bytes.NewBuffer(body))
-		}
+func (c statementCheck) applies() bool {
+	return c.effect != "" && c.actionMatched && c.resourceMatched && c.conditionsMatched
+}
 
-		// Sign the request
-		SignRequest(r, "14789", "wen", body)
-		// Skip signature verification for certain paths if needed
-		// if r.URL.Path == "/public/endpoint" {
-		// 	next.ServeHTTP(w, r)
-		// 	return
-		// }
-
-		// Verify signature in the server
-		valid, err := VerifyRequestSignature(r, body)
-		if err != nil || !valid {
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte("Invalid signature"))
-			return
-		}
+// matchAction reports whether a statement action matches the requested
+// action. Actions are case-insensitive. "*" matches every HTTP method, while
+// namespaced actions like admin:CreateAccessKey are only matched by the
+// action itself or a wildcard in the namespace such as "admin:*" or
+// "admin:Create*", so that existing broad grants do not include them.
+func matchAction(pattern, action string) bool {
+	pattern = strings.ToUpper(pattern)
+	action = strings.ToUpper(action)
+	if pattern == action {
+		return true
+	}
+	if !strings.Contains(action, ":") {
+		return pattern == "*"
+	}
+	prefix, ok := strings.CutSuffix(pattern, "*")
+	return ok && strings.Contains(prefix, ":") && strings.HasPrefix(action, prefix)
+}
 
-		// Verify whether the access key is available
-		accessKeyID := r.Header.Get("X-Access-Key-ID")
-		valid, err = ValidateAccessKey(accessKeyID)
-		if err != nil || !valid {
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte("Invalid access key"))
-			return
-		}
+func checkStatement(perm *Permissions, rc *RequestContext) statementCheck {
+	var c statementCheck
 
-		// Get all permissions for the access key
-		permissions, err := GetAccessKeyPermissions(accessKeyID)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("Error getting permissions"))
-			return
-		}
+	effect := strings.ToLower(perm.Effect)
+	if effect != "allow" && effect != "deny" {
+		return c
+	}
+	c.effect = effect
 
-		// Check if the access key has permission to access the endpoint
-		// This is a simplified example, you would need to implement your own permission checking logic
-		//var perms map[string]interface{}
-		//err = json.Unmarshal([]byte(permissions), &perms)
-		//if err != nil {
-		//	w.WriteHeader(http.StatusInternalServerError)
-		//	w.Write([]byte("Error parsing permissions"))
-		//	return
-		//}
-
-		// Example permission check
-		log.Printf("Checking permission for %s /// %s /// %s", permissions, r.Method, r.URL.Path)
-		if !hasPermission(permissions, r.Method, r.URL.Path) {
-			w.WriteHeader(http.StatusForbidden)
-			w.Write([]byte("Insufficient permissions"))
-			return
+	// Check if method is allowed
+	requested := rc.Action
+	if requested == "" {
+		requested = rc.Method
+	}
+	for _, action := range perm.Actions {
+		if matchAction(action, requested) {
+			c.actionMatched = true
+			break
 		}
+	}
+	if !c.actionMatched {
+		return c
+	}
 
-		// Call the next handler
-		f.ServeHTTP(w, r)
-	})
+	// Check if path is allowed
+	for _, resource := range perm.Resources {
+		if matchResource(resource, rc.Path, rc) {
+			c.resourceMatched = true
+			break
+		}
+	}
+	if !c.resourceMatched {
+		return c
+	}
 
+	c.conditionsMatched = len(perm.Conditions) == 0 || perm.Conditions.Evaluate(rc)
+	return c
 }
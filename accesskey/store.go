@@ -0,0 +1,204 @@
+package accesskey
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrAccessKeyNotFound is returned when an access key does not exist
+	ErrAccessKeyNotFound = errors.New("access key not found")
+	// ErrRoleNotFound is returned when a role does not exist
+	ErrRoleNotFound = errors.New("role not found")
+	// ErrRoleExists is returned when creating or renaming a role to a name that is taken
+	ErrRoleExists = errors.New("role name already exists")
+	// ErrUserNotFound is returned when a user does not exist
+	ErrUserNotFound = errors.New("user not found")
+	// ErrUserExists is returned when creating a user with a username that is taken
+	ErrUserExists = errors.New("username already exists")
+	// ErrInvalidPermissions is returned when a permissions document cannot be parsed
+	ErrInvalidPermissions = errors.New("invalid permissions")
+	// ErrGroupNotFound is returned when a group does not exist
+	ErrGroupNotFound = errors.New("group not found")
+	// ErrGroupExists is returned when creating a group with a name that is taken
+	ErrGroupExists = errors.New("group name already exists")
+	// ErrPolicyNotFound is returned when a managed policy does not exist
+	ErrPolicyNotFound = errors.New("policy not found")
+	// ErrPolicyExists is returned when creating a policy with a name that is taken
+	ErrPolicyExists = errors.New("policy name already exists")
+	// ErrPolicyVersionNotFound is returned when a policy version does not exist
+	ErrPolicyVersionNotFound = errors.New("policy version not found")
+)
+
+// Store persists access keys, roles and the bindings between them
+type Store interface {
+	// CreateAccessKey stores a new access key
+	CreateAccessKey(key *AccessKey) error
+	// GetAccessKey returns the access key or ErrAccessKeyNotFound
+	GetAccessKey(accessKeyID string) (*AccessKey, error)
+	// ListAccessKeys returns all access keys of a user
+	ListAccessKeys(userID int64) ([]AccessKey, error)
+	// ListAllAccessKeys returns the access keys of all users
+	ListAllAccessKeys() ([]AccessKey, error)
+	// UpdateAccessKeyStatus sets the status of an access key
+	UpdateAccessKeyStatus(accessKeyID string, status string) error
+	// RetireAccessKey sets the status of an active access key to inactive and
+	// reports whether it was active. Missing keys are not an error.
+	RetireAccessKey(accessKeyID string) (bool, error)
+	// UpdateAccessKeySecret replaces the stored secret of an access key
+	UpdateAccessKeySecret(accessKeyID string, secret string) error
+	// SetAccessKeyGraceUntil sets the end of the rotation grace period of an access key
+	SetAccessKeyGraceUntil(accessKeyID string, until time.Time) error
+	// ListGraceEndedAccessKeys returns active access keys whose rotation grace period ended before now
+	ListGraceEndedAccessKeys(now time.Time) ([]AccessKey, error)
+	// ListAccessKeysExpiringBefore returns active access keys with an expiry time before t
+	ListAccessKeysExpiringBefore(t time.Time) ([]AccessKey, error)
+	// UpdateAccessKeyTags replaces the tags of an access key
+	UpdateAccessKeyTags(accessKeyID string, tags map[string]string) error
+	// UpdateAccessKeyRateLimit sets the rate limit of an access key, nil removes it
+	UpdateAccessKeyRateLimit(accessKeyID string, limit *RateLimit) error
+	// TouchAccessKey records the last time an access key was used
+	TouchAccessKey(accessKeyID string, usedAt time.Time) error
+	// DeleteAccessKey deletes an access key with its role bindings and policy
+	// attachments, or returns ErrAccessKeyNotFound
+	DeleteAccessKey(accessKeyID string) error
+
+	// CreateRole stores a new role and sets its ID, or returns ErrRoleExists
+	CreateRole(role *Role) error
+	// GetRole returns the role or ErrRoleNotFound
+	GetRole(roleID int) (*Role, error)
+	// ListRoles returns all roles ordered by ID
+	ListRoles() ([]*Role, error)
+	// UpdateRole replaces the name, description and permissions of a role
+	UpdateRole(role *Role) error
+	// DeleteRole deletes a role with all its bindings and policy attachments,
+	// or returns ErrRoleNotFound
+	DeleteRole(roleID int) error
+	// UpdateRoleRateLimit sets the rate limit of a role, nil removes it
+	UpdateRoleRateLimit(roleID int, limit *RateLimit) error
+
+	// BindRole assigns a role to an access key
+	BindRole(accessKeyID string, roleID int) error
+	// UnbindRole removes a role from an access key
+	UnbindRole(accessKeyID string, roleID int) error
+	// ListAccessKeyRoles returns all roles assigned to an access key
+	ListAccessKeyRoles(accessKeyID string) ([]*Role, error)
+
+	// CreateUser stores a new user and sets its ID, or returns ErrUserExists
+	CreateUser(user *User) error
+	// GetUser returns the user or ErrUserNotFound
+	GetUser(userID int64) (*User, error)
+	// GetUserByName returns the user or ErrUserNotFound
+	GetUserByName(username string) (*User, error)
+	// ListSubUsers returns the RAM sub-accounts of a main account
+	ListSubUsers(parentID int64) ([]User, error)
+	// UpdateUserStatus sets the status of a user
+	UpdateUserStatus(userID int64, status string) error
+	// UpdateUserPassword replaces the password hash of a user
+	UpdateUserPassword(userID int64, passwordHash string) error
+
+	// CreateGroup stores a new group and sets its ID, or returns ErrGroupExists
+	CreateGroup(group *Group) error
+	// GetGroup returns the group or ErrGroupNotFound
+	GetGroup(groupID int) (*Group, error)
+	// ListGroups returns all groups ordered by ID
+	ListGroups() ([]*Group, error)
+	// AddGroupMember adds a user to a group
+	AddGroupMember(groupID int, userID int64) error
+	// RemoveGroupMember removes a user from a group
+	RemoveGroupMember(groupID int, userID int64) error
+	// ListGroupMembers returns the members of a group ordered by ID
+	ListGroupMembers(groupID int) ([]User, error)
+	// ListUserGroups returns the groups of a user ordered by ID
+	ListUserGroups(userID int64) ([]*Group, error)
+	// BindGroupRole attaches a role to a group
+	BindGroupRole(groupID int, roleID int) error
+	// UnbindGroupRole detaches a role from a group
+	UnbindGroupRole(groupID int, roleID int) error
+	// ListGroupRoles returns the roles attached to a group ordered by ID
+	ListGroupRoles(groupID int) ([]*Role, error)
+	// BindUserRole attaches a role to a user
+	BindUserRole(userID int64, roleID int) error
+	// UnbindUserRole detaches a role from a user
+	UnbindUserRole(userID int64, roleID int) error
+	// ListUserRoles returns the roles attached to a user ordered by ID
+	ListUserRoles(userID int64) ([]*Role, error)
+
+	// CreatePolicy stores a new policy with its Document as version 1, sets
+	// its ID and default version, or returns ErrPolicyExists
+	CreatePolicy(policy *Policy) error
+	// GetPolicy returns the policy with the document of its default version,
+	// or ErrPolicyNotFound
+	GetPolicy(policyID int) (*Policy, error)
+	// ListPolicies returns all policies ordered by ID
+	ListPolicies() ([]*Policy, error)
+	// CreatePolicyVersion stores the next version of a policy and makes it
+	// the default version if setDefault is true
+	CreatePolicyVersion(policyID int, document []*Permissions, setDefault bool) (*PolicyVersion, error)
+	// GetPolicyVersion returns a policy version or ErrPolicyVersionNotFound
+	GetPolicyVersion(policyID int, version int) (*PolicyVersion, error)
+	// ListPolicyVersions returns the versions of a policy, oldest first
+	ListPolicyVersions(policyID int) ([]PolicyVersion, error)
+	// SetDefaultPolicyVersion sets the default version of a policy
+	SetDefaultPolicyVersion(policyID int, version int) error
+	// AttachPolicy attaches a policy to a role, user or access key
+	AttachPolicy(policyID int, targetType, targetID string) error
+	// DetachPolicy detaches a policy from a role, user or access key
+	DetachPolicy(policyID int, targetType, targetID string) error
+	// ListAttachedPolicies returns the policies attached to a role, user or
+	// access key ordered by ID
+	ListAttachedPolicies(targetType, targetID string) ([]*Policy, error)
+
+	// CreateTemporaryCredential stores temporary credentials issued by AssumeRole
+	CreateTemporaryCredential(cred *TemporaryCredential) error
+	// GetTemporaryCredential returns temporary credentials or ErrAccessKeyNotFound
+	GetTemporaryCredential(accessKeyID string) (*TemporaryCredential, error)
+	// DeleteExpiredTemporaryCredentials deletes temporary credentials expired before now
+	DeleteExpiredTemporaryCredentials(now time.Time) (int64, error)
+}
+
+// ParsePermissions parses a permissions JSON document. Both a single
+// permission object and an array of permission objects are accepted.
+func ParsePermissions(data string) ([]*Permissions, error) {
+	trimmed := bytes.TrimSpace([]byte(data))
+	if len(trimmed) == 0 || bytes.Equal(trimmed, []byte("null")) {
+		return nil, nil
+	}
+
+	var perms []*Permissions
+	if trimmed[0] == '{' {
+		var perm Permissions
+		if err := json.Unmarshal(trimmed, &perm); err != nil {
+			return nil, err
+		}
+		perms = []*Permissions{&perm}
+	} else if err := json.Unmarshal(trimmed, &perms); err != nil {
+		return nil, err
+	}
+
+	for _, perm := range perms {
+		if err := perm.Conditions.Validate(); err != nil {
+			return nil, err
+		}
+		for _, resource := range perm.Resources {
+			if _, err := compiledPattern(resource); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return perms, nil
+}
+
+// marshalPermissions converts permissions to the JSON stored in the database
+func marshalPermissions(perms []*Permissions) (string, error) {
+	if perms == nil {
+		perms = []*Permissions{}
+	}
+	data, err := json.Marshal(perms)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
@@ -0,0 +1,875 @@
+package accesskey
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemoryStore is an in-memory Store, useful for tests and single process setups
+type MemoryStore struct {
+	mu         sync.RWMutex
+	keys       map[string]*AccessKey
+	roles      map[int]*Role
+	bindings   map[string][]int
+	tempCreds  map[string]*TemporaryCredential
+	users      map[int64]*User
+	groups     map[int]*Group
+	members    map[int]map[int64]bool
+	groupRoles map[int][]int
+	userRoles  map[int64][]int
+	policies   map[int]*Policy
+	versions   map[int][]PolicyVersion
+	attached   map[string][]int
+
+	nextRoleID   int
+	nextUserID   int64
+	nextGroupID  int
+	nextPolicyID int
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		keys:       make(map[string]*AccessKey),
+		roles:      make(map[int]*Role),
+		bindings:   make(map[string][]int),
+		tempCreds:  make(map[string]*TemporaryCredential),
+		users:      make(map[int64]*User),
+		groups:     make(map[int]*Group),
+		members:    make(map[int]map[int64]bool),
+		groupRoles: make(map[int][]int),
+		userRoles:  make(map[int64][]int),
+		policies:   make(map[int]*Policy),
+		versions:   make(map[int][]PolicyVersion),
+		attached:   make(map[string][]int),
+
+		nextRoleID:   1,
+		nextUserID:   1,
+		nextGroupID:  1,
+		nextPolicyID: 1,
+	}
+}
+
+// CreateAccessKey implements Store
+func (s *MemoryStore) CreateAccessKey(key *AccessKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ak := *key
+	if ak.Status == "" {
+		ak.Status = "active"
+	}
+	if ak.CreatedAt.IsZero() {
+		ak.CreatedAt = time.Now()
+	}
+	s.keys[ak.AccessKey] = &ak
+	return nil
+}
+
+// GetAccessKey implements Store
+func (s *MemoryStore) GetAccessKey(accessKeyID string) (*AccessKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ak, ok := s.keys[accessKeyID]
+	if !ok {
+		return nil, ErrAccessKeyNotFound
+	}
+	cp := *ak
+	return &cp, nil
+}
+
+// ListAccessKeys implements Store
+func (s *MemoryStore) ListAccessKeys(userID int64) ([]AccessKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var accessKeys []AccessKey
+	for _, ak := range s.keys {
+		if ak.UserID == userID {
+			accessKeys = append(accessKeys, *ak)
+		}
+	}
+	return accessKeys, nil
+}
+
+// ListAllAccessKeys implements Store
+func (s *MemoryStore) ListAllAccessKeys() ([]AccessKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	accessKeys := make([]AccessKey, 0, len(s.keys))
+	for _, ak := range s.keys {
+		accessKeys = append(accessKeys, *ak)
+	}
+	return accessKeys, nil
+}
+
+// UpdateAccessKeyStatus implements Store
+func (s *MemoryStore) UpdateAccessKeyStatus(accessKeyID string, status string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ak, ok := s.keys[accessKeyID]
+	if !ok {
+		return ErrAccessKeyNotFound
+	}
+	ak.Status = status
+	return nil
+}
+
+// RetireAccessKey implements Store
+func (s *MemoryStore) RetireAccessKey(accessKeyID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ak, ok := s.keys[accessKeyID]
+	if !ok || ak.Status != "active" {
+		return false, nil
+	}
+	ak.Status = "inactive"
+	return true, nil
+}
+
+// UpdateAccessKeySecret implements Store
+func (s *MemoryStore) UpdateAccessKeySecret(accessKeyID string, secret string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ak, ok := s.keys[accessKeyID]
+	if !ok {
+		return ErrAccessKeyNotFound
+	}
+	ak.SecretKey = secret
+	return nil
+}
+
+// SetAccessKeyGraceUntil implements Store
+func (s *MemoryStore) SetAccessKeyGraceUntil(accessKeyID string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ak, ok := s.keys[accessKeyID]
+	if !ok {
+		return ErrAccessKeyNotFound
+	}
+	ak.GraceUntil = until
+	return nil
+}
+
+// ListGraceEndedAccessKeys implements Store
+func (s *MemoryStore) ListGraceEndedAccessKeys(now time.Time) ([]AccessKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var accessKeys []AccessKey
+	for _, ak := range s.keys {
+		if ak.Status == "active" && !ak.GraceUntil.IsZero() && !ak.GraceUntil.After(now) {
+			accessKeys = append(accessKeys, *ak)
+		}
+	}
+	return accessKeys, nil
+}
+
+// ListAccessKeysExpiringBefore implements Store
+func (s *MemoryStore) ListAccessKeysExpiringBefore(t time.Time) ([]AccessKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var accessKeys []AccessKey
+	for _, ak := range s.keys {
+		if ak.Status == "active" && !ak.ExpiresAt.IsZero() && !ak.ExpiresAt.After(t) {
+			accessKeys = append(accessKeys, *ak)
+		}
+	}
+	sort.Slice(accessKeys, func(i, j int) bool {
+		return accessKeys[i].ExpiresAt.Before(accessKeys[j].ExpiresAt)
+	})
+	return accessKeys, nil
+}
+
+// UpdateAccessKeyTags implements Store
+func (s *MemoryStore) UpdateAccessKeyTags(accessKeyID string, tags map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ak, ok := s.keys[accessKeyID]
+	if !ok {
+		return ErrAccessKeyNotFound
+	}
+	ak.Tags = make(map[string]string, len(tags))
+	for k, v := range tags {
+		ak.Tags[k] = v
+	}
+	return nil
+}
+
+// UpdateAccessKeyRateLimit implements Store
+func (s *MemoryStore) UpdateAccessKeyRateLimit(accessKeyID string, limit *RateLimit) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ak, ok := s.keys[accessKeyID]
+	if !ok {
+		return ErrAccessKeyNotFound
+	}
+	ak.RateLimit = copyRateLimit(limit)
+	return nil
+}
+
+// TouchAccessKey implements Store
+func (s *MemoryStore) TouchAccessKey(accessKeyID string, usedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ak, ok := s.keys[accessKeyID]; ok {
+		ak.LastUsedAt = usedAt
+	}
+	return nil
+}
+
+// DeleteAccessKey implements Store
+func (s *MemoryStore) DeleteAccessKey(accessKeyID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.keys[accessKeyID]; !ok {
+		return ErrAccessKeyNotFound
+	}
+	delete(s.keys, accessKeyID)
+	delete(s.bindings, accessKeyID)
+	delete(s.attached, PolicyTargetAccessKey+":"+accessKeyID)
+	return nil
+}
+
+// CreateRole implements Store
+func (s *MemoryStore) CreateRole(role *Role) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range s.roles {
+		if r.Name == role.Name {
+			return ErrRoleExists
+		}
+	}
+
+	now := time.Now()
+	role.ID = s.nextRoleID
+	role.CreatedAt = now
+	role.UpdatedAt = now
+	s.nextRoleID++
+
+	r := *role
+	s.roles[r.ID] = &r
+	return nil
+}
+
+// GetRole implements Store
+func (s *MemoryStore) GetRole(roleID int) (*Role, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	role, ok := s.roles[roleID]
+	if !ok {
+		return nil, ErrRoleNotFound
+	}
+	cp := *role
+	return &cp, nil
+}
+
+// ListRoles implements Store
+func (s *MemoryStore) ListRoles() ([]*Role, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var roles []*Role
+	for _, role := range s.roles {
+		cp := *role
+		roles = append(roles, &cp)
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].ID < roles[j].ID })
+	return roles, nil
+}
+
+// UpdateRole implements Store
+func (s *MemoryStore) UpdateRole(role *Role) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.roles[role.ID]
+	if !ok {
+		return ErrRoleNotFound
+	}
+	for _, other := range s.roles {
+		if other.ID != role.ID && other.Name == role.Name {
+			return ErrRoleExists
+		}
+	}
+	r.Name = role.Name
+	r.Description = role.Description
+	r.Permissions = role.Permissions
+	r.UpdatedAt = time.Now()
+	return nil
+}
+
+// DeleteRole implements Store
+func (s *MemoryStore) DeleteRole(roleID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.roles[roleID]; !ok {
+		return ErrRoleNotFound
+	}
+	delete(s.roles, roleID)
+	for id, roles := range s.bindings {
+		s.bindings[id] = removeID(roles, roleID)
+	}
+	for id, roles := range s.userRoles {
+		s.userRoles[id] = removeID(roles, roleID)
+	}
+	for id, roles := range s.groupRoles {
+		s.groupRoles[id] = removeID(roles, roleID)
+	}
+	delete(s.attached, PolicyTargetRole+":"+strconv.Itoa(roleID))
+	for id, cred := range s.tempCreds {
+		if cred.RoleID == roleID {
+			delete(s.tempCreds, id)
+		}
+	}
+	return nil
+}
+
+// UpdateRoleRateLimit implements Store
+func (s *MemoryStore) UpdateRoleRateLimit(roleID int, limit *RateLimit) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	role, ok := s.roles[roleID]
+	if !ok {
+		return ErrRoleNotFound
+	}
+	role.RateLimit = copyRateLimit(limit)
+	return nil
+}
+
+// BindRole implements Store
+func (s *MemoryStore) BindRole(accessKeyID string, roleID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, id := range s.bindings[accessKeyID] {
+		if id == roleID {
+			return nil
+		}
+	}
+	s.bindings[accessKeyID] = append(s.bindings[accessKeyID], roleID)
+	return nil
+}
+
+// UnbindRole implements Store
+func (s *MemoryStore) UnbindRole(accessKeyID string, roleID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.bindings[accessKeyID] = removeID(s.bindings[accessKeyID], roleID)
+	return nil
+}
+
+// ListAccessKeyRoles implements Store
+func (s *MemoryStore) ListAccessKeyRoles(accessKeyID string) ([]*Role, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var roles []*Role
+	for _, id := range s.bindings[accessKeyID] {
+		if role, ok := s.roles[id]; ok {
+			cp := *role
+			roles = append(roles, &cp)
+		}
+	}
+	return roles, nil
+}
+
+// CreateUser implements Store
+func (s *MemoryStore) CreateUser(user *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range s.users {
+		if u.Username == user.Username {
+			return ErrUserExists
+		}
+	}
+
+	now := time.Now()
+	user.ID = s.nextUserID
+	if user.Status == "" {
+		user.Status = "active"
+	}
+	user.CreatedAt = now
+	user.UpdatedAt = now
+	s.nextUserID++
+
+	u := *user
+	s.users[u.ID] = &u
+	return nil
+}
+
+// GetUser implements Store
+func (s *MemoryStore) GetUser(userID int64) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.users[userID]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	cp := *u
+	return &cp, nil
+}
+
+// GetUserByName implements Store
+func (s *MemoryStore) GetUserByName(username string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, u := range s.users {
+		if u.Username == username {
+			cp := *u
+			return &cp, nil
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+// ListSubUsers implements Store
+func (s *MemoryStore) ListSubUsers(parentID int64) ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var users []User
+	for _, u := range s.users {
+		if u.ParentID == parentID {
+			users = append(users, *u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+// UpdateUserStatus implements Store
+func (s *MemoryStore) UpdateUserStatus(userID int64, status string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	u.Status = status
+	u.UpdatedAt = time.Now()
+	return nil
+}
+
+// UpdateUserPassword implements Store
+func (s *MemoryStore) UpdateUserPassword(userID int64, passwordHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	u.PasswordHash = passwordHash
+	u.UpdatedAt = time.Now()
+	return nil
+}
+
+// CreateGroup implements Store
+func (s *MemoryStore) CreateGroup(group *Group) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, g := range s.groups {
+		if g.Name == group.Name {
+			return ErrGroupExists
+		}
+	}
+
+	now := time.Now()
+	group.ID = s.nextGroupID
+	group.CreatedAt = now
+	group.UpdatedAt = now
+	s.nextGroupID++
+
+	g := *group
+	s.groups[g.ID] = &g
+	return nil
+}
+
+// GetGroup implements Store
+func (s *MemoryStore) GetGroup(groupID int) (*Group, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	g, ok := s.groups[groupID]
+	if !ok {
+		return nil, ErrGroupNotFound
+	}
+	cp := *g
+	return &cp, nil
+}
+
+// ListGroups implements Store
+func (s *MemoryStore) ListGroups() ([]*Group, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var groups []*Group
+	for _, g := range s.groups {
+		cp := *g
+		groups = append(groups, &cp)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].ID < groups[j].ID })
+	return groups, nil
+}
+
+// AddGroupMember implements Store
+func (s *MemoryStore) AddGroupMember(groupID int, userID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.members[groupID] == nil {
+		s.members[groupID] = make(map[int64]bool)
+	}
+	s.members[groupID][userID] = true
+	return nil
+}
+
+// RemoveGroupMember implements Store
+func (s *MemoryStore) RemoveGroupMember(groupID int, userID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.members[groupID], userID)
+	return nil
+}
+
+// ListGroupMembers implements Store
+func (s *MemoryStore) ListGroupMembers(groupID int) ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var users []User
+	for id := range s.members[groupID] {
+		if u, ok := s.users[id]; ok {
+			users = append(users, *u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+// ListUserGroups implements Store
+func (s *MemoryStore) ListUserGroups(userID int64) ([]*Group, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var groups []*Group
+	for id, members := range s.members {
+		if g, ok := s.groups[id]; ok && members[userID] {
+			cp := *g
+			groups = append(groups, &cp)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].ID < groups[j].ID })
+	return groups, nil
+}
+
+// BindGroupRole implements Store
+func (s *MemoryStore) BindGroupRole(groupID int, roleID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.groupRoles[groupID] = addID(s.groupRoles[groupID], roleID)
+	return nil
+}
+
+// UnbindGroupRole implements Store
+func (s *MemoryStore) UnbindGroupRole(groupID int, roleID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.groupRoles[groupID] = removeID(s.groupRoles[groupID], roleID)
+	return nil
+}
+
+// ListGroupRoles implements Store
+func (s *MemoryStore) ListGroupRoles(groupID int) ([]*Role, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.rolesByID(s.groupRoles[groupID]), nil
+}
+
+// BindUserRole implements Store
+func (s *MemoryStore) BindUserRole(userID int64, roleID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.userRoles[userID] = addID(s.userRoles[userID], roleID)
+	return nil
+}
+
+// UnbindUserRole implements Store
+func (s *MemoryStore) UnbindUserRole(userID int64, roleID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.userRoles[userID] = removeID(s.userRoles[userID], roleID)
+	return nil
+}
+
+// ListUserRoles implements Store
+func (s *MemoryStore) ListUserRoles(userID int64) ([]*Role, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.rolesByID(s.userRoles[userID]), nil
+}
+
+// rolesByID returns copies of the roles with the given IDs ordered by ID.
+// s.mu must be held.
+func (s *MemoryStore) rolesByID(ids []int) []*Role {
+	var roles []*Role
+	for _, id := range ids {
+		if role, ok := s.roles[id]; ok {
+			cp := *role
+			roles = append(roles, &cp)
+		}
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].ID < roles[j].ID })
+	return roles
+}
+
+func addID(ids []int, id int) []int {
+	for _, existing := range ids {
+		if existing == id {
+			return ids
+		}
+	}
+	return append(ids, id)
+}
+
+func removeID(ids []int, id int) []int {
+	for i, existing := range ids {
+		if existing == id {
+			return append(ids[:i:i], ids[i+1:]...)
+		}
+	}
+	return ids
+}
+
+// CreatePolicy implements Store
+func (s *MemoryStore) CreatePolicy(policy *Policy) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, p := range s.policies {
+		if p.Name == policy.Name {
+			return ErrPolicyExists
+		}
+	}
+
+	now := time.Now()
+	policy.ID = s.nextPolicyID
+	policy.DefaultVersion = 1
+	policy.CreatedAt = now
+	policy.UpdatedAt = now
+	s.nextPolicyID++
+
+	p := *policy
+	p.Document = nil
+	s.policies[p.ID] = &p
+	s.versions[p.ID] = []PolicyVersion{{PolicyID: p.ID, Version: 1, Document: policy.Document, CreatedAt: now}}
+	return nil
+}
+
+// GetPolicy implements Store
+func (s *MemoryStore) GetPolicy(policyID int) (*Policy, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p, ok := s.policies[policyID]
+	if !ok {
+		return nil, ErrPolicyNotFound
+	}
+	return s.policyWithDocument(p), nil
+}
+
+// ListPolicies implements Store
+func (s *MemoryStore) ListPolicies() ([]*Policy, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var policies []*Policy
+	for _, p := range s.policies {
+		policies = append(policies, s.policyWithDocument(p))
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].ID < policies[j].ID })
+	return policies, nil
+}
+
+// policyWithDocument returns a copy of a policy with the document of its
+// default version. s.mu must be held.
+func (s *MemoryStore) policyWithDocument(p *Policy) *Policy {
+	cp := *p
+	for _, v := range s.versions[p.ID] {
+		if v.Version == p.DefaultVersion {
+			cp.Document = v.Document
+		}
+	}
+	return &cp
+}
+
+// CreatePolicyVersion implements Store
+func (s *MemoryStore) CreatePolicyVersion(policyID int, document []*Permissions, setDefault bool) (*PolicyVersion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.policies[policyID]
+	if !ok {
+		return nil, ErrPolicyNotFound
+	}
+	versions := s.versions[policyID]
+	v := PolicyVersion{
+		PolicyID:  policyID,
+		Version:   versions[len(versions)-1].Version + 1,
+		Document:  document,
+		CreatedAt: time.Now(),
+	}
+	s.versions[policyID] = append(versions, v)
+	if setDefault {
+		p.DefaultVersion = v.Version
+		p.UpdatedAt = v.CreatedAt
+	}
+	return &v, nil
+}
+
+// GetPolicyVersion implements Store
+func (s *MemoryStore) GetPolicyVersion(policyID int, version int) (*PolicyVersion, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, v := range s.versions[policyID] {
+		if v.Version == version {
+			return &v, nil
+		}
+	}
+	return nil, ErrPolicyVersionNotFound
+}
+
+// ListPolicyVersions implements Store
+func (s *MemoryStore) ListPolicyVersions(policyID int) ([]PolicyVersion, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]PolicyVersion(nil), s.versions[policyID]...), nil
+}
+
+// SetDefaultPolicyVersion implements Store
+func (s *MemoryStore) SetDefaultPolicyVersion(policyID int, version int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.policies[policyID]
+	if !ok {
+		return ErrPolicyNotFound
+	}
+	p.DefaultVersion = version
+	p.UpdatedAt = time.Now()
+	return nil
+}
+
+// AttachPolicy implements Store
+func (s *MemoryStore) AttachPolicy(policyID int, targetType, targetID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := targetType + ":" + targetID
+	s.attached[key] = addID(s.attached[key], policyID)
+	return nil
+}
+
+// DetachPolicy implements Store
+func (s *MemoryStore) DetachPolicy(policyID int, targetType, targetID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := targetType + ":" + targetID
+	s.attached[key] = removeID(s.attached[key], policyID)
+	return nil
+}
+
+// ListAttachedPolicies implements Store
+func (s *MemoryStore) ListAttachedPolicies(targetType, targetID string) ([]*Policy, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var policies []*Policy
+	for _, id := range s.attached[targetType+":"+targetID] {
+		if p, ok := s.policies[id]; ok {
+			policies = append(policies, s.policyWithDocument(p))
+		}
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].ID < policies[j].ID })
+	return policies, nil
+}
+
+// CreateTemporaryCredential implements Store
+func (s *MemoryStore) CreateTemporaryCredential(cred *TemporaryCredential) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := *cred
+	s.tempCreds[c.AccessKeyID] = &c
+	return nil
+}
+
+// GetTemporaryCredential implements Store
+func (s *MemoryStore) GetTemporaryCredential(accessKeyID string) (*TemporaryCredential, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	cred, ok := s.tempCreds[accessKeyID]
+	if !ok {
+		return nil, ErrAccessKeyNotFound
+	}
+	c := *cred
+	return &c, nil
+}
+
+// DeleteExpiredTemporaryCredentials implements Store
+func (s *MemoryStore) DeleteExpiredTemporaryCredentials(now time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int64
+	for id, cred := range s.tempCreds {
+		if !cred.ExpiresAt.After(now) {
+			delete(s.tempCreds, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func copyRateLimit(limit *RateLimit) *RateLimit {
+	if limit == nil {
+		return nil
+	}
+	l := *limit
+	return &l
+}
@@ -0,0 +1,209 @@
+package accesskey
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreAccessKeys(t *testing.T) {
+	store := NewMemoryStore()
+	for _, ak := range []*AccessKey{
+		{AccessKey: "AK1", SecretKey: "secret1", UserID: 1},
+		{AccessKey: "AK2", SecretKey: "secret2", UserID: 1, Status: "inactive"},
+		{AccessKey: "AK3", SecretKey: "secret3", UserID: 2},
+	} {
+		if err := store.CreateAccessKey(ak); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ak, err := store.GetAccessKey("AK1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ak.Status != "active" || ak.CreatedAt.IsZero() {
+		t.Errorf("new key has status %q and created at %v", ak.Status, ak.CreatedAt)
+	}
+	// Returned keys are copies
+	ak.Status = "inactive"
+	if ak, _ := store.GetAccessKey("AK1"); ak.Status != "active" {
+		t.Error("modifying a returned key changed the store")
+	}
+
+	if _, err := store.GetAccessKey("AK9"); !errors.Is(err, ErrAccessKeyNotFound) {
+		t.Errorf("GetAccessKey of an unknown key: %v, want ErrAccessKeyNotFound", err)
+	}
+	if err := store.UpdateAccessKeyStatus("AK9", "inactive"); !errors.Is(err, ErrAccessKeyNotFound) {
+		t.Errorf("UpdateAccessKeyStatus of an unknown key: %v, want ErrAccessKeyNotFound", err)
+	}
+
+	keys, err := store.ListAccessKeys(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Errorf("ListAccessKeys(1) returned %d keys, want 2", len(keys))
+	}
+	if keys, _ := store.ListAllAccessKeys(); len(keys) != 3 {
+		t.Errorf("ListAllAccessKeys returned %d keys, want 3", len(keys))
+	}
+
+	// A key is retired only once
+	if ok, err := store.RetireAccessKey("AK1"); !ok || err != nil {
+		t.Errorf("RetireAccessKey = %v, %v, want true", ok, err)
+	}
+	if ok, err := store.RetireAccessKey("AK1"); ok || err != nil {
+		t.Errorf("second RetireAccessKey = %v, %v, want false", ok, err)
+	}
+
+	usedAt := time.Now().Truncate(time.Second)
+	if err := store.TouchAccessKey("AK3", usedAt); err != nil {
+		t.Fatal(err)
+	}
+	if ak, _ := store.GetAccessKey("AK3"); !ak.LastUsedAt.Equal(usedAt) {
+		t.Errorf("LastUsedAt = %v, want %v", ak.LastUsedAt, usedAt)
+	}
+}
+
+func TestMemoryStoreDeleteAccessKey(t *testing.T) {
+	store := NewMemoryStore()
+	if err := store.CreateAccessKey(&AccessKey{AccessKey: "AK1", UserID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	role := &Role{Name: "reader"}
+	if err := store.CreateRole(role); err != nil {
+		t.Fatal(err)
+	}
+	policy := &Policy{Name: "read"}
+	if err := store.CreatePolicy(policy); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.BindRole("AK1", role.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AttachPolicy(policy.ID, PolicyTargetAccessKey, "AK1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.DeleteAccessKey("AK1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteAccessKey("AK1"); !errors.Is(err, ErrAccessKeyNotFound) {
+		t.Errorf("second DeleteAccessKey: %v, want ErrAccessKeyNotFound", err)
+	}
+
+	// A new key with the same ID does not inherit roles or policies
+	if err := store.CreateAccessKey(&AccessKey{AccessKey: "AK1", UserID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if roles, _ := store.ListAccessKeyRoles("AK1"); len(roles) != 0 {
+		t.Errorf("recreated key has %d roles", len(roles))
+	}
+	if policies, _ := store.ListAttachedPolicies(PolicyTargetAccessKey, "AK1"); len(policies) != 0 {
+		t.Errorf("recreated key has %d policies", len(policies))
+	}
+}
+
+func TestMemoryStoreRoles(t *testing.T) {
+	store := NewMemoryStore()
+	reader := &Role{Name: "reader"}
+	writer := &Role{Name: "writer"}
+	for _, role := range []*Role{reader, writer} {
+		if err := store.CreateRole(role); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if reader.ID == 0 || reader.ID == writer.ID {
+		t.Fatalf("role IDs %d and %d", reader.ID, writer.ID)
+	}
+	if err := store.CreateRole(&Role{Name: "reader"}); !errors.Is(err, ErrRoleExists) {
+		t.Errorf("CreateRole with an existing name: %v, want ErrRoleExists", err)
+	}
+	if err := store.UpdateRole(&Role{ID: writer.ID, Name: "reader"}); !errors.Is(err, ErrRoleExists) {
+		t.Errorf("UpdateRole to an existing name: %v, want ErrRoleExists", err)
+	}
+	if err := store.UpdateRole(&Role{ID: writer.ID, Name: "editor", Description: "edits"}); err != nil {
+		t.Fatal(err)
+	}
+	if role, _ := store.GetRole(writer.ID); role.Name != "editor" || role.Description != "edits" {
+		t.Errorf("updated role = %+v", role)
+	}
+
+	if err := store.BindRole("AK1", reader.ID); err != nil {
+		t.Fatal(err)
+	}
+	// Binding twice is a no-op
+	if err := store.BindRole("AK1", reader.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.BindRole("AK1", writer.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.BindUserRole(1, reader.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.BindGroupRole(1, reader.ID); err != nil {
+		t.Fatal(err)
+	}
+	if roles, _ := store.ListAccessKeyRoles("AK1"); len(roles) != 2 {
+		t.Errorf("ListAccessKeyRoles returned %d roles, want 2", len(roles))
+	}
+
+	// Deleting a role removes all its bindings
+	if err := store.DeleteRole(reader.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetRole(reader.ID); !errors.Is(err, ErrRoleNotFound) {
+		t.Errorf("GetRole of a deleted role: %v, want ErrRoleNotFound", err)
+	}
+	if roles, _ := store.ListAccessKeyRoles("AK1"); len(roles) != 1 || roles[0].ID != writer.ID {
+		t.Errorf("ListAccessKeyRoles after delete = %v", roles)
+	}
+	if roles, _ := store.ListUserRoles(1); len(roles) != 0 {
+		t.Errorf("user still has %d roles", len(roles))
+	}
+	if roles, _ := store.ListGroupRoles(1); len(roles) != 0 {
+		t.Errorf("group still has %d roles", len(roles))
+	}
+	if err := store.DeleteRole(reader.ID); !errors.Is(err, ErrRoleNotFound) {
+		t.Errorf("second DeleteRole: %v, want ErrRoleNotFound", err)
+	}
+}
+
+func TestMemoryStoreUsers(t *testing.T) {
+	store := NewMemoryStore()
+	alice := &User{Username: "alice"}
+	if err := store.CreateUser(alice); err != nil {
+		t.Fatal(err)
+	}
+	if alice.ID == 0 || alice.Status != "active" {
+		t.Errorf("created user = %+v", alice)
+	}
+	if err := store.CreateUser(&User{Username: "alice"}); !errors.Is(err, ErrUserExists) {
+		t.Errorf("CreateUser with an existing name: %v, want ErrUserExists", err)
+	}
+	bob := &User{Username: "bob", ParentID: alice.ID}
+	if err := store.CreateUser(bob); err != nil {
+		t.Fatal(err)
+	}
+
+	if u, err := store.GetUserByName("bob"); err != nil || u.ID != bob.ID {
+		t.Errorf("GetUserByName = %+v, %v", u, err)
+	}
+	if _, err := store.GetUserByName("carol"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("GetUserByName of an unknown user: %v, want ErrUserNotFound", err)
+	}
+	if users, _ := store.ListSubUsers(alice.ID); len(users) != 1 || users[0].ID != bob.ID {
+		t.Errorf("ListSubUsers = %+v", users)
+	}
+	if err := store.UpdateUserStatus(bob.ID, "suspended"); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := store.GetUser(bob.ID); u.Status != "suspended" {
+		t.Errorf("status = %q, want suspended", u.Status)
+	}
+	if err := store.UpdateUserStatus(99, "suspended"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("UpdateUserStatus of an unknown user: %v, want ErrUserNotFound", err)
+	}
+}
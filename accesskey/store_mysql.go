@@ -0,0 +1,1208 @@
+package accesskey
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// accessKeyColumns are the access_keys columns read by scanAccessKey
+const accessKeyColumns = "id, key_type, secret_key, public_key, access_key, user_id, status, permissions, created_at, last_used_at, expires_at, rotated_from, grace_until, tags, rate_limit"
+
+// userColumns are the users columns read by scanUser
+const userColumns = "id, parent_id, username, password, status, permissions, created_at, updated_at"
+
+// groupColumns are the user_groups columns read by scanGroup
+const groupColumns = "id, name, description, created_at, updated_at"
+
+// policyColumns are the policies and policy_versions columns read by scanPolicy
+const policyColumns = "p.id, p.name, p.description, p.default_version, p.created_at, p.updated_at, v.document"
+
+// roleColumns are the roles columns read by scanRole
+const roleColumns = "r.id, r.name, r.description, r.permissions, r.created_at, r.updated_at, r.rate_limit"
+
+// MySQLStore is a Store backed by the MySQL tables created by Migrate
+type MySQLStore struct {
+	db *sql.DB
+}
+
+// NewMySQLStore creates a store using the given database. The connection
+// must be opened with parseTime=true, as InitDB does.
+func NewMySQLStore(db *sql.DB) *MySQLStore {
+	return &MySQLStore{db: db}
+}
+
+// CreateAccessKey implements Store
+func (s *MySQLStore) CreateAccessKey(key *AccessKey) error {
+	permissions, err := marshalPermissions(key.Permissions)
+	if err != nil {
+		return err
+	}
+
+	var expiresAt sql.NullTime
+	if !key.ExpiresAt.IsZero() {
+		expiresAt = sql.NullTime{Time: key.ExpiresAt, Valid: true}
+	}
+
+	var rotatedFrom sql.NullString
+	if key.RotatedFrom != "" {
+		rotatedFrom = sql.NullString{String: key.RotatedFrom, Valid: true}
+	}
+
+	tags, err := marshalTags(key.Tags)
+	if err != nil {
+		return err
+	}
+
+	rateLimit, err := marshalRateLimit(key.RateLimit)
+	if err != nil {
+		return err
+	}
+
+	status := key.Status
+	if status == "" {
+		status = "active"
+	}
+
+	var publicKey sql.NullString
+	if key.PublicKey != "" {
+		publicKey = sql.NullString{String: key.PublicKey, Valid: true}
+	}
+
+	_, err = s.db.Exec(
+		"INSERT INTO access_keys (id, key_type, secret_key, public_key, access_key, user_id, status, permissions, expires_at, rotated_from, tags, rate_limit) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		key.ID,
+		key.keyType(),
+		key.SecretKey,
+		publicKey,
+		key.AccessKey,
+		key.UserID,
+		status,
+		permissions,
+		expiresAt,
+		rotatedFrom,
+		tags,
+		rateLimit,
+	)
+	return err
+}
+
+// GetAccessKey implements Store
+func (s *MySQLStore) GetAccessKey(accessKeyID string) (*AccessKey, error) {
+	row := s.db.QueryRow(
+		"SELECT "+accessKeyColumns+" FROM access_keys WHERE access_key = ?",
+		accessKeyID,
+	)
+
+	ak, err := scanAccessKey(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrAccessKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ak, nil
+}
+
+// ListAccessKeys implements Store
+func (s *MySQLStore) ListAccessKeys(userID int64) ([]AccessKey, error) {
+	return s.queryAccessKeys(
+		"SELECT "+accessKeyColumns+" FROM access_keys WHERE user_id = ?",
+		userID,
+	)
+}
+
+// ListAllAccessKeys implements Store
+func (s *MySQLStore) ListAllAccessKeys() ([]AccessKey, error) {
+	return s.queryAccessKeys(
+		"SELECT " + accessKeyColumns + " FROM access_keys",
+	)
+}
+
+func (s *MySQLStore) queryAccessKeys(query string, args ...interface{}) ([]AccessKey, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var accessKeys []AccessKey
+	for rows.Next() {
+		ak, err := scanAccessKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		accessKeys = append(accessKeys, *ak)
+	}
+
+	return accessKeys, rows.Err()
+}
+
+// UpdateAccessKeyStatus implements Store
+func (s *MySQLStore) UpdateAccessKeyStatus(accessKeyID string, status string) error {
+	_, err := s.db.Exec(
+		"UPDATE access_keys SET status = ? WHERE access_key = ?",
+		status,
+		accessKeyID,
+	)
+	return err
+}
+
+// RetireAccessKey implements Store
+func (s *MySQLStore) RetireAccessKey(accessKeyID string) (bool, error) {
+	result, err := s.db.Exec(
+		"UPDATE access_keys SET status = 'inactive' WHERE access_key = ? AND status = 'active'",
+		accessKeyID,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// UpdateAccessKeySecret implements Store
+func (s *MySQLStore) UpdateAccessKeySecret(accessKeyID string, secret string) error {
+	_, err := s.db.Exec(
+		"UPDATE access_keys SET secret_key = ? WHERE access_key = ?",
+		secret,
+		accessKeyID,
+	)
+	return err
+}
+
+// SetAccessKeyGraceUntil implements Store
+func (s *MySQLStore) SetAccessKeyGraceUntil(accessKeyID string, until time.Time) error {
+	_, err := s.db.Exec(
+		"UPDATE access_keys SET grace_until = ? WHERE access_key = ?",
+		until,
+		accessKeyID,
+	)
+	return err
+}
+
+// ListGraceEndedAccessKeys implements Store
+func (s *MySQLStore) ListGraceEndedAccessKeys(now time.Time) ([]AccessKey, error) {
+	return s.queryAccessKeys(
+		"SELECT "+accessKeyColumns+" FROM access_keys WHERE status = 'active' AND grace_until IS NOT NULL AND grace_until <= ?",
+		now,
+	)
+}
+
+// ListAccessKeysExpiringBefore implements Store
+func (s *MySQLStore) ListAccessKeysExpiringBefore(t time.Time) ([]AccessKey, error) {
+	return s.queryAccessKeys(
+		"SELECT "+accessKeyColumns+" FROM access_keys WHERE status = 'active' AND expires_at IS NOT NULL AND expires_at <= ? ORDER BY expires_at",
+		t,
+	)
+}
+
+// UpdateAccessKeyTags implements Store
+func (s *MySQLStore) UpdateAccessKeyTags(accessKeyID string, tags map[string]string) error {
+	data, err := marshalTags(tags)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(
+		"UPDATE access_keys SET tags = ? WHERE access_key = ?",
+		data,
+		accessKeyID,
+	)
+	return err
+}
+
+// UpdateAccessKeyRateLimit implements Store
+func (s *MySQLStore) UpdateAccessKeyRateLimit(accessKeyID string, limit *RateLimit) error {
+	data, err := marshalRateLimit(limit)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(
+		"UPDATE access_keys SET rate_limit = ? WHERE access_key = ?",
+		data,
+		accessKeyID,
+	)
+	return err
+}
+
+// TouchAccessKey implements Store
+func (s *MySQLStore) TouchAccessKey(accessKeyID string, usedAt time.Time) error {
+	_, err := s.db.Exec(
+		"UPDATE access_keys SET last_used_at = ? WHERE access_key = ?",
+		usedAt,
+		accessKeyID,
+	)
+	return err
+}
+
+// TouchAccessKeys records the last use of many access keys in one transaction
+func (s *MySQLStore) TouchAccessKeys(usedAt map[string]time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare("UPDATE access_keys SET last_used_at = ? WHERE access_key = ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for accessKeyID, t := range usedAt {
+		if _, err := stmt.Exec(t, accessKeyID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DeleteAccessKey implements Store
+func (s *MySQLStore) DeleteAccessKey(accessKeyID string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM access_key_roles WHERE access_key_id = ?", accessKeyID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		"DELETE FROM policy_attachments WHERE target_type = ? AND target_id = ?",
+		PolicyTargetAccessKey,
+		accessKeyID,
+	); err != nil {
+		return err
+	}
+	res, err := tx.Exec("DELETE FROM access_keys WHERE access_key = ?", accessKeyID)
+	if err != nil {
+		return err
+	}
+	if err := checkAffected(res, ErrAccessKeyNotFound); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CreateRole implements Store
+func (s *MySQLStore) CreateRole(role *Role) error {
+	permissions, err := marshalPermissions(role.Permissions)
+	if err != nil {
+		return err
+	}
+
+	rateLimit, err := marshalRateLimit(role.RateLimit)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.db.Exec(
+		"INSERT INTO roles (name, description, permissions, rate_limit) VALUES (?, ?, ?, ?)",
+		role.Name,
+		role.Description,
+		permissions,
+		rateLimit,
+	)
+	if err != nil {
+		if isDuplicateEntry(err) {
+			return ErrRoleExists
+		}
+		return err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	role.ID = int(id)
+	return nil
+}
+
+// GetRole implements Store
+func (s *MySQLStore) GetRole(roleID int) (*Role, error) {
+	row := s.db.QueryRow(
+		"SELECT id, name, description, permissions, created_at, updated_at, rate_limit FROM roles WHERE id = ?",
+		roleID,
+	)
+
+	role, err := scanRole(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrRoleNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return role, nil
+}
+
+// ListRoles implements Store
+func (s *MySQLStore) ListRoles() ([]*Role, error) {
+	return s.queryRoles("SELECT " + roleColumns + " FROM roles r ORDER BY r.id")
+}
+
+// UpdateRole implements Store
+func (s *MySQLStore) UpdateRole(role *Role) error {
+	permissions, err := marshalPermissions(role.Permissions)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(
+		"UPDATE roles SET name = ?, description = ?, permissions = ? WHERE id = ?",
+		role.Name,
+		role.Description,
+		permissions,
+		role.ID,
+	)
+	if isDuplicateEntry(err) {
+		return ErrRoleExists
+	}
+	return err
+}
+
+// DeleteRole implements Store. Bindings to keys, users and groups and
+// temporary credentials are deleted by the foreign keys.
+func (s *MySQLStore) DeleteRole(roleID int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		"DELETE FROM policy_attachments WHERE target_type = ? AND target_id = ?",
+		PolicyTargetRole,
+		strconv.Itoa(roleID),
+	); err != nil {
+		return err
+	}
+	res, err := tx.Exec("DELETE FROM roles WHERE id = ?", roleID)
+	if err != nil {
+		return err
+	}
+	if err := checkAffected(res, ErrRoleNotFound); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UpdateRoleRateLimit implements Store
+func (s *MySQLStore) UpdateRoleRateLimit(roleID int, limit *RateLimit) error {
+	data, err := marshalRateLimit(limit)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("UPDATE roles SET rate_limit = ? WHERE id = ?", data, roleID)
+	return err
+}
+
+// BindRole implements Store
+func (s *MySQLStore) BindRole(accessKeyID string, roleID int) error {
+	_, err := s.db.Exec(
+		"INSERT INTO access_key_roles (access_key_id, role_id) VALUES (?, ?)",
+		accessKeyID,
+		roleID,
+	)
+	return err
+}
+
+// UnbindRole implements Store
+func (s *MySQLStore) UnbindRole(accessKeyID string, roleID int) error {
+	_, err := s.db.Exec(
+		"DELETE FROM access_key_roles WHERE access_key_id = ? AND role_id = ?",
+		accessKeyID,
+		roleID,
+	)
+	return err
+}
+
+// ListAccessKeyRoles implements Store
+func (s *MySQLStore) ListAccessKeyRoles(accessKeyID string) ([]*Role, error) {
+	return s.queryRoles(
+		"SELECT "+roleColumns+" FROM roles r JOIN access_key_roles akr ON r.id = akr.role_id WHERE akr.access_key_id = ?",
+		accessKeyID,
+	)
+}
+
+// CreateUser implements Store
+func (s *MySQLStore) CreateUser(user *User) error {
+	permissions, err := marshalPermissions(user.Permissions)
+	if err != nil {
+		return err
+	}
+
+	var parentID sql.NullInt64
+	if user.ParentID != 0 {
+		parentID = sql.NullInt64{Int64: user.ParentID, Valid: true}
+	}
+
+	status := user.Status
+	if status == "" {
+		status = "active"
+	}
+
+	res, err := s.db.Exec(
+		"INSERT INTO users (parent_id, username, password, status, permissions) VALUES (?, ?, ?, ?, ?)",
+		parentID,
+		user.Username,
+		user.PasswordHash,
+		status,
+		permissions,
+	)
+	if err != nil {
+		if isDuplicateEntry(err) {
+			return ErrUserExists
+		}
+		return err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	user.ID = id
+	user.Status = status
+	return nil
+}
+
+// GetUser implements Store
+func (s *MySQLStore) GetUser(userID int64) (*User, error) {
+	row := s.db.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", userID)
+	user, err := scanUser(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	return user, err
+}
+
+// GetUserByName implements Store
+func (s *MySQLStore) GetUserByName(username string) (*User, error) {
+	row := s.db.QueryRow("SELECT "+userColumns+" FROM users WHERE username = ?", username)
+	user, err := scanUser(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	return user, err
+}
+
+// ListSubUsers implements Store
+func (s *MySQLStore) ListSubUsers(parentID int64) ([]User, error) {
+	rows, err := s.db.Query("SELECT "+userColumns+" FROM users WHERE parent_id = ? ORDER BY id", parentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, *user)
+	}
+	return users, rows.Err()
+}
+
+// UpdateUserStatus implements Store
+func (s *MySQLStore) UpdateUserStatus(userID int64, status string) error {
+	_, err := s.db.Exec("UPDATE users SET status = ? WHERE id = ?", status, userID)
+	return err
+}
+
+// UpdateUserPassword implements Store
+func (s *MySQLStore) UpdateUserPassword(userID int64, passwordHash string) error {
+	_, err := s.db.Exec("UPDATE users SET password = ? WHERE id = ?", passwordHash, userID)
+	return err
+}
+
+// CreateGroup implements Store
+func (s *MySQLStore) CreateGroup(group *Group) error {
+	res, err := s.db.Exec(
+		"INSERT INTO user_groups (name, description) VALUES (?, ?)",
+		group.Name,
+		group.Description,
+	)
+	if err != nil {
+		if isDuplicateEntry(err) {
+			return ErrGroupExists
+		}
+		return err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	group.ID = int(id)
+	return nil
+}
+
+// GetGroup implements Store
+func (s *MySQLStore) GetGroup(groupID int) (*Group, error) {
+	row := s.db.QueryRow("SELECT "+groupColumns+" FROM user_groups WHERE id = ?", groupID)
+	group, err := scanGroup(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrGroupNotFound
+	}
+	return group, err
+}
+
+// ListGroups implements Store
+func (s *MySQLStore) ListGroups() ([]*Group, error) {
+	return s.queryGroups("SELECT " + groupColumns + " FROM user_groups ORDER BY id")
+}
+
+// AddGroupMember implements Store
+func (s *MySQLStore) AddGroupMember(groupID int, userID int64) error {
+	_, err := s.db.Exec(
+		"INSERT IGNORE INTO user_group_members (group_id, user_id) VALUES (?, ?)",
+		groupID,
+		userID,
+	)
+	return err
+}
+
+// RemoveGroupMember implements Store
+func (s *MySQLStore) RemoveGroupMember(groupID int, userID int64) error {
+	_, err := s.db.Exec("DELETE FROM user_group_members WHERE group_id = ? AND user_id = ?", groupID, userID)
+	return err
+}
+
+// ListGroupMembers implements Store
+func (s *MySQLStore) ListGroupMembers(groupID int) ([]User, error) {
+	rows, err := s.db.Query(
+		`SELECT u.id, u.parent_id, u.username, u.password, u.status, u.permissions, u.created_at, u.updated_at
+		FROM users u
+		JOIN user_group_members m ON u.id = m.user_id
+		WHERE m.group_id = ?
+		ORDER BY u.id`,
+		groupID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, *user)
+	}
+	return users, rows.Err()
+}
+
+// ListUserGroups implements Store
+func (s *MySQLStore) ListUserGroups(userID int64) ([]*Group, error) {
+	return s.queryGroups(
+		`SELECT g.id, g.name, g.description, g.created_at, g.updated_at
+		FROM user_groups g
+		JOIN user_group_members m ON g.id = m.group_id
+		WHERE m.user_id = ?
+		ORDER BY g.id`,
+		userID,
+	)
+}
+
+func (s *MySQLStore) queryGroups(query string, args ...interface{}) ([]*Group, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var groups []*Group
+	for rows.Next() {
+		group, err := scanGroup(rows)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+	return groups, rows.Err()
+}
+
+// BindGroupRole implements Store
+func (s *MySQLStore) BindGroupRole(groupID int, roleID int) error {
+	_, err := s.db.Exec(
+		"INSERT IGNORE INTO user_group_roles (group_id, role_id) VALUES (?, ?)",
+		groupID,
+		roleID,
+	)
+	return err
+}
+
+// UnbindGroupRole implements Store
+func (s *MySQLStore) UnbindGroupRole(groupID int, roleID int) error {
+	_, err := s.db.Exec("DELETE FROM user_group_roles WHERE group_id = ? AND role_id = ?", groupID, roleID)
+	return err
+}
+
+// ListGroupRoles implements Store
+func (s *MySQLStore) ListGroupRoles(groupID int) ([]*Role, error) {
+	return s.queryRoles(
+		"SELECT "+roleColumns+" FROM roles r JOIN user_group_roles gr ON r.id = gr.role_id WHERE gr.group_id = ? ORDER BY r.id",
+		groupID,
+	)
+}
+
+// BindUserRole implements Store
+func (s *MySQLStore) BindUserRole(userID int64, roleID int) error {
+	_, err := s.db.Exec(
+		"INSERT IGNORE INTO user_roles (user_id, role_id) VALUES (?, ?)",
+		userID,
+		roleID,
+	)
+	return err
+}
+
+// UnbindUserRole implements Store
+func (s *MySQLStore) UnbindUserRole(userID int64, roleID int) error {
+	_, err := s.db.Exec("DELETE FROM user_roles WHERE user_id = ? AND role_id = ?", userID, roleID)
+	return err
+}
+
+// ListUserRoles implements Store
+func (s *MySQLStore) ListUserRoles(userID int64) ([]*Role, error) {
+	return s.queryRoles(
+		"SELECT "+roleColumns+" FROM roles r JOIN user_roles ur ON r.id = ur.role_id WHERE ur.user_id = ? ORDER BY r.id",
+		userID,
+	)
+}
+
+func (s *MySQLStore) queryRoles(query string, args ...interface{}) ([]*Role, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []*Role
+	for rows.Next() {
+		role, err := scanRole(rows)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+// CreatePolicy implements Store
+func (s *MySQLStore) CreatePolicy(policy *Policy) error {
+	document, err := marshalPermissions(policy.Document)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		"INSERT INTO policies (name, description, default_version) VALUES (?, ?, 1)",
+		policy.Name,
+		policy.Description,
+	)
+	if err != nil {
+		if isDuplicateEntry(err) {
+			return ErrPolicyExists
+		}
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(
+		"INSERT INTO policy_versions (policy_id, version, document) VALUES (?, 1, ?)",
+		id,
+		document,
+	); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	policy.ID = int(id)
+	policy.DefaultVersion = 1
+	return nil
+}
+
+// GetPolicy implements Store
+func (s *MySQLStore) GetPolicy(policyID int) (*Policy, error) {
+	row := s.db.QueryRow(
+		"SELECT "+policyColumns+" FROM policies p JOIN policy_versions v ON v.policy_id = p.id AND v.version = p.default_version WHERE p.id = ?",
+		policyID,
+	)
+	policy, err := scanPolicy(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrPolicyNotFound
+	}
+	return policy, err
+}
+
+// ListPolicies implements Store
+func (s *MySQLStore) ListPolicies() ([]*Policy, error) {
+	return s.queryPolicies(
+		"SELECT " + policyColumns + " FROM policies p JOIN policy_versions v ON v.policy_id = p.id AND v.version = p.default_version ORDER BY p.id",
+	)
+}
+
+// CreatePolicyVersion implements Store
+func (s *MySQLStore) CreatePolicyVersion(policyID int, document []*Permissions, setDefault bool) (*PolicyVersion, error) {
+	data, err := marshalPermissions(document)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Lock the policy so that concurrent edits get consecutive versions
+	var defaultVersion int
+	err = tx.QueryRow("SELECT default_version FROM policies WHERE id = ? FOR UPDATE", policyID).Scan(&defaultVersion)
+	if err == sql.ErrNoRows {
+		return nil, ErrPolicyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	v := PolicyVersion{PolicyID: policyID, Document: document}
+	if err := tx.QueryRow("SELECT COALESCE(MAX(version), 0) + 1 FROM policy_versions WHERE policy_id = ?", policyID).Scan(&v.Version); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO policy_versions (policy_id, version, document) VALUES (?, ?, ?)",
+		policyID,
+		v.Version,
+		data,
+	); err != nil {
+		return nil, err
+	}
+	if setDefault {
+		if _, err := tx.Exec("UPDATE policies SET default_version = ? WHERE id = ?", v.Version, policyID); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	v.CreatedAt = time.Now()
+	return &v, nil
+}
+
+// GetPolicyVersion implements Store
+func (s *MySQLStore) GetPolicyVersion(policyID int, version int) (*PolicyVersion, error) {
+	row := s.db.QueryRow(
+		"SELECT policy_id, version, document, created_at FROM policy_versions WHERE policy_id = ? AND version = ?",
+		policyID,
+		version,
+	)
+	v, err := scanPolicyVersion(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrPolicyVersionNotFound
+	}
+	return v, err
+}
+
+// ListPolicyVersions implements Store
+func (s *MySQLStore) ListPolicyVersions(policyID int) ([]PolicyVersion, error) {
+	rows, err := s.db.Query(
+		"SELECT policy_id, version, document, created_at FROM policy_versions WHERE policy_id = ? ORDER BY version",
+		policyID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []PolicyVersion
+	for rows.Next() {
+		v, err := scanPolicyVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, *v)
+	}
+	return versions, rows.Err()
+}
+
+// SetDefaultPolicyVersion implements Store
+func (s *MySQLStore) SetDefaultPolicyVersion(policyID int, version int) error {
+	_, err := s.db.Exec("UPDATE policies SET default_version = ? WHERE id = ?", version, policyID)
+	return err
+}
+
+// AttachPolicy implements Store
+func (s *MySQLStore) AttachPolicy(policyID int, targetType, targetID string) error {
+	_, err := s.db.Exec(
+		"INSERT IGNORE INTO policy_attachments (policy_id, target_type, target_id) VALUES (?, ?, ?)",
+		policyID,
+		targetType,
+		targetID,
+	)
+	return err
+}
+
+// DetachPolicy implements Store
+func (s *MySQLStore) DetachPolicy(policyID int, targetType, targetID string) error {
+	_, err := s.db.Exec(
+		"DELETE FROM policy_attachments WHERE policy_id = ? AND target_type = ? AND target_id = ?",
+		policyID,
+		targetType,
+		targetID,
+	)
+	return err
+}
+
+// ListAttachedPolicies implements Store
+func (s *MySQLStore) ListAttachedPolicies(targetType, targetID string) ([]*Policy, error) {
+	return s.queryPolicies(
+		`SELECT `+policyColumns+`
+		FROM policies p
+		JOIN policy_versions v ON v.policy_id = p.id AND v.version = p.default_version
+		JOIN policy_attachments a ON a.policy_id = p.id
+		WHERE a.target_type = ? AND a.target_id = ?
+		ORDER BY p.id`,
+		targetType,
+		targetID,
+	)
+}
+
+func (s *MySQLStore) queryPolicies(query string, args ...interface{}) ([]*Policy, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var policies []*Policy
+	for rows.Next() {
+		policy, err := scanPolicy(rows)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, policy)
+	}
+	return policies, rows.Err()
+}
+
+// CreateTemporaryCredential implements Store
+func (s *MySQLStore) CreateTemporaryCredential(cred *TemporaryCredential) error {
+	var policy sql.NullString
+	if cred.Policy != nil {
+		p, err := marshalPermissions(cred.Policy)
+		if err != nil {
+			return err
+		}
+		policy = sql.NullString{String: p, Valid: true}
+	}
+
+	_, err := s.db.Exec(
+		"INSERT INTO sts_credentials (access_key_id, secret_key, session_token_hash, source_access_key, user_id, role_id, policy, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		cred.AccessKeyID,
+		cred.SecretKey,
+		cred.SessionTokenHash,
+		cred.SourceAccessKey,
+		cred.UserID,
+		cred.RoleID,
+		policy,
+		cred.ExpiresAt,
+	)
+	return err
+}
+
+// GetTemporaryCredential implements Store
+func (s *MySQLStore) GetTemporaryCredential(accessKeyID string) (*TemporaryCredential, error) {
+	var cred TemporaryCredential
+	var policy sql.NullString
+
+	err := s.db.QueryRow(
+		"SELECT access_key_id, secret_key, session_token_hash, source_access_key, user_id, role_id, policy, created_at, expires_at FROM sts_credentials WHERE access_key_id = ?",
+		accessKeyID,
+	).Scan(
+		&cred.AccessKeyID,
+		&cred.SecretKey,
+		&cred.SessionTokenHash,
+		&cred.SourceAccessKey,
+		&cred.UserID,
+		&cred.RoleID,
+		&policy,
+		&cred.CreatedAt,
+		&cred.ExpiresAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrAccessKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if policy.Valid {
+		cred.Policy, err = ParsePermissions(policy.String)
+		if err != nil {
+			return nil, err
+		}
+		if cred.Policy == nil {
+			cred.Policy = []*Permissions{}
+		}
+	}
+
+	return &cred, nil
+}
+
+// DeleteExpiredTemporaryCredentials implements Store
+func (s *MySQLStore) DeleteExpiredTemporaryCredentials(now time.Time) (int64, error) {
+	res, err := s.db.Exec("DELETE FROM sts_credentials WHERE expires_at <= ?", now)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanAccessKey(row rowScanner) (*AccessKey, error) {
+	var ak AccessKey
+	var permissions string
+	var lastUsedAt, expiresAt, graceUntil sql.NullTime
+	var publicKey, rotatedFrom, tags, rateLimit sql.NullString
+
+	err := row.Scan(
+		&ak.ID,
+		&ak.KeyType,
+		&ak.SecretKey,
+		&publicKey,
+		&ak.AccessKey,
+		&ak.UserID,
+		&ak.Status,
+		&permissions,
+		&ak.CreatedAt,
+		&lastUsedAt,
+		&expiresAt,
+		&rotatedFrom,
+		&graceUntil,
+		&tags,
+		&rateLimit,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	ak.Permissions, err = ParsePermissions(permissions)
+	if err != nil {
+		return nil, err
+	}
+
+	if lastUsedAt.Valid {
+		ak.LastUsedAt = lastUsedAt.Time
+	}
+
+	if expiresAt.Valid {
+		ak.ExpiresAt = expiresAt.Time
+	}
+
+	ak.PublicKey = publicKey.String
+	ak.RotatedFrom = rotatedFrom.String
+	if graceUntil.Valid {
+		ak.GraceUntil = graceUntil.Time
+	}
+
+	if tags.Valid && tags.String != "" {
+		if err := json.Unmarshal([]byte(tags.String), &ak.Tags); err != nil {
+			return nil, err
+		}
+	}
+
+	if ak.RateLimit, err = parseRateLimit(rateLimit); err != nil {
+		return nil, err
+	}
+
+	return &ak, nil
+}
+
+func scanRole(row rowScanner) (*Role, error) {
+	var role Role
+	var description, rateLimit sql.NullString
+	var permissions string
+
+	err := row.Scan(
+		&role.ID,
+		&role.Name,
+		&description,
+		&permissions,
+		&role.CreatedAt,
+		&role.UpdatedAt,
+		&rateLimit,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	role.Description = description.String
+	role.Permissions, err = ParsePermissions(permissions)
+	if err != nil {
+		return nil, err
+	}
+
+	if role.RateLimit, err = parseRateLimit(rateLimit); err != nil {
+		return nil, err
+	}
+
+	return &role, nil
+}
+
+// isDuplicateEntry reports whether err is a MySQL duplicate key error
+func isDuplicateEntry(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+}
+
+// checkAffected returns notFound if a statement changed no rows
+func checkAffected(res sql.Result, notFound error) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return notFound
+	}
+	return nil
+}
+
+// marshalTags converts tags to the JSON stored in the database, NULL if empty
+func marshalTags(tags map[string]string) (sql.NullString, error) {
+	if len(tags) == 0 {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(tags)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+// marshalRateLimit converts a rate limit to the JSON stored in the database, NULL if nil
+func marshalRateLimit(limit *RateLimit) (sql.NullString, error) {
+	if limit == nil {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(limit)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+func parseRateLimit(data sql.NullString) (*RateLimit, error) {
+	if !data.Valid || data.String == "" || data.String == "null" {
+		return nil, nil
+	}
+	var limit RateLimit
+	if err := json.Unmarshal([]byte(data.String), &limit); err != nil {
+		return nil, err
+	}
+	return &limit, nil
+}
+
+func scanPolicy(row rowScanner) (*Policy, error) {
+	var policy Policy
+	var description sql.NullString
+	var document string
+
+	err := row.Scan(
+		&policy.ID,
+		&policy.Name,
+		&description,
+		&policy.DefaultVersion,
+		&policy.CreatedAt,
+		&policy.UpdatedAt,
+		&document,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	policy.Description = description.String
+	policy.Document, err = ParsePermissions(document)
+	if err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+func scanPolicyVersion(row rowScanner) (*PolicyVersion, error) {
+	var v PolicyVersion
+	var document string
+	if err := row.Scan(&v.PolicyID, &v.Version, &document, &v.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	var err error
+	v.Document, err = ParsePermissions(document)
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+func scanGroup(row rowScanner) (*Group, error) {
+	var group Group
+	var description sql.NullString
+	if err := row.Scan(&group.ID, &group.Name, &description, &group.CreatedAt, &group.UpdatedAt); err != nil {
+		return nil, err
+	}
+	group.Description = description.String
+	return &group, nil
+}
+
+func scanUser(row rowScanner) (*User, error) {
+	var user User
+	var parentID sql.NullInt64
+	var permissions string
+
+	err := row.Scan(
+		&user.ID,
+		&parentID,
+		&user.Username,
+		&user.PasswordHash,
+		&user.Status,
+		&permissions,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	user.ParentID = parentID.Int64
+	user.Permissions, err = ParsePermissions(permissions)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
@@ -0,0 +1,329 @@
+package accesskey
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// contentSHA256Header declares the payload hash of a request whose body is
+// not buffered by the middleware
+const contentSHA256Header = "X-Content-SHA256"
+
+// Values of the X-Content-SHA256 header besides the hex SHA-256 of the body
+const (
+	// UnsignedPayload excludes the body from the signature. The middleware
+	// only accepts it for paths allowed with WithUnsignedPayload.
+	UnsignedPayload = "UNSIGNED-PAYLOAD"
+	// StreamingPayload sends the body as signed chunks, see SignStreamingRequest
+	StreamingPayload = "STREAMING-ACCESSKEY2-PAYLOAD"
+)
+
+// DefaultChunkSize is the chunk size of SignStreamingRequest
+const DefaultChunkSize = 64 << 10
+
+// chunkSignatureAlgorithm is the first line of a chunk string to sign
+const chunkSignatureAlgorithm = signatureV2Algorithm + "-PAYLOAD"
+
+var (
+	// ErrContentHashMismatch is returned by reads of the request body when
+	// the body does not match its X-Content-SHA256 header
+	ErrContentHashMismatch = errors.New("content does not match X-Content-SHA256")
+	// ErrUnsignedPayloadNotAllowed is passed to the ErrorResponder for
+	// requests with UNSIGNED-PAYLOAD to paths not allowed by WithUnsignedPayload
+	ErrUnsignedPayloadNotAllowed = errors.New("unsigned payload is not allowed")
+	// ErrInvalidChunk is returned by reads of a streaming request body when a
+	// chunk is malformed or its signature is invalid
+	ErrInvalidChunk = errors.New("invalid signed chunk")
+)
+
+// checkContentSHA256 checks an X-Content-SHA256 value and, if the body has
+// been read by the caller, that it matches the body. Bodies that are not
+// hashed up front are only accepted with deferredPayload.
+func checkContentSHA256(value string, content []byte, deferredPayload bool) error {
+	switch value {
+	case "":
+		return nil
+	case UnsignedPayload, StreamingPayload:
+		if !deferredPayload {
+			return ErrUnsignedPayloadNotAllowed
+		}
+		return nil
+	}
+	declared, err := hex.DecodeString(value)
+	if err != nil || len(declared) != sha256.Size || value != strings.ToLower(value) {
+		return fmt.Errorf("invalid %s header", contentSHA256Header)
+	}
+	if content != nil {
+		hash := sha256.Sum256(content)
+		if !bytes.Equal(hash[:], declared) {
+			return ErrContentHashMismatch
+		}
+	}
+	return nil
+}
+
+// payloadMode returns the X-Content-SHA256 header of a request signed in its
+// headers. Presigned URLs always sign an empty body.
+func payloadMode(r *http.Request) string {
+	if isPresigned(r) {
+		return ""
+	}
+	return r.Header.Get(contentSHA256Header)
+}
+
+// hashingBody hashes a request body as the handler reads it and fails the
+// read that reaches the end if the hash differs from the declared one
+type hashingBody struct {
+	body     io.ReadCloser
+	hash     hash.Hash
+	expected []byte
+	err      error
+}
+
+func newHashingBody(body io.ReadCloser, contentSHA256 string) *hashingBody {
+	expected, _ := hex.DecodeString(contentSHA256)
+	return &hashingBody{body: body, hash: sha256.New(), expected: expected}
+}
+
+func (b *hashingBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.body.Read(p)
+	b.hash.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(b.hash.Sum(nil), b.expected) {
+		err = ErrContentHashMismatch
+	}
+	if err != nil {
+		b.err = err
+	}
+	return n, err
+}
+
+func (b *hashingBody) Close() error {
+	return b.body.Close()
+}
+
+// chunkStringToSign builds the string to sign of a chunk. Every chunk is
+// chained to the signature of the previous one, the first to the signature
+// of the request.
+//
+//	ACCESSKEY2-HMAC-SHA256-PAYLOAD
+//	<timestamp>
+//	<nonce>
+//	<previous signature>
+//	<hex sha256 of chunk data>
+func chunkStringToSign(timestamp, nonce, previousSignature string, data []byte) string {
+	hash := sha256.Sum256(data)
+	return strings.Join([]string{
+		chunkSignatureAlgorithm,
+		timestamp,
+		nonce,
+		previousSignature,
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+}
+
+// SignStreamingRequest signs req like SignRequest and sends body as a stream
+// of signed chunks of at most chunkSize bytes (DefaultChunkSize if not
+// positive), so that neither side has to hold the whole body in memory:
+//
+//	<hex size>;chunk-signature=<signature>\r\n<data>\r\n
+//
+// The body ends with a chunk of size 0. The request is sent with chunked
+// transfer encoding and cannot be retried.
+func SignStreamingRequest(req *http.Request, accessKeyID, accessKeySecret string, body io.Reader, chunkSize int) error {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	if body == nil {
+		body = http.NoBody
+	}
+
+	req.Header.Set(contentSHA256Header, StreamingPayload)
+	if err := signRequest(req, accessKeyID, accessKeySecret, nil, DefaultSignatureVersion, time.Now()); err != nil {
+		req.Header.Del("X-Signature")
+		return err
+	}
+
+	sign := func(stringToSign string) (string, error) {
+		return GenerateSignature(accessKeySecret, stringToSign), nil
+	}
+	if isEd25519Secret(accessKeySecret) {
+		sign = func(stringToSign string) (string, error) {
+			return signEd25519(accessKeySecret, stringToSign)
+		}
+	}
+
+	req.Body = &chunkedWriter{
+		src:       body,
+		sign:      sign,
+		timestamp: req.Header.Get("X-Timestamp"),
+		nonce:     req.Header.Get("X-Nonce"),
+		previous:  req.Header.Get("X-Signature"),
+		chunk:     make([]byte, chunkSize),
+	}
+	req.ContentLength = -1
+	req.GetBody = nil
+	return nil
+}
+
+// chunkedWriter encodes a body into signed chunks as it is read
+type chunkedWriter struct {
+	src       io.Reader
+	sign      func(stringToSign string) (string, error)
+	timestamp string
+	nonce     string
+	previous  string
+	chunk     []byte
+	out       bytes.Buffer
+	done      bool
+}
+
+func (w *chunkedWriter) Read(p []byte) (int, error) {
+	for w.out.Len() == 0 {
+		if w.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(w.src, w.chunk)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return 0, err
+		}
+		if n > 0 {
+			if err := w.writeChunk(w.chunk[:n]); err != nil {
+				return 0, err
+			}
+		}
+		if last {
+			if err := w.writeChunk(nil); err != nil {
+				return 0, err
+			}
+			w.done = true
+		}
+	}
+	return w.out.Read(p)
+}
+
+func (w *chunkedWriter) writeChunk(data []byte) error {
+	signature, err := w.sign(chunkStringToSign(w.timestamp, w.nonce, w.previous, data))
+	if err != nil {
+		return err
+	}
+	w.previous = signature
+	fmt.Fprintf(&w.out, "%x;chunk-signature=%s\r\n", len(data), signature)
+	w.out.Write(data)
+	w.out.WriteString("\r\n")
+	return nil
+}
+
+func (w *chunkedWriter) Close() error {
+	if c, ok := w.src.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// chunkedReader decodes a body sent by SignStreamingRequest. Each chunk is
+// buffered and verified before the handler can read it; a missing final
+// chunk fails the read with io.ErrUnexpectedEOF.
+type chunkedReader struct {
+	r            *bufio.Reader
+	body         io.Closer
+	verify       func(stringToSign, signature string) bool
+	timestamp    string
+	nonce        string
+	previous     string
+	maxChunkSize int64
+	data         []byte
+	err          error
+}
+
+// newChunkedReader returns the decoded body of a streaming request signed
+// with the request signature previous
+func newChunkedReader(r *http.Request, verify func(stringToSign, signature string) bool, maxChunkSize int64) *chunkedReader {
+	return &chunkedReader{
+		r:            bufio.NewReader(r.Body),
+		body:         r.Body,
+		verify:       verify,
+		timestamp:    r.Header.Get("X-Timestamp"),
+		nonce:        r.Header.Get("X-Nonce"),
+		previous:     r.Header.Get("X-Signature"),
+		maxChunkSize: maxChunkSize,
+	}
+}
+
+func (cr *chunkedReader) Read(p []byte) (int, error) {
+	for len(cr.data) == 0 {
+		if cr.err != nil {
+			return 0, cr.err
+		}
+		cr.err = cr.nextChunk()
+	}
+	n := copy(p, cr.data)
+	cr.data = cr.data[n:]
+	return n, nil
+}
+
+// nextChunk reads and verifies the next chunk, io.EOF after the final one
+func (cr *chunkedReader) nextChunk() error {
+	line, err := cr.r.ReadSlice('\n')
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	sizeField, signature, ok := strings.Cut(strings.TrimSuffix(string(line), "\r\n"), ";chunk-signature=")
+	if !ok || signature == "" {
+		return fmt.Errorf("%w: malformed chunk header", ErrInvalidChunk)
+	}
+	size, err := strconv.ParseInt(sizeField, 16, 64)
+	if err != nil || size < 0 {
+		return fmt.Errorf("%w: malformed chunk size", ErrInvalidChunk)
+	}
+	if size > cr.maxChunkSize {
+		return fmt.Errorf("%w: chunk larger than %d bytes", ErrInvalidChunk, cr.maxChunkSize)
+	}
+
+	buf := make([]byte, size+2)
+	if _, err := io.ReadFull(cr.r, buf); err != nil {
+		return unexpectedEOF(err)
+	}
+	if !bytes.HasSuffix(buf, []byte("\r\n")) {
+		return fmt.Errorf("%w: missing chunk terminator", ErrInvalidChunk)
+	}
+	data := buf[:size]
+
+	if !cr.verify(chunkStringToSign(cr.timestamp, cr.nonce, cr.previous, data), signature) {
+		return fmt.Errorf("%w: signature mismatch", ErrInvalidChunk)
+	}
+	cr.previous = signature
+	if size == 0 {
+		return io.EOF
+	}
+	cr.data = data
+	return nil
+}
+
+func (cr *chunkedReader) Close() error {
+	return cr.body.Close()
+}
+
+// unexpectedEOF reports a body that ends before its final chunk
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	if err == bufio.ErrBufferFull {
+		return fmt.Errorf("%w: chunk header too long", ErrInvalidChunk)
+	}
+	return err
+}
@@ -0,0 +1,283 @@
+package accesskey
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// bodyRecorder is a handler recording what it read from the request body
+type bodyRecorder struct {
+	body []byte
+	err  error
+}
+
+func (h *bodyRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.body, h.err = io.ReadAll(r.Body)
+	if h.err != nil {
+		http.Error(w, h.err.Error(), http.StatusBadRequest)
+	}
+}
+
+// streamingTest serves requests through the middleware of a new service
+type streamingTest struct {
+	t       *testing.T
+	handler http.Handler
+	rec     *bodyRecorder
+	id      string
+	secret  string
+}
+
+func newStreamingTest(t *testing.T, opts ...MiddlewareOption) *streamingTest {
+	s, user := newTestService(t)
+	id, secret := newTestKey(t, s, user, allowAll)
+	rec := &bodyRecorder{}
+	return &streamingTest{t: t, handler: s.NewMiddleware(opts...)(rec), rec: rec, id: id, secret: secret}
+}
+
+func (st *streamingTest) serve(req *http.Request) int {
+	w := httptest.NewRecorder()
+	st.handler.ServeHTTP(w, req)
+	return w.Code
+}
+
+// encodedStreamingRequest returns a streaming request and its encoded body
+func (st *streamingTest) encodedStreamingRequest(content []byte, chunkSize int) (*http.Request, []byte) {
+	req := httptest.NewRequest(http.MethodPut, "http://example.com/files/a", nil)
+	if err := SignStreamingRequest(req, st.id, st.secret, bytes.NewReader(content), chunkSize); err != nil {
+		st.t.Fatal(err)
+	}
+	encoded, err := io.ReadAll(req.Body)
+	if err != nil {
+		st.t.Fatal(err)
+	}
+	return req, encoded
+}
+
+// splitChunks splits an encoded streaming body into its chunks
+func splitChunks(t *testing.T, encoded []byte) [][]byte {
+	t.Helper()
+	var chunks [][]byte
+	r := bufio.NewReader(bytes.NewReader(encoded))
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizeField, _, _ := strings.Cut(line, ";")
+		size, err := strconv.ParseInt(sizeField, 16, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, append([]byte(line), data...))
+	}
+}
+
+func TestStreamingRoundTrip(t *testing.T) {
+	st := newStreamingTest(t, WithMaxBodySize(1024))
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+
+	for _, chunkSize := range []int{1, 300, 1024} {
+		req := httptest.NewRequest(http.MethodPut, "http://example.com/files/a", nil)
+		if err := SignStreamingRequest(req, st.id, st.secret, bytes.NewReader(content[:chunkSize*7+3]), chunkSize); err != nil {
+			t.Fatal(err)
+		}
+		if code := st.serve(req); code != http.StatusOK {
+			t.Fatalf("chunk size %d: status %d, read error %v", chunkSize, code, st.rec.err)
+		}
+		if !bytes.Equal(st.rec.body, content[:chunkSize*7+3]) {
+			t.Fatalf("chunk size %d: handler read %d bytes, want %d", chunkSize, len(st.rec.body), chunkSize*7+3)
+		}
+	}
+
+	// An empty body still ends with the final chunk
+	req := httptest.NewRequest(http.MethodPut, "http://example.com/files/a", nil)
+	if err := SignStreamingRequest(req, st.id, st.secret, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	if code := st.serve(req); code != http.StatusOK || len(st.rec.body) != 0 {
+		t.Fatalf("empty body: status %d, read %q", code, st.rec.body)
+	}
+}
+
+func TestStreamingEd25519(t *testing.T) {
+	s, user := newTestService(t)
+	_, priv, err := GenerateAccessKeyPair(WithKeyType(KeyTypeEd25519))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, _ := Ed25519PublicKey(priv)
+	id, err := s.CreateAccessKeyWithPublicKey(user.ID, allowAll, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &bodyRecorder{}
+	handler := s.Middleware(rec)
+
+	content := bytes.Repeat([]byte("x"), 5000)
+	req := httptest.NewRequest(http.MethodPut, "http://example.com/files/a", nil)
+	if err := SignStreamingRequest(req, id, priv, bytes.NewReader(content), 1000); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !bytes.Equal(rec.body, content) {
+		t.Fatalf("status %d, read %d bytes, error %v", w.Code, len(rec.body), rec.err)
+	}
+}
+
+func TestStreamingRejectsModifiedStreams(t *testing.T) {
+	st := newStreamingTest(t)
+	content := bytes.Repeat([]byte("abcdefghij"), 100)
+
+	tests := []struct {
+		name   string
+		modify func(chunks [][]byte) [][]byte
+		err    error
+	}{
+		{"tampered chunk", func(chunks [][]byte) [][]byte {
+			i := bytes.IndexByte(chunks[1], '\n') + 1
+			chunks[1][i] ^= 1
+			return chunks
+		}, ErrInvalidChunk},
+		{"reordered chunks", func(chunks [][]byte) [][]byte {
+			chunks[0], chunks[1] = chunks[1], chunks[0]
+			return chunks
+		}, ErrInvalidChunk},
+		{"dropped chunk", func(chunks [][]byte) [][]byte {
+			return append(chunks[:1], chunks[2:]...)
+		}, ErrInvalidChunk},
+		{"truncated stream", func(chunks [][]byte) [][]byte {
+			return chunks[:len(chunks)-1]
+		}, io.ErrUnexpectedEOF},
+		{"malformed header", func(chunks [][]byte) [][]byte {
+			chunks[0] = bytes.Replace(chunks[0], []byte(";chunk-signature="), []byte(";sig="), 1)
+			return chunks
+		}, ErrInvalidChunk},
+	}
+	for _, tt := range tests {
+		req, encoded := st.encodedStreamingRequest(content, 300)
+		chunks := tt.modify(splitChunks(t, encoded))
+		req.Body = io.NopCloser(bytes.NewReader(bytes.Join(chunks, nil)))
+
+		if code := st.serve(req); code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want %d", tt.name, code, http.StatusBadRequest)
+		}
+		if !errors.Is(st.rec.err, tt.err) {
+			t.Errorf("%s: read error %v, want %v", tt.name, st.rec.err, tt.err)
+		}
+	}
+}
+
+func TestStreamingChunkSizeLimit(t *testing.T) {
+	st := newStreamingTest(t, WithMaxBodySize(100))
+	req, encoded := st.encodedStreamingRequest(bytes.Repeat([]byte("a"), 500), 200)
+	req.Body = io.NopCloser(bytes.NewReader(encoded))
+
+	if code := st.serve(req); code != http.StatusBadRequest || !errors.Is(st.rec.err, ErrInvalidChunk) {
+		t.Fatalf("status %d, read error %v, want ErrInvalidChunk", code, st.rec.err)
+	}
+}
+
+// signWithContentSHA256 signs a request declaring the given body hash
+func (st *streamingTest) signWithContentSHA256(path, contentSHA256 string, body []byte) *http.Request {
+	req := httptest.NewRequest(http.MethodPut, "http://example.com"+path, bytes.NewReader(body))
+	req.Header.Set("X-Content-SHA256", contentSHA256)
+	SignRequest(req, st.id, st.secret, nil)
+	return req
+}
+
+func TestDeclaredContentSHA256(t *testing.T) {
+	st := newStreamingTest(t, WithMaxBodySize(100))
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	hash := sha256.Sum256(content)
+	declared := hex.EncodeToString(hash[:])
+
+	// The body is larger than the middleware would buffer
+	if code := st.serve(st.signWithContentSHA256("/files/a", declared, content)); code != http.StatusOK {
+		t.Fatalf("status %d, read error %v", code, st.rec.err)
+	}
+	if !bytes.Equal(st.rec.body, content) {
+		t.Fatalf("handler read %d bytes, want %d", len(st.rec.body), len(content))
+	}
+
+	// A different body fails the handler's read
+	other := append(bytes.Clone(content[:len(content)-1]), 'x')
+	if code := st.serve(st.signWithContentSHA256("/files/a", declared, other)); code != http.StatusBadRequest {
+		t.Errorf("mismatching body: status %d, want %d", code, http.StatusBadRequest)
+	}
+	if !errors.Is(st.rec.err, ErrContentHashMismatch) {
+		t.Errorf("mismatching body: read error %v, want ErrContentHashMismatch", st.rec.err)
+	}
+
+	// The declared hash is signed
+	req := st.signWithContentSHA256("/files/a", declared, other)
+	otherHash := sha256.Sum256(other)
+	req.Header.Set("X-Content-SHA256", hex.EncodeToString(otherHash[:]))
+	if code := st.serve(req); code != http.StatusUnauthorized {
+		t.Errorf("replaced header: status %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	if code := st.serve(st.signWithContentSHA256("/files/a", "not-a-hash", content)); code != http.StatusUnauthorized {
+		t.Errorf("malformed header: status %d, want %d", code, http.StatusUnauthorized)
+	}
+}
+
+func TestUnsignedPayload(t *testing.T) {
+	st := newStreamingTest(t, WithUnsignedPayload("/upload/**"))
+	content := []byte("anything")
+
+	if code := st.serve(st.signWithContentSHA256("/upload/a/b", UnsignedPayload, content)); code != http.StatusOK {
+		t.Fatalf("allowed path: status %d", code)
+	}
+	if !bytes.Equal(st.rec.body, content) {
+		t.Fatalf("allowed path: handler read %q", st.rec.body)
+	}
+
+	st.rec.body = nil
+	if code := st.serve(st.signWithContentSHA256("/files/a", UnsignedPayload, content)); code != http.StatusUnauthorized {
+		t.Fatalf("other path: status %d, want %d", code, http.StatusUnauthorized)
+	}
+	if st.rec.body != nil {
+		t.Fatal("other path: handler was called")
+	}
+}
+
+// VerifyRequestSignature cannot check bodies that are not hashed up front
+func TestVerifyRequestSignatureRejectsDeferredPayloads(t *testing.T) {
+	s, user := newTestService(t)
+	id, secret := newTestKey(t, s, user, allowAll)
+	content := []byte("body")
+
+	for _, mode := range []string{UnsignedPayload, StreamingPayload} {
+		req := httptest.NewRequest(http.MethodPut, "http://example.com/files/a", nil)
+		req.Header.Set("X-Content-SHA256", mode)
+		SignRequest(req, id, secret, nil)
+		if ok, err := s.VerifyRequestSignature(req, content); ok || !errors.Is(err, ErrUnsignedPayloadNotAllowed) {
+			t.Errorf("%s: VerifyRequestSignature = %v, %v, want ErrUnsignedPayloadNotAllowed", mode, ok, err)
+		}
+	}
+
+	hash := sha256.Sum256([]byte("other body"))
+	req := httptest.NewRequest(http.MethodPut, "http://example.com/files/a", nil)
+	req.Header.Set("X-Content-SHA256", hex.EncodeToString(hash[:]))
+	SignRequest(req, id, secret, nil)
+	if ok, err := s.VerifyRequestSignature(req, content); ok || !errors.Is(err, ErrContentHashMismatch) {
+		t.Errorf("declared hash: VerifyRequestSignature = %v, %v, want ErrContentHashMismatch", ok, err)
+	}
+}
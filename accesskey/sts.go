@@ -0,0 +1,235 @@
+package accesskey
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// TemporaryKeyPrefix prefixes the access key IDs of temporary credentials
+const TemporaryKeyPrefix = "STS."
+
+const (
+	// DefaultSessionDuration is the lifetime of temporary credentials if none is requested
+	DefaultSessionDuration = time.Hour
+	// MaxSessionDuration is the longest lifetime temporary credentials can have
+	MaxSessionDuration = 12 * time.Hour
+)
+
+var (
+	// ErrRoleNotAssumable is returned when the requested role is not a role of the caller key
+	ErrRoleNotAssumable = errors.New("role is not assigned to the caller access key")
+	// ErrInvalidSessionToken is returned when X-Security-Token does not match the temporary credentials
+	ErrInvalidSessionToken = errors.New("invalid session token")
+)
+
+// TemporaryCredential is a short-lived credential issued by AssumeRole
+type TemporaryCredential struct {
+	AccessKeyID      string `json:"access_key_id"`
+	SecretKey        string `json:"secret_key"`
+	SessionTokenHash string `json:"-"`
+	SourceAccessKey  string `json:"source_access_key"`
+	UserID           int64  `json:"user_id"`
+	RoleID           int    `json:"role_id"`
+	// Policy scopes down the permissions of the role, nil means no scope down
+	Policy    []*Permissions `json:"policy,omitempty"`
+	CreatedAt time.Time      `json:"created_at"`
+	ExpiresAt time.Time      `json:"expires_at"`
+}
+
+// Credentials are the temporary credentials returned to the caller of AssumeRole
+type Credentials struct {
+	AccessKeyID  string    `json:"access_key_id"`
+	SecretKey    string    `json:"secret_key"`
+	SessionToken string    `json:"session_token"`
+	Expiration   time.Time `json:"expiration"`
+}
+
+// IsTemporaryAccessKeyID reports whether an access key ID belongs to temporary credentials
+func IsTemporaryAccessKeyID(accessKeyID string) bool {
+	return strings.HasPrefix(accessKeyID, TemporaryKeyPrefix)
+}
+
+// AssumeRole issues temporary credentials for a role of the caller access
+// key, assigned to the key itself, its user or one of the user's groups. The credentials get the role's permissions, further limited by
+// policy if it is not empty, and expire after duration (DefaultSessionDuration
+// if zero, at most MaxSessionDuration).
+func (s *Service) AssumeRole(callerKeyID string, roleID int, policy string, duration time.Duration) (*Credentials, error) {
+	if duration == 0 {
+		duration = DefaultSessionDuration
+	}
+	if duration < 0 || duration > MaxSessionDuration {
+		return nil, fmt.Errorf("session duration must be between 0 and %s", MaxSessionDuration)
+	}
+
+	// Temporary credentials cannot be used to assume another role
+	if IsTemporaryAccessKeyID(callerKeyID) {
+		return nil, errors.New("temporary credentials cannot assume roles")
+	}
+
+	caller, err := s.store.GetAccessKey(callerKeyID)
+	if err != nil {
+		return nil, err
+	}
+	if !s.usable(caller, time.Now()) {
+		return nil, errors.New("caller access key is not active")
+	}
+
+	// The roles of the key, of its user and of the user's groups, as for
+	// authorization
+	sources, err := s.accessKeySources(caller)
+	if err != nil {
+		return nil, err
+	}
+	assigned := false
+	for _, src := range sources {
+		if src.role != nil && src.role.ID == roleID {
+			assigned = true
+			break
+		}
+	}
+	if !assigned {
+		return nil, ErrRoleNotAssumable
+	}
+
+	var sessionPolicy []*Permissions
+	if p := strings.TrimSpace(policy); p != "" && p != "null" {
+		sessionPolicy, err = ParsePermissions(policy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy: %w", err)
+		}
+		if sessionPolicy == nil {
+			sessionPolicy = []*Permissions{}
+		}
+	}
+
+	id, secret, err := GenerateAccessKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	id = TemporaryKeyPrefix + id
+
+	storedSecret, err := s.sealSecret(id, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return nil, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(tokenBytes)
+
+	now := time.Now()
+	cred := &TemporaryCredential{
+		AccessKeyID:      id,
+		SecretKey:        storedSecret,
+		SessionTokenHash: hashSessionToken(token),
+		SourceAccessKey:  caller.AccessKey,
+		UserID:           caller.UserID,
+		RoleID:           roleID,
+		Policy:           sessionPolicy,
+		CreatedAt:        now,
+		ExpiresAt:        now.Add(duration),
+	}
+	if err := s.store.CreateTemporaryCredential(cred); err != nil {
+		return nil, err
+	}
+
+	return &Credentials{
+		AccessKeyID:  id,
+		SecretKey:    secret,
+		SessionToken: token,
+		Expiration:   cred.ExpiresAt,
+	}, nil
+}
+
+// getTemporaryCredential returns temporary credentials that have not expired yet
+func (s *Service) getTemporaryCredential(accessKeyID string) (*TemporaryCredential, error) {
+	cred, err := s.store.GetTemporaryCredential(accessKeyID)
+	if err != nil {
+		return nil, err
+	}
+	if !time.Now().Before(cred.ExpiresAt) {
+		return nil, ErrAccessKeyNotFound
+	}
+	return cred, nil
+}
+
+// checkSessionToken compares the X-Security-Token of a request with the temporary credentials
+func (s *Service) checkSessionToken(accessKeyID, token string) error {
+	if token == "" {
+		return fmt.Errorf("missing X-Security-Token header")
+	}
+	cred, err := s.getTemporaryCredential(accessKeyID)
+	if err != nil {
+		if errors.Is(err, ErrAccessKeyNotFound) {
+			return ErrInvalidSessionToken
+		}
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSessionToken(token)), []byte(cred.SessionTokenHash)) != 1 {
+		return ErrInvalidSessionToken
+	}
+	return nil
+}
+
+// PurgeTemporaryCredentials deletes expired temporary credentials
+func (s *Service) PurgeTemporaryCredentials() (int64, error) {
+	return s.store.DeleteExpiredTemporaryCredentials(time.Now())
+}
+
+// AssumeRoleHandler is an HTTP handler for AssumeRole. It must be wrapped by
+// the signature middleware, the key of the Principal is the caller key;
+// requests without a principal get 401.
+// The request body is {"role_id": 1, "policy": [...], "duration_seconds": 3600}.
+func (s *Service) AssumeRoleHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			RoleID          int             `json:"role_id"`
+			Policy          json.RawMessage `json:"policy"`
+			DurationSeconds int64           `json:"duration_seconds"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		caller := PrincipalFrom(r.Context())
+		if caller == nil {
+			http.Error(w, ErrUnauthenticated.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		creds, err := s.AssumeRole(
+			caller.AccessKeyID,
+			input.RoleID,
+			string(input.Policy),
+			time.Duration(input.DurationSeconds)*time.Second,
+		)
+		if errors.Is(err, ErrRoleNotAssumable) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(creds)
+	})
+}
+
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,89 @@
+package accesskey
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestAssumeRoleHandler(t *testing.T) {
+	s, user := newTestService(t)
+	id, secret := newTestKey(t, s, user, allowAll)
+	roleID, err := s.CreateRole("reader", "", `[{"resources":["api/**"],"actions":["GET"],"effect":"allow"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AssignRoleToAccessKey(id, roleID); err != nil {
+		t.Fatal(err)
+	}
+	body := []byte(`{"role_id":` + strconv.Itoa(roleID) + `}`)
+
+	// Through the middleware the caller is the verified key
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/sts/assume-role", bytes.NewReader(body))
+	SignRequest(req, id, secret, body)
+	w := httptest.NewRecorder()
+	s.Middleware(s.AssumeRoleHandler()).ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var creds Credentials
+	if err := json.NewDecoder(w.Body).Decode(&creds); err != nil {
+		t.Fatal(err)
+	}
+	if !IsTemporaryAccessKeyID(creds.AccessKeyID) || creds.SessionToken == "" {
+		t.Errorf("credentials = %+v", creds)
+	}
+
+	// Without a principal, X-Access-Key-ID is not trusted
+	req = httptest.NewRequest(http.MethodPost, "http://example.com/sts/assume-role", bytes.NewReader(body))
+	req.Header.Set("X-Access-Key-ID", id)
+	w = httptest.NewRecorder()
+	s.AssumeRoleHandler().ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("request without a principal: status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+// Roles of the user and of its groups can be assumed like roles of the key
+func TestAssumeRoleOfUserAndGroup(t *testing.T) {
+	s, user := newTestService(t)
+	id, _ := newTestKey(t, s, user, `[]`)
+	newRole := func(name string) int {
+		t.Helper()
+		roleID, err := s.CreateRole(name, "", `[{"resources":["api/**"],"actions":["GET"],"effect":"allow"}]`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return roleID
+	}
+
+	userRole := newRole("user-role")
+	if err := s.AttachRoleToUser(user.ID, userRole); err != nil {
+		t.Fatal(err)
+	}
+	groupRole := newRole("group-role")
+	group, err := s.CreateGroup("devs", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddUserToGroup(group.ID, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AttachRoleToGroup(group.ID, groupRole); err != nil {
+		t.Fatal(err)
+	}
+	otherRole := newRole("other-role")
+
+	for _, roleID := range []int{userRole, groupRole} {
+		if _, err := s.AssumeRole(id, roleID, "", 0); err != nil {
+			t.Errorf("AssumeRole(%d): %v", roleID, err)
+		}
+	}
+	if _, err := s.AssumeRole(id, otherRole, "", 0); !errors.Is(err, ErrRoleNotAssumable) {
+		t.Errorf("AssumeRole of an unrelated role: %v, want ErrRoleNotAssumable", err)
+	}
+}
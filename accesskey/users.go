@@ -0,0 +1,195 @@
+package accesskey
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrInvalidCredentials is returned when a username or password is wrong
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	// ErrUserNotActive is returned when a suspended or deleted user logs in or gets new access keys
+	ErrUserNotActive = errors.New("user is not active")
+)
+
+// CreateUser creates a user with a hashed password. A parentID of 0 creates
+// a main account, otherwise a RAM sub-account of the given main account.
+func (s *Service) CreateUser(username, password string, parentID int64) (*User, error) {
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return nil, errors.New("username is required")
+	}
+	if len(password) < MinPasswordLength {
+		return nil, fmt.Errorf("password must have at least %d characters", MinPasswordLength)
+	}
+
+	if parentID != 0 {
+		parent, err := s.store.GetUser(parentID)
+		if err != nil {
+			return nil, fmt.Errorf("parent account: %w", err)
+		}
+		if parent.ParentID != 0 {
+			return nil, errors.New("RAM sub-accounts cannot have sub-accounts")
+		}
+		if parent.Status != "active" {
+			return nil, fmt.Errorf("parent account: %w", ErrUserNotActive)
+		}
+	}
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	user := &User{
+		ParentID:     parentID,
+		Username:     username,
+		PasswordHash: hash,
+		Status:       "active",
+	}
+	if err := s.store.CreateUser(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// GetUser returns a user
+func (s *Service) GetUser(userID int64) (*User, error) {
+	return s.store.GetUser(userID)
+}
+
+// ListSubUsers returns the RAM sub-accounts of a main account
+func (s *Service) ListSubUsers(parentID int64) ([]User, error) {
+	return s.store.ListSubUsers(parentID)
+}
+
+// VerifyUserPassword checks the password of an active user and returns the user
+func (s *Service) VerifyUserPassword(username, password string) (*User, error) {
+	user, err := s.store.GetUserByName(username)
+	if errors.Is(err, ErrUserNotFound) {
+		// Check anyway so that unknown usernames take as long as wrong passwords
+		CheckPassword(dummyPasswordHash(), password)
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := CheckPassword(user.PasswordHash, password)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+	if user.Status != "active" {
+		return nil, ErrUserNotActive
+	}
+	return user, nil
+}
+
+// SetUserPassword replaces the password of a user
+func (s *Service) SetUserPassword(userID int64, password string) error {
+	if len(password) < MinPasswordLength {
+		return fmt.Errorf("password must have at least %d characters", MinPasswordLength)
+	}
+	if _, err := s.store.GetUser(userID); err != nil {
+		return err
+	}
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	return s.store.UpdateUserPassword(userID, hash)
+}
+
+// SuspendUser suspends a user and deactivates all its access keys. Suspending
+// a main account also suspends its RAM sub-accounts.
+func (s *Service) SuspendUser(userID int64) error {
+	return s.disableUser(userID, "suspended")
+}
+
+// DeleteUser marks a user as deleted and deactivates all its access keys.
+// Deleting a main account also deletes its RAM sub-accounts.
+func (s *Service) DeleteUser(userID int64) error {
+	return s.disableUser(userID, "deleted")
+}
+
+// ActivateUser reactivates a suspended user. Its access keys stay inactive,
+// new keys have to be issued.
+func (s *Service) ActivateUser(userID int64) error {
+	user, err := s.store.GetUser(userID)
+	if err != nil {
+		return err
+	}
+	if user.Status == "deleted" {
+		return errors.New("deleted users cannot be reactivated")
+	}
+	if user.ParentID != 0 {
+		parent, err := s.store.GetUser(user.ParentID)
+		if err != nil {
+			return err
+		}
+		if parent.Status != "active" {
+			return fmt.Errorf("parent account: %w", ErrUserNotActive)
+		}
+	}
+	return s.store.UpdateUserStatus(userID, "active")
+}
+
+func (s *Service) disableUser(userID int64, status string) error {
+	user, err := s.store.GetUser(userID)
+	if err != nil {
+		return err
+	}
+
+	if user.ParentID == 0 {
+		subUsers, err := s.store.ListSubUsers(userID)
+		if err != nil {
+			return err
+		}
+		for _, sub := range subUsers {
+			if sub.Status == status || sub.Status == "deleted" {
+				continue
+			}
+			if err := s.disableUser(sub.ID, status); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Deactivate the keys first, so that a failure leaves the user active
+	// and the operation can be retried
+	keys, err := s.store.ListAccessKeys(userID)
+	if err != nil {
+		return err
+	}
+	for _, ak := range keys {
+		if ak.Status != "active" {
+			continue
+		}
+		if err := s.store.UpdateAccessKeyStatus(ak.AccessKey, "inactive"); err != nil {
+			return err
+		}
+	}
+
+	return s.store.UpdateUserStatus(userID, status)
+}
+
+// checkUserActive rejects new access keys for suspended and deleted users.
+// Keys of user IDs that are not managed as users are allowed.
+func (s *Service) checkUserActive(userID int64) error {
+	user, err := s.store.GetUser(userID)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if user.Status != "active" {
+		return ErrUserNotActive
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"test/accesskey"
+)
+
+// keyView is an access key as printed by akctl, without its secret
+type keyView struct {
+	AccessKeyID string                   `json:"access_key_id"`
+	KeyType     string                   `json:"key_type"`
+	PublicKey   string                   `json:"public_key,omitempty"`
+	UserID      int64                    `json:"user_id"`
+	Status      string                   `json:"status"`
+	Permissions []*accesskey.Permissions `json:"permissions"`
+	Tags        map[string]string        `json:"tags,omitempty"`
+	CreatedAt   time.Time                `json:"created_at"`
+	LastUsedAt  time.Time                `json:"last_used_at"`
+	ExpiresAt   time.Time                `json:"expires_at"`
+	RotatedFrom string                   `json:"rotated_from,omitempty"`
+	GraceUntil  time.Time                `json:"grace_until"`
+}
+
+func newKeyView(ak accesskey.AccessKey) keyView {
+	return keyView{
+		AccessKeyID: ak.AccessKey,
+		KeyType:     ak.KeyType,
+		PublicKey:   ak.PublicKey,
+		UserID:      ak.UserID,
+		Status:      ak.Status,
+		Permissions: ak.Permissions,
+		Tags:        ak.Tags,
+		CreatedAt:   ak.CreatedAt,
+		LastUsedAt:  ak.LastUsedAt,
+		ExpiresAt:   ak.ExpiresAt,
+		RotatedFrom: ak.RotatedFrom,
+		GraceUntil:  ak.GraceUntil,
+	}
+}
+
+// credentialsView is a new key pair. The secret is only shown once.
+type credentialsView struct {
+	AccessKeyID string `json:"access_key_id"`
+	Secret      string `json:"secret"`
+}
+
+func printCredentials(opts *globalOptions, id, secret string) error {
+	return output(opts, credentialsView{AccessKeyID: id, Secret: secret},
+		[]string{"ACCESS KEY ID", "SECRET"},
+		func() [][]string { return [][]string{{id, secret}} },
+	)
+}
+
+func runKeyCreate(opts *globalOptions, args []string) error {
+	fs := newFlagSet("key create")
+	userID := fs.Int64("user", 0, "user ID")
+	permissions := fs.String("permissions", "", "permissions JSON, @FILE or - for stdin")
+	ttl := fs.Duration("ttl", 0, "lifetime of the key, e.g. 720h; 0 never expires")
+	publicKey := fs.String("public-key", "", "create an ed25519 key with this public key, see key generate")
+	if _, err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+	if *userID == 0 || (*publicKey != "" && *ttl > 0) {
+		return errUsage
+	}
+
+	document, err := readDocument(*permissions)
+	if err != nil {
+		return err
+	}
+	svc, err := openService(opts)
+	if err != nil {
+		return err
+	}
+
+	if *publicKey != "" {
+		id, err := svc.CreateAccessKeyWithPublicKey(*userID, document, *publicKey)
+		if err != nil {
+			return err
+		}
+		return output(opts, map[string]string{"access_key_id": id, "key_type": accesskey.KeyTypeEd25519},
+			[]string{"ACCESS KEY ID", "TYPE"},
+			func() [][]string { return [][]string{{id, accesskey.KeyTypeEd25519}} },
+		)
+	}
+
+	var id, secret string
+	if *ttl > 0 {
+		id, secret, err = svc.CreateAccessKeyWithTTL(*userID, document, *ttl)
+	} else {
+		id, secret, err = svc.CreateAccessKey(*userID, document)
+	}
+	if err != nil {
+		return err
+	}
+	return printCredentials(opts, id, secret)
+}
+
+func runKeyList(opts *globalOptions, args []string) error {
+	fs := newFlagSet("key list")
+	userID := fs.Int64("user", 0, "only list the keys of this user")
+	if _, err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+
+	svc, err := openService(opts)
+	if err != nil {
+		return err
+	}
+	var keys []accesskey.AccessKey
+	if *userID != 0 {
+		keys, err = svc.GetUserAccessKeys(*userID)
+	} else {
+		keys, err = svc.ListAllAccessKeys()
+	}
+	if err != nil {
+		return err
+	}
+
+	views := make([]keyView, len(keys))
+	for i, ak := range keys {
+		views[i] = newKeyView(ak)
+	}
+	return output(opts, views,
+		[]string{"ACCESS KEY ID", "TYPE", "USER", "STATUS", "CREATED", "LAST USED", "EXPIRES"},
+		func() [][]string {
+			rows := make([][]string, len(views))
+			for i, v := range views {
+				rows[i] = []string{
+					v.AccessKeyID,
+					v.KeyType,
+					strconv.FormatInt(v.UserID, 10),
+					v.Status,
+					formatTime(v.CreatedAt),
+					formatTime(v.LastUsedAt),
+					formatTime(v.ExpiresAt),
+				}
+			}
+			return rows
+		},
+	)
+}
+
+func runKeyDisable(opts *globalOptions, args []string) error {
+	fs := newFlagSet("key disable")
+	pos, err := parseFlags(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	svc, err := openService(opts)
+	if err != nil {
+		return err
+	}
+	if err := svc.DeactivateAccessKey(pos[0]); err != nil {
+		return err
+	}
+	fmt.Printf("Disabled access key %s\n", pos[0])
+	return nil
+}
+
+func runKeyRotate(opts *globalOptions, args []string) error {
+	fs := newFlagSet("key rotate")
+	grace := fs.Duration("grace", 24*time.Hour, "how long the old key keeps working")
+	publicKey := fs.String("public-key", "", "public key of the successor of an ed25519 key")
+	pos, err := parseFlags(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	svc, err := openService(opts)
+	if err != nil {
+		return err
+	}
+	if *publicKey != "" {
+		id, err := svc.RotateAccessKeyWithPublicKey(pos[0], *publicKey, *grace)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Rotated access key %s, successor %s\n", pos[0], id)
+		return nil
+	}
+	id, secret, err := svc.RotateAccessKey(pos[0], *grace)
+	if err != nil {
+		return err
+	}
+	return printCredentials(opts, id, secret)
+}
+
+func runKeyDelete(opts *globalOptions, args []string) error {
+	fs := newFlagSet("key delete")
+	pos, err := parseFlags(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	svc, err := openService(opts)
+	if err != nil {
+		return err
+	}
+	if err := svc.DeleteAccessKey(pos[0]); err != nil {
+		return err
+	}
+	fmt.Printf("Deleted access key %s\n", pos[0])
+	return nil
+}
+
+// keyPairView is a key pair generated locally by key generate
+type keyPairView struct {
+	KeyType    string `json:"key_type"`
+	PrivateKey string `json:"private_key"`
+	PublicKey  string `json:"public_key"`
+}
+
+func runKeyGenerate(opts *globalOptions, args []string) error {
+	fs := newFlagSet("key generate")
+	if _, err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+
+	_, privateKey, err := accesskey.GenerateAccessKeyPair(accesskey.WithKeyType(accesskey.KeyTypeEd25519))
+	if err != nil {
+		return err
+	}
+	publicKey, err := accesskey.Ed25519PublicKey(privateKey)
+	if err != nil {
+		return err
+	}
+	v := keyPairView{KeyType: accesskey.KeyTypeEd25519, PrivateKey: privateKey, PublicKey: publicKey}
+	return output(opts, v,
+		[]string{"PRIVATE KEY", "PUBLIC KEY"},
+		func() [][]string { return [][]string{{privateKey, publicKey}} },
+	)
+}
@@ -0,0 +1,193 @@
+// Command akctl administers access keys, roles and policies.
+//
+// Usage:
+//
+//	akctl [-dsn DSN] [-keys-file FILE] [-o table|json] <command> [flags]
+//
+// Commands:
+//
+//	key generate
+//	key create -user ID [-permissions JSON] [-ttl DURATION | -public-key KEY]
+//	key list [-user ID]
+//	key disable ID
+//	key rotate [-grace DURATION] [-public-key KEY] ID
+//	key delete ID
+//	role create -name NAME [-description TEXT] [-permissions JSON]
+//	role attach -role ID (-key ID | -user ID | -group ID)
+//	role detach -role ID (-key ID | -user ID | -group ID)
+//	policy validate [FILE]
+//	policy simulate (-key ID | -policy FILE) -method METHOD -path PATH [flags]
+//	sign -key ID -secret SECRET -method METHOD -url URL [-token TOKEN] [-body TEXT | -body-file FILE] [-payload hash|unsigned]
+//	presign -key ID -secret SECRET [-method METHOD] -url URL [-ttl DURATION]
+//	migrate up [-to VERSION]
+//	migrate down -to VERSION
+//	migrate status
+//
+// The DSN is read from -dsn or the ACCESSKEY_DSN environment variable. If
+// secrets are encrypted at rest, the master keys are read from -keys-file or
+// ACCESSKEY_MASTER_KEYS, see cmd/akencrypt. Commands other than migrate
+// refuse to run until the schema is migrated. key generate creates an
+// Ed25519 key pair locally; register its public key with key create
+// -public-key and pass the private key to sign as -secret. Permissions and policies given
+// as "@FILE" are read from the file, "-" reads standard input.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"test/accesskey"
+)
+
+// errUsage is returned by commands called with invalid arguments
+var errUsage = errors.New("invalid usage")
+
+// globalOptions are the flags given before the command
+type globalOptions struct {
+	dsn      string
+	keysFile string
+	output   string
+}
+
+type command struct {
+	name  string
+	usage string
+	run   func(opts *globalOptions, args []string) error
+}
+
+var commands = []command{
+	{"key generate", "", runKeyGenerate},
+	{"key create", "-user ID [-permissions JSON] [-ttl DURATION | -public-key KEY]", runKeyCreate},
+	{"key list", "[-user ID]", runKeyList},
+	{"key disable", "ID", runKeyDisable},
+	{"key rotate", "[-grace DURATION] [-public-key KEY] ID", runKeyRotate},
+	{"key delete", "ID", runKeyDelete},
+	{"role create", "-name NAME [-description TEXT] [-permissions JSON]", runRoleCreate},
+	{"role attach", "-role ID (-key ID | -user ID | -group ID)", runRoleAttach},
+	{"role detach", "-role ID (-key ID | -user ID | -group ID)", runRoleDetach},
+	{"policy validate", "[FILE]", runPolicyValidate},
+	{"policy simulate", "(-key ID | -policy FILE) -method METHOD -path PATH [-source-ip IP] [-secure] [-header NAME=VALUE]", runPolicySimulate},
+	{"sign", "-key ID -secret SECRET -method METHOD -url URL [-token TOKEN] [-body TEXT | -body-file FILE] [-payload hash|unsigned]", runSign},
+	{"presign", "-key ID -secret SECRET [-method METHOD] -url URL [-ttl DURATION]", runPresign},
+	{"migrate up", "[-to VERSION]", runMigrateUp},
+	{"migrate down", "-to VERSION", runMigrateDown},
+	{"migrate status", "", runMigrateStatus},
+}
+
+func main() {
+	opts := &globalOptions{}
+	flag.StringVar(&opts.dsn, "dsn", os.Getenv("ACCESSKEY_DSN"), "MySQL data source name (default $ACCESSKEY_DSN)")
+	flag.StringVar(&opts.keysFile, "keys-file", "", "file containing the master keys (default $ACCESSKEY_MASTER_KEYS)")
+	flag.StringVar(&opts.output, "o", "table", "output format: table or json")
+	flag.Usage = usage
+	flag.Parse()
+
+	if opts.output != "table" && opts.output != "json" {
+		fmt.Fprintln(os.Stderr, "Error: -o must be table or json")
+		os.Exit(2)
+	}
+
+	cmd, args := findCommand(flag.Args())
+	if cmd == nil {
+		usage()
+		os.Exit(2)
+	}
+
+	if err := cmd.run(opts, args); err != nil {
+		if errors.Is(err, errUsage) {
+			fmt.Fprintf(os.Stderr, "Usage: akctl %s %s\n", cmd.name, cmd.usage)
+			os.Exit(2)
+		}
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
+
+func findCommand(args []string) (*command, []string) {
+	for i := range commands {
+		words := strings.Fields(commands[i].name)
+		if len(args) < len(words) {
+			continue
+		}
+		if strings.Join(args[:len(words)], " ") == commands[i].name {
+			return &commands[i], args[len(words):]
+		}
+	}
+	return nil, nil
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: akctl [-dsn DSN] [-keys-file FILE] [-o table|json] <command> [flags]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %s %s\n", cmd.name, cmd.usage)
+	}
+	fmt.Fprintln(os.Stderr, "\nGlobal flags:")
+	flag.PrintDefaults()
+}
+
+// openService connects to the database, with the keyring if one is configured
+func openService(opts *globalOptions) (*accesskey.Service, error) {
+	if opts.dsn == "" {
+		return nil, errors.New("-dsn or ACCESSKEY_DSN is required")
+	}
+
+	var serviceOpts []accesskey.ServiceOption
+	switch {
+	case opts.keysFile != "":
+		keyring, err := accesskey.LoadKeyringFromFile(opts.keysFile)
+		if err != nil {
+			return nil, fmt.Errorf("load master keys: %w", err)
+		}
+		serviceOpts = append(serviceOpts, accesskey.WithKeyring(keyring))
+	case os.Getenv("ACCESSKEY_MASTER_KEYS") != "":
+		keyring, err := accesskey.LoadKeyringFromEnv("ACCESSKEY_MASTER_KEYS")
+		if err != nil {
+			return nil, fmt.Errorf("load master keys: %w", err)
+		}
+		serviceOpts = append(serviceOpts, accesskey.WithKeyring(keyring))
+	}
+
+	if err := accesskey.InitDB(opts.dsn, serviceOpts...); err != nil {
+		return nil, fmt.Errorf("initialize database: %w", err)
+	}
+	return accesskey.DefaultService(), nil
+}
+
+// newFlagSet creates the flag set of a command. Errors are returned instead
+// of exiting, so that main prints the usage of the command.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return fs
+}
+
+// parseFlags parses the flags of a command and returns its positional arguments
+func parseFlags(fs *flag.FlagSet, args []string, positional int) ([]string, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, fmt.Errorf("%w: %v", errUsage, err)
+	}
+	if fs.NArg() != positional {
+		return nil, errUsage
+	}
+	return fs.Args(), nil
+}
+
+// readDocument returns a JSON document given on the command line. "@FILE"
+// reads the file and "-" reads standard input.
+func readDocument(arg string) (string, error) {
+	switch {
+	case arg == "-":
+		data, err := io.ReadAll(os.Stdin)
+		return string(data), err
+	case strings.HasPrefix(arg, "@"):
+		data, err := os.ReadFile(arg[1:])
+		return string(data), err
+	default:
+		return arg, nil
+	}
+}
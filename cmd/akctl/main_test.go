@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"test/accesskey"
+)
+
+// captureStdout returns what run writes to standard output
+func captureStdout(t *testing.T, run func() error) (string, error) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	out := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		out <- string(data)
+	}()
+	runErr := run()
+	w.Close()
+	return <-out, runErr
+}
+
+// writeFile writes content to a file in a temporary directory
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFindCommand(t *testing.T) {
+	tests := []struct {
+		args     []string
+		name     string
+		cmdArgs  []string
+		notFound bool
+	}{
+		{[]string{"key", "create", "-user", "1"}, "key create", []string{"-user", "1"}, false},
+		{[]string{"sign", "-key", "AK1"}, "sign", []string{"-key", "AK1"}, false},
+		{[]string{"migrate", "status"}, "migrate status", []string{}, false},
+		{[]string{"key"}, "", nil, true},
+		{[]string{"key", "unknown"}, "", nil, true},
+		{nil, "", nil, true},
+	}
+	for _, tt := range tests {
+		cmd, args := findCommand(tt.args)
+		if tt.notFound {
+			if cmd != nil {
+				t.Errorf("findCommand(%q) = %s, want none", tt.args, cmd.name)
+			}
+			continue
+		}
+		if cmd == nil || cmd.name != tt.name || strings.Join(args, " ") != strings.Join(tt.cmdArgs, " ") {
+			t.Errorf("findCommand(%q) = %v, %q, want %s", tt.args, cmd, args, tt.name)
+		}
+	}
+}
+
+func TestUsageErrors(t *testing.T) {
+	opts := &globalOptions{output: "table"}
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"key list", []string{"-unknown"}},
+		{"key disable", nil},
+		{"key disable", []string{"AK1", "AK2"}},
+		{"sign", []string{"-key", "AK1", "-url", "http://example.com/"}},
+		{"sign", []string{"-key", "AK1", "-secret", "s", "-url", "http://example.com/", "-body", "a", "-body-file", "b"}},
+		{"presign", []string{"-key", "AK1", "-secret", "s"}},
+		{"policy simulate", []string{"-method", "GET", "-path", "/"}},
+		{"policy simulate", []string{"-key", "AK1", "-policy", "p.json", "-method", "GET", "-path", "/"}},
+		{"migrate down", nil},
+	}
+	for _, tt := range tests {
+		cmd, _ := findCommand(strings.Fields(tt.name))
+		if err := cmd.run(opts, tt.args); !errors.Is(err, errUsage) {
+			t.Errorf("%s %q: %v, want errUsage", tt.name, tt.args, err)
+		}
+	}
+
+	// Commands using the database need a DSN
+	t.Setenv("ACCESSKEY_DSN", "")
+	for _, name := range []string{"key list", "migrate status"} {
+		cmd, _ := findCommand(strings.Fields(name))
+		if err := cmd.run(opts, nil); err == nil || errors.Is(err, errUsage) {
+			t.Errorf("%s without a DSN: %v", name, err)
+		}
+	}
+}
+
+func TestReadDocument(t *testing.T) {
+	path := writeFile(t, "doc.json", `[]`)
+	if doc, err := readDocument("@" + path); err != nil || doc != `[]` {
+		t.Errorf("readDocument(@file) = %q, %v", doc, err)
+	}
+	if doc, err := readDocument(`{"a":1}`); err != nil || doc != `{"a":1}` {
+		t.Errorf("readDocument(literal) = %q, %v", doc, err)
+	}
+	if _, err := readDocument("@" + filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("readDocument of a missing file succeeded")
+	}
+}
+
+func TestHeaderFlags(t *testing.T) {
+	h := headerFlags{}
+	for _, v := range []string{"X-Env=prod", "X-Env=dev", "X-Empty="} {
+		if err := h.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := http.Header(h).Values("X-Env"); len(got) != 2 || got[1] != "dev" {
+		t.Errorf("X-Env = %q", got)
+	}
+	for _, v := range []string{"X-Env", "=prod"} {
+		if err := h.Set(v); err == nil {
+			t.Errorf("Set(%q) succeeded, want an error", v)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	if got, want := shellQuote(`it's`), `'it'\''s'`; got != want {
+		t.Errorf("shellQuote = %s, want %s", got, want)
+	}
+}
+
+// newService returns a service with an access key allowed to do everything
+func newService(t *testing.T) (*accesskey.Service, string, string) {
+	t.Helper()
+	s := accesskey.NewService(accesskey.NewMemoryStore())
+	user, err := s.CreateUser("alice", "password123", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, secret, err := s.CreateAccessKey(user.ID, `[{"actions":["*"],"resources":["**"],"effect":"allow"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, id, secret
+}
+
+func TestSign(t *testing.T) {
+	opts := &globalOptions{output: "table"}
+	_, id, secret := newService(t)
+
+	out, err := captureStdout(t, func() error {
+		return runSign(opts, []string{"-key", id, "-secret", secret, "-method", "post", "-url", "http://example.com/api?a=1",
+			"-body", `{"name":"it's"}`, "-content-type", "application/json"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"curl -X POST",
+		"-H 'X-Access-Key-Id: " + id + "'",
+		"-H 'X-Signature: ",
+		"-H 'Content-Type: application/json'",
+		`--data-binary '{"name":"it'\''s"}'`,
+		"'http://example.com/api?a=1'",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output does not contain %s:\n%s", want, out)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"-payload", "zip"},
+		{"-signature-version", "3"},
+		{"-body-file", filepath.Join(t.TempDir(), "missing")},
+	} {
+		args = append([]string{"-key", id, "-secret", secret, "-url", "http://example.com/"}, args...)
+		if _, err := captureStdout(t, func() error { return runSign(opts, args) }); err == nil {
+			t.Errorf("sign %q succeeded, want an error", args)
+		}
+	}
+}
+
+func TestPresign(t *testing.T) {
+	opts := &globalOptions{output: "table"}
+	s, id, secret := newService(t)
+
+	out, err := captureStdout(t, func() error {
+		return runPresign(opts, []string{"-key", id, "-secret", secret, "-url", "http://example.com/files/a", "-ttl", "5m"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	presigned := strings.TrimSpace(out)
+	if !strings.Contains(presigned, "X-Expires=300") {
+		t.Errorf("presigned URL %s does not expire in 5 minutes", presigned)
+	}
+	if ok, err := s.VerifyRequestSignature(httptest.NewRequest(http.MethodGet, presigned, nil), nil); !ok || err != nil {
+		t.Errorf("VerifyRequestSignature(%s) = %v, %v", presigned, ok, err)
+	}
+
+	args := []string{"-key", id, "-secret", secret, "-url", "http://example.com/files/a", "-ttl", (8 * 24 * time.Hour).String()}
+	if _, err := captureStdout(t, func() error { return runPresign(opts, args) }); err == nil {
+		t.Error("presign with a TTL above the maximum succeeded")
+	}
+}
+
+func TestKeyGenerate(t *testing.T) {
+	out, err := captureStdout(t, func() error {
+		return runKeyGenerate(&globalOptions{output: "json"}, nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v keyPairView
+	if err := json.Unmarshal([]byte(out), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.KeyType != accesskey.KeyTypeEd25519 {
+		t.Errorf("key type %q", v.KeyType)
+	}
+	if pub, err := accesskey.Ed25519PublicKey(v.PrivateKey); err != nil || pub != v.PublicKey {
+		t.Errorf("public key %q does not belong to the private key: %v", v.PublicKey, err)
+	}
+}
+
+func TestPolicyCommands(t *testing.T) {
+	policy := writeFile(t, "policy.json", `[
+		{"resources":["/api/**"],"actions":["GET"],"effect":"allow","conditions":{"StringEquals":{"header:X-Env":"prod"}}},
+		{"resources":["/api/admin/**"],"actions":["*"],"effect":"deny"}
+	]`)
+	invalid := writeFile(t, "invalid.json", `[{"resources":["/api/**"],"effect":"allow","conditions":{"StringLike":{"tag:a":"b"}}}]`)
+	table := &globalOptions{output: "table"}
+
+	out, err := captureStdout(t, func() error { return runPolicyValidate(table, []string{policy}) })
+	if err != nil || !strings.Contains(out, "2 statement(s)") {
+		t.Errorf("policy validate = %q, %v", out, err)
+	}
+	if _, err := captureStdout(t, func() error { return runPolicyValidate(table, []string{invalid}) }); err == nil {
+		t.Error("policy validate accepted an invalid policy")
+	}
+
+	tests := []struct {
+		args     []string
+		decision string
+	}{
+		{[]string{"-method", "get", "-path", "/api/items", "-header", "X-Env=prod"}, accesskey.DecisionAllow},
+		{[]string{"-method", "GET", "-path", "/api/items", "-header", "X-Env=dev"}, accesskey.DecisionImplicitDeny},
+		{[]string{"-method", "GET", "-path", "/api/admin/a", "-header", "X-Env=prod"}, accesskey.DecisionExplicitDeny},
+	}
+	for _, tt := range tests {
+		args := append([]string{"-policy", policy}, tt.args...)
+		out, err := captureStdout(t, func() error { return runPolicySimulate(&globalOptions{output: "json"}, args) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		var e accesskey.Explanation
+		if err := json.Unmarshal([]byte(out), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Decision != tt.decision {
+			t.Errorf("policy simulate %q: decision %s, want %s", tt.args, e.Decision, tt.decision)
+		}
+	}
+
+	out, err = captureStdout(t, func() error {
+		return runPolicySimulate(table, []string{"-policy", policy, "-method", "GET", "-path", "/api/items"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "Decision: implicit_deny") || !strings.Contains(out, "conditions") {
+		t.Errorf("policy simulate table output:\n%s", out)
+	}
+	if _, err := captureStdout(t, func() error {
+		return runPolicySimulate(table, []string{"-policy", policy, "-method", "GET", "-path", "/", "-source-ip", "nope"})
+	}); err == nil {
+		t.Error("policy simulate accepted an invalid source IP")
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"test/accesskey"
+)
+
+// openDB connects to the database without checking the schema
+func openDB(opts *globalOptions) (*sql.DB, error) {
+	if opts.dsn == "" {
+		return nil, errors.New("-dsn or ACCESSKEY_DSN is required")
+	}
+	return accesskey.OpenDB(opts.dsn)
+}
+
+func runMigrateUp(opts *globalOptions, args []string) error {
+	fs := newFlagSet("migrate up")
+	to := fs.Int("to", 0, "schema version to migrate to (default latest)")
+	if _, err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+
+	db, err := openDB(opts)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	version := *to
+	if version == 0 {
+		version = accesskey.LatestSchemaVersion()
+	}
+	if err := accesskey.MigrateTo(context.Background(), db, version); err != nil {
+		return err
+	}
+	fmt.Printf("Schema is at version %d\n", version)
+	return nil
+}
+
+func runMigrateDown(opts *globalOptions, args []string) error {
+	fs := newFlagSet("migrate down")
+	to := fs.Int("to", -1, "schema version to revert to, 0 drops all tables")
+	if _, err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+	if *to < 0 {
+		return errUsage
+	}
+
+	db, err := openDB(opts)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := accesskey.MigrateTo(context.Background(), db, *to); err != nil {
+		return err
+	}
+	fmt.Printf("Schema is at version %d\n", *to)
+	return nil
+}
+
+// migrationView is a migration and whether it has been applied
+type migrationView struct {
+	Version   int       `json:"version"`
+	Name      string    `json:"name"`
+	Applied   bool      `json:"applied"`
+	AppliedAt time.Time `json:"applied_at"`
+}
+
+func runMigrateStatus(opts *globalOptions, args []string) error {
+	fs := newFlagSet("migrate status")
+	if _, err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+
+	db, err := openDB(opts)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	migrations, err := accesskey.Migrations()
+	if err != nil {
+		return err
+	}
+	applied, err := accesskey.MigrationStatus(context.Background(), db)
+	if err != nil {
+		return err
+	}
+	appliedAt := make(map[int]time.Time, len(applied))
+	for _, a := range applied {
+		appliedAt[a.Version] = a.AppliedAt
+	}
+
+	views := make([]migrationView, len(migrations))
+	for i, mig := range migrations {
+		at, ok := appliedAt[mig.Version]
+		views[i] = migrationView{Version: mig.Version, Name: mig.Name, Applied: ok, AppliedAt: at}
+	}
+	if err := output(opts, views,
+		[]string{"VERSION", "NAME", "STATE", "APPLIED"},
+		func() [][]string {
+			rows := make([][]string, len(views))
+			for i, v := range views {
+				state := "pending"
+				if v.Applied {
+					state = "applied"
+				}
+				rows[i] = []string{strconv.Itoa(v.Version), v.Name, state, formatTime(v.AppliedAt)}
+			}
+			return rows
+		},
+	); err != nil {
+		return err
+	}
+
+	// Report unknown or changed migrations through the exit status
+	if err := accesskey.CheckSchema(context.Background(), db); err != nil && !errors.Is(err, accesskey.ErrSchemaOutdated) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"test/accesskey"
+)
+
+func runPolicyValidate(opts *globalOptions, args []string) error {
+	fs := newFlagSet("policy validate")
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+	if fs.NArg() > 1 {
+		return errUsage
+	}
+
+	arg := "-"
+	if fs.NArg() == 1 {
+		arg = "@" + fs.Arg(0)
+	}
+	document, err := readDocument(arg)
+	if err != nil {
+		return err
+	}
+	perms, err := accesskey.ParsePermissions(document)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Valid policy with %d statement(s)\n", len(perms))
+	return nil
+}
+
+// headerFlags collects repeated -header NAME=VALUE flags
+type headerFlags http.Header
+
+func (h headerFlags) String() string { return "" }
+
+func (h headerFlags) Set(value string) error {
+	name, val, ok := strings.Cut(value, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("header must be NAME=VALUE: %q", value)
+	}
+	http.Header(h).Add(name, val)
+	return nil
+}
+
+func runPolicySimulate(opts *globalOptions, args []string) error {
+	fs := newFlagSet("policy simulate")
+	key := fs.String("key", "", "access key ID to simulate")
+	policy := fs.String("policy", "", "policy file to simulate, - for stdin")
+	method := fs.String("method", "", "HTTP method or action, e.g. GET or admin:ListRoles")
+	path := fs.String("path", "", "request path")
+	sourceIP := fs.String("source-ip", "", "source IP address")
+	secure := fs.Bool("secure", false, "request is made over TLS")
+	headers := headerFlags{}
+	fs.Var(headers, "header", "request header NAME=VALUE, may be repeated")
+	if _, err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+	if (*key == "") == (*policy == "") || *method == "" || *path == "" {
+		return errUsage
+	}
+
+	rc := &accesskey.RequestContext{
+		Method:          strings.ToUpper(*method),
+		Path:            *path,
+		SecureTransport: *secure,
+		Headers:         http.Header(headers),
+		Time:            time.Now(),
+	}
+	if strings.Contains(*method, ":") {
+		rc.Method = ""
+		rc.Action = *method
+	}
+	if *sourceIP != "" {
+		if rc.SourceIP = net.ParseIP(*sourceIP); rc.SourceIP == nil {
+			return fmt.Errorf("invalid source IP %q", *sourceIP)
+		}
+	}
+
+	var explanation *accesskey.Explanation
+	if *key != "" {
+		svc, err := openService(opts)
+		if err != nil {
+			return err
+		}
+		if explanation, err = svc.Explain(*key, rc); err != nil {
+			return err
+		}
+	} else {
+		arg := *policy
+		if arg != "-" {
+			arg = "@" + arg
+		}
+		document, err := readDocument(arg)
+		if err != nil {
+			return err
+		}
+		perms, err := accesskey.ParsePermissions(document)
+		if err != nil {
+			return err
+		}
+		explanation = accesskey.ExplainPermissions(perms, rc)
+	}
+
+	if opts.output == "json" {
+		return printJSON(explanation)
+	}
+	fmt.Printf("Decision: %s\nReason:   %s\n\n", explanation.Decision, explanation.Reason)
+	rows := make([][]string, len(explanation.Statements))
+	for i, st := range explanation.Statements {
+		matched := "no"
+		if st.Matched {
+			matched = "yes"
+		}
+		reason := st.Reason
+		if reason == "" {
+			reason = "-"
+		}
+		rows[i] = []string{
+			statementSource(st),
+			st.Statement.Effect,
+			strings.Join(st.Statement.Actions, ","),
+			strings.Join(st.Statement.Resources, ","),
+			matched,
+			reason,
+		}
+	}
+	return printTable([]string{"SOURCE", "EFFECT", "ACTION", "RESOURCE", "MATCHED", "REASON"}, rows)
+}
+
+// statementSource describes where a statement came from
+func statementSource(st accesskey.StatementResult) string {
+	source := st.Source
+	if st.GroupName != "" {
+		source += " group=" + st.GroupName
+	}
+	if st.RoleName != "" {
+		source += " role=" + st.RoleName
+	}
+	if st.PolicyName != "" {
+		source += fmt.Sprintf(" policy=%s@v%d", st.PolicyName, st.PolicyVersion)
+	}
+	return source
+}
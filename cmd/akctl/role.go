@@ -0,0 +1,130 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+)
+
+func runRoleCreate(opts *globalOptions, args []string) error {
+	fs := newFlagSet("role create")
+	name := fs.String("name", "", "role name")
+	description := fs.String("description", "", "role description")
+	permissions := fs.String("permissions", "", "permissions JSON, @FILE or - for stdin")
+	if _, err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+	if *name == "" {
+		return errUsage
+	}
+
+	document, err := readDocument(*permissions)
+	if err != nil {
+		return err
+	}
+	svc, err := openService(opts)
+	if err != nil {
+		return err
+	}
+	roleID, err := svc.CreateRole(*name, *description, document)
+	if err != nil {
+		return err
+	}
+
+	return output(opts, map[string]interface{}{"role_id": roleID, "name": *name},
+		[]string{"ROLE ID", "NAME"},
+		func() [][]string { return [][]string{{strconv.Itoa(roleID), *name}} },
+	)
+}
+
+// roleTarget is what a role is attached to or detached from
+type roleTarget struct {
+	roleID  int
+	key     string
+	userID  int64
+	groupID int
+}
+
+// parseRoleTarget parses -role and exactly one of -key, -user and -group
+func parseRoleTarget(fs *flag.FlagSet, args []string) (*roleTarget, error) {
+	t := &roleTarget{}
+	fs.IntVar(&t.roleID, "role", 0, "role ID")
+	fs.StringVar(&t.key, "key", "", "access key ID")
+	fs.Int64Var(&t.userID, "user", 0, "user ID")
+	fs.IntVar(&t.groupID, "group", 0, "group ID")
+	if _, err := parseFlags(fs, args, 0); err != nil {
+		return nil, err
+	}
+
+	targets := 0
+	for _, set := range []bool{t.key != "", t.userID != 0, t.groupID != 0} {
+		if set {
+			targets++
+		}
+	}
+	if t.roleID == 0 || targets != 1 {
+		return nil, errUsage
+	}
+	return t, nil
+}
+
+func (t *roleTarget) String() string {
+	switch {
+	case t.key != "":
+		return "access key " + t.key
+	case t.userID != 0:
+		return fmt.Sprintf("user %d", t.userID)
+	default:
+		return fmt.Sprintf("group %d", t.groupID)
+	}
+}
+
+func runRoleAttach(opts *globalOptions, args []string) error {
+	t, err := parseRoleTarget(newFlagSet("role attach"), args)
+	if err != nil {
+		return err
+	}
+
+	svc, err := openService(opts)
+	if err != nil {
+		return err
+	}
+	switch {
+	case t.key != "":
+		err = svc.AssignRoleToAccessKey(t.key, t.roleID)
+	case t.userID != 0:
+		err = svc.AttachRoleToUser(t.userID, t.roleID)
+	default:
+		err = svc.AttachRoleToGroup(t.groupID, t.roleID)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Attached role %d to %s\n", t.roleID, t)
+	return nil
+}
+
+func runRoleDetach(opts *globalOptions, args []string) error {
+	t, err := parseRoleTarget(newFlagSet("role detach"), args)
+	if err != nil {
+		return err
+	}
+
+	svc, err := openService(opts)
+	if err != nil {
+		return err
+	}
+	switch {
+	case t.key != "":
+		err = svc.UnassignRoleFromAccessKey(t.key, t.roleID)
+	case t.userID != 0:
+		err = svc.DetachRoleFromUser(t.userID, t.roleID)
+	default:
+		err = svc.DetachRoleFromGroup(t.groupID, t.roleID)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Detached role %d from %s\n", t.roleID, t)
+	return nil
+}
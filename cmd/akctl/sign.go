@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"test/accesskey"
+)
+
+func runSign(opts *globalOptions, args []string) error {
+	fs := newFlagSet("sign")
+	key := fs.String("key", os.Getenv("ACCESSKEY_ID"), "access key ID (default $ACCESSKEY_ID)")
+	secret := fs.String("secret", os.Getenv("ACCESSKEY_SECRET"), "access key secret (default $ACCESSKEY_SECRET)")
+	token := fs.String("token", os.Getenv("ACCESSKEY_SESSION_TOKEN"), "session token of temporary credentials (default $ACCESSKEY_SESSION_TOKEN)")
+	method := fs.String("method", http.MethodGet, "HTTP method")
+	rawURL := fs.String("url", "", "request URL")
+	body := fs.String("body", "", "request body")
+	bodyFile := fs.String("body-file", "", "file containing the request body, - for stdin")
+	contentType := fs.String("content-type", "", "Content-Type of the body")
+	version := fs.String("signature-version", accesskey.DefaultSignatureVersion, "signature version")
+	payload := fs.String("payload", "", "send the body hash in X-Content-SHA256 (hash) or leave the body unsigned (unsigned)")
+	if _, err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+	if *key == "" || *secret == "" || *rawURL == "" || (*body != "" && *bodyFile != "") {
+		return errUsage
+	}
+
+	content := []byte(*body)
+	if *bodyFile != "" {
+		arg := *bodyFile
+		if arg != "-" {
+			arg = "@" + arg
+		}
+		data, err := readDocument(arg)
+		if err != nil {
+			return err
+		}
+		content = []byte(data)
+	}
+
+	req, err := http.NewRequest(strings.ToUpper(*method), *rawURL, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	if *contentType != "" {
+		req.Header.Set("Content-Type", *contentType)
+	}
+	if *token != "" {
+		req.Header.Set("X-Security-Token", *token)
+	}
+	switch *payload {
+	case "":
+	case "hash":
+		hash := sha256.Sum256(content)
+		req.Header.Set("X-Content-SHA256", hex.EncodeToString(hash[:]))
+	case "unsigned":
+		req.Header.Set("X-Content-SHA256", accesskey.UnsignedPayload)
+	default:
+		return fmt.Errorf("unknown payload mode %q", *payload)
+	}
+	if err := accesskey.SignRequestWithVersion(req, *key, *secret, content, *version); err != nil {
+		return err
+	}
+
+	fmt.Println(curlCommand(req, content))
+	return nil
+}
+
+// curlCommand returns a curl command line sending the signed request
+func curlCommand(req *http.Request, content []byte) string {
+	parts := []string{"curl -X " + req.Method}
+
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range req.Header[name] {
+			parts = append(parts, "-H "+shellQuote(name+": "+value))
+		}
+	}
+
+	if len(content) > 0 {
+		parts = append(parts, "--data-binary "+shellQuote(string(content)))
+	}
+	parts = append(parts, shellQuote(req.URL.String()))
+	return strings.Join(parts, " \\\n  ")
+}
+
+// shellQuote quotes s for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func runPresign(opts *globalOptions, args []string) error {
+	fs := newFlagSet("presign")
+	key := fs.String("key", os.Getenv("ACCESSKEY_ID"), "access key ID (default $ACCESSKEY_ID)")
+	secret := fs.String("secret", os.Getenv("ACCESSKEY_SECRET"), "access key secret (default $ACCESSKEY_SECRET)")
+	method := fs.String("method", http.MethodGet, "HTTP method")
+	rawURL := fs.String("url", "", "URL to presign")
+	ttl := fs.Duration("ttl", 15*time.Minute, "how long the URL stays valid")
+	if _, err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+	if *key == "" || *secret == "" || *rawURL == "" {
+		return errUsage
+	}
+
+	presigned, err := accesskey.Presign(strings.ToUpper(*method), *rawURL, *key, *secret, *ttl)
+	if err != nil {
+		return err
+	}
+	fmt.Println(presigned)
+	return nil
+}
@@ -0,0 +1,61 @@
+// Command akencrypt encrypts the plaintext secrets in access_keys.secret_key
+// with the configured master key, and re-encrypts secrets sealed with an older
+// master key after a master key rotation.
+//
+// The master keys are read from -keys-file or the ACCESSKEY_MASTER_KEYS
+// environment variable, one id:base64key entry per line or comma separated,
+// the first entry being the primary key.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"test/accesskey"
+)
+
+func main() {
+	dsn := flag.String("dsn", os.Getenv("ACCESSKEY_DSN"), "MySQL data source name (default $ACCESSKEY_DSN)")
+	keysFile := flag.String("keys-file", "", "file containing the master keys (default $ACCESSKEY_MASTER_KEYS)")
+	genKey := flag.Bool("gen-key", false, "print a new random master key and exit")
+	flag.Parse()
+
+	if *genKey {
+		key, err := accesskey.GenerateMasterKey()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error generating master key:", err)
+			os.Exit(1)
+		}
+		fmt.Println(key)
+		return
+	}
+
+	var keyring *accesskey.Keyring
+	var err error
+	if *keysFile != "" {
+		keyring, err = accesskey.LoadKeyringFromFile(*keysFile)
+	} else {
+		keyring, err = accesskey.LoadKeyringFromEnv("ACCESSKEY_MASTER_KEYS")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading master keys:", err)
+		os.Exit(1)
+	}
+
+	if *dsn == "" {
+		fmt.Fprintln(os.Stderr, "Error: -dsn or ACCESSKEY_DSN is required")
+		os.Exit(2)
+	}
+	if err := accesskey.InitDB(*dsn, accesskey.WithKeyring(keyring)); err != nil {
+		fmt.Fprintln(os.Stderr, "Error initializing database:", err)
+		os.Exit(1)
+	}
+
+	n, err := accesskey.EncryptSecrets()
+	fmt.Printf("Encrypted %d access key secrets with master key %s\n", n, keyring.PrimaryKeyID())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error encrypting secrets:", err)
+		os.Exit(1)
+	}
+}
@@ -5,6 +5,7 @@ go 1.22.5
 require (
 	github.com/PuerkitoBio/goquery v1.9.0
 	github.com/go-sql-driver/mysql v1.9.1
+	golang.org/x/crypto v0.33.0
 )
 
 require (
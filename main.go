@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"os"
 	"test/accesskey"
 )
 
@@ -43,8 +44,15 @@ func main() {
 	fmt.Println("\nCreating access key with permissions:")
 	fmt.Println(string(permissionsJSON))
 
+	// Set ACCESSKEY_DEV_MODE=1 to sign unsigned requests with a demo key
+	var opts []accesskey.MiddlewareOption
+	if os.Getenv("ACCESSKEY_DEV_MODE") == "1" {
+		opts = append(opts, accesskey.WithDevMode("14789", "wen"))
+	}
+	middleware := accesskey.NewMiddleware(opts...)
+
 	handler := http.HandlerFunc(testHandler)
-	http.Handle("/api/v1/users/123", accesskey.CreateMiddleware(handler))
+	http.Handle("/api/v1/users/123", middleware(handler))
 
 	http.ListenAndServe(":8080", nil)
 	// In a real application, you would also:
@@ -53,7 +61,8 @@ func main() {
 	// 3. Validate access keys and check permissions for each request
 }
 func testHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Printf("Hello, World!")
+	p := accesskey.PrincipalFrom(r.Context())
+	fmt.Fprintf(w, "Hello, user %d (access key %s)!\n", p.UserID, p.AccessKeyID)
 }
 
 // GenerateAccessKeyPair is now implemented in the accesskey package